@@ -4,20 +4,24 @@ go 1.13
 
 require (
 	github.com/aeden/traceroute v0.0.0-20210211061815-03f5f7cb7908
-	github.com/anacrolix/log v0.8.0
 	github.com/anacrolix/dht v1.0.1 // indirect
+	github.com/anacrolix/log v0.8.0
 	github.com/anacrolix/torrent v1.25.1
-	github.com/gin-gonic/gin v1.7.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/gin-gonic/gin v1.7.1
 	github.com/go-chi/chi/v5 v5.0.3
 	github.com/go-chi/httplog v0.2.0 // indirect
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/mux v1.8.0
 	github.com/jaypipes/ghw v0.7.0
+	github.com/klauspost/compress v1.11.13
+	github.com/klauspost/reedsolomon v1.9.13
 	github.com/rs/zerolog v1.18.1-0.20200514152719-663cbb4c8469 // indirect
 	github.com/skycoin/dmsg v0.0.0-20210329160412-4e25fc9ad26c
 	github.com/skycoin/skycoin v0.27.1
 	github.com/stretchr/testify v1.7.0
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
@@ -1,19 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/skycoin/skycoin/src/cipher/encoder"
 	"github.com/urfave/cli/v2"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -21,8 +28,6 @@ import (
 )
 
 func initCLI() *cli.App {
-	filesList = processDirAndGenerateMeta(".")
-
 	app := cli.NewApp()
 	app.Name = "manifest"
 	app.Usage = "create manifest files in current directory"
@@ -30,9 +35,30 @@ func initCLI() *cli.App {
 	addCLICommands(app)
 
 	app.Action = func(cnx *cli.Context) error {
+		if cnx.NArg() > 0 {
+			return usageError("unknown command %q", cnx.Args().First())
+		}
 		cli.ShowAppHelpAndExit(cnx, 0)
 		return nil
 	}
+	app.OnUsageError = func(cnx *cli.Context, err error, isSubcommand bool) error {
+		return usageError("%w", err)
+	}
+	app.Before = func(cnx *cli.Context) error {
+		config, err := loadRepositoryConfig(currentDir)
+		if err != nil {
+			return err
+		}
+		chunkSize = config.ChunkSize
+		mmapThreshold = config.MmapThreshold
+		return nil
+	}
+	for _, command := range app.Commands {
+		command.OnUsageError = app.OnUsageError
+		for _, subcommand := range command.Subcommands {
+			subcommand.OnUsageError = app.OnUsageError
+		}
+	}
 
 	sort.Sort(cli.FlagsByName(app.Flags))
 	cli.VersionFlag = &cli.BoolFlag{
@@ -46,77 +72,1406 @@ func initCLI() *cli.App {
 func addCLICommands(app *cli.App) {
 	app.Commands = []*cli.Command{
 		{
-			Name:      "init",
-			Usage:     "initialize tool environment by create the .cxo folder",
-			UsageText: "create the manifest folder .cxo in current directory",
+			Name:      "init",
+			Usage:     "initialize tool environment by create the .cxo folder",
+			UsageText: "create the manifest folder .cxo in current directory",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "compression",
+					Value: codecNone,
+					Usage: "compression codec for stored chunks: none, gzip or zstd",
+				},
+				&cli.StringFlag{
+					Name:  "chunk-size",
+					Value: strconv.Itoa(defaultChunkSize),
+					Usage: "size of the chunks files are hashed in, a power of two like 256K or 1M",
+				},
+				&cli.StringFlag{
+					Name:  "chunk-store",
+					Usage: "where the stored chunks are kept: a folder, a file:// URL or an s3://bucket/prefix URL, .cxo/chunks by default",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				err := createFolder(".cxo")
+				if err != nil {
+					return err
+				}
+				fmt.Println("Create .cxo foler in current directory: ")
+				if !isFolderExist(currentDir + manifestConfigFile) {
+					config, err := loadRepositoryConfig(currentDir)
+					if err != nil {
+						return err
+					}
+					if err := writeRepositoryConfig(currentDir, config); err != nil {
+						return err
+					}
+				}
+				for _, key := range []string{"chunk-size", "compression", "chunk-store"} {
+					if cnx.IsSet(key) {
+						if err := setRepositoryConfigValue(currentDir, key, []string{cnx.String(key)}); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "commit",
+			Usage:     "commit all the files' metadatum into the .cxo file",
+			UsageText: "commit all the metadata files into the .cxo folder",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "print-json",
+					Value: false,
+					Usage: "print files in the directory in json ",
+				},
+				&cli.BoolFlag{
+					Name:  "meta",
+					Value: false,
+					Usage: "add metadata section in json",
+				},
+				&cli.BoolFlag{
+					Name:  "store-chunks",
+					Value: false,
+					Usage: "store the files' chunk data in the .cxo folder",
+				},
+				&cli.BoolFlag{
+					Name:  "continue-on-error",
+					Value: false,
+					Usage: "record unreadable files as errored entries instead of failing",
+				},
+				&cli.BoolFlag{
+					Name:  "progress-json",
+					Value: false,
+					Usage: "report progress as JSON lines on stderr",
+				},
+				&cli.BoolFlag{
+					Name:  "torrent-hashes",
+					Value: false,
+					Usage: "also compute the torrent hashes of the chunks, for 'manifest export-torrent'",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				metaFlag := false
+				if cnx.Bool("meta") {
+					if !cnx.Bool("print-json") {
+						return usageError("the -meta flag requires the -print-json flag")
+					}
+					metaFlag = true
+				}
+				cxoPath := currentDir + "/.cxo/"
+				if !isFolderExist(cxoPath) {
+					return usageError("please use 'manifest init' command before 'manifest commit'")
+				}
+				continueOnError = cnx.Bool("continue-on-error")
+
+				config, err := loadRepositoryConfig(currentDir)
+				if err != nil {
+					return err
+				}
+
+				return withRepositoryLock(func() error {
+					if cnx.Bool("store-chunks") || config.StoreChunks {
+						store, err := openChunkStore(currentDir)
+						if err != nil {
+							return err
+						}
+						defer store.close()
+						chunks = store
+					}
+					if cnx.Bool("torrent-hashes") {
+						cache, err := loadTorrentHashCache()
+						if err != nil {
+							return err
+						}
+						torrentHashes = cache
+						defer func() { torrentHashes = nil }()
+					}
+					ctx, stop := getInterruptContext()
+					defer stop()
+					terminal := isTerminal(os.Stderr)
+					if terminal || cnx.Bool("progress-json") {
+						totalFiles, totalBytes, err := countFiles(ctx, ".")
+						if err != nil && ctx.Err() == nil {
+							return err
+						}
+						progress = newProgressReporter(totalFiles, totalBytes, terminal, cnx.Bool("progress-json"))
+						progress.start()
+					}
+					var err error
+					filesList, err = processDirAndGenerateMeta(ctx, ".")
+					if progress != nil {
+						progress.stop()
+						progress = nil
+					}
+					if ctx.Err() != nil {
+						return interruptedError("commit interrupted, no checkpoint written")
+					}
+					if err != nil {
+						return err
+					}
+
+					manifestOuputBody, err := getManifestOutputBody(filesList)
+					if err != nil {
+						return err
+					}
+					if _, err := writeCheckpoint(manifestOuputBody); err != nil {
+						return err
+					}
+					if torrentHashes != nil {
+						if err := torrentHashes.save(); err != nil {
+							return err
+						}
+					}
+					if cnx.Bool("print-json") {
+						err = printFilesInJson(filesList, &manifestOuputBody.ManifestHeader, metaFlag)
+						if err != nil {
+							return err
+						}
+					}
+					return reportFileErrors(filesList)
+				})
+			},
+		},
+		{
+			Name:      "watch",
+			Usage:     "commit the files' metadatum whenever they change",
+			UsageText: "watch the directory and write a checkpoint after its files changed, reading only the changed files",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "quiet-period",
+					Value: defaultQuietPeriod,
+					Usage: "write a checkpoint once no change was seen for this long",
+				},
+				&cli.DurationFlag{
+					Name:  "interval",
+					Value: 0,
+					Usage: "also write a checkpoint this often while changes keep coming, 0 to wait for the quiet period",
+				},
+				&cli.DurationFlag{
+					Name:  "poll-interval",
+					Value: defaultPollInterval,
+					Usage: "how often to scan the directory if it can not be watched",
+				},
+				&cli.BoolFlag{
+					Name:  "store-chunks",
+					Value: false,
+					Usage: "store the files' chunk data in the .cxo folder",
+				},
+				&cli.BoolFlag{
+					Name:  "continue-on-error",
+					Value: false,
+					Usage: "record unreadable files as errored entries instead of skipping the checkpoint",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if !isFolderExist(currentDir + "/.cxo/") {
+					return usageError("please use 'manifest init' command before 'manifest watch'")
+				}
+				if cnx.Duration("quiet-period") <= 0 || cnx.Duration("poll-interval") <= 0 || cnx.Duration("interval") < 0 {
+					return usageError("the -quiet-period and -poll-interval flags must be positive")
+				}
+				continueOnError = cnx.Bool("continue-on-error")
+
+				config, err := loadRepositoryConfig(currentDir)
+				if err != nil {
+					return err
+				}
+
+				ctx, stop := getInterruptContext()
+				defer stop()
+				return watchDirectory(ctx, cnx.Bool("store-chunks") || config.StoreChunks,
+					cnx.Duration("quiet-period"), cnx.Duration("interval"), cnx.Duration("poll-interval"))
+			},
+		},
+		{
+			Name:      "export-torrent",
+			Usage:     "write a .torrent of the files of a checkpoint",
+			UsageText: "manifest export-torrent [-format v1|v2|hybrid] [-piece-length bytes] [-output file] <checkpoint|latest>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "format",
+					Value: torrentFormatHybrid,
+					Usage: "torrent format: v1, v2 or hybrid",
+				},
+				&cli.IntFlag{
+					Name:  "piece-length",
+					Usage: "piece length in bytes, the chunk size of the repository by default, which avoids reading data again",
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "name of the .torrent file, <checkpoint>.torrent by default",
+				},
+				&cli.StringFlag{
+					Name:  "announce",
+					Usage: "tracker URL",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() != 1 {
+					return usageError("export-torrent requires a checkpoint, see 'manifest list'")
+				}
+				format := cnx.String("format")
+				pieceLength := cnx.Int("piece-length")
+				if !cnx.IsSet("piece-length") {
+					pieceLength = chunkSize
+				}
+				switch format {
+				case torrentFormatV1:
+					if pieceLength <= 0 {
+						return usageError("the piece length must be positive")
+					}
+				case torrentFormatV2, torrentFormatHybrid:
+					if pieceLength < torrentBlockSize || pieceLength&(pieceLength-1) != 0 {
+						return usageError("the piece length of v2 torrents must be a power of two of at least %d", torrentBlockSize)
+					}
+				default:
+					return usageError("unknown torrent format %q", format)
+				}
+				checkpoint, err := getCheckpointFile(cnx.Args().First())
+				if err != nil {
+					return err
+				}
+				output := cnx.String("output")
+				if output == "" {
+					output = strings.TrimSuffix(filepath.Base(checkpoint), ".cxo") + ".torrent"
+				}
+				return withRepositoryLock(func() error {
+					return exportTorrent(checkpoint, output, format, pieceLength, cnx.String("announce"))
+				})
+			},
+		},
+		{
+			Name:      "import-torrent",
+			Usage:     "compare the files of a .torrent with the files in the directory",
+			UsageText: "manifest import-torrent <file.torrent>: report the files that are missing, differ or are not in the torrent",
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() != 1 {
+					return usageError("import-torrent requires a .torrent file")
+				}
+				return compareTorrent(cnx.Args().First())
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "write the files of a checkpoint as a checksum list",
+			UsageText: "manifest export -format sha256sum|b2sum|mtree|csv|jsonl [-output file] <checkpoint|latest>\n   manifest export -json [-output file] <checkpoint|latest>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "format",
+					Value: exportFormatSha256sum,
+					Usage: "output format: sha256sum, b2sum, mtree, csv or jsonl",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "write the whole checkpoint with its meta and temp files as canonical JSON, for 'manifest import -json'",
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "file to write, stdout by default",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() != 1 {
+					return usageError("export requires a checkpoint, see 'manifest list'")
+				}
+				format := cnx.String("format")
+				switch format {
+				case exportFormatSha256sum, exportFormatB2sum, exportFormatMtree, exportFormatCSV, exportFormatJSONL:
+				default:
+					return usageError("unknown export format %q", format)
+				}
+				if cnx.Bool("json") && cnx.IsSet("format") {
+					return usageError("the -json flag can not be used with the -format flag")
+				}
+				checkpoint, err := getCheckpointFile(cnx.Args().First())
+				if err != nil {
+					return err
+				}
+				export := func(w io.Writer) error {
+					if cnx.Bool("json") {
+						return exportCheckpointJSON(checkpoint, w)
+					}
+					return exportCheckpoint(checkpoint, format, w)
+				}
+				output := cnx.String("output")
+				if output == "" {
+					return export(os.Stdout)
+				}
+				file, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				if err := export(file); err != nil {
+					file.Close()
+					return err
+				}
+				return file.Close()
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "write a checkpoint of the files of a sha256sum or mtree list, or of a tar or zip archive",
+			UsageText: "manifest import -format sha256sum|mtree <file>: then check the directory with 'manifest verify'\n   manifest import -json <file>: import a checkpoint written by 'manifest export -json'\n   manifest import -archive <archive>: hash the files of a tar or zip archive without extracting them",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "format",
+					Value: exportFormatSha256sum,
+					Usage: "input format: sha256sum or mtree",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "read a checkpoint written by 'manifest export -json'",
+				},
+				&cli.BoolFlag{
+					Name:  "archive",
+					Usage: "read a tar, tar.gz, tar.zst or zip archive, storing its chunks if the repository stores chunks",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() != 1 {
+					return usageError("import requires a checksum list, a JSON checkpoint or an archive")
+				}
+				if cnx.Bool("json") && cnx.IsSet("format") {
+					return usageError("the -json flag can not be used with the -format flag")
+				}
+				if cnx.Bool("archive") && (cnx.Bool("json") || cnx.IsSet("format")) {
+					return usageError("the -archive flag can not be used with the -json and -format flags")
+				}
+				if !isFolderExist(currentDir + "/.cxo/") {
+					return usageError("please use 'manifest init' command before 'manifest import'")
+				}
+				return withRepositoryLock(func() error {
+					if cnx.Bool("json") {
+						return importCheckpointJSON(cnx.Args().First())
+					}
+					if cnx.Bool("archive") {
+						format, err := getArchiveFormat(cnx.Args().First(), "")
+						if err != nil {
+							return err
+						}
+						config, err := loadRepositoryConfig(currentDir)
+						if err != nil {
+							return err
+						}
+						if config.StoreChunks {
+							store, err := openChunkStore(currentDir)
+							if err != nil {
+								return err
+							}
+							defer store.close()
+							chunks = store
+							defer func() { chunks = nil }()
+						}
+						return importArchive(cnx.Args().First(), format)
+					}
+					return importChecksums(cnx.String("format"), cnx.Args().First())
+				})
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "compare the files of a checkpoint with the files in the directory",
+			UsageText: "manifest verify [-sample percent] [-seed n] [-since days] [checkpoint|latest]: report the files that are missing or differ",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "sample",
+					Usage: "only hash this share of the data, like 1%, in chunks picked at random weighted by size",
+				},
+				&cli.Int64Flag{
+					Name:  "seed",
+					Usage: "seed of the random sample, the same seed picks the same chunks",
+				},
+				&cli.IntFlag{
+					Name:  "since",
+					Usage: "only hash the files, or with -sample the chunks, not verified in this many days",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				name := "latest"
+				if cnx.NArg() > 0 {
+					name = cnx.Args().First()
+				}
+				var options verifyOptions
+				if cnx.IsSet("sample") {
+					sample, err := parseSample(cnx.String("sample"))
+					if err != nil {
+						return err
+					}
+					options.sample = sample
+				}
+				options.seed = cnx.Int64("seed")
+				if options.sinceDays = cnx.Int("since"); options.sinceDays < 0 {
+					return usageError("the -since flag must be a number of days")
+				}
+				checkpoint, err := getCheckpointFile(name)
+				if err != nil {
+					return err
+				}
+				return verifyCheckpoint(checkpoint, options)
+			},
+		},
+		{
+			Name:      "dupes",
+			Usage:     "report identical files, shared chunk runs and the dedup ratio of each directory",
+			UsageText: "manifest dupes [-min-run chunks] [-repository dir]... [checkpoint|latest]...",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "min-run",
+					Value: defaultMinChunkRun,
+					Usage: "report runs of at least this many consecutive chunks two files share",
+				},
+				&cli.StringSliceFlag{
+					Name:  "repository",
+					Usage: "also search the latest checkpoint of the repository in this directory, can be repeated",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.Int("min-run") < 1 {
+					return usageError("the -min-run flag must be positive")
+				}
+				names := cnx.Args().Slice()
+				repositories := cnx.StringSlice("repository")
+				if len(names) == 0 && (len(repositories) == 0 || isFolderExist(currentDir+manifestCXOFolder)) {
+					names = []string{"latest"}
+				}
+				var checkpoints []string
+				for _, name := range names {
+					checkpoint, err := getCheckpointFile(name)
+					if err != nil {
+						return err
+					}
+					checkpoints = append(checkpoints, checkpoint)
+				}
+				for _, repository := range repositories {
+					dir, err := filepath.Abs(repository)
+					if err != nil {
+						return err
+					}
+					repositoryCheckpoints, err := getRepositoryCheckpointFiles(dir)
+					if err != nil {
+						return err
+					}
+					if len(repositoryCheckpoints) == 0 {
+						return usageError("%s has no checkpoints", repository)
+					}
+					checkpoints = append(checkpoints, repositoryCheckpoints[len(repositoryCheckpoints)-1])
+				}
+				return printDupes(os.Stdout, checkpoints, cnx.Int("min-run"))
+			},
+		},
+		{
+			Name:      "find",
+			Usage:     "search the files of all the checkpoints by name, path, hash, size or date",
+			UsageText: "manifest find [-name glob] [-path glob] [-regex re] [-hash sha256] [-chunk hash] [-min-size n] [-max-size n] [-after date] [-before date] [-changed-after date] [-changed-before date]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "glob the file name matches, e.g. '*.log'",
+				},
+				&cli.StringFlag{
+					Name:  "path",
+					Usage: "glob the path relative to the directory matches, e.g. 'docs/*/*.txt'",
+				},
+				&cli.StringFlag{
+					Name:  "regex",
+					Usage: "regular expression the path relative to the directory matches",
+				},
+				&cli.StringFlag{
+					Name:  "hash",
+					Usage: "sha256 of the whole file, in hex or base64",
+				},
+				&cli.StringFlag{
+					Name:  "chunk",
+					Usage: "hash of a chunk of the file, in hex",
+				},
+				&cli.StringFlag{
+					Name:  "min-size",
+					Usage: "minimum file size in bytes, or with a K, M, G or T suffix",
+				},
+				&cli.StringFlag{
+					Name:  "max-size",
+					Usage: "maximum file size in bytes, or with a K, M, G or T suffix",
+				},
+				&cli.StringFlag{
+					Name:  "after",
+					Usage: "only checkpoints created at or after this date (2006-01-02 or RFC 3339)",
+				},
+				&cli.StringFlag{
+					Name:  "before",
+					Usage: "only checkpoints created before this date",
+				},
+				&cli.StringFlag{
+					Name:  "changed-after",
+					Usage: "only files changed on or after this day (2006-01-02)",
+				},
+				&cli.StringFlag{
+					Name:  "changed-before",
+					Usage: "only files changed before this day",
+				},
+				&cli.BoolFlag{
+					Name:  "list-checkpoints",
+					Usage: "list every checkpoint a file is in, not only the first and the last",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() > 0 {
+					return usageError("find takes no arguments, use the -name, -path or -regex flags")
+				}
+				query := findQuery{name: cnx.String("name"), path: cnx.String("path"), maxSize: -1}
+				var err error
+				if cnx.IsSet("regex") {
+					if query.regex, err = regexp.Compile(cnx.String("regex")); err != nil {
+						return usageError("invalid regular expression: %w", err)
+					}
+				}
+				if cnx.IsSet("hash") {
+					if query.hash, err = parseFindHash(cnx.String("hash")); err != nil {
+						return err
+					}
+				}
+				if cnx.IsSet("chunk") {
+					if query.chunk, err = hex.DecodeString(cnx.String("chunk")); err != nil || len(query.chunk) != 32 {
+						return usageError("%q is not a chunk hash in hex", cnx.String("chunk"))
+					}
+				}
+				if cnx.IsSet("min-size") {
+					if query.minSize, err = parseSize(cnx.String("min-size")); err != nil {
+						return err
+					}
+				}
+				if cnx.IsSet("max-size") {
+					if query.maxSize, err = parseSize(cnx.String("max-size")); err != nil {
+						return err
+					}
+				}
+				for _, date := range []struct {
+					flag  string
+					value *time.Time
+				}{{"after", &query.after}, {"before", &query.before}} {
+					if cnx.IsSet(date.flag) {
+						if *date.value, err = parseDate(cnx.String(date.flag)); err != nil {
+							return err
+						}
+					}
+				}
+				for _, date := range []struct {
+					flag  string
+					value *string
+				}{{"changed-after", &query.changedAfter}, {"changed-before", &query.changedBefore}} {
+					if cnx.IsSet(date.flag) {
+						day, err := parseDate(cnx.String(date.flag))
+						if err != nil {
+							return err
+						}
+						*date.value = day.Format("2006-01-02")
+					}
+				}
+				if !isFolderExist(currentDir + "/.cxo/") {
+					return usageError("please use 'manifest init' command before 'manifest find'")
+				}
+				return withRepositoryLock(func() error {
+					index, err := updateFindIndex()
+					if err != nil {
+						return err
+					}
+					return printFindResults(os.Stdout, index.find(&query), cnx.Bool("list-checkpoints"))
+				})
+			},
+		},
+		{
+			Name:      "history",
+			Usage:     "show the versions of a file across the checkpoints, or restore one",
+			UsageText: "manifest history <path>\n   manifest history -version <checkpoint> -output <file|-> <path>\n   manifest history -version <checkpoint> -restore <path>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "version",
+					Usage: "checkpoint whose version of the file to write",
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "write the version to this file, - for stdout",
+				},
+				&cli.BoolFlag{
+					Name:  "restore",
+					Usage: "replace the file in the directory with the version",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() != 1 {
+					return usageError("history requires the path of a file")
+				}
+				if cnx.IsSet("version") == (cnx.String("output") == "" && !cnx.Bool("restore")) {
+					return usageError("the -version flag requires the -output or the -restore flag, and the other way around")
+				}
+				if cnx.String("output") != "" && cnx.Bool("restore") {
+					return usageError("the -output and -restore flags can not be used together")
+				}
+				absPath, err := filepath.Abs(cnx.Args().First())
+				if err != nil {
+					return err
+				}
+				relPath, err := filepath.Rel(currentDir, absPath)
+				if err != nil || relPath == "." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) || relPath == ".." {
+					return usageError("%s is not a file of the directory", cnx.Args().First())
+				}
+				versions, err := getFileHistory(relPath)
+				if err != nil {
+					return err
+				}
+				if !cnx.IsSet("version") {
+					return printFileHistory(os.Stdout, relPath, versions)
+				}
+
+				return withRepositoryLock(func() error {
+					checkpoint, err := getCheckpointFile(cnx.String("version"))
+					if err != nil {
+						return err
+					}
+					version, err := getHistoryVersion(versions, checkpoint)
+					if err != nil {
+						return err
+					}
+					var store *chunkStore
+					if isFolderExist(currentDir + manifestChunksFolder) {
+						if store, err = openChunkStore(currentDir); err != nil {
+							return err
+						}
+						defer store.close()
+					}
+					switch output := cnx.String("output"); {
+					case cnx.Bool("restore"):
+						err = restoreHistoryVersion(store, version, absPath)
+					case output == "-":
+						err = writeHistoryVersion(store, version, os.Stdout)
+					default:
+						err = restoreHistoryVersion(store, version, output)
+					}
+					if err == nil && cnx.Bool("restore") {
+						fmt.Printf("restored %s as of checkpoint %s\n", relPath, strings.TrimSuffix(filepath.Base(checkpoint), ".cxo"))
+					}
+					return err
+				})
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "list the files added, removed or modified between two checkpoints",
+			UsageText: "manifest diff <checkpoint> [checkpoint|latest]: directories with the same hash in both are skipped",
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() < 1 || cnx.NArg() > 2 {
+					return usageError("diff requires one or two checkpoints")
+				}
+				names := []string{cnx.Args().Get(0), "latest"}
+				if cnx.NArg() == 2 {
+					names[1] = cnx.Args().Get(1)
+				}
+				var checkpoints []string
+				for _, name := range names {
+					checkpoint, err := getCheckpointFile(name)
+					if err != nil {
+						return err
+					}
+					checkpoints = append(checkpoints, checkpoint)
+				}
+				return diffCheckpoints(os.Stdout, checkpoints[0], checkpoints[1])
+			},
+		},
+		{
+			Name:      "dir-hash",
+			Usage:     "print the hash of a directory of a checkpoint and of the directories below it",
+			UsageText: "manifest dir-hash [-checkpoint name] [dir]: directories with the same hash have the same files",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "checkpoint",
+					Value: "latest",
+					Usage: "checkpoint to read",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() > 1 {
+					return usageError("dir-hash takes at most one directory")
+				}
+				dir := "."
+				if cnx.NArg() == 1 {
+					dir = cnx.Args().First()
+				}
+				checkpoint, err := getCheckpointFile(cnx.String("checkpoint"))
+				if err != nil {
+					return err
+				}
+				return printDirectoryHashes(os.Stdout, checkpoint, dir)
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "show or change the settings of the repository, kept in .cxo/config",
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() > 0 {
+					return usageError("unknown config command %q, use get or set", cnx.Args().First())
+				}
+				return cli.ShowSubcommandHelp(cnx)
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:      "get",
+					Usage:     "print a setting, or all of them",
+					UsageText: "manifest config get [chunk-size|hash-algorithm|ignore|creator|signing-key|compression|store-chunks]",
+					Action: func(cnx *cli.Context) error {
+						if cnx.NArg() > 1 {
+							return usageError("config get takes at most one setting")
+						}
+						config, err := loadRepositoryConfig(currentDir)
+						if err != nil {
+							return err
+						}
+						return printRepositoryConfig(config, cnx.Args().First())
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "change a setting",
+					UsageText: "manifest config set <setting> <value>: ignore takes any number of patterns, which replace the current ones",
+					Action: func(cnx *cli.Context) error {
+						if cnx.NArg() < 1 || (cnx.NArg() < 2 && cnx.Args().First() != "ignore") {
+							return usageError("config set requires a setting and its value")
+						}
+						if !isFolderExist(currentDir + "/.cxo/") {
+							return usageError("please use 'manifest init' command before 'manifest config set'")
+						}
+						return withRepositoryLock(func() error {
+							return setRepositoryConfigValue(currentDir, cnx.Args().First(), cnx.Args().Slice()[1:])
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:      "reconcile",
+			Usage:     "list the chunk hashes only one of two hash sets has, exchanging sketches the size of the difference",
+			UsageText: "manifest reconcile <temp|checkpoint> <temp|checkpoint>, or manifest reconcile -command 'ssh host \"cd dir && manifest reconcile-serve\"' [temp|checkpoint]: prints < for the hashes only the first set has, > for those only the second one has",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "command",
+					Usage: "shell command running 'manifest reconcile-serve' for the second hash set, over its stdin and stdout",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				command := cnx.String("command")
+				if (command == "" && cnx.NArg() != 2) || (command != "" && cnx.NArg() > 1) {
+					return usageError("reconcile requires two hash sets, or -command and at most one hash set")
+				}
+				localName := "latest"
+				if cnx.NArg() > 0 {
+					localName = cnx.Args().First()
+				}
+				local, err := readHashSet(localName)
+				if err != nil {
+					return err
+				}
+				if command == "" {
+					remote, err := readHashSet(cnx.Args().Get(1))
+					if err != nil {
+						return err
+					}
+					onlyLocal, onlyRemote, stats, err := reconcileHashSets(local, getLocalSketchSource(remote))
+					if err != nil {
+						return err
+					}
+					printReconcileResult(os.Stdout, onlyLocal, onlyRemote, stats, localName, cnx.Args().Get(1))
+					return nil
+				}
+
+				remote := exec.Command("sh", "-c", command)
+				remote.Stderr = os.Stderr
+				stdin, err := remote.StdinPipe()
+				if err != nil {
+					return err
+				}
+				stdout, err := remote.StdoutPipe()
+				if err != nil {
+					return err
+				}
+				if err := remote.Start(); err != nil {
+					return err
+				}
+				onlyLocal, onlyRemote, stats, err := reconcileHashSets(local, getStreamSketchSource(stdout, stdin))
+				stdin.Close()
+				if waitErr := remote.Wait(); err == nil && waitErr != nil {
+					err = fmt.Errorf("%s: %w", command, waitErr)
+				}
+				if err != nil {
+					return err
+				}
+				printReconcileResult(os.Stdout, onlyLocal, onlyRemote, stats, localName, "the remote set")
+				return nil
+			},
+		},
+		{
+			Name:      "reconcile-serve",
+			Usage:     "send sketches of a hash set to 'manifest reconcile -command' over stdin and stdout",
+			UsageText: "manifest reconcile-serve [temp|checkpoint]: the hash set of the latest checkpoint by default",
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() > 1 {
+					return usageError("reconcile-serve takes at most one hash set")
+				}
+				name := "latest"
+				if cnx.NArg() == 1 {
+					name = cnx.Args().First()
+				}
+				set, err := readHashSet(name)
+				if err != nil {
+					return err
+				}
+				return serveReconcile(set, os.Stdin, os.Stdout)
+			},
+		},
+		{
+			Name:  "hashset",
+			Usage: "export the chunk hashes of checkpoints as a compact Bloom or cuckoo filter, and query or merge filters",
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() > 0 {
+					return usageError("unknown hashset command %q, use export, query or merge", cnx.Args().First())
+				}
+				return cli.ShowSubcommandHelp(cnx)
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:      "export",
+					Usage:     "write a filter of the chunk hashes of checkpoints",
+					UsageText: "manifest hashset export [-filter bloom|cuckoo] [-fp-rate 0.001] [-capacity n] [-output file] [temp|checkpoint]...: the hashes of all the hash sets given, of the latest checkpoint by default",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "filter",
+							Value: filterBloom,
+							Usage: "bloom or cuckoo, cuckoo filters are smaller below a false positive rate of about 0.3%",
+						},
+						&cli.Float64Flag{
+							Name:  "fp-rate",
+							Value: defaultFilterFpRate,
+							Usage: "false positive rate of the filter",
+						},
+						&cli.IntFlag{
+							Name:  "capacity",
+							Usage: "number of hashes the filter is sized for, at least the hashes exported: filters merged later need the same capacity",
+						},
+						&cli.StringFlag{
+							Name:  "output",
+							Usage: "file the filter is written to, the name of the first hash set with the filter type as extension by default",
+						},
+					},
+					Action: func(cnx *cli.Context) error {
+						names := cnx.Args().Slice()
+						if len(names) == 0 {
+							names = []string{"latest"}
+						}
+						var hashes [][]byte
+						for _, name := range names {
+							set, err := readHashSet(name)
+							if err != nil {
+								return err
+							}
+							hashes = append(hashes, set...)
+						}
+						SortByteArrays(hashes)
+						hashes, err := getDistinctHashes(hashes)
+						if err != nil {
+							return err
+						}
+						filter, err := newHashSetFilter(cnx.String("filter"), hashes, cnx.Float64("fp-rate"), cnx.Int("capacity"))
+						if err != nil {
+							return err
+						}
+						output := cnx.String("output")
+						if output == "" {
+							path, err := getHashSetFile(names[0])
+							if err != nil {
+								return err
+							}
+							output = strings.TrimSuffix(filepath.Base(path), ".temp") + "." + filter.data.Type
+						}
+						if err := filter.write(output); err != nil {
+							return err
+						}
+						fmt.Printf("%s: %s\n", output, filter.describe())
+						return nil
+					},
+				},
+				{
+					Name:      "query",
+					Usage:     "print whether chunk hashes are in a filter",
+					UsageText: "manifest hashset query <filter> <hash>...: hashes in hex or base64, 'probably present' may be a false positive, 'absent' is certain",
+					Action: func(cnx *cli.Context) error {
+						if cnx.NArg() < 2 {
+							return usageError("hashset query requires a filter and at least one hash")
+						}
+						filter, err := readHashSetFilter(cnx.Args().First())
+						if err != nil {
+							return err
+						}
+						_, err = queryHashSetFilter(os.Stdout, filter, cnx.Args().Slice()[1:])
+						return err
+					},
+				},
+				{
+					Name:      "merge",
+					Usage:     "write the union of filters of the same type and size",
+					UsageText: "manifest hashset merge -output <file> <filter> <filter>...",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "output",
+							Usage: "file the merged filter is written to",
+						},
+					},
+					Action: func(cnx *cli.Context) error {
+						if cnx.String("output") == "" || cnx.NArg() < 2 {
+							return usageError("hashset merge requires -output and at least two filters")
+						}
+						merged, err := readHashSetFilter(cnx.Args().First())
+						if err != nil {
+							return err
+						}
+						for _, name := range cnx.Args().Slice()[1:] {
+							filter, err := readHashSetFilter(name)
+							if err != nil {
+								return err
+							}
+							if err := merged.merge(filter); err != nil {
+								return fmt.Errorf("%s: %w", name, err)
+							}
+						}
+						if err := merged.write(cnx.String("output")); err != nil {
+							return err
+						}
+						fmt.Printf("%s: %s\n", cnx.String("output"), merged.describe())
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:      "merge",
+			Usage:     "write a checkpoint combining the files of several checkpoints, possibly of other repositories",
+			UsageText: "manifest merge [-conflict fail|newest|sequence] [prefix=]<checkpoint>...: each checkpoint is mounted under its prefix, or at the top; checkpoints of other repositories are given by their path",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "conflict",
+					Value: mergeFail,
+					Usage: "for files that differ at the same path: fail, keep the file of the newest checkpoint, or of the one of larger sequence id",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() < 1 {
+					return usageError("merge requires at least one checkpoint")
+				}
+				if !isFolderExist(currentDir + "/.cxo/") {
+					return usageError("please use 'manifest init' command before 'manifest merge'")
+				}
+				return withRepositoryLock(func() error {
+					var sources []*mergeSource
+					for _, arg := range cnx.Args().Slice() {
+						source, err := parseMergeSource(arg)
+						if err != nil {
+							return err
+						}
+						sources = append(sources, source)
+					}
+					body, err := mergeCheckpoints(sources, cnx.String("conflict"), os.Stdout)
+					if err != nil {
+						return err
+					}
+					baseName, err := writeCheckpoint(body)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("merged %d checkpoints into checkpoint %s: %d files, %d bytes\n",
+						len(sources), baseName, len(filesList.fileNames), body.ManifestHeader.BodyDataFileSize)
+					return nil
+				})
+			},
+		},
+		{
+			Name:      "sync",
+			Usage:     "make a directory hold the files of a checkpoint, copying only the chunks it does not have",
+			UsageText: "manifest sync [-checkpoint latest] [-delete] [-dry-run] <destination>: chunks are read from the chunk store or the files of the current directory, changed files are rewritten where they differ and the files written are checked against the checkpoint",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "checkpoint",
+					Value: "latest",
+					Usage: "checkpoint to sync the destination to",
+				},
+				&cli.BoolFlag{
+					Name:  "delete",
+					Usage: "remove the files and directories the checkpoint does not have, and move renamed files instead of copying them",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print what would be done without changing the destination",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() != 1 {
+					return usageError("sync requires a destination directory")
+				}
+				return withRepositoryLock(func() error {
+					checkpoint, err := getCheckpointFile(cnx.String("checkpoint"))
+					if err != nil {
+						return err
+					}
+					options := syncOptions{delete: cnx.Bool("delete"), dryRun: cnx.Bool("dry-run")}
+					stats, err := syncCheckpoint(checkpoint, cnx.Args().First(), options, os.Stdout)
+					printSyncStats(os.Stdout, stats)
+					return err
+				})
+			},
+		},
+		{
+			Name:      "serve",
+			Usage:     "serve the checkpoints read only over HTTP and WebDAV",
+			UsageText: "manifest serve [-listen 127.0.0.1:8080]: directory listings and downloads under /files/, WebDAV under /dav/, JSON metadata under /api/checkpoints",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "listen",
+					Value: defaultServeAddress,
+					Usage: "address to listen on, give :8080 to serve other machines",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				if cnx.NArg() > 0 {
+					return usageError("serve takes no arguments")
+				}
+				if !isFolderExist(currentDir + "/.cxo/") {
+					return usageError("please use 'manifest init' command before 'manifest serve'")
+				}
+				var store *chunkStore
+				if isFolderExist(currentDir + manifestChunksFolder) {
+					var err error
+					if store, err = openChunkStore(currentDir); err != nil {
+						return err
+					}
+					defer store.close()
+				}
+				listener, err := net.Listen("tcp", cnx.String("listen"))
+				if err != nil {
+					return err
+				}
+				fmt.Printf("serving the checkpoints on http://%s/files/, WebDAV on http://%s/dav/\n", listener.Addr(), listener.Addr())
+				return http.Serve(listener, newServeHandler(newServedRepository(store)))
+			},
+		},
+		{
+			Name:      "archive",
+			Usage:     "write the files of a checkpoint to a tar or zip archive, with the checkpoint to verify them",
+			UsageText: "manifest archive [-format tar|tar.gz|tar.zst|zip] -o <archive|-> [checkpoint|latest]: the files are read from the chunk store, or from the directory while they are unchanged",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "o",
+					Usage: "archive to write, - for stdout",
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "tar, tar.gz, tar.zst or zip, by default from the extension of the archive",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				args, err := parseTrailingFlags(cnx)
+				if err != nil {
+					return err
+				}
+				if len(args) > 1 {
+					return usageError("archive takes at most one checkpoint")
+				}
+				output := cnx.String("o")
+				if output == "" {
+					return usageError("archive requires the -o flag")
+				}
+				if !isFolderExist(currentDir + "/.cxo/") {
+					return usageError("please use 'manifest init' command before 'manifest archive'")
+				}
+				format := cnx.String("format")
+				if output == "-" && format == "" {
+					format = archiveFormatTar
+				}
+				format, err = getArchiveFormat(output, format)
+				if err != nil {
+					return err
+				}
+				name := "latest"
+				if len(args) == 1 {
+					name = args[0]
+				}
+				checkpoint, err := getCheckpointFile(name)
+				if err != nil {
+					return err
+				}
+				var store *chunkStore
+				if isFolderExist(currentDir + manifestChunksFolder) {
+					if store, err = openChunkStore(currentDir); err != nil {
+						return err
+					}
+					defer store.close()
+				}
+				skipped := 0
+				err = writeArchiveFile(output, func(w io.Writer) error {
+					skipped, err = archiveCheckpoint(store, checkpoint, w, format)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				if skipped > 0 {
+					return partialError("%d files were not archived", skipped)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "unarchive",
+			Usage:     "extract a tar or zip archive and verify its files",
+			UsageText: "manifest unarchive [-format tar|tar.gz|tar.zst|zip] [-o directory] <archive|->: the files are checked against the checkpoint written in the archive by 'manifest archive'",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "o",
+					Value: ".",
+					Usage: "directory to extract to",
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "tar, tar.gz, tar.zst or zip, by default from the extension of the archive",
+				},
+			},
 			Action: func(cnx *cli.Context) error {
-				err := createFolder(".cxo")
-				if err == nil {
-					fmt.Println("Create .cxo foler in current directory: ")
+				args, err := parseTrailingFlags(cnx)
+				if err != nil {
+					return err
+				}
+				if len(args) != 1 {
+					return usageError("unarchive requires an archive")
+				}
+				name := args[0]
+				format := cnx.String("format")
+				if name == "-" && format == "" {
+					format = archiveFormatTar
 				}
+				format, err = getArchiveFormat(name, format)
+				if err != nil {
+					return err
+				}
+				if name == "-" && format == archiveFormatZip {
+					return usageError("zip archives can not be read from stdin")
+				}
+				_, err = unarchive(name, format, cnx.String("o"), os.Stdout)
 				return err
 			},
 		},
 		{
-			Name:      "commit",
-			Usage:     "commit all the files' metadatum into the .cxo file",
-			UsageText: "commit all the metadata files into the .cxo folder",
+			Name:      "stats",
+			Usage:     "report the sizes, extensions, ages, churn and chunk dedup of the files of a checkpoint",
+			UsageText: "manifest stats [-format text|json|html] [-o file] [-top 10] [-churn 10] [checkpoint|latest]: the html format is a self-contained page",
 			Flags: []cli.Flag{
-				&cli.BoolFlag{
-					Name:  "print-json",
-					Value: false,
-					Usage: "print files in the directory in json ",
+				&cli.StringFlag{
+					Name:  "format",
+					Value: statsFormatText,
+					Usage: "output format: text, json or html",
 				},
-				&cli.BoolFlag{
-					Name:  "meta",
-					Value: false,
-					Usage: "add metadata section in json",
+				&cli.StringFlag{
+					Name:  "o",
+					Usage: "file to write the report to instead of stdout",
+				},
+				&cli.IntFlag{
+					Name:  "top",
+					Value: 10,
+					Usage: "number of extensions and directories reported",
+				},
+				&cli.IntFlag{
+					Name:  "churn",
+					Value: 10,
+					Usage: "number of the last pairs of consecutive checkpoints the churn is reported for",
 				},
 			},
 			Action: func(cnx *cli.Context) error {
-				metaFlag := false
-				if cnx.Bool("meta") {
-					if !cnx.Bool("print-json") {
-						cli.ShowAppHelpAndExit(cnx, 0)
-					}
-					metaFlag = true
+				if cnx.NArg() > 1 {
+					return usageError("stats takes at most one checkpoint")
 				}
-				cxoPath := currentDir + "/.cxo/"
-				if !isFolderExist(cxoPath) {
-					fmt.Println("please use 'manifest init' command before 'manifest commit'")
-					os.Exit(1)
+				if cnx.Int("top") < 0 || cnx.Int("churn") < 0 {
+					return usageError("the -top and -churn flags can not be negative")
 				}
-
-				cxoFile, err := createFolderAndFile("./.cxo/checkpoints/", manifestCXOFolder, ".cxo")
+				if !isFolderExist(currentDir + "/.cxo/") {
+					return usageError("please use 'manifest init' command before 'manifest stats'")
+				}
+				name := "latest"
+				if cnx.NArg() == 1 {
+					name = cnx.Args().First()
+				}
+				checkpoint, err := getCheckpointFile(name)
 				if err != nil {
 					return err
 				}
-				defer cxoFile.Close()
-
-				// manifest .cxo file
-				var manifestOuputBody ManifestOuputBody
-				manifestOuputBody.ManifestBody = *getManifestBody(filesList)
-				manifestOuputBody.ManifestHeader = *getManifestDirectoryHeader(&manifestOuputBody.ManifestBody)
-				manifestOuputBody.FileList = *getFileList(filesList)
-
-				serializedOuputBody := encoder.Serialize(manifestOuputBody)
-				_, err = cxoFile.Write(serializedOuputBody)
-				if err != nil {
+				options := statsOptions{top: cnx.Int("top"), churn: cnx.Int("churn")}
+				if cnx.String("o") == "" {
+					return printCheckpointStats(os.Stdout, checkpoint, cnx.String("format"), options)
+				}
+				var output bytes.Buffer
+				if err := printCheckpointStats(&output, checkpoint, cnx.String("format"), options); err != nil {
 					return err
 				}
-				if cnx.Bool("print-json") {
-					printFilesInJson(filesList, &manifestOuputBody.ManifestHeader, metaFlag)
+				return writeFileAtomic(cnx.String("o"), output.Bytes())
+			},
+		},
+		{
+			Name:      "list",
+			Usage:     "list all the checkpoints in the .cxo folder",
+			UsageText: "list the checkpoints with their files' total size and the size of their stored chunks",
+			Action: func(cnx *cli.Context) error {
+				return listCheckpoints()
+			},
+		},
+		{
+			Name:      "pack",
+			Usage:     "pack the stored chunks into storage blocks",
+			UsageText: "move the loose chunk objects in .cxo/chunks/ into large immutable storage blocks in .cxo/blocks/",
+			Flags: []cli.Flag{
+				&cli.Uint64Flag{
+					Name:  "block-size",
+					Value: defaultBlockSizeMB,
+					Usage: "maximum size of a storage block in MB",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				return withRepositoryLock(func() error {
+					store, err := openChunkStore(currentDir)
+					if err != nil {
+						return err
+					}
+					defer store.close()
+					count, err := store.pack(cnx.Uint64("block-size") << 20)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("wrote %d storage blocks\n", count)
+					return nil
+				})
+			},
+		},
+		{
+			Name:      "repack",
+			Usage:     "rewrite the storage blocks without the chunks no checkpoint references",
+			UsageText: "rewrite the storage blocks holding chunks that are not referenced by any checkpoint",
+			Flags: []cli.Flag{
+				&cli.Uint64Flag{
+					Name:  "block-size",
+					Value: defaultBlockSizeMB,
+					Usage: "maximum size of a storage block in MB",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				return withRepositoryLock(func() error {
+					referenced, err := getReferencedChunks()
+					if err != nil {
+						return err
+					}
+					store, err := openChunkStore(currentDir)
+					if err != nil {
+						return err
+					}
+					defer store.close()
+					count, size, err := store.repack(referenced, cnx.Uint64("block-size")<<20)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("dropped %d chunks, %d bytes\n", count, size)
+					return nil
+				})
+			},
+		},
+		{
+			Name:      "parity",
+			Usage:     "compute Reed-Solomon parity for the storage blocks",
+			UsageText: "compute the parity of every storage block that has none yet into .cxo/parity/",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "data-shards",
+					Value: defaultDataShards,
+					Usage: "number of data shards in a stripe",
+				},
+				&cli.IntFlag{
+					Name:  "parity-shards",
+					Value: defaultParityShards,
+					Usage: "number of parity shards in a stripe, the overhead is parity-shards/data-shards",
+				},
+			},
+			Action: func(cnx *cli.Context) error {
+				return withRepositoryLock(func() error {
+					store, err := openChunkStore(currentDir)
+					if err != nil {
+						return err
+					}
+					defer store.close()
+					count, err := store.writeParity(cnx.Int("data-shards"), cnx.Int("parity-shards"))
+					if err != nil {
+						return err
+					}
+					fmt.Printf("wrote parity for %d storage blocks\n", count)
+					return nil
+				})
+			},
+		},
+		{
+			Name:      "scrub",
+			Usage:     "check the stored chunks and storage blocks for damage",
+			UsageText: "read every stored chunk and check it against its hash, and every storage block against its parity",
+			Action: func(cnx *cli.Context) error {
+				store, err := openChunkStore(currentDir)
+				if err != nil {
+					return err
 				}
-
-				// manifest meta and temp files
-				err = generateMetaAndTempFiles()
+				defer store.close()
+				report, err := store.scrub()
 				if err != nil {
 					return err
 				}
-
+				printScrubReport(report)
+				if len(report.BadChunks) > 0 || len(report.BadBlocks) > 0 {
+					return verifyError("scrub found damage, run 'manifest repair'")
+				}
 				return nil
 			},
 		},
+		{
+			Name:      "repair",
+			Usage:     "reconstruct damaged storage blocks from their parity and damaged chunks from the files",
+			UsageText: "scrub the chunk store, rebuild the damaged storage blocks from their parity and the damaged loose chunks from the files of the directory that still have them",
+			Action: func(cnx *cli.Context) error {
+				return withRepositoryLock(func() error {
+					store, err := openChunkStore(currentDir)
+					if err != nil {
+						return err
+					}
+					defer store.close()
+					report, err := store.scrub()
+					if err != nil {
+						return err
+					}
+					printScrubReport(report)
+					// the chunks are repaired even if some blocks can not be
+					repaired, blockErr := store.repairBlocks(report.BadBlocks, os.Stderr)
+					fmt.Printf("repaired %d of %d storage blocks\n", repaired, len(report.BadBlocks))
+					rebuilt, missing, err := store.repairChunks(report.BadChunks)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("rebuilt %d damaged chunks from the files of the directory\n", rebuilt)
+					switch {
+					case blockErr != nil && len(missing) > 0:
+						return verifyError("%v, and %d damaged chunks are no longer in the files of the directory", blockErr, len(missing))
+					case len(missing) > 0:
+						return verifyError("%d damaged chunks are no longer in the files of the directory", len(missing))
+					}
+					return blockErr
+				})
+			},
+		},
 	}
 }
 
@@ -127,27 +1482,82 @@ func main() {
 
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(getExitCode(err))
 	}
 
 }
 
-func processDirAndGenerateMeta(dir string) *FilesInfoList {
+// parseTrailingFlags sets the flags given after the positional arguments,
+// which urfave/cli stops parsing at, and returns the positional arguments.
+// It is for commands whose flags all take a value, like archive -o
+func parseTrailingFlags(cnx *cli.Context) ([]string, error) {
+	var args []string
+	rest := cnx.Args().Slice()
+	for i := 0; i < len(rest); i++ {
+		arg := rest[i]
+		if arg == "--" {
+			args = append(args, rest[i+1:]...)
+			break
+		}
+		if arg == "-" || !strings.HasPrefix(arg, "-") {
+			args = append(args, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		var value string
+		if index := strings.Index(name, "="); index >= 0 {
+			name, value = name[:index], name[index+1:]
+		} else if i+1 < len(rest) {
+			i++
+			value = rest[i]
+		} else {
+			return nil, usageError("flag needs an argument: %s", arg)
+		}
+		if err := cnx.Set(name, value); err != nil {
+			return nil, usageError("invalid flag %s: %v", arg, err)
+		}
+	}
+	return args, nil
+}
+
+// processDirAndGenerateMeta walks the directory and reads every file in it.
+// With continueOnError set, files that can not be read are kept as errored
+// entries and unreadable directories are skipped, instead of failing.
+// Cancelling ctx stops the walk after the file being read.
+func processDirAndGenerateMeta(ctx context.Context, dir string) (*FilesInfoList, error) {
 	var FilesAndDirectories FilesInfoList
 	var directories []string
-	var directoriesSize []int
 	var files []string
 	var filesSize []int
 	var filesHash []HashVariable
-	var tempFileHash HashVariable
 	var filesMetaList ManifestDirectMetaList
 	var ChunksList [][]ChunkHash
 	var filesCreateDate []string
+	var filesError []string
+	var skipped []string
 
-	err := filepath.Walk(dir,
+	rules, err := loadIgnoreRules(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(dir,
 		func(path string, info os.FileInfo, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if rules.isIgnored(path, info != nil && info.IsDir()) {
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			if err != nil {
-				return err
+				if !continueOnError {
+					return err
+				}
+				skipped = append(skipped, err.Error())
+				return nil
 			}
 
 			if info.IsDir() {
@@ -155,30 +1565,50 @@ func processDirAndGenerateMeta(dir string) *FilesInfoList {
 					return filepath.SkipDir
 				}
 				directories = append(directories, path)
-				dirSize, err := getDirectorySize(path)
+			} else if info.Name() != appName {
+				fileHash, filechunks, fileMeta, err := getFileData(path, info)
 				if err != nil {
-					return err
+					if !continueOnError {
+						return err
+					}
+					filesError = append(filesError, err.Error())
+				} else {
+					filesError = append(filesError, "")
 				}
-				directoriesSize = append(directoriesSize, dirSize)
-			} else if info.Name() != appName {
 				files = append(files, path)
 				filesSize = append(filesSize, int(info.Size()))
 				filesCreateDate = append(filesCreateDate, timespecToDate(info.Sys().(*syscall.Stat_t).Ctim))
-				tempFileHash = HashVariable{[]byte("base64,sha256"), []byte(hashFileAndEncoding(path))}
-				filechunks, err := getFileChunks(path)
-				if err != nil {
-					return err
+				ChunksList = append(ChunksList, filechunks)
+				filesHash = append(filesHash, fileHash)
+				filesMetaList = append(filesMetaList, fileMeta)
+				if progress != nil {
+					progress.addFile()
 				}
-				ChunksList = append(ChunksList, *filechunks)
-				filesHash = append(filesHash, tempFileHash)
-
-				filesMetaList = append(filesMetaList, getFileMeta(path))
 			}
 
 			return nil
 		})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	// the size of a directory is that of the files scanned under it, without
+	// the .cxo folder and the ignored files
+	directoriesSize := make([]int, len(directories))
+	directoryIndex := make(map[string]int, len(directories))
+	for i, directory := range directories {
+		directoryIndex[directory] = i
+	}
+	root := filepath.Clean(dir)
+	for i, file := range files {
+		for parent := filepath.Dir(file); ; parent = filepath.Dir(parent) {
+			if index, ok := directoryIndex[parent]; ok {
+				directoriesSize[index] += filesSize[i]
+			}
+			if parent == root || parent == filepath.Dir(parent) {
+				break
+			}
+		}
 	}
 
 	FilesAndDirectories.directoryNames = directories
@@ -189,48 +1619,133 @@ func processDirAndGenerateMeta(dir string) *FilesInfoList {
 	FilesAndDirectories.filesMetaList = filesMetaList
 	FilesAndDirectories.filesChunksList = ChunksList
 	FilesAndDirectories.filesCreationDateList = filesCreateDate
-	return &FilesAndDirectories
+	FilesAndDirectories.filesErrorList = filesError
+	FilesAndDirectories.skippedList = skipped
+	return &FilesAndDirectories, nil
+}
+
+// getFileData reads the file, or takes its data from the cache of watch mode
+// if the file did not change since it was read
+func getFileData(path string, info os.FileInfo) (HashVariable, []ChunkHash, FileMeta, error) {
+	if fileCache != nil {
+		return fileCache.get(path, info)
+	}
+	return readFileData(path)
+}
+
+// readFileData hashes the file and its chunks and reads its metadata
+func readFileData(path string) (HashVariable, []ChunkHash, FileMeta, error) {
+	fileHash, filechunks, holes, err := getFileChunks(path)
+	if err != nil {
+		return HashVariable{}, nil, FileMeta{}, err
+	}
+	fileMeta, err := getFileMeta(path)
+	if err != nil {
+		return HashVariable{}, nil, FileMeta{}, err
+	}
+	fileMeta.Holes = holes
+	return fileHash, filechunks, fileMeta, nil
 }
 
-func getFileChunks(filepath string) (*[]ChunkHash, error) {
+// reportFileErrors prints the files and directories that could not be read
+func reportFileErrors(fList *FilesInfoList) error {
+	count := 0
+	for _, fileError := range (*fList).filesErrorList {
+		if fileError != "" {
+			fmt.Fprintln(os.Stderr, fileError)
+			count++
+		}
+	}
+	for _, skipped := range (*fList).skippedList {
+		fmt.Fprintln(os.Stderr, skipped)
+		count++
+	}
+	if count > 0 {
+		return partialError("%d files or directories could not be read", count)
+	}
+	return nil
+}
 
+// getFileChunks hashes the file and its chunks in one pass, reading them
+// with pread, or from a mapping of the file for files of at least
+// mmapThreshold bytes. The chunks in the holes of sparse files are not read,
+// the holes are returned to be recorded in the checkpoint
+func getFileChunks(filepath string) (HashVariable, []ChunkHash, []FileExtent, error) {
 	var fileData []ChunkHash
-	var size uint64
 
 	file, err := os.Open(filepath)
 	if err != nil {
-		return nil, err
+		return HashVariable{}, nil, nil, err
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return HashVariable{}, nil, nil, err
+	}
+	fileSize := info.Size()
+	holes, err := getFileHoles(file, fileSize)
+	if err != nil {
+		return HashVariable{}, nil, nil, err
+	}
+	var mapped []byte
+	if mmapThreshold > 0 && fileSize >= mmapThreshold {
+		if mapped, err = syscall.Mmap(int(file.Fd()), 0, int(fileSize), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+			return HashVariable{}, nil, nil, err
+		}
+		defer syscall.Munmap(mapped)
+	}
 
 	bf := make([]byte, chunkSize)
 	hs := sha256.New()
+	fileHash := sha256.New()
+	var zeroHash []byte
 
-	for {
-		size = chunkSize
-		readTotal, err := file.Read(bf)
-		if err != nil && err != io.EOF {
-			return nil, err
+	for offset := int64(0); offset < fileSize; offset += int64(chunkSize) {
+		size := uint64(chunkSize)
+		if remaining := fileSize - offset; remaining < int64(chunkSize) {
+			size = uint64(remaining)
 		}
-		if readTotal == 0 {
-			break
+		var hash []byte
+		if isInHole(holes, offset, offset+int64(size)) {
+			for i := range bf {
+				bf[i] = 0
+			}
+			if zeroHash == nil {
+				zeroHash = hashChunkData(nil)
+			}
+			hash = zeroHash
+		} else {
+			if err := readFileAt(file, mapped, bf[:size], offset); err != nil {
+				return HashVariable{}, nil, nil, err
+			}
+			for i := size; i < uint64(chunkSize); i++ {
+				bf[i] = 0
+			}
+			hs.Write(bf)
+			hash = hs.Sum(nil)
+			hs.Reset()
 		}
+		fileHash.Write(bf[:size])
 
-		for readTotal < chunkSize {
-			size = uint64(readTotal)
-			readTotal = readTotal + copy(bf[readTotal:], []byte{0x0000})
+		if progress != nil {
+			progress.addBytes(int(size))
+		}
+		if chunks != nil {
+			if err := chunks.put(hash, bf[:size]); err != nil {
+				return HashVariable{}, nil, nil, err
+			}
+		}
+		if torrentHashes != nil {
+			torrentHashes.add(hash, bf[:size])
 		}
-
-		hs.Write(bf)
-		hash := hs.Sum(nil)
-		hs.Reset()
 		fileData = append(fileData, ChunkHash{size, hash})
 	}
 
-	return &fileData, nil
+	encoded := base64.StdEncoding.EncodeToString(fileHash.Sum(nil))
+	return HashVariable{[]byte("base64,sha256"), []byte(encoded)}, fileData, holes, nil
 }
 
-func printFilesInJson(fList *FilesInfoList, dirHeader *ManifestDirectoryHeader, metaflag bool) {
+func printFilesInJson(fList *FilesInfoList, dirHeader *ManifestDirectoryHeader, metaflag bool) error {
 	var dirmeta DirectoryMetaList
 	var filemeta FileDataList
 
@@ -238,9 +1753,10 @@ func printFilesInJson(fList *FilesInfoList, dirHeader *ManifestDirectoryHeader,
 		fh := (*fList).filesHashlist[indx].Hash
 		fs := (*fList).fileSizes[indx]
 		meta := (*fList).filesMetaList[indx]
-		fileInfo := FileData{fn, fs, fh, &meta}
+		fe := (*fList).filesErrorList[indx]
+		fileInfo := FileData{fn, fs, fh, &meta, fe}
 		if !metaflag {
-			fileInfo = FileData{fn, fs, fh, nil}
+			fileInfo = FileData{fn, fs, fh, nil, fe}
 		}
 
 		filemeta = append(filemeta, fileInfo)
@@ -263,9 +1779,10 @@ func printFilesInJson(fList *FilesInfoList, dirHeader *ManifestDirectoryHeader,
 
 	jsons, err := json.MarshalIndent(metadata, "", "   ")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	fmt.Println(string(jsons))
+	return nil
 }
 
 func getManifestBody(fList *FilesInfoList) *ManifestDirectoryBody {
@@ -290,6 +1807,11 @@ func getManifestBody(fList *FilesInfoList) *ManifestDirectoryBody {
 			HashList:   fileHashList,
 			MetaString: []byte{},
 		}
+		if fileError := (*fList).filesErrorList[indx]; fileError != "" {
+			manifestFile.MetaString = getErrorMetaString(fileError)
+		} else {
+			manifestFile.MetaString = getFileMetaString((*fList).filesMetaList[indx])
+		}
 		fileHashList.ChunksHashes = nil
 		result.ManifestFileList = append(result.ManifestFileList, manifestFile)
 	}
@@ -307,10 +1829,11 @@ func getManifestBody(fList *FilesInfoList) *ManifestDirectoryBody {
 		result.ManifestFileList = append(result.ManifestFileList, manifestFile)
 	}
 
+	setDirectoryHashes(currentDir, &result)
 	return &result
 }
 
-func getManifestDirectoryHeader(body *ManifestDirectoryBody) *ManifestDirectoryHeader {
+func getManifestDirectoryHeader(body *ManifestDirectoryBody) (*ManifestDirectoryHeader, error) {
 	var result ManifestDirectoryHeader
 	dataSize := 0
 
@@ -326,34 +1849,50 @@ func getManifestDirectoryHeader(body *ManifestDirectoryBody) *ManifestDirectoryH
 	bodySegmentLength := uint64(segLenth)
 	bodyDataFileSize := uint64(dataSize)
 
-	user, err := user.Current()
+	config, err := loadRepositoryConfig(currentDir)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	creator := config.Creator
+	if creator == "" {
+		user, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		creator = user.Name
+	}
+	tags, err := getConfigTags(config)
+	if err != nil {
+		return nil, err
 	}
 
 	result = ManifestDirectoryHeader{
 		VersionString:     version,
 		SequenceId:        sequenceid,
-		Creator:           user.Name,
+		Creator:           creator,
 		CreatedAt:         createat,
 		BodySegmentLength: bodySegmentLength,
 		BodyDataFileSize:  bodyDataFileSize,
-		MetaDataTags:      KeysValuesList{},
-		ChunkSize:         chunkSize,
+		MetaDataTags:      tags,
+		ChunkSize:         int64(chunkSize),
 	}
 
-	manifestMeta.ManifestHeaderMeta = *getManifestHeaderMetaData(&result)
-	return &result
+	headerMeta, err := getManifestHeaderMetaData(&result)
+	if err != nil {
+		return nil, err
+	}
+	manifestMeta.ManifestHeaderMeta = *headerMeta
+	return &result, nil
 }
 
-func getManifestHeaderMetaData(header *ManifestDirectoryHeader) *ManifestHeaderMetaData {
+func getManifestHeaderMetaData(header *ManifestDirectoryHeader) (*ManifestHeaderMetaData, error) {
 	var result ManifestHeaderMetaData
 
 	creationTime := (*header).CreatedAt
 
 	filename, err := getPreviousManifest((*header).SequenceId)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	previousManifest := filename
 
@@ -369,7 +1908,7 @@ func getManifestHeaderMetaData(header *ManifestDirectoryHeader) *ManifestHeaderM
 		SequenceId:       (*header).SequenceId,
 		UniqueId:         id,
 	}
-	return &result
+	return &result, nil
 }
 
 func getPreviousManifest(currentSequenctId uint64) (string, error) { // ToDo
@@ -402,7 +1941,7 @@ func getPreviousManifest(currentSequenctId uint64) (string, error) { // ToDo
 }
 
 func getSequenceId() uint64 {
-	cxoFolderName := currentDir + "/.cxo/checkpoints/"
+	cxoFolderName := currentDir + manifestCXOFolder
 	files, _ := ioutil.ReadDir(cxoFolderName)
 	count := 0
 	for _, file := range files {
@@ -433,6 +1972,9 @@ func getFileListHeader(fList *FilesInfoList) *FileListHeader {
 	var fileSize uint64
 
 	for indx, fileHash := range (*fList).filesHashlist {
+		if (*fList).filesErrorList[indx] != "" {
+			continue
+		}
 		fileFullName = (*fList).fileNames[indx]
 		path, fileName := filepath.Split(fileFullName)
 		tempFileRef.Name = fileName
@@ -461,11 +2003,14 @@ func getFileItemList(fList *FilesInfoList) *[]FileItem {
 	var tempFileHeader FileItemHeader
 
 	for indx, fileHash := range (*fList).filesHashlist {
+		if (*fList).filesErrorList[indx] != "" {
+			continue
+		}
 		tempFileItem.ChunksHashList = (*fList).filesChunksList[indx]
 		tempFileHeader.Id = fileHash.Hash
 		tempFileHeader.SequenceId = getSequenceId()
 		tempFileHeader.CreationDate = (*fList).filesCreationDateList[indx]
-		tempFileHeader.Size = chunkSize
+		tempFileHeader.Size = uint64(chunkSize)
 		tempFileHeader.MetaDatum = KeysValuesList{}
 		tempFileItem.Header = tempFileHeader
 		result = append(result, tempFileItem)
@@ -546,27 +2091,149 @@ func getChunkHashSetMeta(chunkSet *ChunkHashSet) *ChunkHashSetMeta {
 	return &result
 }
 
-func generateMetaAndTempFiles() error {
-	metaFile, err := createFolderAndFile("./.cxo/meta/", manifestMetaFolder, ".meta")
+// getManifestOutputBody builds the checkpoint of the scanned files
+func getManifestOutputBody(fList *FilesInfoList) (*ManifestOuputBody, error) {
+	var result ManifestOuputBody
+	result.ManifestBody = *getManifestBody(fList)
+	header, err := getManifestDirectoryHeader(&result.ManifestBody)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer metaFile.Close()
-	serializedMetaBody := encoder.Serialize(manifestMeta)
-	_, err = metaFile.Write(serializedMetaBody)
+	result.ManifestHeader = *header
+	result.FileList = *getFileList(fList)
+	return &result, nil
+}
+
+// writeCheckpoint writes the checkpoint and its meta and temp files, returning
+// their base name
+func writeCheckpoint(body *ManifestOuputBody) (string, error) {
+	// the checkpoint is written first, meta and temp files are derived from it
+	baseName := getCheckpointBaseName()
+	err := writeFileAtomic(currentDir+manifestCXOFolder+baseName+".cxo", encoder.Serialize(*body))
 	if err != nil {
-		return err
+		return "", err
+	}
+	if err := generateMetaAndTempFiles(baseName); err != nil {
+		return baseName, err
 	}
+	// 'manifest find' updates the index again if this fails
+	if _, err := updateFindIndex(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not update %s: %v\n", manifestFindIndexFile, err)
+	}
+	return baseName, nil
+}
 
-	tempFile, err := createFolderAndFile("./.cxo/temp/", manifestTempFolder, ".temp")
+func generateMetaAndTempFiles(baseName string) error {
+	serializedMetaBody := encoder.Serialize(manifestMeta)
+	err := writeFileAtomic(currentDir+manifestMetaFolder+baseName+".meta", serializedMetaBody)
 	if err != nil {
 		return err
 	}
-	defer tempFile.Close()
+
 	serializedTempBody := encoder.Serialize(manifestTemp)
-	_, err = tempFile.Write(serializedTempBody)
+	return writeFileAtomic(currentDir+manifestTempFolder+baseName+".temp", serializedTempBody)
+}
+
+func listCheckpoints() error {
+	var store *chunkStore
+	if isFolderExist(currentDir + manifestChunksFolder) {
+		s, err := openChunkStore(currentDir)
+		if err != nil {
+			return err
+		}
+		defer s.close()
+		store = s
+	}
+
+	checkpoints, err := getCheckpointFiles()
 	if err != nil {
 		return err
 	}
+
+	for _, filename := range checkpoints {
+		manifest, err := readManifestFile(filename)
+		if err != nil {
+			return err
+		}
+		header := manifest.ManifestHeader
+		fileCount := 0
+		for _, file := range manifest.ManifestBody.ManifestFileList {
+			if file.FileName != nil {
+				fileCount++
+			}
+		}
+		fmt.Printf("%s  sequence %d  created %s  files %d  size %d bytes\n",
+			filepath.Base(filename), header.SequenceId,
+			time.Unix(int64(header.CreatedAt), 0).Format("2006-01-02 15:04:05"),
+			fileCount, header.BodyDataFileSize)
+
+		if store != nil {
+			stats, err := store.statsFor(getCheckpointChunkHashes(manifest))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("    stored chunks %d  logical %d bytes  physical %d bytes\n",
+				stats.Count, stats.LogicalSize, stats.PhysicalSize)
+		}
+	}
+
+	if store != nil {
+		stats, err := store.stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("chunk store (%s): chunks %d  logical %d bytes  physical %d bytes\n",
+			store.codec, stats.Count, stats.LogicalSize, stats.PhysicalSize)
+
+		blocksSize, paritySize, err := store.parityStats()
+		if err != nil {
+			return err
+		}
+		if blocksSize > 0 {
+			fmt.Printf("storage blocks %d  size %d bytes  parity %d bytes (%.1f%% overhead)\n",
+				len(store.blocks), blocksSize, paritySize, float64(paritySize)*100/float64(blocksSize))
+		}
+	}
 	return nil
 }
+
+func getCheckpointChunkHashes(manifest *ManifestOuputBody) [][]byte {
+	var result [][]byte
+	for _, file := range manifest.ManifestBody.ManifestFileList {
+		result = append(result, file.HashList.ChunksHashes...)
+	}
+	return result
+}
+
+// getReferencedChunks returns the hashes of all the chunks referenced by any checkpoint
+func getReferencedChunks() (map[string]bool, error) {
+	result := make(map[string]bool)
+	checkpoints, err := getCheckpointFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range checkpoints {
+		manifest, err := readManifestFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range getCheckpointChunkHashes(manifest) {
+			result[string(hash)] = true
+		}
+	}
+	return result, nil
+}
+
+func printScrubReport(report *ScrubReport) {
+	for _, hash := range report.BadChunks {
+		fmt.Printf("damaged chunk %x\n", hash)
+	}
+	for _, path := range report.BadBlocks {
+		fmt.Printf("damaged storage block %s\n", filepath.Base(path))
+	}
+	for _, path := range report.UnprotectedBlocks {
+		fmt.Printf("storage block without parity %s\n", filepath.Base(path))
+	}
+	fmt.Printf("scrub: %d damaged chunks, %d damaged storage blocks, %d storage blocks without parity\n",
+		len(report.BadChunks), len(report.BadBlocks), len(report.UnprotectedBlocks))
+}
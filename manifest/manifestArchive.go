@@ -0,0 +1,578 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	archiveFormatTar     = "tar"
+	archiveFormatTarGzip = "tar.gz"
+	archiveFormatTarZstd = "tar.zst"
+	archiveFormatZip     = "zip"
+	// the checkpoint of the files, first in the archives written by
+	// 'manifest archive', so that 'manifest unarchive' can verify them
+	archiveCheckpointName = ".cxo-checkpoint.cxo"
+)
+
+// archiveEntry is a file or directory read from an archive
+type archiveEntry struct {
+	name    string
+	isDir   bool
+	regular bool
+	size    int64
+	// permissions of the entry, 0666 for zip archives without them
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// archiveWriter writes the entries of a tar or zip archive
+type archiveWriter interface {
+	addDir(name string, modTime time.Time) error
+	addFile(name string, size int64, modTime time.Time, write func(io.Writer) error) error
+	close() error
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	// the compressor the tar is written to, nil for a plain tar
+	compressor io.WriteCloser
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+// getArchiveFormat returns the format given, or the one of the extension of
+// the archive
+func getArchiveFormat(name string, format string) (string, error) {
+	switch format {
+	case archiveFormatTar, archiveFormatTarGzip, archiveFormatTarZstd, archiveFormatZip:
+		return format, nil
+	case "":
+	default:
+		return "", usageError("unknown archive format %q, use tar, tar.gz, tar.zst or zip", format)
+	}
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveFormatTar, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveFormatTarGzip, nil
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return archiveFormatTarZstd, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveFormatZip, nil
+	}
+	return "", usageError("the format of %s is not known from its extension, give -format tar, tar.gz, tar.zst or zip", name)
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case archiveFormatZip:
+		return &zipArchiveWriter{zip.NewWriter(w)}, nil
+	case archiveFormatTarGzip:
+		compressor := gzip.NewWriter(w)
+		return &tarArchiveWriter{tar.NewWriter(compressor), compressor}, nil
+	case archiveFormatTarZstd:
+		compressor, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tar.NewWriter(compressor), compressor}, nil
+	}
+	return &tarArchiveWriter{tw: tar.NewWriter(w)}, nil
+}
+
+func (a *tarArchiveWriter) addDir(name string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: modTime, Format: tar.FormatPAX})
+}
+
+func (a *tarArchiveWriter) addFile(name string, size int64, modTime time.Time, write func(io.Writer) error) error {
+	if err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: modTime, Format: tar.FormatPAX}); err != nil {
+		return err
+	}
+	return write(a.tw)
+}
+
+func (a *tarArchiveWriter) close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+	return nil
+}
+
+func (a *zipArchiveWriter) addDir(name string, modTime time.Time) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modTime})
+	return err
+}
+
+func (a *zipArchiveWriter) addFile(name string, size int64, modTime time.Time, write func(io.Writer) error) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime, UncompressedSize64: uint64(size)}
+	header.SetMode(0644)
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return write(w)
+}
+
+func (a *zipArchiveWriter) close() error {
+	return a.zw.Close()
+}
+
+// archiveCheckpoint writes the files of the checkpoint to a tar or zip
+// archive, after the checkpoint itself. The files are read from the chunk
+// store, or from the current directory while they are unchanged, and checked
+// against their hashes
+func archiveCheckpoint(store *chunkStore, checkpoint string, w io.Writer, format string) (int, error) {
+	data, err := ioutil.ReadFile(checkpoint)
+	if err != nil {
+		return 0, err
+	}
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return 0, err
+	}
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	modTime := time.Unix(int64(manifest.ManifestHeader.CreatedAt), 0)
+	err = archive.addFile(archiveCheckpointName, int64(len(data)), modTime, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	name := strings.TrimSuffix(filepath.Base(checkpoint), ".cxo")
+	skipped := 0
+	for _, entry := range getExportEntries(manifest) {
+		switch {
+		case entry.relPath == ".":
+		case entry.isDir:
+			err = archive.addDir(entry.relPath, modTime)
+		case getFileEntryError(entry.file) != "" || !hasChunkHashes(entry.file):
+			fmt.Fprintf(os.Stderr, "skipping %s, which the checkpoint has no data for\n", entry.relPath)
+			skipped++
+		default:
+			version := &historyVersion{checkpoint: name, path: filepath.FromSlash(entry.relPath), entry: entry.file}
+			err = archive.addFile(entry.relPath, entry.file.Size, modTime, func(w io.Writer) error {
+				return writeHistoryVersion(store, version, w)
+			})
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return skipped, archive.close()
+}
+
+// readArchive calls the function with each entry of a tar or zip archive
+// and a reader of its data
+func readArchive(name string, format string, fn func(entry archiveEntry, r io.Reader) error) error {
+	if format == archiveFormatZip {
+		archive, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			entry := archiveEntry{
+				name:    file.Name,
+				isDir:   file.FileInfo().IsDir(),
+				regular: file.FileInfo().Mode().IsRegular(),
+				size:    int64(file.UncompressedSize64),
+				mode:    file.Mode().Perm(),
+				modTime: file.Modified,
+			}
+			if entry.mode == 0 {
+				entry.mode = 0666
+			}
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(entry, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	switch format {
+	case archiveFormatTarGzip:
+		decompressor, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		r = decompressor
+	case archiveFormatTarZstd:
+		decompressor, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		r = decompressor
+	}
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := archiveEntry{
+			name:    header.Name,
+			isDir:   header.Typeflag == tar.TypeDir,
+			regular: header.Typeflag == tar.TypeReg,
+			size:    header.Size,
+			mode:    os.FileMode(header.Mode).Perm(),
+			modTime: header.ModTime,
+		}
+		if err := fn(entry, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// getArchiveEntryPath returns the path of an entry of an archive relative to
+// the directory it is extracted to, rejecting paths outside it
+func getArchiveEntryPath(name string) (string, error) {
+	relPath, err := cleanImportPath(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return "", fmt.Errorf("archive entry %q is outside the directory", name)
+	}
+	return relPath, nil
+}
+
+// unarchive extracts a tar or zip archive to the directory, and checks the
+// files against the checkpoint the archives written by 'manifest archive'
+// start with. It returns the name of that checkpoint, empty if the archive
+// has none
+func unarchive(name string, format string, dest string, w io.Writer) (string, error) {
+	var checkpoint *ManifestOuputBody
+	var entries map[string]*ManifestFile
+	extracted := make(map[string]string)
+	err := readArchive(name, format, func(entry archiveEntry, r io.Reader) error {
+		if entry.name == archiveCheckpointName {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			var manifest ManifestOuputBody
+			if err := encoder.DeserializeRawExact(data, &manifest); err != nil {
+				return fmt.Errorf("the checkpoint of the archive can not be read: %w", err)
+			}
+			checkpoint = &manifest
+			entries = getCheckpointTree(checkpoint).entries
+			return nil
+		}
+		relPath, err := getArchiveEntryPath(entry.name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, relPath)
+		if entry.isDir {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if !entry.regular {
+			fmt.Fprintf(w, "skipping %s, which is not a regular file\n", entry.name)
+			return nil
+		}
+		var holes []FileExtent
+		if fileEntry := entries[relPath]; fileEntry != nil {
+			if holes, err = getFileEntryHoles(fileEntry); err != nil {
+				return err
+			}
+		}
+		hash, err := extractArchiveFile(r, target, entry, holes)
+		if err != nil {
+			return fmt.Errorf("%s: %w", relPath, err)
+		}
+		extracted[relPath] = hash
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if checkpoint == nil {
+		fmt.Fprintf(w, "extracted %d files to %s, the archive has no checkpoint to verify them against\n", len(extracted), dest)
+		return "", nil
+	}
+
+	var paths []string
+	for relPath := range entries {
+		paths = append(paths, relPath)
+	}
+	for relPath := range extracted {
+		if entries[relPath] == nil {
+			paths = append(paths, relPath)
+		}
+	}
+	sort.Strings(paths)
+	failed := 0
+	for _, relPath := range paths {
+		entry := entries[relPath]
+		hash, ok := extracted[relPath]
+		switch {
+		case entry == nil:
+			fmt.Fprintf(w, "not in the checkpoint %s\n", relPath)
+			failed++
+		case entry.FileName == nil || getFileEntryError(entry) != "" || !hasChunkHashes(entry):
+		case !ok:
+			fmt.Fprintf(w, "missing %s\n", relPath)
+			failed++
+		case hash != string(entry.HashList.FileHash.Hash):
+			fmt.Fprintf(w, "content differs %s\n", relPath)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return "", verifyError("%d files of the archive do not match its checkpoint", failed)
+	}
+	name = fmt.Sprintf("sequence %d of %s", checkpoint.ManifestHeader.SequenceId,
+		time.Unix(int64(checkpoint.ManifestHeader.CreatedAt), 0).Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "extracted %d files to %s, verified against the checkpoint of the archive (%s)\n", len(extracted), dest, name)
+	return name, nil
+}
+
+// extractArchiveFile writes the data to the file through a temporary file,
+// leaving the holes of sparse files as holes, and returns its hash. The file
+// gets the permissions of the entry masked by the umask, and its time
+func extractArchiveFile(r io.Reader, target string, entry archiveEntry, holes []FileExtent) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return "", err
+	}
+	tempFile, err := createTempFile(filepath.Dir(target), entry.mode)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	hash := sha256.New()
+	writer := &sparseWriter{file: tempFile, holes: holes}
+	if _, err := io.Copy(io.MultiWriter(writer, hash), r); err != nil {
+		return "", err
+	}
+	if err := writer.close(); err != nil {
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chtimes(tempFile.Name(), entry.modTime, entry.modTime); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tempFile.Name(), target); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// getReaderChunks hashes the data of the reader and its chunks like
+// getFileChunks, storing the chunks if the commit stores them
+func getReaderChunks(r io.Reader) (HashVariable, []ChunkHash, int64, error) {
+	var result []ChunkHash
+	var total int64
+	bf := make([]byte, chunkSize)
+	fileHash := sha256.New()
+	for {
+		size, err := io.ReadFull(r, bf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return HashVariable{}, nil, 0, err
+		}
+		hash := hashChunkData(bf[:size])
+		fileHash.Write(bf[:size])
+		if chunks != nil {
+			if err := chunks.put(hash, bf[:size]); err != nil {
+				return HashVariable{}, nil, 0, err
+			}
+		}
+		result = append(result, ChunkHash{uint64(size), hash})
+		total += int64(size)
+		if size < chunkSize {
+			break
+		}
+	}
+	encoded := base64.StdEncoding.EncodeToString(fileHash.Sum(nil))
+	return HashVariable{[]byte("base64,sha256"), []byte(encoded)}, result, total, nil
+}
+
+// importArchive writes a checkpoint of the files of a tar or zip archive,
+// read without extracting them. The chunks are stored if the repository
+// stores them, so that the files can be restored from the checkpoint
+func importArchive(name string, format string) error {
+	var fList FilesInfoList
+	dirs := map[string]bool{".": true}
+	seen := make(map[string]bool)
+	err := readArchive(name, format, func(entry archiveEntry, r io.Reader) error {
+		if entry.name == archiveCheckpointName {
+			return nil
+		}
+		relPath, err := getArchiveEntryPath(entry.name)
+		if err != nil {
+			return err
+		}
+		if entry.isDir {
+			dirs[relPath] = true
+			return nil
+		}
+		if !entry.regular {
+			fmt.Fprintf(os.Stderr, "skipping %s, which is not a regular file\n", entry.name)
+			return nil
+		}
+		if seen[relPath] {
+			return fmt.Errorf("%s is in the archive twice", relPath)
+		}
+		seen[relPath] = true
+		fileHash, fileChunks, size, err := getReaderChunks(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", relPath, err)
+		}
+		fList.fileNames = append(fList.fileNames, relPath)
+		fList.fileSizes = append(fList.fileSizes, int(size))
+		fList.filesHashlist = append(fList.filesHashlist, fileHash)
+		fList.filesMetaList = append(fList.filesMetaList, FileMeta{})
+		fList.filesChunksList = append(fList.filesChunksList, fileChunks)
+		fList.filesCreationDateList = append(fList.filesCreationDateList, entry.modTime.Format("2006-01-02"))
+		fList.filesErrorList = append(fList.filesErrorList, "")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if len(fList.fileNames) == 0 && len(dirs) == 1 {
+		return errors.New(name + " has no files")
+	}
+
+	dirSizes := make(map[string]int)
+	for i, relPath := range fList.fileNames {
+		for dir := filepath.Dir(relPath); ; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			dirSizes[dir] += fList.fileSizes[i]
+			if dir == "." {
+				break
+			}
+		}
+	}
+	for dir := range dirs {
+		for parent := filepath.Dir(dir); parent != "."; parent = filepath.Dir(parent) {
+			dirs[parent] = true
+		}
+	}
+	for dir := range dirs {
+		if seen[dir] {
+			return fmt.Errorf("%s: %s is a file and a directory", name, dir)
+		}
+		fList.directoryNames = append(fList.directoryNames, dir)
+	}
+	sort.Strings(fList.directoryNames)
+	for _, dir := range fList.directoryNames {
+		fList.diretorySizes = append(fList.diretorySizes, dirSizes[dir])
+	}
+	filesList = &fList
+
+	body, err := getManifestOutputBody(&fList)
+	if err != nil {
+		return err
+	}
+	body.ManifestHeader.MetaDataTags.Add(KeyValueByte{[]byte("imported-from"), []byte("archive:" + filepath.Base(name))})
+	headerMeta, err := getManifestHeaderMetaData(&body.ManifestHeader)
+	if err != nil {
+		return err
+	}
+	manifestMeta.ManifestHeaderMeta = *headerMeta
+
+	baseName, err := writeCheckpoint(body)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d files from %s into checkpoint %s\n", len(fList.fileNames), name, baseName)
+	return nil
+}
+
+// writeArchiveFile writes the archive to the file through a temporary file,
+// or to stdout for "-"
+func writeArchiveFile(output string, write func(w io.Writer) error) error {
+	if output == "-" {
+		return write(os.Stdout)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(output), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	buffered := &bufferedFileWriter{file: tempFile}
+	if err := write(buffered); err != nil {
+		return err
+	}
+	if err := buffered.flush(); err != nil {
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), output)
+}
+
+// bufferedFileWriter groups the small writes of the archive writers
+type bufferedFileWriter struct {
+	file   *os.File
+	buffer bytes.Buffer
+}
+
+func (w *bufferedFileWriter) Write(p []byte) (int, error) {
+	w.buffer.Write(p)
+	if w.buffer.Len() >= chunkSize {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *bufferedFileWriter) flush() error {
+	_, err := w.buffer.WriteTo(w.file)
+	return err
+}
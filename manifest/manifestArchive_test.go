@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	defer setupTestRepository(t)()
+	a := make([]byte, 2*chunkSize+100)
+	_, err := rand.Read(a)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join("sub", "empty"), 0700))
+	require.NoError(t, ioutil.WriteFile("a", a, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "b"), []byte("b"), 0600))
+	require.NoError(t, ioutil.WriteFile("empty", nil, 0600))
+	checkpoint := commitTestRepository(t)
+	manifest, err := readManifestFile(checkpoint)
+	require.NoError(t, err)
+	createdAt := time.Unix(int64(manifest.ManifestHeader.CreatedAt), 0)
+
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer syscall.Umask(syscall.Umask(027))
+	for _, name := range []string{"out.tar", "out.tgz", "out.tar.zst", "out.zip"} {
+		t.Run(name, func(t *testing.T) {
+			format, err := getArchiveFormat(name, "")
+			require.NoError(t, err)
+			archive := filepath.Join(dir, name)
+			err = writeArchiveFile(archive, func(w io.Writer) error {
+				skipped, err := archiveCheckpoint(nil, checkpoint, w, format)
+				require.Equal(t, 0, skipped)
+				return err
+			})
+			require.NoError(t, err)
+
+			dest := filepath.Join(dir, name+".d")
+			var out bytes.Buffer
+			verified, err := unarchive(archive, format, dest, &out)
+			require.NoError(t, err, out.String())
+			require.NotEmpty(t, verified)
+			requireSameFiles(t, ".", dest)
+			// the files get the mode of the archive masked by the umask,
+			// and the time of the checkpoint
+			info, err := os.Stat(filepath.Join(dest, "a"))
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+			require.True(t, createdAt.Equal(info.ModTime()), info.ModTime())
+		})
+	}
+
+	_, err = getArchiveFormat("out.rar", "")
+	require.Error(t, err)
+	require.Equal(t, exitUsage, getExitCode(err))
+}
+
+func TestArchiveCommandLine(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, ioutil.WriteFile("a", []byte("a"), 0600))
+	checkpoint := commitTestRepository(t)
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the flags can follow the checkpoint and the archive
+	archive := filepath.Join(dir, "out.tar.zst")
+	require.NoError(t, initCLI().Run([]string{"manifest", "archive", checkpoint, "-o", archive}))
+	dest := filepath.Join(dir, "dest")
+	require.NoError(t, initCLI().Run([]string{"manifest", "unarchive", archive, "-o=" + dest}))
+	requireSameFiles(t, ".", dest)
+	require.NoError(t, initCLI().Run([]string{"manifest", "archive", "-format", "zip", "-o", filepath.Join(dir, "out"), "latest"}))
+	require.FileExists(t, filepath.Join(dir, "out"))
+
+	err = initCLI().Run([]string{"manifest", "archive", checkpoint})
+	require.Equal(t, exitUsage, getExitCode(err))
+	err = initCLI().Run([]string{"manifest", "archive", checkpoint, "-o"})
+	require.Equal(t, exitUsage, getExitCode(err))
+	err = initCLI().Run([]string{"manifest", "archive", checkpoint, "-x", "y"})
+	require.Equal(t, exitUsage, getExitCode(err))
+}
+
+func TestUnarchiveTampered(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, ioutil.WriteFile("a", []byte("first"), 0600))
+	require.NoError(t, ioutil.WriteFile("b", []byte("second"), 0600))
+	checkpoint := commitTestRepository(t)
+	data, err := ioutil.ReadFile(checkpoint)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var buffer bytes.Buffer
+	archive, err := newArchiveWriter(&buffer, archiveFormatTar)
+	require.NoError(t, err)
+	for _, file := range []struct{ name, data string }{
+		{archiveCheckpointName, string(data)},
+		{"a", "FIRST"},
+		{"c", "third"},
+		{"../escape", "outside"},
+	} {
+		require.NoError(t, archive.addFile(file.name, int64(len(file.data)), time.Now(), func(w io.Writer) error {
+			_, err := io.WriteString(w, file.data)
+			return err
+		}))
+		if file.name == "c" {
+			// an archive without the escaping entry
+			require.NoError(t, archive.close())
+			tampered := filepath.Join(dir, "tampered.tar")
+			require.NoError(t, ioutil.WriteFile(tampered, buffer.Bytes(), 0600))
+			buffer.Reset()
+			archive, err = newArchiveWriter(&buffer, archiveFormatTar)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, archive.close())
+
+	var out bytes.Buffer
+	_, err = unarchive(filepath.Join(dir, "tampered.tar"), archiveFormatTar, filepath.Join(dir, "out"), &out)
+	require.Error(t, err)
+	require.Equal(t, exitVerify, getExitCode(err))
+	require.Contains(t, out.String(), "content differs a\n")
+	require.Contains(t, out.String(), "missing b\n")
+	require.Contains(t, out.String(), "not in the checkpoint c\n")
+
+	escaping := filepath.Join(dir, "escaping.tar")
+	require.NoError(t, ioutil.WriteFile(escaping, buffer.Bytes(), 0600))
+	_, err = unarchive(escaping, archiveFormatTar, filepath.Join(dir, "out"), &out)
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "escape"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestImportArchive(t *testing.T) {
+	defer setupTestRepository(t)()
+	a := make([]byte, chunkSize+100)
+	_, err := rand.Read(a)
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir("sub", 0700))
+	require.NoError(t, ioutil.WriteFile("a", a, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "b"), []byte("b"), 0600))
+	checkpoint := commitTestRepository(t)
+
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "out.tar.gz")
+	require.NoError(t, writeArchiveFile(archive, func(w io.Writer) error {
+		_, err := archiveCheckpoint(nil, checkpoint, w, archiveFormatTarGzip)
+		return err
+	}))
+
+	store, err := openChunkStore(currentDir)
+	require.NoError(t, err)
+	defer store.close()
+	chunks = store
+	defer func() { chunks = nil }()
+	require.NoError(t, importArchive(archive, archiveFormatTarGzip))
+
+	imported, err := getCheckpointFile("latest")
+	require.NoError(t, err)
+	require.NotEqual(t, checkpoint, imported)
+	require.NoError(t, verifyCheckpoint(imported, verifyOptions{}))
+	manifest, err := readManifestFile(imported)
+	require.NoError(t, err)
+	original, err := readManifestFile(checkpoint)
+	require.NoError(t, err)
+	require.Equal(t, getCheckpointTree(original).hashes, getCheckpointTree(manifest).hashes)
+
+	// the chunks are stored, so the files can be restored from the imported checkpoint
+	require.NoError(t, os.Remove("a"))
+	var restored bytes.Buffer
+	tree := getCheckpointTree(manifest)
+	version := &historyVersion{checkpoint: filepath.Base(imported), path: "a", entry: tree.entries["a"]}
+	require.NoError(t, writeHistoryVersion(store, version, &restored))
+	require.True(t, bytes.Equal(a, restored.Bytes()))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// ChunkStore keeps the serialized chunk objects of a repository by their
+// hash. The chunkStore of the repository keeps its loose chunks in one, and
+// its storage blocks and their parity in the .cxo folder
+type ChunkStore interface {
+	Has(hash []byte) (bool, error)
+	// Get returns an error for which os.IsNotExist is true for a missing chunk
+	Get(hash []byte) ([]byte, error)
+	Put(hash []byte, object []byte) error
+	// Delete does nothing for a missing chunk
+	Delete(hash []byte) error
+	// List calls fn for every chunk with the size of its object
+	List(fn func(hash []byte, size int64) error) error
+}
+
+// localChunkStore keeps every chunk object in its own file, in a folder named
+// after the first byte of its hash
+type localChunkStore struct {
+	dir string
+}
+
+// openChunkBackend opens the chunk store of the URL, the chunks folder of the
+// repository if it is empty. A file:// URL or a path, relative to the
+// repository, is a local folder, which can be on another disk, and an
+// s3://bucket/prefix URL a bucket of an S3-compatible object store, see
+// manifestS3.go
+func openChunkBackend(repoDir string, storeURL string) (ChunkStore, error) {
+	if storeURL == "" {
+		return newLocalChunkStore(repoDir + manifestChunksFolder)
+	}
+	parsed, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, usageError("invalid chunk store URL %q: %v", storeURL, err)
+	}
+	switch parsed.Scheme {
+	case "s3":
+		return newS3ChunkStore(parsed)
+	case "file":
+		if parsed.Host != "" && parsed.Host != "localhost" {
+			return nil, usageError("the file chunk store %q is not on this machine", storeURL)
+		}
+		return newLocalChunkStore(parsed.Path)
+	case "":
+		dir := storeURL
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(repoDir, dir)
+		}
+		return newLocalChunkStore(dir)
+	}
+	return nil, usageError("unknown chunk store %q, use a path, a file:// or an s3:// URL", storeURL)
+}
+
+// checkChunkStoreURL checks the chunk store setting without opening the store
+func checkChunkStoreURL(storeURL string) error {
+	if storeURL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(storeURL)
+	if err != nil {
+		return usageError("invalid chunk store URL %q: %v", storeURL, err)
+	}
+	switch parsed.Scheme {
+	case "s3":
+		_, err = getS3Options(parsed)
+		return err
+	case "file", "":
+		return nil
+	}
+	return usageError("unknown chunk store %q, use a path, a file:// or an s3:// URL", storeURL)
+}
+
+// chunkStoreHasChunks reports whether the chunk store of the URL holds any
+// chunk
+func chunkStoreHasChunks(repoDir string, storeURL string) (bool, error) {
+	backend, err := openChunkBackend(repoDir, storeURL)
+	if err != nil {
+		return false, err
+	}
+	errFound := errors.New("found a chunk")
+	err = backend.List(func(hash []byte, size int64) error {
+		return errFound
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+func newLocalChunkStore(dir string) (*localChunkStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &localChunkStore{dir: dir}, nil
+}
+
+func (s *localChunkStore) chunkPath(hash []byte) string {
+	name := hex.EncodeToString(hash)
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *localChunkStore) Has(hash []byte) (bool, error) {
+	_, err := os.Stat(s.chunkPath(hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localChunkStore) Get(hash []byte) ([]byte, error) {
+	return ioutil.ReadFile(s.chunkPath(hash))
+}
+
+func (s *localChunkStore) Put(hash []byte, object []byte) error {
+	return writeFileAtomic(s.chunkPath(hash), object)
+}
+
+func (s *localChunkStore) Delete(hash []byte) error {
+	if err := os.Remove(s.chunkPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localChunkStore) List(fn func(hash []byte, size int64) error) error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		hash, err := hex.DecodeString(info.Name())
+		if err != nil {
+			return nil
+		}
+		return fn(hash, info.Size())
+	})
+}
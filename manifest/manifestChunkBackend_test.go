@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkStoreBackends(t *testing.T) {
+	defer setupTestRepository(t)()
+	other, err := ioutil.TempDir("", "chunks")
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+
+	backend, err := openChunkBackend(currentDir, "")
+	require.NoError(t, err)
+	require.Equal(t, currentDir+manifestChunksFolder, backend.(*localChunkStore).dir)
+	backend, err = openChunkBackend(currentDir, "file://"+other)
+	require.NoError(t, err)
+	require.Equal(t, other, backend.(*localChunkStore).dir)
+	backend, err = openChunkBackend(currentDir, "../elsewhere")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(filepath.Dir(currentDir), "elsewhere"), backend.(*localChunkStore).dir)
+	os.RemoveAll(filepath.Join(filepath.Dir(currentDir), "elsewhere"))
+	for _, storeURL := range []string{"ftp://host/chunks", "file://host/chunks", "s3://bucket/chunks?endpoint=ftp://host"} {
+		_, err = openChunkBackend(currentDir, storeURL)
+		require.Equal(t, exitUsage, getExitCode(err), storeURL)
+	}
+
+	// the chunks of a repository can be kept on another disk
+	require.NoError(t, setRepositoryConfigValue(currentDir, "chunk-store", []string{"file://" + other}))
+	store, err := openChunkStore(currentDir)
+	require.NoError(t, err)
+	defer store.close()
+	data := []byte("chunk on another disk")
+	hash := hashChunkData(data)
+	require.NoError(t, store.put(hash, data))
+	requireChunkStored(t, store, hash, true)
+	// the chunk would be lost with another chunk store
+	err = setRepositoryConfigValue(currentDir, "chunk-store", []string{""})
+	require.Equal(t, exitUsage, getExitCode(err))
+	name := hex.EncodeToString(hash)
+	_, err = os.Stat(filepath.Join(other, name[:2], name))
+	require.NoError(t, err)
+	read, err := store.get(hash)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	var listed [][]byte
+	require.NoError(t, store.backend.List(func(hash []byte, size int64) error {
+		listed = append(listed, hash)
+		return nil
+	}))
+	require.Equal(t, [][]byte{hash}, listed)
+	require.NoError(t, store.backend.Delete(hash))
+	require.NoError(t, store.backend.Delete(hash))
+	requireChunkStored(t, store, hash, false)
+	_, err = store.get(hash)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, setRepositoryConfigValue(currentDir, "chunk-store", []string{""}))
+
+	// an error of the backend is not a missing chunk
+	notFolder := filepath.Join(other, "file")
+	require.NoError(t, ioutil.WriteFile(notFolder, nil, 0600))
+	broken := &chunkStore{backend: &localChunkStore{dir: notFolder}}
+	_, err = broken.has(hash)
+	require.Error(t, err)
+	_, err = readCheckpointChunk(broken, "missing", hash, 0, len(data))
+	require.Error(t, err)
+	require.False(t, os.IsNotExist(err))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	codecNone = "none"
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+)
+
+var (
+	// zstd encoder and decoder are expensive to create and safe to share
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+type chunkStore struct {
+	// the loose chunk objects, not yet packed into storage blocks
+	backend   ChunkStore
+	blocksDir string
+	parityDir string
+	codec     string
+	// storage blocks and the location of every chunk they hold
+	blocks     []*storageBlock
+	blockIndex map[string]blockLocation
+	// block files that could not be opened
+	unreadableBlocks []string
+}
+
+func isValidCodec(codec string) bool {
+	return codec == codecNone || codec == codecGzip || codec == codecZstd
+}
+
+// openChunkStore opens the chunk store of the repository rooted at repoDir,
+// using the compression codec and the chunk store backend recorded for the
+// repository
+func openChunkStore(repoDir string) (*chunkStore, error) {
+	config, err := loadRepositoryConfig(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	// the chunks folder tells the commands that the repository stores chunks,
+	// wherever the backend keeps them
+	if err := os.MkdirAll(repoDir+manifestChunksFolder, os.ModePerm); err != nil {
+		return nil, err
+	}
+	backend, err := openChunkBackend(repoDir, config.ChunkStore)
+	if err != nil {
+		return nil, err
+	}
+	store := &chunkStore{
+		backend:   backend,
+		blocksDir: repoDir + manifestBlocksFolder,
+		parityDir: repoDir + manifestParityFolder,
+		codec:     config.Compression,
+	}
+	if err := store.loadStorageBlocks(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *chunkStore) close() error {
+	return s.closeStorageBlocks()
+}
+
+// getLegacyRepositoryCodec reads the codec of a repository created before
+// .cxo/config
+func getLegacyRepositoryCodec(repoDir string) (string, error) {
+	data, err := ioutil.ReadFile(repoDir + manifestCodecFile)
+	if os.IsNotExist(err) {
+		return codecNone, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	codec := strings.TrimSpace(string(data))
+	if !isValidCodec(codec) {
+		return "", fmt.Errorf("unknown compression codec %q in %s", codec, manifestCodecFile)
+	}
+	return codec, nil
+}
+
+func setRepositoryCodec(repoDir string, codec string) error {
+	return setRepositoryConfigValue(repoDir, "compression", []string{codec})
+}
+
+func (s *chunkStore) has(hash []byte) (bool, error) {
+	if _, ok := s.blockIndex[string(hash)]; ok {
+		return true, nil
+	}
+	return s.backend.Has(hash)
+}
+
+// put stores the chunk data (without padding) under its hash, unless a chunk
+// with the same hash is already stored
+func (s *chunkStore) put(hash []byte, data []byte) error {
+	if found, err := s.has(hash); err != nil || found {
+		return err
+	}
+	return s.writeChunk(hash, data)
+}
+
+// writeChunk writes the chunk object of the data to the backend, replacing
+// the object stored under the hash
+func (s *chunkStore) writeChunk(hash []byte, data []byte) error {
+	payload, err := compressChunk(s.codec, data)
+	if err != nil {
+		return err
+	}
+	object := ChunkObject{
+		Codec: []byte(s.codec),
+		Size:  uint64(len(data)),
+		Data:  payload,
+	}
+
+	return s.backend.Put(hash, encoder.Serialize(object))
+}
+
+// get returns the chunk data without padding, checking it against the hash
+func (s *chunkStore) get(hash []byte) ([]byte, error) {
+	objectBytes, err := s.readObjectBytes(hash)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunkObject(hash, objectBytes)
+}
+
+// readObjectBytes returns the serialized chunk object from its storage block,
+// or from the backend
+func (s *chunkStore) readObjectBytes(hash []byte) ([]byte, error) {
+	if location, ok := s.blockIndex[string(hash)]; ok {
+		return location.block.objectBytes(location.entry), nil
+	}
+	return s.backend.Get(hash)
+}
+
+func (s *chunkStore) readObject(hash []byte) (*ChunkObject, error) {
+	objectBytes, err := s.readObjectBytes(hash)
+	if err != nil {
+		return nil, err
+	}
+	return deserializeChunkObject(hash, objectBytes)
+}
+
+func deserializeChunkObject(hash []byte, objectBytes []byte) (*ChunkObject, error) {
+	var object ChunkObject
+	if err := encoder.DeserializeRawExact(objectBytes, &object); err != nil {
+		return nil, fmt.Errorf("chunk %x: %w", hash, err)
+	}
+	return &object, nil
+}
+
+// decodeChunkObject decompresses a serialized chunk object and checks the
+// data against the hash
+func decodeChunkObject(hash []byte, objectBytes []byte) ([]byte, error) {
+	object, err := deserializeChunkObject(hash, objectBytes)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decompressChunk(string(object.Codec), object.Data)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != object.Size {
+		return nil, fmt.Errorf("chunk %x: size mismatch", hash)
+	}
+	if !bytes.Equal(hashChunkData(data), hash) {
+		return nil, fmt.Errorf("chunk %x: hash mismatch", hash)
+	}
+	return data, nil
+}
+
+// statsFor reports the logical and physical size of the given chunks,
+// counting every distinct stored chunk once
+func (s *chunkStore) statsFor(hashes [][]byte) (*ChunkStoreStats, error) {
+	var result ChunkStoreStats
+	seen := make(map[string]bool)
+
+	for _, hash := range hashes {
+		if seen[string(hash)] {
+			continue
+		}
+		found, err := s.has(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		seen[string(hash)] = true
+		objectBytes, err := s.readObjectBytes(hash)
+		if err != nil {
+			return nil, err
+		}
+		object, err := deserializeChunkObject(hash, objectBytes)
+		if err != nil {
+			return nil, err
+		}
+		result.Count++
+		result.LogicalSize += int64(object.Size)
+		result.PhysicalSize += int64(len(objectBytes))
+	}
+
+	return &result, nil
+}
+
+// stats reports the logical and physical size of all stored chunks
+func (s *chunkStore) stats() (*ChunkStoreStats, error) {
+	var hashes [][]byte
+	err := s.backend.List(func(hash []byte, size int64) error {
+		hashes = append(hashes, hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range s.blocks {
+		for _, entry := range block.header.Index {
+			hashes = append(hashes, entry.Hash)
+		}
+	}
+	return s.statsFor(hashes)
+}
+
+// hashChunkData hashes chunk data the same way getFileChunks does, padding
+// it with zeros up to chunkSize
+func hashChunkData(data []byte) []byte {
+	bf := make([]byte, chunkSize)
+	copy(bf, data)
+	h := sha256.Sum256(bf)
+	return h[:]
+}
+
+func compressChunk(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case codecNone:
+		return data, nil
+	case codecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case codecZstd:
+		if zstdEncoder == nil {
+			w, err := zstd.NewWriter(nil)
+			if err != nil {
+				return nil, err
+			}
+			zstdEncoder = w
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
+
+func decompressChunk(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case codecNone:
+		return data, nil
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case codecZstd:
+		if zstdDecoder == nil {
+			r, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			zstdDecoder = r
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
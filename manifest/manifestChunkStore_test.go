@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireChunkStored(t *testing.T, store *chunkStore, hash []byte, stored bool) {
+	found, err := store.has(hash)
+	require.NoError(t, err)
+	require.Equal(t, stored, found)
+}
+
+func TestChunkStoreCodecs(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "chunkstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(repoDir)
+	require.NoError(t, os.Mkdir(repoDir+"/.cxo", 0700))
+
+	data := bytes.Repeat([]byte("log line for the chunk store\n"), 4096)
+	var hashes [][]byte
+
+	for i, codec := range []string{codecNone, codecGzip, codecZstd} {
+		require.NoError(t, setRepositoryCodec(repoDir, codec))
+		store, err := openChunkStore(repoDir)
+		require.NoError(t, err)
+		require.Equal(t, codec, store.codec)
+
+		chunkData := append([]byte{byte(i)}, data...)
+		hash := hashChunkData(chunkData)
+		require.NoError(t, store.put(hash, chunkData))
+		hashes = append(hashes, hash)
+
+		object, err := store.readObject(hash)
+		require.NoError(t, err)
+		require.Equal(t, codec, string(object.Codec))
+	}
+
+	// chunks written with other codecs stay readable
+	store, err := openChunkStore(repoDir)
+	require.NoError(t, err)
+	for i, hash := range hashes {
+		chunkData, err := store.get(hash)
+		require.NoError(t, err)
+		require.Equal(t, append([]byte{byte(i)}, data...), chunkData)
+	}
+
+	stats, err := store.stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), stats.Count)
+	require.Equal(t, int64(3*(len(data)+1)), stats.LogicalSize)
+	require.True(t, stats.PhysicalSize < stats.LogicalSize)
+
+	require.Error(t, setRepositoryCodec(repoDir, "lz4"))
+}
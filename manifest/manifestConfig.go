@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	configVersion       = 1
+	hashAlgorithmSha256 = "sha256"
+	// chunks are pieces of the torrents of a checkpoint, which are powers of
+	// two of at least the torrent block size
+	minChunkSize = torrentBlockSize
+	maxChunkSize = 64 << 20
+)
+
+// configKeys are the settings of RepositoryConfig, in the order they are
+// written
+var configKeys = []string{"chunk-size", "hash-algorithm", "ignore", "creator", "signing-key", "compression", "store-chunks", "mmap-threshold", "chunk-store"}
+
+func getDefaultRepositoryConfig() RepositoryConfig {
+	return RepositoryConfig{
+		Version:       configVersion,
+		ChunkSize:     defaultChunkSize,
+		HashAlgorithm: hashAlgorithmSha256,
+		Compression:   codecNone,
+	}
+}
+
+// loadRepositoryConfig reads the configuration of the repository in the
+// directory. A repository without .cxo/config has the default settings, with
+// the codec of .cxo/compression if it was created before the configuration
+func loadRepositoryConfig(repoDir string) (*RepositoryConfig, error) {
+	data, err := ioutil.ReadFile(repoDir + manifestConfigFile)
+	if os.IsNotExist(err) {
+		result := getDefaultRepositoryConfig()
+		if result.Compression, err = getLegacyRepositoryCodec(repoDir); err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseRepositoryConfig(data)
+}
+
+func parseRepositoryConfig(data []byte) (*RepositoryConfig, error) {
+	result := getDefaultRepositoryConfig()
+	result.Version = 0
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%s line %d: expected key = value", manifestConfigFile, n+1)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		var err error
+		switch key {
+		case "version":
+			if result.Version, err = strconv.Atoi(value); err == nil && result.Version > configVersion {
+				return nil, fmt.Errorf("%s is version %d, this version of manifest reads version %d", manifestConfigFile, result.Version, configVersion)
+			}
+		case "ignore":
+			// one line for each pattern
+			err = result.setValue(key, append(result.Ignore, value))
+		default:
+			err = result.setValue(key, []string{value})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", manifestConfigFile, n+1, err)
+		}
+	}
+	if result.Version < 1 {
+		return nil, fmt.Errorf("%s has no version", manifestConfigFile)
+	}
+	return &result, nil
+}
+
+// format returns the configuration as written to .cxo/config
+func (c *RepositoryConfig) format() ([]byte, error) {
+	var result bytes.Buffer
+	fmt.Fprintln(&result, "# settings of the repository, change them with 'manifest config set'")
+	fmt.Fprintf(&result, "version = %d\n", c.Version)
+	for _, key := range configKeys {
+		values, err := c.getValues(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			fmt.Fprintln(&result, strings.TrimSpace(key+" = "+value))
+		}
+	}
+	return result.Bytes(), nil
+}
+
+// getValues returns the values of a setting, one for all of them but ignore
+func (c *RepositoryConfig) getValues(key string) ([]string, error) {
+	switch key {
+	case "chunk-size":
+		return []string{strconv.Itoa(c.ChunkSize)}, nil
+	case "hash-algorithm":
+		return []string{c.HashAlgorithm}, nil
+	case "ignore":
+		return c.Ignore, nil
+	case "creator":
+		return []string{c.Creator}, nil
+	case "signing-key":
+		return []string{c.SigningKey}, nil
+	case "compression":
+		return []string{c.Compression}, nil
+	case "store-chunks":
+		return []string{strconv.FormatBool(c.StoreChunks)}, nil
+	case "mmap-threshold":
+		return []string{strconv.FormatInt(c.MmapThreshold, 10)}, nil
+	case "chunk-store":
+		return []string{c.ChunkStore}, nil
+	}
+	return nil, usageError("unknown setting %q, the settings are %s", key, strings.Join(configKeys, ", "))
+}
+
+// setValue checks and changes a setting. ignore takes any number of
+// patterns, which replace the current ones, the other settings one value
+func (c *RepositoryConfig) setValue(key string, values []string) error {
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") || value != strings.TrimSpace(value) {
+			return usageError("the values of settings can not start or end with spaces or span lines")
+		}
+	}
+	if key == "ignore" {
+		for _, value := range values {
+			if _, err := parseIgnorePattern(value); err != nil {
+				return usageError("invalid ignore pattern %q: %w", value, err)
+			}
+		}
+		c.Ignore = append([]string{}, values...)
+		return nil
+	}
+	if _, err := c.getValues(key); err != nil {
+		return err
+	}
+	if len(values) != 1 {
+		return usageError("%s takes one value", key)
+	}
+	value := values[0]
+	switch key {
+	case "chunk-size":
+		size, err := parseSize(value)
+		if err != nil || size < minChunkSize || size > maxChunkSize || size&(size-1) != 0 {
+			return usageError("the chunk size must be a power of two from %s to %s", formatBytes(minChunkSize), formatBytes(maxChunkSize))
+		}
+		c.ChunkSize = int(size)
+	case "hash-algorithm":
+		if value != hashAlgorithmSha256 {
+			return usageError("unsupported hash algorithm %q, use %s", value, hashAlgorithmSha256)
+		}
+		c.HashAlgorithm = value
+	case "creator":
+		c.Creator = value
+	case "signing-key":
+		c.SigningKey = value
+	case "compression":
+		if !isValidCodec(value) {
+			return usageError("unknown compression codec %q, use one of none, gzip, zstd", value)
+		}
+		c.Compression = value
+	case "store-chunks":
+		storeChunks, err := strconv.ParseBool(value)
+		if err != nil {
+			return usageError("store-chunks is true or false")
+		}
+		c.StoreChunks = storeChunks
+	case "mmap-threshold":
+		threshold, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		c.MmapThreshold = threshold
+	case "chunk-store":
+		if err := checkChunkStoreURL(value); err != nil {
+			return err
+		}
+		c.ChunkStore = value
+	}
+	return nil
+}
+
+func writeRepositoryConfig(repoDir string, config *RepositoryConfig) error {
+	data, err := config.format()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(repoDir+manifestConfigFile, data)
+}
+
+// setRepositoryConfigValue changes a setting of the repository in the
+// directory. The chunk size can not change once there are checkpoints, whose
+// chunk hashes would no longer be those of the chunks read, and the chunk
+// store can not change while it holds chunks the repository would lose
+func setRepositoryConfigValue(repoDir string, key string, values []string) error {
+	config, err := loadRepositoryConfig(repoDir)
+	if err != nil {
+		return err
+	}
+	previousChunkSize := config.ChunkSize
+	previousChunkStore := config.ChunkStore
+	if err := config.setValue(key, values); err != nil {
+		return err
+	}
+	if config.ChunkStore != previousChunkStore {
+		stored, err := chunkStoreHasChunks(repoDir, previousChunkStore)
+		if err != nil {
+			return err
+		}
+		if stored {
+			return usageError("the chunk store still holds chunks, 'manifest pack' moves them into the storage blocks of the repository before the chunk store can change")
+		}
+	}
+	if config.ChunkSize != previousChunkSize {
+		checkpoints, err := getRepositoryCheckpointFiles(repoDir)
+		if err != nil {
+			return err
+		}
+		if len(checkpoints) > 0 {
+			return usageError("the chunk size can not change once the repository has checkpoints")
+		}
+	}
+	return writeRepositoryConfig(repoDir, config)
+}
+
+// getConfigTags returns the settings a checkpoint was written with, as tags
+// of its header. store-chunks is whether chunks were stored, from the setting
+// or the -store-chunks flag
+func getConfigTags(config *RepositoryConfig) (KeysValuesList, error) {
+	var result KeysValuesList
+	result.Add(KeyValueByte{[]byte("config.version"), []byte(strconv.Itoa(config.Version))})
+	for _, key := range configKeys {
+		values, err := config.getValues(key)
+		if err != nil {
+			return result, err
+		}
+		if key == "store-chunks" {
+			values = []string{strconv.FormatBool(chunks != nil)}
+		}
+		for _, value := range values {
+			result.Add(KeyValueByte{[]byte("config." + key), []byte(value)})
+		}
+	}
+	return result, nil
+}
+
+func printRepositoryConfig(config *RepositoryConfig, key string) error {
+	if key != "" {
+		values, err := config.getValues(key)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			fmt.Println(value)
+		}
+		return nil
+	}
+	data, err := config.format()
+	if err != nil {
+		return err
+	}
+	// without the comment line
+	_, err = os.Stdout.Write(data[bytes.IndexByte(data, '\n')+1:])
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryConfig(t *testing.T) {
+	defer setupTestRepository(t)()
+
+	// repositories created before the configuration keep their codec
+	require.NoError(t, ioutil.WriteFile(currentDir+manifestCodecFile, []byte("gzip\n"), 0600))
+	config, err := loadRepositoryConfig(currentDir)
+	require.NoError(t, err)
+	require.Equal(t, codecGzip, config.Compression)
+	require.Equal(t, defaultChunkSize, config.ChunkSize)
+
+	require.NoError(t, setRepositoryConfigValue(currentDir, "chunk-size", []string{"1M"}))
+	require.NoError(t, setRepositoryConfigValue(currentDir, "creator", []string{"Build Server"}))
+	require.NoError(t, setRepositoryConfigValue(currentDir, "ignore", []string{"*.log", "tmp/"}))
+	require.NoError(t, setRepositoryConfigValue(currentDir, "store-chunks", []string{"true"}))
+	require.Error(t, setRepositoryConfigValue(currentDir, "chunk-size", []string{"1000"}))
+	require.Error(t, setRepositoryConfigValue(currentDir, "hash-algorithm", []string{"md5"}))
+	require.Error(t, setRepositoryConfigValue(currentDir, "color", []string{"blue"}))
+	require.Error(t, setRepositoryConfigValue(currentDir, "creator", []string{"a\nb"}))
+
+	data, err := ioutil.ReadFile(currentDir + manifestConfigFile)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "version = 1\nchunk-size = 1048576\nhash-algorithm = sha256\nignore = *.log\nignore = tmp/\ncreator = Build Server\n")
+	config, err = loadRepositoryConfig(currentDir)
+	require.NoError(t, err)
+	require.Equal(t, RepositoryConfig{
+		Version:       configVersion,
+		ChunkSize:     1 << 20,
+		HashAlgorithm: hashAlgorithmSha256,
+		Ignore:        []string{"*.log", "tmp/"},
+		Creator:       "Build Server",
+		Compression:   codecGzip,
+		StoreChunks:   true,
+	}, *config)
+
+	_, err = parseRepositoryConfig([]byte("version = 2\n"))
+	require.Error(t, err)
+	_, err = parseRepositoryConfig([]byte("chunk-size = 262144\n"))
+	require.Error(t, err)
+
+	// commit honours the settings and records them in the header
+	savedChunkSize := chunkSize
+	chunkSize = config.ChunkSize
+	defer func() { chunkSize = savedChunkSize }()
+	require.NoError(t, os.Mkdir("tmp", 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("tmp", "a"), []byte("a"), 0600))
+	require.NoError(t, ioutil.WriteFile("b.log", []byte("b"), 0600))
+	require.NoError(t, ioutil.WriteFile("c", []byte("c"), 0600))
+	manifest, err := readManifestFile(commitTestRepository(t))
+	require.NoError(t, err)
+	header := manifest.ManifestHeader
+	require.Equal(t, "Build Server", header.Creator)
+	require.Equal(t, int64(1<<20), header.ChunkSize)
+	tags := make(map[string][]string)
+	for i, key := range header.MetaDataTags.Keys {
+		tags[string(key)] = append(tags[string(key)], string(header.MetaDataTags.Values[i]))
+	}
+	require.Equal(t, []string{"*.log", "tmp/"}, tags["config.ignore"])
+	require.Equal(t, []string{"1048576"}, tags["config.chunk-size"])
+	require.Equal(t, []string{"false"}, tags["config.store-chunks"])
+	var names []string
+	for _, entry := range manifest.ManifestBody.ManifestFileList {
+		if entry.FileName != nil {
+			names = append(names, string(entry.FileName))
+		}
+	}
+	require.Equal(t, []string{"c"}, names)
+
+	require.Error(t, setRepositoryConfigValue(currentDir, "chunk-size", []string{"256K"}))
+	require.NoError(t, setRepositoryConfigValue(currentDir, "chunk-size", []string{"1M"}))
+}
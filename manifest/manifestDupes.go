@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultMinChunkRun = 4
+	// chunks found in more places than this, such as the chunk of zeros, are
+	// left out of the shared runs, which would otherwise grow quadratically
+	maxRunChunkOccurrences = 64
+)
+
+// dupeFile is a file of one of the checkpoints searched for duplicates
+type dupeFile struct {
+	root    string
+	relPath string
+	size    int64
+	hash    string
+	chunks  [][]byte
+	// size of each chunk
+	sizes []int
+}
+
+// getContentKey returns the same key for files with the same content
+func (f *dupeFile) getContentKey() string {
+	return f.hash + ":" + strconv.FormatInt(f.size, 10)
+}
+
+// dupeGroup is a set of files with the same content
+type dupeGroup struct {
+	files  []*dupeFile
+	wasted int64
+}
+
+// chunkRun is a run of consecutive chunks two files have in common
+type chunkRun struct {
+	a, b           *dupeFile
+	startA, startB int
+	length         int
+	size           int64
+}
+
+// directoryDedup is the size of the files below a directory and the size of
+// their distinct chunks
+type directoryDedup struct {
+	root    string
+	relPath string
+	logical int64
+	unique  map[string]int64
+}
+
+// dupeOccurrence is the position of a chunk in a file
+type dupeOccurrence struct {
+	file  int
+	index int
+}
+
+type runKey struct {
+	a, b  int
+	delta int
+}
+
+// getDupeFiles reads the files of the checkpoints, a file that is the same in
+// several checkpoints of a repository counts once
+func getDupeFiles(checkpoints []string) ([]*dupeFile, error) {
+	var result []*dupeFile
+	seen := make(map[string]bool)
+	for _, checkpoint := range checkpoints {
+		manifest, err := readManifestFile(checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		root := getCheckpointRoot(manifest)
+		fileList := manifest.ManifestBody.ManifestFileList
+		for i := range fileList {
+			entry := &fileList[i]
+			if entry.FileName == nil || getFileEntryError(entry) != "" {
+				continue
+			}
+			file := &dupeFile{
+				root:    root,
+				relPath: getManifestFileRelPath(root, entry),
+				size:    entry.Size,
+				hash:    string(entry.HashList.FileHash.Hash),
+			}
+			key := file.root + "\x00" + file.relPath + "\x00" + file.hash
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if hasChunkHashes(entry) {
+				file.chunks = entry.HashList.ChunksHashes
+				file.sizes = getChunkSizes(entry, getCheckpointChunkSize(manifest))
+			}
+			result = append(result, file)
+		}
+	}
+	return result, nil
+}
+
+// getDupeGroups returns the sets of identical files, most wasted bytes first
+func getDupeGroups(files []*dupeFile) []*dupeGroup {
+	byHash := make(map[string]*dupeGroup)
+	var result []*dupeGroup
+	for _, file := range files {
+		key := file.getContentKey()
+		group, ok := byHash[key]
+		if !ok {
+			group = &dupeGroup{}
+			byHash[key] = group
+			result = append(result, group)
+		}
+		group.files = append(group.files, file)
+	}
+	groups := result[:0]
+	for _, group := range result {
+		if len(group.files) > 1 && group.files[0].size > 0 {
+			group.wasted = int64(len(group.files)-1) * group.files[0].size
+			groups = append(groups, group)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].wasted > groups[j].wasted
+	})
+	return groups
+}
+
+// getChunkRuns returns the runs of at least minRun consecutive chunks that
+// files which are not identical have in common, largest first
+func getChunkRuns(files []*dupeFile, minRun int) []chunkRun {
+	// one file of each set of identical files
+	var distinct []*dupeFile
+	seen := make(map[string]bool)
+	for _, file := range files {
+		key := file.getContentKey()
+		if !seen[key] && len(file.chunks) >= minRun {
+			seen[key] = true
+			distinct = append(distinct, file)
+		}
+	}
+
+	occurrences := make(map[string][]dupeOccurrence)
+	for fileIndex, file := range distinct {
+		for index, hash := range file.chunks {
+			occurrences[string(hash)] = append(occurrences[string(hash)], dupeOccurrence{fileIndex, index})
+		}
+	}
+	pairs := make(map[runKey][]int)
+	for _, places := range occurrences {
+		if len(places) < 2 || len(places) > maxRunChunkOccurrences {
+			continue
+		}
+		for i, a := range places {
+			for _, b := range places[i+1:] {
+				if a.file == b.file {
+					continue
+				}
+				key := runKey{a.file, b.file, a.index - b.index}
+				pairs[key] = append(pairs[key], a.index)
+			}
+		}
+	}
+
+	var result []chunkRun
+	for key, indexes := range pairs {
+		if len(indexes) < minRun {
+			continue
+		}
+		sort.Ints(indexes)
+		start := 0
+		for i := 1; i <= len(indexes); i++ {
+			if i < len(indexes) && indexes[i] == indexes[i-1]+1 {
+				continue
+			}
+			if length := i - start; length >= minRun {
+				run := chunkRun{
+					a:      distinct[key.a],
+					b:      distinct[key.b],
+					startA: indexes[start],
+					startB: indexes[start] - key.delta,
+					length: length,
+				}
+				for _, size := range run.a.sizes[run.startA : run.startA+length] {
+					run.size += int64(size)
+				}
+				result = append(result, run)
+			}
+			start = i
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].size != result[j].size {
+			return result[i].size > result[j].size
+		}
+		if result[i].a.relPath != result[j].a.relPath {
+			return result[i].a.relPath < result[j].a.relPath
+		}
+		if result[i].b.relPath != result[j].b.relPath {
+			return result[i].b.relPath < result[j].b.relPath
+		}
+		return result[i].startA < result[j].startA
+	})
+	return result
+}
+
+// getDirectoryDedup returns the logical and unique size of every directory,
+// sorted by path. Files without chunk hashes count as one chunk
+func getDirectoryDedup(files []*dupeFile) []*directoryDedup {
+	byDir := make(map[string]*directoryDedup)
+	var result []*directoryDedup
+	for _, file := range files {
+		for dir := filepath.Dir(file.relPath); ; dir = filepath.Dir(dir) {
+			key := file.root + "\x00" + dir
+			stats, ok := byDir[key]
+			if !ok {
+				stats = &directoryDedup{root: file.root, relPath: dir, unique: make(map[string]int64)}
+				byDir[key] = stats
+				result = append(result, stats)
+			}
+			stats.add(file)
+			if dir == "." {
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].root != result[j].root {
+			return result[i].root < result[j].root
+		}
+		return result[i].relPath < result[j].relPath
+	})
+	return result
+}
+
+func (d *directoryDedup) add(file *dupeFile) {
+	d.logical += file.size
+	if file.chunks == nil {
+		d.unique["file:"+file.hash] = file.size
+	}
+	for i, hash := range file.chunks {
+		// chunks that only differ in trailing zeros have the same hash
+		if int64(file.sizes[i]) > d.unique[string(hash)] {
+			d.unique[string(hash)] = int64(file.sizes[i])
+		}
+	}
+}
+
+func (d *directoryDedup) getRatio() float64 {
+	if unique := d.uniqueSize(); unique > 0 {
+		return float64(d.logical) / float64(unique)
+	}
+	return 1
+}
+
+func (d *directoryDedup) uniqueSize() int64 {
+	var result int64
+	for _, size := range d.unique {
+		result += size
+	}
+	return result
+}
+
+// printDupes prints the identical files, the shared chunk runs and the dedup
+// ratio of each directory of the checkpoints
+func printDupes(w io.Writer, checkpoints []string, minRun int) error {
+	files, err := getDupeFiles(checkpoints)
+	if err != nil {
+		return err
+	}
+	roots := make(map[string]bool)
+	for _, file := range files {
+		roots[file.root] = true
+	}
+	// paths are relative unless the checkpoints are of several directories
+	getName := func(root string, relPath string) string {
+		if len(roots) > 1 {
+			return filepath.Join(root, relPath)
+		}
+		return relPath
+	}
+
+	groups := getDupeGroups(files)
+	var wasted int64
+	fmt.Fprintln(w, "identical files:")
+	for _, group := range groups {
+		wasted += group.wasted
+		sum, err := base64.StdEncoding.DecodeString(group.files[0].hash)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  %d files of %s, %s wasted, sha256 %s\n",
+			len(group.files), formatBytes(group.files[0].size), formatBytes(group.wasted), hex.EncodeToString(sum))
+		for _, file := range group.files {
+			fmt.Fprintf(w, "    %s\n", getName(file.root, file.relPath))
+		}
+	}
+	fmt.Fprintf(w, "  %d sets, %s wasted\n", len(groups), formatBytes(wasted))
+
+	runs := getChunkRuns(files, minRun)
+	fmt.Fprintf(w, "shared runs of at least %d chunks:\n", minRun)
+	for _, run := range runs {
+		fmt.Fprintf(w, "  %s (chunk %d) and %s (chunk %d): %d chunks, %s\n",
+			getName(run.a.root, run.a.relPath), run.startA, getName(run.b.root, run.b.relPath), run.startB,
+			run.length, formatBytes(run.size))
+	}
+	fmt.Fprintf(w, "  %d runs\n", len(runs))
+
+	fmt.Fprintln(w, "dedup ratio by directory:")
+	total := &directoryDedup{unique: make(map[string]int64)}
+	for _, file := range files {
+		total.add(file)
+	}
+	for _, dir := range getDirectoryDedup(files) {
+		fmt.Fprintf(w, "  %s  logical %s  unique %s  ratio %.2f\n",
+			getName(dir.root, dir.relPath), formatBytes(dir.logical), formatBytes(dir.uniqueSize()), dir.getRatio())
+	}
+	fmt.Fprintf(w, "overall: logical %s  unique %s  ratio %.2f\n",
+		formatBytes(total.logical), formatBytes(total.uniqueSize()), total.getRatio())
+	return nil
+}
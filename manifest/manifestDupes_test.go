@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDupes(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.MkdirAll("sub", 0700))
+	shared := make([]byte, 5*chunkSize)
+	_, err := rand.Read(shared)
+	require.NoError(t, err)
+	other := make([]byte, 2*chunkSize)
+	_, err = rand.Read(other)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile("a", shared, 0600))
+	require.NoError(t, ioutil.WriteFile("sub/copy", shared, 0600))
+	// the shared chunks one chunk later in the file
+	require.NoError(t, ioutil.WriteFile("sub/b", append(append(other[:chunkSize:chunkSize], shared...), other...), 0600))
+	require.NoError(t, ioutil.WriteFile("small", []byte("small"), 0600))
+	checkpoint := commitTestRepository(t)
+
+	files, err := getDupeFiles([]string{checkpoint, checkpoint})
+	require.NoError(t, err)
+	require.Len(t, files, 4)
+
+	groups := getDupeGroups(files)
+	require.Len(t, groups, 1)
+	require.Len(t, groups[0].files, 2)
+	require.Equal(t, int64(len(shared)), groups[0].wasted)
+
+	runs := getChunkRuns(files, 4)
+	require.Len(t, runs, 1)
+	require.Equal(t, "a", runs[0].a.relPath)
+	require.Equal(t, "sub/b", runs[0].b.relPath)
+	require.Equal(t, 0, runs[0].startA)
+	require.Equal(t, 1, runs[0].startB)
+	require.Equal(t, 5, runs[0].length)
+	require.Equal(t, int64(len(shared)), runs[0].size)
+	require.Empty(t, getChunkRuns(files, 6))
+
+	dirs := getDirectoryDedup(files)
+	require.Len(t, dirs, 2)
+	require.Equal(t, ".", dirs[0].relPath)
+	require.Equal(t, int64(3*len(shared)+3*chunkSize+5), dirs[0].logical)
+	require.Equal(t, int64(len(shared)+2*chunkSize+5), dirs[0].uniqueSize())
+	require.Equal(t, "sub", dirs[1].relPath)
+	require.Equal(t, int64(len(shared)+2*chunkSize), dirs[1].uniqueSize())
+
+	var output bytes.Buffer
+	require.NoError(t, printDupes(&output, []string{checkpoint}, 4))
+	require.Contains(t, output.String(), "2 files of 1.2 MiB, 1.2 MiB wasted")
+	require.Contains(t, output.String(), "a (chunk 0) and sub/b (chunk 1): 5 chunks, 1.2 MiB")
+}
+
+func TestDupesOtherChunkSize(t *testing.T) {
+	defer setupTestRepository(t)()
+	savedChunkSize := chunkSize
+	defer func() { chunkSize = savedChunkSize }()
+	// a checkpoint of another repository with larger chunks
+	chunkSize = 2 * savedChunkSize
+	require.NoError(t, ioutil.WriteFile("a", make([]byte, 3*savedChunkSize), 0600))
+	checkpoint := commitTestRepository(t)
+	chunkSize = savedChunkSize
+
+	files, err := getDupeFiles([]string{checkpoint})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, []int{2 * savedChunkSize, savedChunkSize}, files[0].sizes)
+}
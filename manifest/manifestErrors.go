@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// exit codes of the manifest command
+const (
+	// the command succeeded
+	exitOK = 0
+	// any error not covered below, e.g. the repository is locked
+	exitFailure = 1
+	// the command line is invalid or the repository is not initialized
+	exitUsage = 2
+	// a file or the repository could not be read or written
+	exitIO = 3
+	// data does not match its checkpoint or its hash
+	exitVerify = 4
+	// the command completed, but some files could not be read and were
+	// recorded as errored entries (--continue-on-error)
+	exitPartial = 5
+	// the command was interrupted by SIGINT or SIGTERM before it completed
+	exitInterrupted = 130
+)
+
+// manifestError is an error with the exit code the command ends with
+type manifestError struct {
+	code int
+	err  error
+}
+
+func (e *manifestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *manifestError) Unwrap() error {
+	return e.err
+}
+
+func usageError(format string, a ...interface{}) error {
+	return &manifestError{exitUsage, fmt.Errorf(format, a...)}
+}
+
+func verifyError(format string, a ...interface{}) error {
+	return &manifestError{exitVerify, fmt.Errorf(format, a...)}
+}
+
+func partialError(format string, a ...interface{}) error {
+	return &manifestError{exitPartial, fmt.Errorf(format, a...)}
+}
+
+func interruptedError(format string, a ...interface{}) error {
+	return &manifestError{exitInterrupted, fmt.Errorf(format, a...)}
+}
+
+// getExitCode returns the exit code for the error returned by a command,
+// treating file system errors as I/O errors
+func getExitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var manifestErr *manifestError
+	if errors.As(err, &manifestErr) {
+		return manifestErr.code
+	}
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	var syscallErr *os.SyscallError
+	var errno syscall.Errno
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) ||
+		errors.As(err, &syscallErr) || errors.As(err, &errno) {
+		return exitIO
+	}
+	return exitFailure
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCodes(t *testing.T) {
+	_, openErr := os.Open("/nonexistent/manifest")
+	require.Error(t, openErr)
+
+	require.Equal(t, exitOK, getExitCode(nil))
+	require.Equal(t, exitFailure, getExitCode(fmt.Errorf("repository is locked")))
+	require.Equal(t, exitUsage, getExitCode(usageError("unknown command %q", "frob")))
+	require.Equal(t, exitIO, getExitCode(openErr))
+	require.Equal(t, exitIO, getExitCode(fmt.Errorf("reading checkpoint: %w", openErr)))
+	require.Equal(t, exitVerify, getExitCode(verifyError("block can not be repaired: %w", openErr)))
+	require.Equal(t, exitPartial, getExitCode(partialError("%d files could not be read", 2)))
+	require.Equal(t, exitInterrupted, getExitCode(interruptedError("commit interrupted")))
+}
+
+func TestErroredEntry(t *testing.T) {
+	file := ManifestFile{MetaString: []byte{}}
+	require.Equal(t, "", getFileEntryError(&file))
+
+	file.MetaString = getErrorMetaString("open bad.txt: permission denied")
+	require.Equal(t, "open bad.txt: permission denied", getFileEntryError(&file))
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"golang.org/x/crypto/blake2b"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	exportFormatSha256sum = "sha256sum"
+	exportFormatB2sum     = "b2sum"
+	exportFormatMtree     = "mtree"
+	exportFormatCSV       = "csv"
+	exportFormatJSONL     = "jsonl"
+)
+
+// exportEntry is a file or directory of an exported checkpoint
+type exportEntry struct {
+	relPath string
+	isDir   bool
+	file    *ManifestFile
+}
+
+// importEntry is a file or directory read from a checksum list
+type importEntry struct {
+	relPath   string
+	isDir     bool
+	size      int64
+	sizeKnown bool
+	sha256    []byte
+}
+
+// checksumPathEscaper escapes the names of sha256sum and b2sum lines the way
+// GNU coreutils does, for names with a backslash, newline or carriage return
+var checksumPathEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+var checksumPathUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+
+// lessPathComponents orders paths by their components, so that the entries of
+// a directory are next to each other
+func lessPathComponents(a, b []string) bool {
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// getExportEntries returns the entries of the checkpoint, top directory first
+// and sorted by their path
+func getExportEntries(manifest *ManifestOuputBody) []exportEntry {
+	root := getCheckpointRoot(manifest)
+	var result []exportEntry
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		result = append(result, exportEntry{
+			relPath: filepath.ToSlash(getManifestFileRelPath(root, entry)),
+			isDir:   entry.FileName == nil,
+			file:    entry,
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].relPath, result[j].relPath
+		if a == "." || b == "." {
+			return a == "." && b != "."
+		}
+		return lessPathComponents(strings.Split(a, "/"), strings.Split(b, "/"))
+	})
+	return result
+}
+
+// getFileSha256 returns the sha256 of a checkpoint entry
+func getFileSha256(file *ManifestFile) ([]byte, error) {
+	if string(file.HashList.FileHash.HashType) != "base64,sha256" {
+		return nil, fmt.Errorf("unknown hash type %q", file.HashList.FileHash.HashType)
+	}
+	return base64.StdEncoding.DecodeString(string(file.HashList.FileHash.Hash))
+}
+
+// exportCheckpoint writes the entries of the checkpoint in the format. Only
+// b2sum reads data, from the chunk store or the unchanged files, as the
+// checkpoint has no blake2b hashes
+func exportCheckpoint(checkpoint string, format string, w io.Writer) error {
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return err
+	}
+	var store *chunkStore
+	if format == exportFormatB2sum && isFolderExist(currentDir+manifestChunksFolder) {
+		store, err = openChunkStore(currentDir)
+		if err != nil {
+			return err
+		}
+		defer store.close()
+	}
+
+	out := bufio.NewWriter(w)
+	var csvWriter *csv.Writer
+	switch format {
+	case exportFormatMtree:
+		fmt.Fprintln(out, "#mtree")
+	case exportFormatCSV:
+		csvWriter = csv.NewWriter(out)
+		if err := csvWriter.Write([]string{"path", "type", "size", "sha256", "error"}); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range getExportEntries(manifest) {
+		fileError := getFileEntryError(entry.file)
+		var sum []byte
+		if !entry.isDir && fileError == "" {
+			if sum, err = getFileSha256(entry.file); err != nil {
+				return fmt.Errorf("%s: %w", entry.relPath, err)
+			}
+		}
+		size := ""
+		if !entry.isDir && isFileSizeKnown(entry.file) {
+			size = strconv.FormatInt(entry.file.Size, 10)
+		}
+
+		switch format {
+		case exportFormatSha256sum, exportFormatB2sum:
+			if entry.isDir {
+				continue
+			}
+			if fileError != "" {
+				fmt.Fprintf(os.Stderr, "leaving out %s: %s\n", entry.relPath, fileError)
+				continue
+			}
+			if format == exportFormatB2sum {
+				if !hasChunkHashes(entry.file) {
+					fmt.Fprintf(os.Stderr, "leaving out %s: the checkpoint has no chunk hashes for it\n", entry.relPath)
+					continue
+				}
+				if sum, err = getFileBlake2b(store, entry); err != nil {
+					return err
+				}
+			}
+			out.WriteString(formatChecksumLine(hex.EncodeToString(sum), entry.relPath))
+		case exportFormatMtree:
+			if entry.isDir {
+				fmt.Fprintf(out, "%s type=dir\n", escapeMtreePath(getMtreePath(entry.relPath)))
+				continue
+			}
+			if fileError != "" {
+				fmt.Fprintf(os.Stderr, "leaving out %s: %s\n", entry.relPath, fileError)
+				continue
+			}
+			fmt.Fprintf(out, "%s type=file", escapeMtreePath(getMtreePath(entry.relPath)))
+			if size != "" {
+				fmt.Fprintf(out, " size=%s", size)
+			}
+			fmt.Fprintf(out, " sha256digest=%x\n", sum)
+		case exportFormatCSV:
+			record := []string{entry.relPath, "file", size, hex.EncodeToString(sum), fileError}
+			if entry.isDir {
+				record[1] = "dir"
+			}
+			if err := csvWriter.Write(record); err != nil {
+				return err
+			}
+		case exportFormatJSONL:
+			record := ExportRecord{Type: "file", Error: fileError}
+			if entry.isDir {
+				record.Type = "dir"
+			}
+			if utf8.ValidString(entry.relPath) {
+				record.Path = entry.relPath
+			} else {
+				record.PathBase64 = base64.StdEncoding.EncodeToString([]byte(entry.relPath))
+			}
+			if size != "" {
+				record.Size = &entry.file.Size
+			}
+			if sum != nil {
+				record.Sha256 = hex.EncodeToString(sum)
+			}
+			line, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			out.Write(append(line, '\n'))
+		default:
+			return usageError("unknown export format %q", format)
+		}
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+func getFileBlake2b(store *chunkStore, entry exportEntry) ([]byte, error) {
+	hash, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	sizes := getManifestFileChunkSizes(entry.file)
+	for index, chunkHash := range entry.file.HashList.ChunksHashes {
+		data, err := readCheckpointChunk(store, entry.relPath, chunkHash, index, sizes[index])
+		if err != nil {
+			return nil, err
+		}
+		hash.Write(data)
+	}
+	return hash.Sum(nil), nil
+}
+
+func formatChecksumLine(sum string, path string) string {
+	if strings.ContainsAny(path, "\\\n\r") {
+		return "\\" + sum + "  " + checksumPathEscaper.Replace(path) + "\n"
+	}
+	return sum + "  " + path + "\n"
+}
+
+// parseChecksumLine parses a line of sha256sum, in the default format or the
+// BSD format of --tag, returning the hex sum and the path
+func parseChecksumLine(line string) (string, string, error) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+	var sum, path string
+	if strings.HasPrefix(line, "SHA256 (") {
+		end := strings.LastIndex(line, ") = ")
+		if end < 0 {
+			return "", "", fmt.Errorf("malformed line %q", line)
+		}
+		path, sum = line[len("SHA256 ("):end], line[end+len(") = "):]
+	} else {
+		separator := strings.IndexByte(line, ' ')
+		if separator < 0 || separator+1 >= len(line) || (line[separator+1] != ' ' && line[separator+1] != '*') {
+			return "", "", fmt.Errorf("malformed line %q", line)
+		}
+		sum, path = line[:separator], line[separator+2:]
+	}
+	if escaped {
+		path = checksumPathUnescaper.Replace(path)
+	}
+	return sum, path, nil
+}
+
+func getMtreePath(relPath string) string {
+	if relPath == "." {
+		return relPath
+	}
+	return "./" + relPath
+}
+
+// escapeMtreePath encodes the characters mtree(5) does not allow in names,
+// whitespace, non-printable characters, '#', '=', '\' and glob characters,
+// as a backslash and three octal digits
+func escapeMtreePath(path string) string {
+	var result strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("#=\\*?[", c) >= 0 {
+			fmt.Fprintf(&result, "\\%03o", c)
+		} else {
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
+}
+
+func unescapeMtreePath(path string) (string, error) {
+	var result strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] != '\\' {
+			result.WriteByte(path[i])
+			continue
+		}
+		if i+3 < len(path) && isOctalDigits(path[i+1:i+4]) {
+			value, _ := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			result.WriteByte(byte(value))
+			i += 3
+			continue
+		}
+		if i+1 >= len(path) {
+			return "", fmt.Errorf("malformed name %q", path)
+		}
+		i++
+		switch path[i] {
+		case '\\':
+			result.WriteByte('\\')
+		case 'n':
+			result.WriteByte('\n')
+		case 'r':
+			result.WriteByte('\r')
+		case 't':
+			result.WriteByte('\t')
+		case 's':
+			result.WriteByte(' ')
+		default:
+			result.WriteByte(path[i])
+		}
+	}
+	return result.String(), nil
+}
+
+func isOctalDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '7' {
+			return false
+		}
+	}
+	return len(s) == 3
+}
+
+// cleanImportPath returns the path of an entry of a checksum list relative to
+// the current directory, rejecting paths outside it
+func cleanImportPath(path string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside the directory", path)
+	}
+	return cleaned, nil
+}
+
+func parseSha256Sum(hexSum string) ([]byte, error) {
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil || len(sum) != 32 {
+		return nil, fmt.Errorf("invalid sha256 %q", hexSum)
+	}
+	return sum, nil
+}
+
+// parseSha256SumList reads the output of sha256sum, which has no sizes
+func parseSha256SumList(r io.Reader) ([]importEntry, error) {
+	var result []importEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		hexSum, path, err := parseChecksumLine(line)
+		if err == nil {
+			path, err = cleanImportPath(path)
+		}
+		var sum []byte
+		if err == nil {
+			sum, err = parseSha256Sum(hexSum)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		result = append(result, importEntry{relPath: path, sha256: sum})
+	}
+	return result, scanner.Err()
+}
+
+// parseMtree reads an mtree(5) specification, with full paths as written by
+// 'manifest export' and 'bsdtar --format mtree', or with the relative names
+// and ".." of 'mtree -c'. Files need a sha256digest
+func parseMtree(r io.Reader) ([]importEntry, error) {
+	var result []importEntry
+	defaults := make(map[string]string)
+	var dirStack []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var line string
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		part := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(part, "\\") && !strings.HasSuffix(part, "\\\\") {
+			line += strings.TrimSuffix(part, "\\") + " "
+			continue
+		}
+		line, part = "", line+part
+		if part == "" || strings.HasPrefix(part, "#") {
+			continue
+		}
+
+		fields := strings.Fields(part)
+		keywords := make(map[string]string)
+		for _, field := range fields[1:] {
+			pair := strings.SplitN(field, "=", 2)
+			if len(pair) == 2 {
+				keywords[pair[0]] = pair[1]
+			} else {
+				keywords[pair[0]] = ""
+			}
+		}
+		switch fields[0] {
+		case "/set":
+			for key, value := range keywords {
+				defaults[key] = value
+			}
+			continue
+		case "/unset":
+			for key := range keywords {
+				if key == "all" {
+					defaults = make(map[string]string)
+				}
+				delete(defaults, key)
+			}
+			continue
+		case "..":
+			if len(dirStack) > 0 {
+				dirStack = dirStack[:len(dirStack)-1]
+			}
+			continue
+		}
+		for key, value := range defaults {
+			if _, ok := keywords[key]; !ok {
+				keywords[key] = value
+			}
+		}
+
+		name, err := unescapeMtreePath(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		fullPath := strings.Contains(name, "/")
+		if !fullPath && len(dirStack) > 0 {
+			name = dirStack[len(dirStack)-1] + "/" + name
+		}
+		path, err := cleanImportPath(name)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		entry := importEntry{relPath: path}
+		switch keywords["type"] {
+		case "dir":
+			entry.isDir = true
+			if !fullPath && path != "." {
+				dirStack = append(dirStack, path)
+			}
+		case "file", "":
+			hexSum, ok := keywords["sha256digest"]
+			if !ok {
+				hexSum, ok = keywords["sha256"]
+			}
+			if !ok {
+				return nil, fmt.Errorf("line %d: %s has no sha256digest", lineNo, path)
+			}
+			if entry.sha256, err = parseSha256Sum(hexSum); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if size, ok := keywords["size"]; ok {
+				if entry.size, err = strconv.ParseInt(size, 10, 64); err != nil || entry.size < 0 {
+					return nil, fmt.Errorf("line %d: invalid size %q", lineNo, size)
+				}
+				entry.sizeKnown = true
+			}
+		default:
+			// links, devices and the like have no data to verify
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result, scanner.Err()
+}
+
+// importChecksums writes a checkpoint of the files of a sha256sum or mtree
+// list, to verify the files in the current directory against it. The
+// entries have no chunk hashes, and no size if the list has none
+func importChecksums(format string, listPath string) error {
+	file, err := os.Open(listPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var entries []importEntry
+	switch format {
+	case exportFormatSha256sum:
+		entries, err = parseSha256SumList(file)
+	case exportFormatMtree:
+		entries, err = parseMtree(file)
+	default:
+		return usageError("can not import the %q format, only sha256sum and mtree", format)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", listPath, err)
+	}
+
+	var fList FilesInfoList
+	unknownSize := make(map[int]bool)
+	dirSizes := map[string]int{".": 0}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if seen[entry.relPath] {
+			return fmt.Errorf("%s: %s is listed twice", listPath, entry.relPath)
+		}
+		seen[entry.relPath] = true
+		for dir := entry.relPath; dir != "."; {
+			if dir != entry.relPath || entry.isDir {
+				dirSizes[dir] += int(entry.size)
+			}
+			dir = filepath.Dir(dir)
+		}
+		dirSizes["."] += int(entry.size)
+		if entry.isDir {
+			continue
+		}
+		if !entry.sizeKnown {
+			unknownSize[len(fList.fileNames)] = true
+		}
+		fList.fileNames = append(fList.fileNames, entry.relPath)
+		fList.fileSizes = append(fList.fileSizes, int(entry.size))
+		fList.filesHashlist = append(fList.filesHashlist,
+			HashVariable{[]byte("base64,sha256"), []byte(base64.StdEncoding.EncodeToString(entry.sha256))})
+		fList.filesMetaList = append(fList.filesMetaList, FileMeta{})
+		fList.filesChunksList = append(fList.filesChunksList, nil)
+		fList.filesCreationDateList = append(fList.filesCreationDateList, "")
+		fList.filesErrorList = append(fList.filesErrorList, "")
+	}
+	for dir := range dirSizes {
+		fList.directoryNames = append(fList.directoryNames, dir)
+	}
+	sort.Strings(fList.directoryNames)
+	for _, dir := range fList.directoryNames {
+		fList.diretorySizes = append(fList.diretorySizes, dirSizes[dir])
+	}
+	filesList = &fList
+
+	body, err := getManifestOutputBody(&fList)
+	if err != nil {
+		return err
+	}
+	for index := range unknownSize {
+		var kvList KeysValuesList
+		kvList.Add(KeyValueByte{[]byte("size"), []byte("unknown")})
+		body.ManifestBody.ManifestFileList[index].MetaString = encoder.Serialize(kvList)
+	}
+	body.ManifestHeader.MetaDataTags.Add(KeyValueByte{[]byte("imported-from"), []byte(format + ":" + filepath.Base(listPath))})
+	headerMeta, err := getManifestHeaderMetaData(&body.ManifestHeader)
+	if err != nil {
+		return err
+	}
+	manifestMeta.ManifestHeaderMeta = *headerMeta
+
+	baseName, err := writeCheckpoint(body)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d files from %s into checkpoint %s, check them with 'manifest verify %s'\n",
+		len(fList.fileNames), listPath, baseName, baseName)
+	return nil
+}
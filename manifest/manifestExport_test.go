@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportPathEscaping(t *testing.T) {
+	for _, name := range []string{"plain", "with space", "back\\slash", "new\nline", "tab\tand#hash=x*?[", "caf\xc3\xa9"} {
+		sum, path, err := parseChecksumLine(strings.TrimSuffix(formatChecksumLine("00ff", name), "\n"))
+		require.NoError(t, err)
+		require.Equal(t, "00ff", sum)
+		require.Equal(t, name, path)
+
+		escaped := escapeMtreePath(name)
+		require.False(t, strings.ContainsAny(escaped, " \t\n#="))
+		unescaped, err := unescapeMtreePath(escaped)
+		require.NoError(t, err)
+		require.Equal(t, name, unescaped)
+	}
+
+	sum, path, err := parseChecksumLine("SHA256 (a (1).txt) = 00ff")
+	require.NoError(t, err)
+	require.Equal(t, "00ff", sum)
+	require.Equal(t, "a (1).txt", path)
+	_, _, err = parseChecksumLine("00ff")
+	require.Error(t, err)
+
+	_, err = cleanImportPath("../outside")
+	require.Error(t, err)
+	_, err = cleanImportPath("/etc/passwd")
+	require.Error(t, err)
+	path, err = cleanImportPath("./sub/../a")
+	require.NoError(t, err)
+	require.Equal(t, "a", path)
+}
+
+func TestParseMtree(t *testing.T) {
+	const digest = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	spec := "#mtree\n" +
+		"/set type=file uid=0\n" +
+		". type=dir\n" +
+		"    a\\040b size=0 \\\n" +
+		"        sha256digest=" + digest + "\n" +
+		"sub type=dir\n" +
+		"    c sha256=" + digest + "\n" +
+		"    link type=link link=c\n" +
+		"..\n" +
+		"./full/d type=file size=0 sha256digest=" + digest + "\n"
+	entries, err := parseMtree(strings.NewReader(spec))
+	require.NoError(t, err)
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.relPath)
+	}
+	require.Equal(t, []string{".", "a b", "sub", "sub/c", "full/d"}, paths)
+	require.True(t, entries[1].sizeKnown)
+	require.False(t, entries[3].sizeKnown)
+	require.True(t, entries[2].isDir)
+
+	_, err = parseMtree(strings.NewReader("./a type=file size=1\n"))
+	require.Error(t, err)
+}
+
+func TestExportImportAndVerify(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.MkdirAll("sub dir", 0700))
+	files := map[string]string{"a": "first", "sub dir/b#1": "second", "new\nline": "third"}
+	for name, data := range files {
+		require.NoError(t, ioutil.WriteFile(name, []byte(data), 0600))
+	}
+	checkpoint := commitTestRepository(t)
+	require.NoError(t, verifyCheckpoint(checkpoint, verifyOptions{}))
+
+	var csvOutput, jsonOutput bytes.Buffer
+	require.NoError(t, exportCheckpoint(checkpoint, exportFormatCSV, &csvOutput))
+	require.Contains(t, csvOutput.String(), "\n\"new\nline\",file,5,")
+	require.NoError(t, exportCheckpoint(checkpoint, exportFormatJSONL, &jsonOutput))
+	require.Contains(t, jsonOutput.String(), `{"path":"a","type":"file","size":5,"sha256":`)
+
+	var b2sumOutput bytes.Buffer
+	require.NoError(t, exportCheckpoint(checkpoint, exportFormatB2sum, &b2sumOutput))
+	require.Len(t, strings.Split(strings.TrimSpace(b2sumOutput.String()), "\n"), 3)
+
+	listDir, err := ioutil.TempDir("", "lists")
+	require.NoError(t, err)
+	defer os.RemoveAll(listDir)
+	for _, format := range []string{exportFormatSha256sum, exportFormatMtree} {
+		var output bytes.Buffer
+		require.NoError(t, exportCheckpoint(checkpoint, format, &output))
+		listPath := filepath.Join(listDir, "list."+format)
+		require.NoError(t, ioutil.WriteFile(listPath, output.Bytes(), 0600))
+		require.NoError(t, importChecksums(format, listPath))
+
+		imported, err := getCheckpointFile("latest")
+		require.NoError(t, err)
+		require.NotEqual(t, checkpoint, imported)
+		manifest, err := readManifestFile(imported)
+		require.NoError(t, err)
+		require.Len(t, manifest.ManifestBody.ManifestFileList, 5)
+		require.NoError(t, verifyCheckpoint(imported, verifyOptions{}))
+
+		// the list exported from the imported checkpoint is the same
+		var exported bytes.Buffer
+		require.NoError(t, exportCheckpoint(imported, format, &exported))
+		require.Equal(t, output.String(), exported.String())
+	}
+
+	require.NoError(t, ioutil.WriteFile("a", []byte("FIRST"), 0600))
+	require.NoError(t, os.Remove("sub dir/b#1"))
+	err = verifyCheckpoint(checkpoint, verifyOptions{})
+	require.Error(t, err)
+	require.Equal(t, exitVerify, getExitCode(err))
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	hashSetFilterVersion = 1
+	filterBloom          = "bloom"
+	filterCuckoo         = "cuckoo"
+	defaultFilterFpRate  = 0.001
+	// fingerprints in a bucket of a cuckoo filter
+	cuckooBucketSize = 4
+	// share of the slots of a cuckoo filter filled at most
+	cuckooLoadFactor = 0.95
+	// moves of fingerprints before an insert gives up
+	cuckooMaxKicks = 500
+)
+
+// The hashes added to the filters are sha256 hashes, whose bytes are used as
+// the hash functions: bytes 0 to 16 for the double hashing of Bloom filters,
+// bytes 16 to 24 for the bucket and 24 to 32 for the fingerprint of cuckoo
+// filters, so that other programs can query the filters
+
+// hashSetFilter is a Bloom or cuckoo filter of chunk hashes
+type hashSetFilter struct {
+	data HashSetFilter
+	// seeded, so exporting the same hashes gives the same filter
+	random *rand.Rand
+}
+
+// newBloomFilter returns an empty Bloom filter for the number of hashes with
+// the false positive rate
+func newBloomFilter(count int, fpRate float64) *hashSetFilter {
+	n := math.Max(float64(count), 1)
+	bits := math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	hashCount := math.Max(math.Round(bits/n*math.Ln2), 1)
+	words := (uint64(bits) + 63) / 64
+	return &hashSetFilter{data: HashSetFilter{
+		Version:   hashSetFilterVersion,
+		Type:      filterBloom,
+		Bits:      words * 64,
+		HashCount: uint32(hashCount),
+		Data:      make([]byte, words*8),
+	}}
+}
+
+// newCuckooFilter returns an empty cuckoo filter for the number of hashes
+// with the false positive rate, with a power of two of buckets
+func newCuckooFilter(count int, fpRate float64) *hashSetFilter {
+	buckets := uint64(1)
+	for float64(buckets*cuckooBucketSize)*cuckooLoadFactor < float64(count) {
+		buckets *= 2
+	}
+	// a query compares 2 buckets of fingerprints, each one matching with a
+	// probability of 2^-bits
+	bits := math.Log2(2 * cuckooBucketSize / fpRate)
+	size := uint32(math.Min(math.Max(math.Ceil(bits/8), 1), 4))
+	return newCuckooFilterOfSize(buckets, size)
+}
+
+func newCuckooFilterOfSize(buckets uint64, fingerprintSize uint32) *hashSetFilter {
+	return &hashSetFilter{
+		data: HashSetFilter{
+			Version:         hashSetFilterVersion,
+			Type:            filterCuckoo,
+			Buckets:         buckets,
+			BucketSize:      cuckooBucketSize,
+			FingerprintSize: fingerprintSize,
+			Data:            make([]byte, buckets*cuckooBucketSize*uint64(fingerprintSize)),
+		},
+		random: rand.New(rand.NewSource(1)),
+	}
+}
+
+// newHashSetFilter returns a filter of the hashes sized for the capacity, or
+// for the hashes if there are more. Filters are merged only if they have the
+// same size, so filters of checkpoints meant to be merged are given the same
+// capacity. A cuckoo filter is made twice as large if the hashes do not fit
+func newHashSetFilter(filterType string, hashes [][]byte, fpRate float64, capacity int) (*hashSetFilter, error) {
+	if !(fpRate > 0 && fpRate < 1) {
+		return nil, usageError("the false positive rate must be between 0 and 1")
+	}
+	if capacity < len(hashes) {
+		capacity = len(hashes)
+	}
+	var result *hashSetFilter
+	switch filterType {
+	case filterBloom:
+		result = newBloomFilter(capacity, fpRate)
+	case filterCuckoo:
+		result = newCuckooFilter(capacity, fpRate)
+	default:
+		return nil, usageError("unknown filter %q, use bloom or cuckoo", filterType)
+	}
+	for {
+		full := false
+		for _, hash := range hashes {
+			if err := result.add(hash); err != nil {
+				full = true
+				break
+			}
+		}
+		if !full {
+			return result, nil
+		}
+		result = newCuckooFilterOfSize(result.data.Buckets*2, result.data.FingerprintSize)
+	}
+}
+
+func readHashSetFilter(name string) (*hashSetFilter, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	result := hashSetFilter{random: rand.New(rand.NewSource(1))}
+	if err := encoder.DeserializeRawExact(data, &result.data); err != nil {
+		return nil, fmt.Errorf("%s is not a hash set filter: %w", name, err)
+	}
+	if err := result.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &result, nil
+}
+
+func (f *hashSetFilter) check() error {
+	d := &f.data
+	if d.Version != hashSetFilterVersion {
+		return fmt.Errorf("filter version %d, this version of manifest reads version %d", d.Version, hashSetFilterVersion)
+	}
+	switch d.Type {
+	case filterBloom:
+		if d.Bits == 0 || d.Bits%64 != 0 || uint64(len(d.Data)) != d.Bits/8 || d.HashCount == 0 {
+			return errors.New("invalid Bloom filter")
+		}
+	case filterCuckoo:
+		if d.Buckets == 0 || d.Buckets&(d.Buckets-1) != 0 || d.BucketSize == 0 || d.FingerprintSize == 0 || d.FingerprintSize > 4 ||
+			uint64(len(d.Data)) != d.Buckets*uint64(d.BucketSize)*uint64(d.FingerprintSize) {
+			return errors.New("invalid cuckoo filter")
+		}
+	default:
+		return fmt.Errorf("unknown filter %q", d.Type)
+	}
+	return nil
+}
+
+// getBloomBits returns the bits of a hash in a Bloom filter
+func (f *hashSetFilter) getBloomBits(hash []byte) []uint64 {
+	h1 := binary.LittleEndian.Uint64(hash[0:8])
+	h2 := binary.LittleEndian.Uint64(hash[8:16]) | 1
+	result := make([]uint64, f.data.HashCount)
+	for i := range result {
+		result[i] = (h1 + uint64(i)*h2) % f.data.Bits
+	}
+	return result
+}
+
+// getCuckooSlot returns the first bucket and the fingerprint of a hash in a
+// cuckoo filter, fingerprints are never 0, which marks empty slots
+func (f *hashSetFilter) getCuckooSlot(hash []byte) (uint64, uint32) {
+	bucket := binary.LittleEndian.Uint64(hash[16:24]) & (f.data.Buckets - 1)
+	fingerprint := uint32(binary.LittleEndian.Uint64(hash[24:32]) & (1<<(8*f.data.FingerprintSize) - 1))
+	if fingerprint == 0 {
+		fingerprint = 1
+	}
+	return bucket, fingerprint
+}
+
+// getAlternateBucket returns the other bucket of a fingerprint
+func (f *hashSetFilter) getAlternateBucket(bucket uint64, fingerprint uint32) uint64 {
+	return (bucket ^ mixIBLTHash(uint64(fingerprint))) & (f.data.Buckets - 1)
+}
+
+func (f *hashSetFilter) getFingerprint(bucket uint64, slot int) uint32 {
+	size := uint64(f.data.FingerprintSize)
+	offset := (bucket*uint64(f.data.BucketSize) + uint64(slot)) * size
+	var result uint32
+	for i := uint64(0); i < size; i++ {
+		result |= uint32(f.data.Data[offset+i]) << (8 * i)
+	}
+	return result
+}
+
+func (f *hashSetFilter) setFingerprint(bucket uint64, slot int, fingerprint uint32) {
+	size := uint64(f.data.FingerprintSize)
+	offset := (bucket*uint64(f.data.BucketSize) + uint64(slot)) * size
+	for i := uint64(0); i < size; i++ {
+		f.data.Data[offset+i] = byte(fingerprint >> (8 * i))
+	}
+}
+
+func (f *hashSetFilter) hasFingerprint(bucket uint64, fingerprint uint32) bool {
+	for slot := 0; slot < int(f.data.BucketSize); slot++ {
+		if f.getFingerprint(bucket, slot) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// insertFingerprint adds a fingerprint to one of its buckets, moving the
+// fingerprints in the way to their other bucket. It fails if the filter is
+// too full, having dropped the last fingerprint moved, so the filter is then
+// thrown away
+func (f *hashSetFilter) insertFingerprint(bucket uint64, fingerprint uint32) error {
+	if f.hasFingerprint(bucket, fingerprint) || f.hasFingerprint(f.getAlternateBucket(bucket, fingerprint), fingerprint) {
+		return nil
+	}
+	for kick := 0; kick < cuckooMaxKicks; kick++ {
+		for _, candidate := range []uint64{bucket, f.getAlternateBucket(bucket, fingerprint)} {
+			for slot := 0; slot < int(f.data.BucketSize); slot++ {
+				if f.getFingerprint(candidate, slot) == 0 {
+					f.setFingerprint(candidate, slot, fingerprint)
+					f.data.Count++
+					return nil
+				}
+			}
+		}
+		slot := f.random.Intn(int(f.data.BucketSize))
+		evicted := f.getFingerprint(bucket, slot)
+		f.setFingerprint(bucket, slot, fingerprint)
+		fingerprint = evicted
+		bucket = f.getAlternateBucket(bucket, fingerprint)
+	}
+	return errors.New("the cuckoo filter is full")
+}
+
+func checkFilterHash(hash []byte) error {
+	if len(hash) != 32 {
+		return fmt.Errorf("hash of %d bytes, filters hold sha256 hashes", len(hash))
+	}
+	return nil
+}
+
+func (f *hashSetFilter) add(hash []byte) error {
+	if err := checkFilterHash(hash); err != nil {
+		return err
+	}
+	if f.data.Type == filterCuckoo {
+		return f.insertFingerprint(f.getCuckooSlot(hash))
+	}
+	for _, bit := range f.getBloomBits(hash) {
+		f.data.Data[bit/8] |= 1 << (bit % 8)
+	}
+	f.data.Count++
+	return nil
+}
+
+// contains reports whether the hash is probably in the filter, hashes that
+// were added always are
+func (f *hashSetFilter) contains(hash []byte) bool {
+	if checkFilterHash(hash) != nil {
+		return false
+	}
+	if f.data.Type == filterCuckoo {
+		bucket, fingerprint := f.getCuckooSlot(hash)
+		return f.hasFingerprint(bucket, fingerprint) || f.hasFingerprint(f.getAlternateBucket(bucket, fingerprint), fingerprint)
+	}
+	for _, bit := range f.getBloomBits(hash) {
+		if f.data.Data[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// merge adds the hashes of another filter of the same type and size. The
+// count of merged Bloom filters counts the hashes of both filters
+func (f *hashSetFilter) merge(other *hashSetFilter) error {
+	d, o := &f.data, &other.data
+	if d.Type != o.Type || d.Bits != o.Bits || d.HashCount != o.HashCount ||
+		d.Buckets != o.Buckets || d.BucketSize != o.BucketSize || d.FingerprintSize != o.FingerprintSize {
+		return usageError("only filters of the same type and size can be merged, export them with the same -capacity")
+	}
+	if d.Type == filterBloom {
+		for i := range d.Data {
+			d.Data[i] |= o.Data[i]
+		}
+		d.Count += o.Count
+		return nil
+	}
+	for bucket := uint64(0); bucket < o.Buckets; bucket++ {
+		for slot := 0; slot < int(o.BucketSize); slot++ {
+			if fingerprint := other.getFingerprint(bucket, slot); fingerprint != 0 {
+				if err := f.insertFingerprint(bucket, fingerprint); err != nil {
+					return fmt.Errorf("%w, export the filters with a larger -capacity", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// getFpRate returns the expected false positive rate of the filter
+func (f *hashSetFilter) getFpRate() float64 {
+	d := &f.data
+	if d.Type == filterCuckoo {
+		slots := 2 * float64(d.BucketSize) * float64(d.Count) / float64(d.Buckets*uint64(d.BucketSize))
+		return math.Min(slots/math.Exp2(8*float64(d.FingerprintSize)), 1)
+	}
+	k := float64(d.HashCount)
+	return math.Pow(1-math.Exp(-k*float64(d.Count)/float64(d.Bits)), k)
+}
+
+func (f *hashSetFilter) describe() string {
+	d := &f.data
+	if d.Type == filterCuckoo {
+		return fmt.Sprintf("cuckoo filter of %d hashes, %d buckets of %d fingerprints of %d bits, %s, false positive rate %.2g",
+			d.Count, d.Buckets, d.BucketSize, 8*d.FingerprintSize, formatBytes(int64(len(d.Data))), f.getFpRate())
+	}
+	return fmt.Sprintf("bloom filter of %d hashes, %d bits, %d hash functions, %s, false positive rate %.2g",
+		d.Count, d.Bits, d.HashCount, formatBytes(int64(len(d.Data))), f.getFpRate())
+}
+
+func (f *hashSetFilter) write(name string) error {
+	return writeFileAtomic(name, encoder.Serialize(f.data))
+}
+
+// parseChunkHash parses a chunk hash given in hex or base64
+func parseChunkHash(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if hash, err := hex.DecodeString(value); err == nil && len(hash) == 32 {
+		return hash, nil
+	}
+	if hash, err := base64.StdEncoding.DecodeString(value); err == nil && len(hash) == 32 {
+		return hash, nil
+	}
+	return nil, usageError("%q is not a sha256 in hex or base64", value)
+}
+
+// queryHashSetFilter prints whether each hash is probably in the filter and
+// returns the number of those that are not
+func queryHashSetFilter(w io.Writer, filter *hashSetFilter, hashes []string) (int, error) {
+	absent := 0
+	for _, value := range hashes {
+		hash, err := parseChunkHash(value)
+		if err != nil {
+			return 0, err
+		}
+		if filter.contains(hash) {
+			fmt.Fprintf(w, "probably present %x\n", hash)
+		} else {
+			fmt.Fprintf(w, "absent %x\n", hash)
+			absent++
+		}
+	}
+	return absent, nil
+}
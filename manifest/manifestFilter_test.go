@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashSetFilters(t *testing.T) {
+	for _, filterType := range []string{filterBloom, filterCuckoo} {
+		t.Run(filterType, func(t *testing.T) {
+			hashes := randomHashes(t, 20000)
+			others := randomHashes(t, 20000)
+			filter, err := newHashSetFilter(filterType, hashes, 0.001, 0)
+			require.NoError(t, err)
+			// cuckoo filters hold a fingerprint once, even for two hashes
+			require.InDelta(t, len(hashes), filter.data.Count, 5)
+
+			for _, hash := range hashes {
+				require.True(t, filter.contains(hash))
+			}
+			falsePositives := 0
+			for _, hash := range others {
+				if filter.contains(hash) {
+					falsePositives++
+				}
+			}
+			require.True(t, falsePositives < 3*len(others)/1000, "%d false positives", falsePositives)
+			require.True(t, filter.getFpRate() < 0.002, "rate %g", filter.getFpRate())
+
+			name := filepath.Join(t.TempDir(), "hashes."+filterType)
+			require.NoError(t, filter.write(name))
+			read, err := readHashSetFilter(name)
+			require.NoError(t, err)
+			require.Equal(t, filter.data, read.data)
+		})
+	}
+}
+
+func TestMergeHashSetFilters(t *testing.T) {
+	for _, filterType := range []string{filterBloom, filterCuckoo} {
+		t.Run(filterType, func(t *testing.T) {
+			a := randomHashes(t, 3000)
+			b := randomHashes(t, 3000)
+			// sized for both sets
+			filterA, err := newHashSetFilter(filterType, a, 0.001, 6000)
+			require.NoError(t, err)
+			filterB, err := newHashSetFilter(filterType, b, 0.001, 6000)
+			require.NoError(t, err)
+			require.NoError(t, filterA.merge(filterB))
+			for _, hash := range append(a, b...) {
+				require.True(t, filterA.contains(hash))
+			}
+
+			other, err := newHashSetFilter(filterType, randomHashes(t, 100000), 0.001, 0)
+			require.NoError(t, err)
+			require.Error(t, filterA.merge(other))
+		})
+	}
+}
+
+func TestQueryHashSetFilter(t *testing.T) {
+	hashes := randomHashes(t, 100)
+	filter, err := newHashSetFilter(filterCuckoo, hashes, 0.0001, 0)
+	require.NoError(t, err)
+	absentHash := randomHashes(t, 1)[0]
+
+	var out bytes.Buffer
+	absent, err := queryHashSetFilter(&out, filter, []string{hex.EncodeToString(hashes[0]), hex.EncodeToString(absentHash)})
+	require.NoError(t, err)
+	require.Equal(t, 1, absent)
+	require.Equal(t, "probably present "+hex.EncodeToString(hashes[0])+"\nabsent "+hex.EncodeToString(absentHash)+"\n", out.String())
+
+	_, err = queryHashSetFilter(&out, filter, []string{"not a hash"})
+	require.Equal(t, exitUsage, getExitCode(err))
+	_, err = newHashSetFilter("quotient", hashes, 0.001, 0)
+	require.Equal(t, exitUsage, getExitCode(err))
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const findIndexVersion = 1
+
+// findIndex is the index of the files of all the checkpoints, kept in
+// .cxo/find-index and brought up to date when a checkpoint is written
+type findIndex struct {
+	data FindIndex
+	// index of each file version in data.Files, by findIndexFileKey
+	files map[string]int
+	// index of each content in data.Contents, by file hash
+	contents map[string]int
+	changed  bool
+}
+
+// findQuery selects file versions, the zero value of a field matches all
+type findQuery struct {
+	name    string
+	path    string
+	regex   *regexp.Regexp
+	hash    []byte
+	chunk   []byte
+	minSize int64
+	// -1 for no limit
+	maxSize int64
+	// checkpoints created in this range
+	after, before time.Time
+	// files changed in this range
+	changedAfter, changedBefore string
+}
+
+// findResult is a file version matching a query, with the checkpoints it is in
+type findResult struct {
+	file        *FindIndexFile
+	checkpoints []*FindIndexCheckpoint
+	// positions of the chunk searched for
+	chunkIndexes []int
+}
+
+func newFindIndex() *findIndex {
+	return &findIndex{
+		data:     FindIndex{Version: findIndexVersion},
+		files:    make(map[string]int),
+		contents: make(map[string]int),
+	}
+}
+
+func findIndexFileKey(file *FindIndexFile) string {
+	return file.Path + "\x00" + string(file.Hash) + "\x00" + strconv.FormatInt(file.Size, 10) + "\x00" + file.Date
+}
+
+// loadFindIndex reads the index, an index that can not be read is rebuilt
+func loadFindIndex() (*findIndex, error) {
+	result := newFindIndex()
+	data, err := ioutil.ReadFile(currentDir + manifestFindIndexFile)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := encoder.DeserializeRawExact(data, &result.data); err != nil || result.data.Version != findIndexVersion {
+		fmt.Fprintf(os.Stderr, "rebuilding %s\n", manifestFindIndexFile)
+		return newFindIndex(), nil
+	}
+	for i := range result.data.Files {
+		result.files[findIndexFileKey(&result.data.Files[i])] = i
+	}
+	for i, content := range result.data.Contents {
+		result.contents[string(content.Hash)] = i
+	}
+	return result, nil
+}
+
+// updateFindIndex adds the checkpoints that are not in the index yet, and
+// rebuilds it if checkpoints were removed. It must hold the repository lock
+func updateFindIndex() (*findIndex, error) {
+	index, err := loadFindIndex()
+	if err != nil {
+		return nil, err
+	}
+	checkpoints, err := getCheckpointFiles()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		present[strings.TrimSuffix(filepath.Base(checkpoint), ".cxo")] = true
+	}
+	indexed := make(map[string]bool, len(index.data.Checkpoints))
+	for _, checkpoint := range index.data.Checkpoints {
+		if !present[checkpoint.Name] {
+			index = newFindIndex()
+			indexed = make(map[string]bool)
+			break
+		}
+		indexed[checkpoint.Name] = true
+	}
+	for _, checkpoint := range checkpoints {
+		if !indexed[strings.TrimSuffix(filepath.Base(checkpoint), ".cxo")] {
+			if err := index.addCheckpoint(checkpoint); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if index.changed {
+		if err := writeFileAtomic(currentDir+manifestFindIndexFile, encoder.Serialize(index.data)); err != nil {
+			return nil, err
+		}
+		index.changed = false
+	}
+	return index, nil
+}
+
+func (index *findIndex) addCheckpoint(checkpoint string) error {
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return err
+	}
+	id := uint32(len(index.data.Checkpoints))
+	index.data.Checkpoints = append(index.data.Checkpoints, FindIndexCheckpoint{
+		Name:      strings.TrimSuffix(filepath.Base(checkpoint), ".cxo"),
+		CreatedAt: manifest.ManifestHeader.CreatedAt,
+	})
+	index.changed = true
+
+	root := getCheckpointRoot(manifest)
+	items := manifest.FileList.FileItemList
+	// the file items are those of the files that are not errored, in order
+	item := 0
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		if entry.FileName == nil || getFileEntryError(entry) != "" {
+			continue
+		}
+		file := FindIndexFile{
+			Path: filepath.ToSlash(getManifestFileRelPath(root, entry)),
+			Size: entry.Size,
+			Hash: entry.HashList.FileHash.Hash,
+		}
+		if !isFileSizeKnown(entry) {
+			file.Size = -1
+		}
+		if item < len(items) {
+			file.Date = items[item].Header.CreationDate
+		}
+		item++
+
+		key := findIndexFileKey(&file)
+		if existing, ok := index.files[key]; ok {
+			index.data.Files[existing].Checkpoints = append(index.data.Files[existing].Checkpoints, id)
+		} else {
+			file.Checkpoints = []uint32{id}
+			index.files[key] = len(index.data.Files)
+			index.data.Files = append(index.data.Files, file)
+		}
+		if _, ok := index.contents[string(file.Hash)]; !ok && hasChunkHashes(entry) {
+			index.contents[string(file.Hash)] = len(index.data.Contents)
+			index.data.Contents = append(index.data.Contents, FindIndexContent{
+				Hash:        file.Hash,
+				ChunkHashes: entry.HashList.ChunksHashes,
+			})
+		}
+	}
+	return nil
+}
+
+// find returns the file versions matching the query, sorted by path
+func (index *findIndex) find(query *findQuery) []findResult {
+	// positions of the chunk in each content
+	var chunkContents map[string][]int
+	if query.chunk != nil {
+		chunkContents = make(map[string][]int)
+		for _, content := range index.data.Contents {
+			for i, hash := range content.ChunkHashes {
+				if string(hash) == string(query.chunk) {
+					chunkContents[string(content.Hash)] = append(chunkContents[string(content.Hash)], i)
+				}
+			}
+		}
+	}
+
+	var result []findResult
+	for i := range index.data.Files {
+		file := &index.data.Files[i]
+		if !query.matchFile(file) {
+			continue
+		}
+		var chunkIndexes []int
+		if chunkContents != nil {
+			if chunkIndexes = chunkContents[string(file.Hash)]; chunkIndexes == nil {
+				continue
+			}
+		}
+		var checkpoints []*FindIndexCheckpoint
+		for _, id := range file.Checkpoints {
+			checkpoint := &index.data.Checkpoints[id]
+			created := time.Unix(int64(checkpoint.CreatedAt), 0)
+			if (query.after.IsZero() || !created.Before(query.after)) && (query.before.IsZero() || created.Before(query.before)) {
+				checkpoints = append(checkpoints, checkpoint)
+			}
+		}
+		if len(checkpoints) > 0 {
+			result = append(result, findResult{file, checkpoints, chunkIndexes})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.file.Path != b.file.Path {
+			return lessPathComponents(strings.Split(a.file.Path, "/"), strings.Split(b.file.Path, "/"))
+		}
+		return checkpointNameLess(a.checkpoints[0].Name, b.checkpoints[0].Name)
+	})
+	return result
+}
+
+func (query *findQuery) matchFile(file *FindIndexFile) bool {
+	if query.name != "" {
+		if ok, _ := filepath.Match(query.name, filepath.Base(file.Path)); !ok {
+			return false
+		}
+	}
+	if query.path != "" {
+		if ok, _ := filepath.Match(query.path, file.Path); !ok {
+			return false
+		}
+	}
+	if query.regex != nil && !query.regex.MatchString(file.Path) {
+		return false
+	}
+	if query.hash != nil && string(query.hash) != string(file.Hash) {
+		return false
+	}
+	if query.minSize > 0 && file.Size < query.minSize {
+		return false
+	}
+	if query.maxSize >= 0 && (file.Size < 0 || file.Size > query.maxSize) {
+		return false
+	}
+	// the dates are "2006-01-02", which sort as strings
+	if query.changedAfter != "" && (file.Date == "" || file.Date < query.changedAfter) {
+		return false
+	}
+	if query.changedBefore != "" && (file.Date == "" || file.Date >= query.changedBefore) {
+		return false
+	}
+	return true
+}
+
+// parseFindHash returns the FileHash of a sha256 given in hex or base64
+func parseFindHash(value string) ([]byte, error) {
+	if sum, err := hex.DecodeString(value); err == nil && len(sum) == 32 {
+		return []byte(base64.StdEncoding.EncodeToString(sum)), nil
+	}
+	if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == 32 {
+		return []byte(value), nil
+	}
+	return nil, usageError("%q is not a sha256 in hex or base64", value)
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix for
+// powers of 1024
+func parseSize(value string) (int64, error) {
+	number, multiplier := value, int64(1)
+	if len(value) > 1 {
+		if i := strings.IndexByte("KMGT", strings.ToUpper(value)[len(value)-1]); i >= 0 {
+			number, multiplier = value[:len(value)-1], int64(1)<<(10*uint(i+1))
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, usageError("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// parseDate parses a date as 2006-01-02 in local time, or as RFC 3339
+func parseDate(value string) (time.Time, error) {
+	if result, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return result, nil
+	}
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, usageError("invalid date %q, use 2006-01-02 or 2006-01-02T15:04:05Z07:00", value)
+	}
+	return result, nil
+}
+
+func printFindResults(w io.Writer, results []findResult, listCheckpoints bool) error {
+	for _, result := range results {
+		file := result.file
+		size := "size unknown"
+		if file.Size >= 0 {
+			size = strconv.FormatInt(file.Size, 10) + " bytes"
+		}
+		sum, err := base64.StdEncoding.DecodeString(string(file.Hash))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s  %s  sha256 %x", file.Path, size, sum)
+		if file.Date != "" {
+			fmt.Fprintf(w, "  changed %s", file.Date)
+		}
+		if result.chunkIndexes != nil {
+			fmt.Fprintf(w, "  chunk %s", strings.Trim(fmt.Sprint(result.chunkIndexes), "[]"))
+		}
+		checkpoints := result.checkpoints
+		if listCheckpoints || len(checkpoints) == 1 {
+			var names []string
+			for _, checkpoint := range checkpoints {
+				names = append(names, checkpoint.Name)
+			}
+			fmt.Fprintf(w, "\n    in %s\n", strings.Join(names, ", "))
+		} else {
+			fmt.Fprintf(w, "\n    in %d checkpoints, first %s, last %s\n",
+				len(checkpoints), checkpoints[0].Name, checkpoints[len(checkpoints)-1].Name)
+		}
+	}
+	fmt.Fprintf(w, "%d file versions found\n", len(results))
+	return nil
+}
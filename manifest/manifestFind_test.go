@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindIndex(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.MkdirAll("docs", 0700))
+	data := make([]byte, chunkSize+10)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile("docs/big.bin", data, 0600))
+	require.NoError(t, ioutil.WriteFile("docs/notes.txt", []byte("version 1"), 0600))
+	first := commitTestRepository(t)
+	require.NoError(t, ioutil.WriteFile("docs/notes.txt", []byte("version 2"), 0600))
+	commitTestRepository(t)
+	require.FileExists(t, currentDir+manifestFindIndexFile)
+
+	index, err := loadFindIndex()
+	require.NoError(t, err)
+	require.Len(t, index.data.Checkpoints, 2)
+	require.Len(t, index.data.Files, 3)
+
+	results := index.find(&findQuery{name: "*.txt", maxSize: -1})
+	require.Len(t, results, 2)
+	require.Equal(t, "docs/notes.txt", results[0].file.Path)
+	require.Len(t, results[0].checkpoints, 1)
+
+	results = index.find(&findQuery{path: "docs/*", minSize: int64(chunkSize), maxSize: -1})
+	require.Len(t, results, 1)
+	require.Len(t, results[0].checkpoints, 2)
+	require.Equal(t, today(), results[0].file.Date)
+
+	require.Len(t, index.find(&findQuery{regex: regexp.MustCompile(`^docs/.*\.bin$`), maxSize: int64(chunkSize)}), 0)
+
+	hash, err := parseFindHash(hex.EncodeToString(sha256Sum([]byte("version 1"))))
+	require.NoError(t, err)
+	results = index.find(&findQuery{hash: hash, maxSize: -1})
+	require.Len(t, results, 1)
+
+	results = index.find(&findQuery{chunk: hashChunkData(data[chunkSize:]), maxSize: -1})
+	require.Len(t, results, 1)
+	require.Equal(t, []int{1}, results[0].chunkIndexes)
+
+	require.Len(t, index.find(&findQuery{after: time.Now().Add(time.Hour), maxSize: -1}), 0)
+	require.Len(t, index.find(&findQuery{changedBefore: today(), maxSize: -1}), 0)
+
+	// removing a checkpoint rebuilds the index
+	require.NoError(t, os.Remove(first))
+	index, err = updateFindIndex()
+	require.NoError(t, err)
+	require.Len(t, index.data.Checkpoints, 1)
+	require.Len(t, index.data.Files, 2)
+
+	var output bytes.Buffer
+	require.NoError(t, printFindResults(&output, index.find(&findQuery{name: "notes.txt", maxSize: -1}), false))
+	require.Contains(t, output.String(), "docs/notes.txt  9 bytes  sha256 ")
+	require.Contains(t, output.String(), "1 file versions found")
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{"0": 0, "12": 12, "3K": 3072, "2m": 2 << 20, "1G": 1 << 30} {
+		size, err := parseSize(value)
+		require.NoError(t, err)
+		require.Equal(t, expected, size)
+	}
+	for _, value := range []string{"", "K", "-1", "1X", "1.5M"} {
+		_, err := parseSize(value)
+		require.Error(t, err)
+	}
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
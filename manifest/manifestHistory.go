@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	historyAdded    = "added"
+	historyModified = "modified"
+	historyRenamed  = "renamed"
+	historyDeleted  = "deleted"
+)
+
+// historyVersion is a change of a file in a checkpoint
+type historyVersion struct {
+	checkpoint string
+	sequenceId uint64
+	createdAt  uint64
+	// path of the file in the checkpoint
+	path   string
+	status string
+	// the other path of a renamed file
+	renamedFrom string
+	renamedTo   string
+	// nil if the file was deleted
+	entry *ManifestFile
+}
+
+// historyCheckpoint is the files of a checkpoint by path
+type historyCheckpoint struct {
+	name   string
+	header ManifestDirectoryHeader
+	files  map[string]*ManifestFile
+	// paths by content, built when looking for renames
+	byContent map[string][]string
+}
+
+func loadHistoryCheckpoint(checkpoint string) (*historyCheckpoint, error) {
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	result := historyCheckpoint{
+		name:   strings.TrimSuffix(filepath.Base(checkpoint), ".cxo"),
+		header: manifest.ManifestHeader,
+		files:  make(map[string]*ManifestFile),
+	}
+	root := getCheckpointRoot(manifest)
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		if entry.FileName != nil {
+			result.files[getManifestFileRelPath(root, entry)] = entry
+		}
+	}
+	return &result, nil
+}
+
+func getHistoryContentKey(entry *ManifestFile) string {
+	return string(entry.HashList.FileHash.Hash) + ":" + strconv.FormatInt(entry.Size, 10)
+}
+
+// findRename returns a path of the checkpoint with the content of the entry
+// that is not in the other checkpoint, or an empty string
+func (c *historyCheckpoint) findRename(entry *ManifestFile, other *historyCheckpoint) string {
+	if getFileEntryError(entry) != "" {
+		return ""
+	}
+	if c.byContent == nil {
+		c.byContent = make(map[string][]string)
+		for path, file := range c.files {
+			if getFileEntryError(file) == "" {
+				key := getHistoryContentKey(file)
+				c.byContent[key] = append(c.byContent[key], path)
+			}
+		}
+	}
+	var result string
+	for _, path := range c.byContent[getHistoryContentKey(entry)] {
+		if other.files[path] == nil && (result == "" || path < result) {
+			result = path
+		}
+	}
+	return result
+}
+
+// getFileHistory returns the versions of the file, oldest first. It walks the
+// checkpoints from the newest one, following the file to its older names when
+// it was renamed, that is when a file with the same content disappeared
+func getFileHistory(relPath string) ([]historyVersion, error) {
+	checkpoints, err := getCheckpointFiles()
+	if err != nil {
+		return nil, err
+	}
+	var result []historyVersion
+	path := relPath
+	var current *historyCheckpoint
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		if current == nil {
+			if current, err = loadHistoryCheckpoint(checkpoints[i]); err != nil {
+				return nil, err
+			}
+		}
+		previous := &historyCheckpoint{files: map[string]*ManifestFile{}}
+		if i > 0 {
+			if previous, err = loadHistoryCheckpoint(checkpoints[i-1]); err != nil {
+				return nil, err
+			}
+		}
+		version := historyVersion{
+			checkpoint: current.name,
+			sequenceId: current.header.SequenceId,
+			createdAt:  current.header.CreatedAt,
+			path:       path,
+			entry:      current.files[path],
+		}
+		before := previous.files[path]
+		switch {
+		case version.entry != nil && before == nil:
+			version.status = historyAdded
+			if from := previous.findRename(version.entry, current); from != "" {
+				version.status = historyRenamed
+				version.renamedFrom = from
+				path = from
+			}
+		case version.entry != nil && getHistoryContentKey(version.entry) != getHistoryContentKey(before):
+			version.status = historyModified
+		case version.entry != nil && getFileEntryError(version.entry) != getFileEntryError(before):
+			version.status = historyModified
+		case version.entry == nil && before != nil:
+			version.status = historyDeleted
+			version.renamedTo = current.findRename(before, previous)
+		}
+		if version.status != "" {
+			result = append(result, version)
+		}
+		current = previous
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result, nil
+}
+
+func printFileHistory(w io.Writer, relPath string, versions []historyVersion) error {
+	if len(versions) == 0 {
+		return usageError("%s is not in any checkpoint", relPath)
+	}
+	for _, version := range versions {
+		fmt.Fprintf(w, "%s  sequence %d  %s  ", version.checkpoint, version.sequenceId,
+			time.Unix(int64(version.createdAt), 0).Format("2006-01-02 15:04:05"))
+		switch {
+		case version.entry == nil:
+			fmt.Fprintf(w, "-")
+		case getFileEntryError(version.entry) != "":
+			fmt.Fprintf(w, "unreadable: %s", getFileEntryError(version.entry))
+		default:
+			sum, err := getFileSha256(version.entry)
+			if err != nil {
+				return err
+			}
+			if isFileSizeKnown(version.entry) {
+				fmt.Fprintf(w, "%d bytes  ", version.entry.Size)
+			}
+			fmt.Fprintf(w, "sha256 %x", sum)
+		}
+		fmt.Fprintf(w, "  %s", version.status)
+		if version.renamedFrom != "" {
+			fmt.Fprintf(w, " from %s", version.renamedFrom)
+		}
+		if version.renamedTo != "" {
+			fmt.Fprintf(w, " (renamed to %s)", version.renamedTo)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// getHistoryVersion returns the version of the file in the checkpoint, the
+// last change at or before it
+func getHistoryVersion(versions []historyVersion, checkpoint string) (*historyVersion, error) {
+	name := strings.TrimSuffix(filepath.Base(checkpoint), ".cxo")
+	var result *historyVersion
+	for i := range versions {
+		if checkpointNameLess(name, versions[i].checkpoint) {
+			break
+		}
+		result = &versions[i]
+	}
+	if result == nil || result.entry == nil {
+		return nil, usageError("the file is not in checkpoint %s", name)
+	}
+	if getFileEntryError(result.entry) != "" || !hasChunkHashes(result.entry) {
+		return nil, usageError("checkpoint %s has no chunk hashes for %s", name, result.path)
+	}
+	return result, nil
+}
+
+// writeHistoryVersion writes the data of a version of a file, read from the
+// chunk store, or from the file if it is still the same, and checks it
+// against the hash of the file. The chunks in holes are zeros, not read
+func writeHistoryVersion(store *chunkStore, version *historyVersion, w io.Writer) error {
+	hash := sha256.New()
+	sizes := getManifestFileChunkSizes(version.entry)
+	holes, err := getFileEntryHoles(version.entry)
+	if err != nil {
+		return err
+	}
+	for index, chunkHash := range version.entry.HashList.ChunksHashes {
+		offset := int64(index) * int64(chunkSize)
+		if isInHole(holes, offset, offset+int64(sizes[index])) {
+			data := make([]byte, sizes[index])
+			hash.Write(data)
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := readCheckpointChunk(store, version.path, chunkHash, index, sizes[index])
+		if err != nil {
+			return verifyError("chunk %d of %s is not stored, commit with -store-chunks to keep old versions: %w", index, version.path, err)
+		}
+		hash.Write(data)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if base64.StdEncoding.EncodeToString(hash.Sum(nil)) != string(version.entry.HashList.FileHash.Hash) {
+		return verifyError("the data of %s does not match its hash in checkpoint %s", version.path, version.checkpoint)
+	}
+	return nil
+}
+
+// restoreHistoryVersion writes the version of a file to the file name through
+// a temporary file, replacing the file only once the data was checked. The
+// holes of sparse files are left as holes, and the file keeps its
+// permissions, or gets those of the umask if it is new
+func restoreHistoryVersion(store *chunkStore, version *historyVersion, filename string) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	tempFile, err := createTempFile(dir, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if info, err := os.Stat(filename); err == nil {
+		if err := tempFile.Chmod(info.Mode().Perm()); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	holes, err := getFileEntryHoles(version.entry)
+	if err != nil {
+		return err
+	}
+	writer := &sparseWriter{file: tempFile, holes: holes}
+	if err := writeHistoryVersion(store, version, writer); err != nil {
+		return err
+	}
+	if err := writer.close(); err != nil {
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filename)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileHistory(t *testing.T) {
+	defer setupTestRepository(t)()
+	store, err := openChunkStore(currentDir)
+	require.NoError(t, err)
+	defer store.close()
+	chunks = store
+	defer func() { chunks = nil }()
+
+	first := make([]byte, chunkSize+100)
+	_, err = rand.Read(first)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile("a", first, 0600))
+	require.NoError(t, ioutil.WriteFile("other", []byte("other"), 0600))
+	commitTestRepository(t)
+	unchanged := commitTestRepository(t)
+	require.NoError(t, ioutil.WriteFile("a", []byte("second"), 0600))
+	second := commitTestRepository(t)
+	require.NoError(t, os.Rename("a", "b"))
+	commitTestRepository(t)
+	require.NoError(t, os.Remove("b"))
+	commitTestRepository(t)
+
+	versions, err := getFileHistory("b")
+	require.NoError(t, err)
+	var statuses, paths []string
+	for _, version := range versions {
+		statuses = append(statuses, version.status)
+		paths = append(paths, version.path)
+	}
+	require.Equal(t, []string{historyAdded, historyModified, historyRenamed, historyDeleted}, statuses)
+	require.Equal(t, []string{"a", "a", "b", "b"}, paths)
+	require.Equal(t, "a", versions[2].renamedFrom)
+
+	versions, err = getFileHistory("a")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	require.Equal(t, historyDeleted, versions[2].status)
+	require.Equal(t, "b", versions[2].renamedTo)
+
+	// the version of the second checkpoint is the first one
+	version, err := getHistoryVersion(versions, unchanged)
+	require.NoError(t, err)
+	var output bytes.Buffer
+	require.NoError(t, writeHistoryVersion(store, version, &output))
+	require.Equal(t, first, output.Bytes())
+
+	version, err = getHistoryVersion(versions, second)
+	require.NoError(t, err)
+	require.NoError(t, restoreHistoryVersion(store, version, "a"))
+	data, err := ioutil.ReadFile("a")
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+
+	// a restored file keeps its permissions
+	require.NoError(t, ioutil.WriteFile("a", []byte("third"), 0600))
+	require.NoError(t, os.Chmod("a", 0750))
+	require.NoError(t, restoreHistoryVersion(store, version, "a"))
+	info, err := os.Stat("a")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	output.Reset()
+	require.NoError(t, printFileHistory(&output, "b", versions[:1]))
+	require.Contains(t, output.String(), "sequence 0  "+time.Unix(int64(versions[0].createdAt), 0).Format("2006-01-02"))
+	require.Contains(t, output.String(), "bytes  sha256 ")
+	require.Error(t, printFileHistory(&output, "missing", nil))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRules holds the patterns of the .cxoignore file of a tree. A pattern
+// without a slash matches the name of a file or directory at any depth, a
+// pattern with a slash matches the path relative to the root of the tree,
+// and a pattern ending in a slash only matches directories
+type ignoreRules struct {
+	root     string
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	pattern  string
+	anchored bool
+	dirOnly  bool
+}
+
+// loadIgnoreRules reads the .cxoignore file of the tree and the ignore
+// patterns of its repository configuration, a missing file ignores nothing
+func loadIgnoreRules(root string) (*ignoreRules, error) {
+	result := ignoreRules{root: root}
+	config, err := loadRepositoryConfig(root)
+	if err != nil {
+		return nil, err
+	}
+	lines := config.Ignore
+	file, err := os.Open(root + manifestIgnoreFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, err := parseIgnorePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		result.patterns = append(result.patterns, pattern)
+	}
+	return &result, nil
+}
+
+func parseIgnorePattern(line string) (ignorePattern, error) {
+	var pattern ignorePattern
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if _, err := filepath.Match(line, ""); err != nil {
+		return pattern, err
+	}
+	pattern.pattern = line
+	return pattern, nil
+}
+
+// isIgnored reports whether the path, relative to the root of the rules or
+// below it, or one of the directories it is in matches one of the patterns
+func (r *ignoreRules) isIgnored(path string, isDir bool) bool {
+	if len(r.patterns) == 0 {
+		return false
+	}
+	relPath, err := filepath.Rel(r.root, path)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return false
+	}
+	parts := strings.Split(relPath, string(filepath.Separator))
+	for i := range parts {
+		last := i == len(parts)-1
+		if r.matches(strings.Join(parts[:i+1], "/"), parts[i], isDir || !last) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ignoreRules) matches(relPath string, name string, isDir bool) bool {
+	for _, pattern := range r.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		subject := name
+		if pattern.anchored {
+			subject = relPath
+		}
+		// errors were ruled out when loading the patterns
+		if matched, _ := filepath.Match(pattern.pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
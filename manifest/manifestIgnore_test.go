@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ignore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rules, err := loadIgnoreRules(dir)
+	require.NoError(t, err)
+	require.False(t, rules.isIgnored(filepath.Join(dir, "a.log"), false))
+
+	content := "# build output\nbuild/\n*.log\n/docs/draft.txt\n"
+	require.NoError(t, ioutil.WriteFile(dir+manifestIgnoreFile, []byte(content), 0600))
+	rules, err = loadIgnoreRules(dir)
+	require.NoError(t, err)
+
+	require.True(t, rules.isIgnored(filepath.Join(dir, "a.log"), false))
+	require.True(t, rules.isIgnored(filepath.Join(dir, "sub", "b.log"), false))
+	require.True(t, rules.isIgnored(filepath.Join(dir, "build"), true))
+	require.False(t, rules.isIgnored(filepath.Join(dir, "build"), false))
+	require.True(t, rules.isIgnored(filepath.Join(dir, "sub", "build", "out.o"), false))
+	require.True(t, rules.isIgnored(filepath.Join(dir, "docs", "draft.txt"), false))
+	require.False(t, rules.isIgnored(filepath.Join(dir, "sub", "docs", "draft.txt"), false))
+	require.False(t, rules.isIgnored(filepath.Join(dir, "a.txt"), false))
+	require.False(t, rules.isIgnored(dir, true))
+
+	require.NoError(t, ioutil.WriteFile(dir+manifestIgnoreFile, []byte("[\n"), 0600))
+	_, err = loadIgnoreRules(dir)
+	require.Error(t, err)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	checkpointJSONFormat  = "manifest-checkpoint"
+	checkpointJSONVersion = 1
+)
+
+// jsonTextFields are the []byte fields holding text, by type and field name
+var jsonTextFields = map[string]bool{
+	"ManifestDirectoryHeader.VersionString": true,
+	"ManifestFile.Path":                     true,
+	"ManifestFile.FileName":                 true,
+	"HashVariable.HashType":                 true,
+	"HashVariable.Hash":                     true,
+	"KeysValuesList.Keys":                   true,
+	"KeysValuesList.Values":                 true,
+	"FileItemRef.Hash":                      true,
+	"FileChunksHash.FileHash":               true,
+	"FileItemHeader.Id":                     true,
+}
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// getJSONFieldName returns the key of a struct field, its name in snake_case
+func getJSONFieldName(name string) string {
+	var result strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 && !unicode.IsUpper(rune(name[i-1])) {
+				result.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		result.WriteRune(r)
+	}
+	return result.String()
+}
+
+// exportCheckpointJSON writes the checkpoint with its meta and temp files as
+// one JSON document, which 'manifest import -json' turns back into the same
+// bytes. The document is a CheckpointDocument mapped field by field:
+//   - a struct is an object whose keys are its field names in snake_case
+//     (SequenceId is "sequence_id"), in the order of the declaration; import
+//     requires every key and no other
+//   - integers are numbers, which may need the full 64 bits
+//   - slices are arrays, an empty slice is []
+//   - text, the string fields and the []byte fields of jsonTextFields, is a
+//     JSON string if it is valid UTF-8 and {"base64": "..."} otherwise
+//   - other []byte fields, hashes, ids and the serialized key-value lists of
+//     MetaString, are lowercase hex strings
+func exportCheckpointJSON(checkpoint string, w io.Writer) error {
+	document := CheckpointDocument{Format: checkpointJSONFormat, Version: checkpointJSONVersion}
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return err
+	}
+	document.Checkpoint = *manifest
+	baseName := strings.TrimSuffix(filepath.Base(checkpoint), ".cxo")
+	for _, part := range []struct {
+		fileName string
+		value    interface{}
+	}{
+		{currentDir + manifestMetaFolder + baseName + ".meta", &document.Meta},
+		{currentDir + manifestTempFolder + baseName + ".temp", &document.Temp},
+	} {
+		data, err := ioutil.ReadFile(part.fileName)
+		if err != nil {
+			return err
+		}
+		if err := encoder.DeserializeRawExact(data, part.value); err != nil {
+			return fmt.Errorf("failed to deserialize %s: %w", part.fileName, err)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := encodeCanonicalJSON(&buffer, reflect.ValueOf(document), false); err != nil {
+		return err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, buffer.Bytes(), "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	_, err = indented.WriteTo(w)
+	return err
+}
+
+func encodeCanonicalJSON(buffer *bytes.Buffer, value reflect.Value, text bool) error {
+	switch value.Kind() {
+	case reflect.Struct:
+		buffer.WriteByte('{')
+		valueType := value.Type()
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			fmt.Fprintf(buffer, "%q:", getJSONFieldName(field.Name))
+			if err := encodeCanonicalJSON(buffer, value.Field(i), jsonTextFields[valueType.Name()+"."+field.Name]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('}')
+	case reflect.String:
+		encodeJSONText(buffer, []byte(value.String()))
+	case reflect.Slice:
+		if value.Type() == bytesType {
+			if text {
+				encodeJSONText(buffer, value.Bytes())
+			} else {
+				fmt.Fprintf(buffer, "%q", hex.EncodeToString(value.Bytes()))
+			}
+			return nil
+		}
+		buffer.WriteByte('[')
+		for i := 0; i < value.Len(); i++ {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := encodeCanonicalJSON(buffer, value.Index(i), text); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buffer.WriteString(strconv.FormatInt(value.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buffer.WriteString(strconv.FormatUint(value.Uint(), 10))
+	case reflect.Bool:
+		buffer.WriteString(strconv.FormatBool(value.Bool()))
+	default:
+		return fmt.Errorf("can not encode %s as checkpoint JSON", value.Type())
+	}
+	return nil
+}
+
+func encodeJSONText(buffer *bytes.Buffer, data []byte) {
+	if utf8.Valid(data) {
+		textEncoder := json.NewEncoder(buffer)
+		textEncoder.SetEscapeHTML(false)
+		textEncoder.Encode(string(data))
+		// Encode ends the value with a newline
+		buffer.Truncate(buffer.Len() - 1)
+		return
+	}
+	fmt.Fprintf(buffer, `{"base64":%q}`, base64.StdEncoding.EncodeToString(data))
+}
+
+// readCheckpointJSON reads a document written by exportCheckpointJSON
+func readCheckpointJSON(r io.Reader) (*CheckpointDocument, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	var document CheckpointDocument
+	if err := decodeCanonicalJSON(parsed, reflect.ValueOf(&document).Elem(), false, ""); err != nil {
+		return nil, err
+	}
+	if document.Format != checkpointJSONFormat || document.Version != checkpointJSONVersion {
+		return nil, fmt.Errorf("not a %s document of version %d", checkpointJSONFormat, checkpointJSONVersion)
+	}
+	return &document, nil
+}
+
+func decodeCanonicalJSON(parsed interface{}, value reflect.Value, text bool, path string) error {
+	switch value.Kind() {
+	case reflect.Struct:
+		object, ok := parsed.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", getJSONPath(path))
+		}
+		valueType := value.Type()
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			key := getJSONFieldName(field.Name)
+			fieldValue, ok := object[key]
+			if !ok {
+				return fmt.Errorf("%s: missing key %q", getJSONPath(path), key)
+			}
+			err := decodeCanonicalJSON(fieldValue, value.Field(i), jsonTextFields[valueType.Name()+"."+field.Name], path+"."+key)
+			if err != nil {
+				return err
+			}
+		}
+		if len(object) != valueType.NumField() {
+			known := make(map[string]bool)
+			for i := 0; i < valueType.NumField(); i++ {
+				known[getJSONFieldName(valueType.Field(i).Name)] = true
+			}
+			for key := range object {
+				if !known[key] {
+					return fmt.Errorf("%s: unknown key %q", getJSONPath(path), key)
+				}
+			}
+		}
+	case reflect.String:
+		data, err := decodeJSONText(parsed, path)
+		if err != nil {
+			return err
+		}
+		value.SetString(string(data))
+	case reflect.Slice:
+		if value.Type() == bytesType {
+			var data []byte
+			var err error
+			if text {
+				data, err = decodeJSONText(parsed, path)
+			} else if s, ok := parsed.(string); !ok {
+				err = fmt.Errorf("%s: expected a hex string", getJSONPath(path))
+			} else if data, err = hex.DecodeString(s); err != nil {
+				err = fmt.Errorf("%s: %w", getJSONPath(path), err)
+			}
+			if err != nil {
+				return err
+			}
+			value.SetBytes(data)
+			return nil
+		}
+		array, ok := parsed.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array", getJSONPath(path))
+		}
+		slice := reflect.MakeSlice(value.Type(), len(array), len(array))
+		for i, element := range array {
+			if err := decodeCanonicalJSON(element, slice.Index(i), text, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		value.Set(slice)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := parsed.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected an integer", getJSONPath(path))
+		}
+		n, err := strconv.ParseInt(number.String(), 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s: %w", getJSONPath(path), err)
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := parsed.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected an integer", getJSONPath(path))
+		}
+		n, err := strconv.ParseUint(number.String(), 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s: %w", getJSONPath(path), err)
+		}
+		value.SetUint(n)
+	case reflect.Bool:
+		b, ok := parsed.(bool)
+		if !ok {
+			return fmt.Errorf("%s: expected a boolean", getJSONPath(path))
+		}
+		value.SetBool(b)
+	default:
+		return fmt.Errorf("can not decode %s from checkpoint JSON", value.Type())
+	}
+	return nil
+}
+
+func decodeJSONText(parsed interface{}, path string) ([]byte, error) {
+	switch text := parsed.(type) {
+	case string:
+		return []byte(text), nil
+	case map[string]interface{}:
+		if encoded, ok := text["base64"].(string); ok && len(text) == 1 {
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", getJSONPath(path), err)
+			}
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: expected a string or {\"base64\": ...}", getJSONPath(path))
+}
+
+func getJSONPath(path string) string {
+	if path == "" {
+		return "document"
+	}
+	return strings.TrimPrefix(path, ".")
+}
+
+// importCheckpointJSON writes the checkpoint, meta and temp files of a
+// document written by 'manifest export -json' as a new checkpoint
+func importCheckpointJSON(documentPath string) error {
+	file, err := os.Open(documentPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	document, err := readCheckpointJSON(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", documentPath, err)
+	}
+	if err := checkCheckpointChunkSize(&document.Checkpoint, documentPath); err != nil {
+		return err
+	}
+	manifestMeta = document.Meta
+	manifestTemp = document.Temp
+	baseName, err := writeCheckpoint(&document.Checkpoint)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %s as checkpoint %s\n", documentPath, baseName)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointJSONRoundTrip(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.MkdirAll("sub", 0700))
+	files := map[string][]byte{"a": []byte("first"), "sub/b\xff": make([]byte, 2*chunkSize+1), "empty": nil}
+	for name, data := range files {
+		require.NoError(t, ioutil.WriteFile(name, data, 0600))
+	}
+	checkpoint := commitTestRepository(t)
+
+	var document bytes.Buffer
+	require.NoError(t, exportCheckpointJSON(checkpoint, &document))
+	require.Contains(t, document.String(), `"format": "manifest-checkpoint"`)
+	require.Contains(t, document.String(), `"file_name": {`)
+	require.Contains(t, document.String(), `"hash_type": "base64,sha256"`)
+
+	documentPath := filepath.Join(currentDir, "checkpoint.json")
+	require.NoError(t, ioutil.WriteFile(documentPath, document.Bytes(), 0600))
+	require.NoError(t, importCheckpointJSON(documentPath))
+	imported, err := getCheckpointFile("latest")
+	require.NoError(t, err)
+	require.NotEqual(t, checkpoint, imported)
+
+	// the checkpoint, meta and temp files are the same bytes
+	baseName := strings.TrimSuffix(filepath.Base(checkpoint), ".cxo")
+	importedName := strings.TrimSuffix(filepath.Base(imported), ".cxo")
+	for _, folder := range []string{manifestCXOFolder, manifestMetaFolder, manifestTempFolder} {
+		extension := "." + filepath.Base(folder)
+		if folder == manifestCXOFolder {
+			extension = ".cxo"
+		}
+		original, err := ioutil.ReadFile(currentDir + folder + baseName + extension)
+		require.NoError(t, err)
+		copied, err := ioutil.ReadFile(currentDir + folder + importedName + extension)
+		require.NoError(t, err)
+		require.Equal(t, original, copied)
+	}
+
+	var exported bytes.Buffer
+	require.NoError(t, exportCheckpointJSON(imported, &exported))
+	require.Equal(t, document.String(), exported.String())
+
+	// the chunk hashes of a checkpoint with other chunks would not be read
+	// right by the commands using the chunk size of the repository
+	other := strings.Replace(document.String(), fmt.Sprintf(`"chunk_size": %d`, chunkSize), fmt.Sprintf(`"chunk_size": %d`, 2*chunkSize), 1)
+	require.NotEqual(t, document.String(), other)
+	require.NoError(t, ioutil.WriteFile(documentPath, []byte(other), 0600))
+	err = importCheckpointJSON(documentPath)
+	require.Equal(t, exitUsage, getExitCode(err))
+	require.Contains(t, err.Error(), "has chunks of")
+}
+
+func TestReadCheckpointJSONErrors(t *testing.T) {
+	_, err := readCheckpointJSON(strings.NewReader(`{"format": "manifest-checkpoint"}`))
+	require.EqualError(t, err, `document: missing key "version"`)
+
+	var document bytes.Buffer
+	require.NoError(t, encodeCanonicalJSON(&document, reflect.ValueOf(CheckpointDocument{
+		Format: checkpointJSONFormat, Version: checkpointJSONVersion}), false))
+	valid := document.String()
+	_, err = readCheckpointJSON(strings.NewReader(valid))
+	require.NoError(t, err)
+
+	_, err = readCheckpointJSON(strings.NewReader(strings.Replace(valid, `"version":1`, `"version":1,"extra":0`, 1)))
+	require.EqualError(t, err, `document: unknown key "extra"`)
+	_, err = readCheckpointJSON(strings.NewReader(strings.Replace(valid, `"version":1`, `"version":2`, 1)))
+	require.Error(t, err)
+	_, err = readCheckpointJSON(strings.NewReader(strings.Replace(valid, `"id":""`, `"id":"zz"`, 1)))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checkpoint.file_list.header.chunk_hash_set_list.id")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// repositoryLock is the lock file while this process holds the lock
+var repositoryLock *os.File
+
+// acquireRepositoryLock takes the lock of the repository with flock(2) on its
+// lock file. The kernel releases it when the process ends, so a lock left by
+// a process that is gone is free without being removed. The file holds the
+// process, host and time of the owner for the error of the other processes
+func acquireRepositoryLock() error {
+	lockPath := currentDir + manifestLockFile
+	for {
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			if err == syscall.EWOULDBLOCK {
+				return getLockedError(lockPath)
+			}
+			return err
+		}
+		// the previous owner removes the file before it releases the lock,
+		// a lock on a removed file is no lock
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		current, err := os.Stat(lockPath)
+		if err == nil && os.SameFile(opened, current) {
+			repositoryLock = file
+			break
+		}
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	content := fmt.Sprintf("%d %s %d\n", os.Getpid(), hostname, time.Now().Unix())
+	if err := repositoryLock.Truncate(0); err != nil {
+		return err
+	}
+	_, err := repositoryLock.WriteAt([]byte(content), 0)
+	return err
+}
+
+// releaseRepositoryLock removes the lock file and then releases the lock
+func releaseRepositoryLock() error {
+	if repositoryLock == nil {
+		return nil
+	}
+	err := os.Remove(currentDir + manifestLockFile)
+	if closeErr := repositoryLock.Close(); err == nil {
+		err = closeErr
+	}
+	repositoryLock = nil
+	return err
+}
+
+// getLockedError describes the owner of the lock. The file may be empty or
+// cut short while the owner writes it, the lock is held all the same
+func getLockedError(lockPath string) error {
+	pid, host, since, err := readRepositoryLock(lockPath)
+	if err != nil || pid == 0 {
+		return fmt.Errorf("repository is locked by another process")
+	}
+	return fmt.Errorf("repository is locked by process %d on %s since %s",
+		pid, host, time.Unix(since, 0).Format("2006-01-02 15:04:05"))
+}
+
+func readRepositoryLock(lockPath string) (int, string, int64, error) {
+	data, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return 0, "", 0, nil
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("malformed lock file %s", lockPath)
+	}
+	since, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("malformed lock file %s", lockPath)
+	}
+	return pid, fields[1], since, nil
+}
+
+// withRepositoryLock runs fn holding the repository lock, after removing the
+// artefacts an interrupted run may have left
+func withRepositoryLock(fn func() error) error {
+	if err := acquireRepositoryLock(); err != nil {
+		return err
+	}
+	defer releaseRepositoryLock()
+
+	if err := recoverRepository(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// recoverRepository removes the temporary files of interrupted writes and
+// moves the newest checkpoint out of the way if it can not be decoded, as
+// left by versions that wrote checkpoints in place
+func recoverRepository() error {
+	err := filepath.Walk(currentDir+"/.cxo", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasPrefix(info.Name(), tempFilePrefix) {
+			fmt.Printf("removing partial file %s\n", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	checkpoints, err := getCheckpointFiles()
+	if err != nil {
+		return err
+	}
+	if len(checkpoints) == 0 {
+		return nil
+	}
+	filename := checkpoints[len(checkpoints)-1]
+	if _, err := readManifestFile(filename); err != nil {
+		fmt.Printf("moving undecodable checkpoint %s to %s\n", filename, filename+".corrupt")
+		return os.Rename(filename, filename+".corrupt")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryLockAndRecovery(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(repoDir)
+	require.NoError(t, os.MkdirAll(repoDir+manifestCXOFolder, 0700))
+	savedDir := currentDir
+	currentDir = repoDir
+	defer func() { currentDir = savedDir }()
+
+	require.NoError(t, acquireRepositoryLock())
+	err = acquireRepositoryLock()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("locked by process %d", os.Getpid()))
+	require.NoError(t, releaseRepositoryLock())
+
+	// a lock file left by a process that is gone is not locked
+	hostname, _ := os.Hostname()
+	stale := fmt.Sprintf("%d %s 1\n", 1<<30, hostname)
+	require.NoError(t, ioutil.WriteFile(repoDir+manifestLockFile, []byte(stale), 0600))
+	require.NoError(t, acquireRepositoryLock())
+	require.NoError(t, releaseRepositoryLock())
+
+	// a locked file is held even while its owner has not written it yet
+	owner, err := os.OpenFile(repoDir+manifestLockFile, os.O_RDWR|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	require.NoError(t, syscall.Flock(int(owner.Fd()), syscall.LOCK_EX))
+	err = acquireRepositoryLock()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "locked by another process")
+	require.NoError(t, owner.Close())
+	require.NoError(t, acquireRepositoryLock())
+	require.NoError(t, releaseRepositoryLock())
+
+	baseName := getCheckpointBaseName()
+	require.NoError(t, writeFileAtomic(repoDir+manifestCXOFolder+baseName+".cxo", []byte("partial")))
+	require.Equal(t, baseName+"_1", getCheckpointBaseName())
+
+	tempPath := repoDir + manifestCXOFolder + tempFilePrefix + "1"
+	require.NoError(t, ioutil.WriteFile(tempPath, []byte("partial"), 0600))
+	require.NoError(t, withRepositoryLock(func() error { return nil }))
+	_, err = os.Stat(tempPath)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(repoDir + manifestCXOFolder + baseName + ".cxo.corrupt")
+	require.NoError(t, err)
+	_, err = os.Stat(repoDir + manifestLockFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCheckpointOrder(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.MkdirAll(currentDir+manifestCXOFolder, 0700))
+	for _, name := range []string{"100_10", "99", "100_2", "100", "100_1"} {
+		require.NoError(t, ioutil.WriteFile(currentDir+manifestCXOFolder+name+".cxo", nil, 0600))
+	}
+	checkpoints, err := getCheckpointFiles()
+	require.NoError(t, err)
+	var names []string
+	for _, checkpoint := range checkpoints {
+		names = append(names, filepath.Base(checkpoint))
+	}
+	require.Equal(t, []string{"99.cxo", "100.cxo", "100_1.cxo", "100_2.cxo", "100_10.cxo"}, names)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// conflicting files are taken from the checkpoint created last
+	mergePreferNewest = "newest"
+	// conflicting files are taken from the checkpoint of larger sequence id
+	mergePreferSequence = "sequence"
+	// conflicting files fail the merge
+	mergeFail = "fail"
+)
+
+// mergeSource is a checkpoint merged under a prefix of the combined view
+type mergeSource struct {
+	name     string
+	prefix   string
+	manifest *ManifestOuputBody
+}
+
+// mergeFile is a file of the combined view and the checkpoint it comes from
+type mergeFile struct {
+	source       *mergeSource
+	entry        *ManifestFile
+	chunks       []ChunkHash
+	creationDate string
+}
+
+// parseMergeSource reads a checkpoint given as [prefix=]checkpoint, merged
+// under the prefix or at the top of the combined view
+func parseMergeSource(arg string) (*mergeSource, error) {
+	prefix, name := ".", arg
+	if i := strings.Index(arg, "="); i >= 0 {
+		cleaned, err := cleanImportPath(arg[:i])
+		if err != nil {
+			return nil, usageError("invalid prefix of %s: %v", arg, err)
+		}
+		prefix, name = filepath.ToSlash(cleaned), arg[i+1:]
+	}
+	checkpoint, err := getCheckpointFile(name)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &mergeSource{name: name, prefix: prefix, manifest: manifest}, nil
+}
+
+func (s *mergeSource) getMergedPath(relPath string) string {
+	return filepath.ToSlash(filepath.Join(s.prefix, relPath))
+}
+
+// prefers reports whether the files of the source replace those of the other
+// source under the rule. Of checkpoints as new as each other, the one given
+// last is preferred
+func (s *mergeSource) prefers(other *mergeSource, rule string) bool {
+	a, b := &s.manifest.ManifestHeader, &other.manifest.ManifestHeader
+	if rule == mergePreferSequence && a.SequenceId != b.SequenceId {
+		return a.SequenceId > b.SequenceId
+	}
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return true
+}
+
+// getMergeFiles returns the files of the source with their chunks and
+// creation dates, which the FileList of the checkpoint has for the files
+// that are not errored, in order
+func (s *mergeSource) getMergeFiles() ([]*mergeFile, error) {
+	header := &s.manifest.ManifestHeader
+	items := s.manifest.FileList.FileItemList
+	var result []*mergeFile
+	fileList := s.manifest.ManifestBody.ManifestFileList
+	item := 0
+	for i := range fileList {
+		entry := &fileList[i]
+		if entry.FileName == nil {
+			continue
+		}
+		file := &mergeFile{source: s, entry: entry}
+		result = append(result, file)
+		if getFileEntryError(entry) != "" {
+			continue
+		}
+		if item < len(items) {
+			file.creationDate = items[item].Header.CreationDate
+		}
+		item++
+		if len(entry.HashList.ChunksHashes) == 0 {
+			continue
+		}
+		if header.ChunkSize != int64(chunkSize) {
+			return nil, fmt.Errorf("%s has chunks of %d bytes, those of the repository are %d bytes", s.name, header.ChunkSize, chunkSize)
+		}
+		for j, size := range getManifestFileChunkSizes(entry) {
+			file.chunks = append(file.chunks, ChunkHash{Size: uint64(size), Hash: entry.HashList.ChunksHashes[j]})
+		}
+	}
+	return result, nil
+}
+
+// mergeCheckpoints returns the checkpoint of the files of all the sources,
+// each under its prefix. Files at the same path are resolved by the rule,
+// and printed; a file at the path of a directory fails the merge. Sizes,
+// chunk hash sets and their totals are those of the combined files
+func mergeCheckpoints(sources []*mergeSource, rule string, w io.Writer) (*ManifestOuputBody, error) {
+	if rule != mergePreferNewest && rule != mergePreferSequence && rule != mergeFail {
+		return nil, usageError("unknown conflict rule %q, use newest, sequence or fail", rule)
+	}
+	files := make(map[string]*mergeFile)
+	// the source of each directory
+	dirs := map[string]*mergeSource{".": nil}
+	var conflicts []string
+	for _, source := range sources {
+		for dir := source.prefix; dir != "."; dir = filepath.ToSlash(filepath.Dir(dir)) {
+			dirs[dir] = source
+		}
+		root := getCheckpointRoot(source.manifest)
+		fileList := source.manifest.ManifestBody.ManifestFileList
+		for i := range fileList {
+			if entry := &fileList[i]; entry.FileName == nil {
+				dirs[source.getMergedPath(getManifestFileRelPath(root, entry))] = source
+			}
+		}
+		sourceFiles, err := source.getMergeFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range sourceFiles {
+			path := source.getMergedPath(getManifestFileRelPath(root, file.entry))
+			previous := files[path]
+			if previous == nil {
+				files[path] = file
+				continue
+			}
+			if string(previous.entry.HashList.FileHash.Hash) == string(file.entry.HashList.FileHash.Hash) && previous.entry.Size == file.entry.Size {
+				continue
+			}
+			if rule == mergeFail {
+				conflicts = append(conflicts, fmt.Sprintf("%s differs in %s and %s", path, previous.source.name, source.name))
+				continue
+			}
+			winner, loser := previous, file
+			if source.prefers(previous.source, rule) {
+				winner, loser = file, previous
+			}
+			files[path] = winner
+			fmt.Fprintf(w, "conflict %s: kept from %s, not from %s\n", path, winner.source.name, loser.source.name)
+		}
+	}
+	for path, file := range files {
+		if dirs[path] != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s is a file in %s and a directory in %s", path, file.source.name, dirs[path].name))
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, fmt.Errorf("%d conflicts:\n%s", len(conflicts), strings.Join(conflicts, "\n"))
+	}
+
+	var fList FilesInfoList
+	var metaStrings [][]byte
+	dirSizes := make(map[string]int)
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return lessPathComponents(strings.Split(paths[i], "/"), strings.Split(paths[j], "/"))
+	})
+	for _, path := range paths {
+		file := files[path]
+		for dir := filepath.ToSlash(filepath.Dir(path)); ; dir = filepath.ToSlash(filepath.Dir(dir)) {
+			dirSizes[dir] += int(file.entry.Size)
+			if dir == "." {
+				break
+			}
+		}
+		fList.fileNames = append(fList.fileNames, path)
+		fList.fileSizes = append(fList.fileSizes, int(file.entry.Size))
+		fList.filesHashlist = append(fList.filesHashlist, file.entry.HashList.FileHash)
+		fList.filesMetaList = append(fList.filesMetaList, FileMeta{})
+		fList.filesChunksList = append(fList.filesChunksList, file.chunks)
+		fList.filesCreationDateList = append(fList.filesCreationDateList, file.creationDate)
+		fList.filesErrorList = append(fList.filesErrorList, getFileEntryError(file.entry))
+		metaStrings = append(metaStrings, file.entry.MetaString)
+	}
+	for dir := range dirs {
+		fList.directoryNames = append(fList.directoryNames, dir)
+	}
+	sort.Strings(fList.directoryNames)
+	for _, dir := range fList.directoryNames {
+		fList.diretorySizes = append(fList.diretorySizes, dirSizes[dir])
+	}
+	filesList = &fList
+
+	body, err := getManifestOutputBody(&fList)
+	if err != nil {
+		return nil, err
+	}
+	// the holes, unknown sizes and errors of the entries are kept as they are
+	for i, metaString := range metaStrings {
+		body.ManifestBody.ManifestFileList[i].MetaString = metaString
+	}
+	setDirectoryHashes(currentDir, &body.ManifestBody)
+	var merged []string
+	for _, source := range sources {
+		merged = append(merged, source.prefix+"="+filepath.Base(source.name))
+	}
+	body.ManifestHeader.MetaDataTags.Add(KeyValueByte{[]byte("merged-from"), []byte(strings.Join(merged, ","))})
+	headerMeta, err := getManifestHeaderMetaData(&body.ManifestHeader)
+	if err != nil {
+		return nil, err
+	}
+	manifestMeta.ManifestHeaderMeta = *headerMeta
+	return body, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getMergeTestFiles(body *ManifestOuputBody) map[string]*ManifestFile {
+	result := make(map[string]*ManifestFile)
+	fileList := body.ManifestBody.ManifestFileList
+	for i := range fileList {
+		result[getManifestFileRelPath(currentDir, &fileList[i])] = &fileList[i]
+	}
+	return result
+}
+
+func TestMergeCheckpoints(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.Mkdir("sub", 0700))
+	require.NoError(t, ioutil.WriteFile("a", bytes.Repeat([]byte("a"), chunkSize+10), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "b"), []byte("first b"), 0600))
+	first, err := parseMergeSource("disk1=" + commitTestRepository(t))
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "b"), []byte("second b"), 0600))
+	require.NoError(t, ioutil.WriteFile("c", []byte("c"), 0600))
+	second, err := parseMergeSource("disk/2=" + commitTestRepository(t))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	body, err := mergeCheckpoints([]*mergeSource{first, second}, mergeFail, &out)
+	require.NoError(t, err)
+	require.Empty(t, out.String())
+	files := getMergeTestFiles(body)
+	for _, path := range []string{".", "disk1", "disk1/sub", "disk", "disk/2", "disk/2/sub"} {
+		require.NotNil(t, files[path], path)
+		require.Nil(t, files[path].FileName, path)
+	}
+	require.Equal(t, int64(len("first b")), files["disk1/sub/b"].Size)
+	require.Equal(t, int64(len("second b")), files["disk/2/sub/b"].Size)
+	require.Nil(t, files["disk1/c"])
+	require.NotNil(t, files["disk/2/c"])
+
+	total := 2*(chunkSize+10) + len("first b") + len("second b") + len("c")
+	require.Equal(t, uint64(total), body.ManifestHeader.BodyDataFileSize)
+	require.Equal(t, int64(total), files["."].Size)
+	require.Equal(t, int64(len("second b")+len("c")+chunkSize+10), files["disk/2"].Size)
+	// two chunks for each copy of a, one for each other file
+	require.Equal(t, int64(7), manifestMeta.ChunkHashSetListMeta.HashCountTotal)
+	require.Equal(t, []int64{int64(total)}, manifestMeta.ChunkHashSetListMeta.ChunkSetDataSizeList)
+	require.Len(t, manifestTemp.HashSet.HashSet, 7)
+	require.Len(t, files["disk1/a"].HashList.ChunksHashes, 2)
+
+	// the same files at the top conflict
+	first.prefix, second.prefix = ".", "."
+	_, err = mergeCheckpoints([]*mergeSource{first, second}, mergeFail, &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sub/b differs")
+
+	body, err = mergeCheckpoints([]*mergeSource{first, second}, mergePreferNewest, &out)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "conflict sub/b: kept from")
+	require.Equal(t, int64(len("second b")), getMergeTestFiles(body)["sub/b"].Size)
+
+	out.Reset()
+	body, err = mergeCheckpoints([]*mergeSource{second, first}, mergePreferSequence, &out)
+	require.NoError(t, err)
+	require.Equal(t, int64(len("second b")), getMergeTestFiles(body)["sub/b"].Size)
+
+	// a file where the other checkpoint has a directory always conflicts
+	require.NoError(t, os.RemoveAll("sub"))
+	require.NoError(t, ioutil.WriteFile("sub", []byte("file"), 0600))
+	third, err := parseMergeSource(commitTestRepository(t))
+	require.NoError(t, err)
+	_, err = mergeCheckpoints([]*mergeSource{first, third}, mergePreferNewest, &out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sub is a file")
+
+	_, err = mergeCheckpoints([]*mergeSource{first}, "largest", &out)
+	require.Equal(t, exitUsage, getExitCode(err))
+	_, err = parseMergeSource("../up=latest")
+	require.Equal(t, exitUsage, getExitCode(err))
+}
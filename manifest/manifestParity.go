@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	parityFileMagic   = "CXOPARIT"
+	parityFileVersion = 1
+	// magic followed by the uint64 length of the serialized header
+	parityFilePrefixSize = 16
+	// size of a shard, a stripe of a storage block is DataShards shards long
+	parityShardSize     = 65536
+	defaultDataShards   = 10
+	defaultParityShards = 2
+)
+
+// parityFile holds the Reed-Solomon parity shards of one storage block.
+// The block is split into stripes of DataShards shards each, and every stripe
+// records the hash of each of its data and parity shards so damaged shards
+// can be located.
+type parityFile struct {
+	file   *os.File
+	header ParityFileHeader
+	// offset of the first stripe in the file
+	stripesStart uint64
+}
+
+func (s *chunkStore) parityPath(blockPath string) string {
+	name := strings.TrimSuffix(filepath.Base(blockPath), ".blk")
+	return filepath.Join(s.parityDir, name+".par")
+}
+
+// writeParity computes the parity of every storage block that has none yet,
+// returning the number of parity files written
+func (s *chunkStore) writeParity(dataShards int, parityShards int) (int, error) {
+	count := 0
+	for _, block := range s.blocks {
+		if _, err := os.Stat(s.parityPath(block.path)); err == nil {
+			continue
+		}
+		if err := s.writeBlockParity(block, dataShards, parityShards); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (s *chunkStore) writeBlockParity(block *storageBlock, dataShards int, parityShards int) error {
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	stripeSize := uint64(dataShards) * parityShardSize
+	header := ParityFileHeader{
+		Version:      parityFileVersion,
+		BlockSize:    uint64(len(block.data)),
+		DataShards:   uint32(dataShards),
+		ParityShards: uint32(parityShards),
+		ShardSize:    parityShardSize,
+		StripeCount:  (uint64(len(block.data)) + stripeSize - 1) / stripeSize,
+	}
+	header.StripeLength = uint64(len(encoder.Serialize(ParityStripe{
+		ShardHashes: make([][]byte, dataShards+parityShards),
+		Parity:      make([][]byte, parityShards),
+	}))) + uint64(dataShards+parityShards)*sha256.Size + uint64(parityShards)*parityShardSize
+
+	if err := os.MkdirAll(s.parityDir, os.ModePerm); err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(s.parityDir, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if _, err := tempFile.Write(getParityFilePrefix(&header)); err != nil {
+		return err
+	}
+	for stripe := uint64(0); stripe < header.StripeCount; stripe++ {
+		shards := make([][]byte, dataShards+parityShards)
+		for i := range shards {
+			shards[i] = make([]byte, parityShardSize)
+		}
+		start := stripe * stripeSize
+		for i := 0; i < dataShards; i++ {
+			offset := start + uint64(i)*parityShardSize
+			if offset < uint64(len(block.data)) {
+				copy(shards[i], block.data[offset:])
+			}
+		}
+		if err := enc.Encode(shards); err != nil {
+			return err
+		}
+
+		var parityStripe ParityStripe
+		for _, shard := range shards {
+			h := sha256.Sum256(shard)
+			parityStripe.ShardHashes = append(parityStripe.ShardHashes, h[:])
+		}
+		parityStripe.Parity = shards[dataShards:]
+		serializedStripe := encoder.Serialize(parityStripe)
+		if uint64(len(serializedStripe)) != header.StripeLength {
+			return fmt.Errorf("unexpected parity stripe length %d", len(serializedStripe))
+		}
+		if _, err := tempFile.Write(serializedStripe); err != nil {
+			return err
+		}
+	}
+
+	if err := tempFile.Sync(); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), s.parityPath(block.path))
+}
+
+func getParityFilePrefix(header *ParityFileHeader) []byte {
+	serializedHeader := encoder.Serialize(*header)
+	prefix := make([]byte, parityFilePrefixSize)
+	copy(prefix, parityFileMagic)
+	binary.LittleEndian.PutUint64(prefix[len(parityFileMagic):], uint64(len(serializedHeader)))
+	return append(prefix, serializedHeader...)
+}
+
+func openParityFile(path string) (*parityFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &parityFile{file: file}
+
+	prefix := make([]byte, parityFilePrefixSize)
+	if _, err := io.ReadFull(file, prefix); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("parity file %s: %w", path, err)
+	}
+	if string(prefix[:len(parityFileMagic)]) != parityFileMagic {
+		file.Close()
+		return nil, fmt.Errorf("parity file %s: bad magic", path)
+	}
+	headerBytes := make([]byte, binary.LittleEndian.Uint64(prefix[len(parityFileMagic):]))
+	if _, err := io.ReadFull(file, headerBytes); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("parity file %s: %w", path, err)
+	}
+	if err := encoder.DeserializeRawExact(headerBytes, &result.header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("parity file %s: %w", path, err)
+	}
+	result.stripesStart = parityFilePrefixSize + uint64(len(headerBytes))
+	return result, nil
+}
+
+func (p *parityFile) close() error {
+	return p.file.Close()
+}
+
+func (p *parityFile) readStripe(stripe uint64) (*ParityStripe, error) {
+	var result ParityStripe
+	buf := make([]byte, p.header.StripeLength)
+	if _, err := p.file.ReadAt(buf, int64(p.stripesStart+stripe*p.header.StripeLength)); err != nil {
+		return nil, err
+	}
+	if err := encoder.DeserializeRawExact(buf, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// readBlockShards reads the data shards of a stripe from the block file.
+// Shards past the end of the block are zero, shards that can not be read or
+// do not match their hash are nil.
+func (p *parityFile) readBlockShards(block *os.File, stripe uint64, parityStripe *ParityStripe) ([][]byte, error) {
+	dataShards := int(p.header.DataShards)
+	shards := make([][]byte, dataShards+int(p.header.ParityShards))
+	start := stripe * uint64(dataShards) * p.header.ShardSize
+
+	for i := 0; i < dataShards; i++ {
+		shard := make([]byte, p.header.ShardSize)
+		offset := start + uint64(i)*p.header.ShardSize
+		if offset < p.header.BlockSize {
+			length := p.header.BlockSize - offset
+			if length > p.header.ShardSize {
+				length = p.header.ShardSize
+			}
+			n, err := block.ReadAt(shard[:length], int64(offset))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if uint64(n) < length {
+				continue
+			}
+		}
+		h := sha256.Sum256(shard)
+		if bytes.Equal(h[:], parityStripe.ShardHashes[i]) {
+			shards[i] = shard
+		}
+	}
+	for i, shard := range parityStripe.Parity {
+		h := sha256.Sum256(shard)
+		if bytes.Equal(h[:], parityStripe.ShardHashes[dataShards+i]) {
+			shards[dataShards+i] = shard
+		}
+	}
+	return shards, nil
+}
+
+// checkBlockParity returns the stripes of the block file that do not match
+// the parity file
+func (s *chunkStore) checkBlockParity(blockPath string) ([]uint64, error) {
+	var result []uint64
+	parity, err := openParityFile(s.parityPath(blockPath))
+	if err != nil {
+		return nil, err
+	}
+	defer parity.close()
+	block, err := os.Open(blockPath)
+	if os.IsNotExist(err) {
+		for stripe := uint64(0); stripe < parity.header.StripeCount; stripe++ {
+			result = append(result, stripe)
+		}
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer block.Close()
+
+	for stripe := uint64(0); stripe < parity.header.StripeCount; stripe++ {
+		parityStripe, err := parity.readStripe(stripe)
+		if err != nil {
+			result = append(result, stripe)
+			continue
+		}
+		shards, err := parity.readBlockShards(block, stripe, parityStripe)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range shards {
+			if shard == nil {
+				result = append(result, stripe)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// repairBlock reconstructs the damaged stripes of a block file from its
+// parity, returning the number of stripes repaired
+func (s *chunkStore) repairBlock(blockPath string) (int, error) {
+	parity, err := openParityFile(s.parityPath(blockPath))
+	if err != nil {
+		return 0, err
+	}
+	defer parity.close()
+	enc, err := reedsolomon.New(int(parity.header.DataShards), int(parity.header.ParityShards))
+	if err != nil {
+		return 0, err
+	}
+
+	block, err := os.OpenFile(blockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer block.Close()
+
+	repaired := 0
+	for stripe := uint64(0); stripe < parity.header.StripeCount; stripe++ {
+		parityStripe, err := parity.readStripe(stripe)
+		if err != nil {
+			// the data is checked against the chunk hashes after the repair
+			continue
+		}
+		shards, err := parity.readBlockShards(block, stripe, parityStripe)
+		if err != nil {
+			return repaired, err
+		}
+		damaged := false
+		for _, shard := range shards[:parity.header.DataShards] {
+			if shard == nil {
+				damaged = true
+			}
+		}
+		if !damaged {
+			continue
+		}
+		if err := enc.ReconstructData(shards); err != nil {
+			return repaired, fmt.Errorf("stripe %d: %w", stripe, err)
+		}
+
+		start := stripe * uint64(parity.header.DataShards) * parity.header.ShardSize
+		for i, shard := range shards[:parity.header.DataShards] {
+			offset := start + uint64(i)*parity.header.ShardSize
+			if offset >= parity.header.BlockSize {
+				break
+			}
+			length := parity.header.BlockSize - offset
+			if length > parity.header.ShardSize {
+				length = parity.header.ShardSize
+			}
+			if _, err := block.WriteAt(shard[:length], int64(offset)); err != nil {
+				return repaired, err
+			}
+		}
+		repaired++
+	}
+
+	if err := block.Truncate(int64(parity.header.BlockSize)); err != nil {
+		return repaired, err
+	}
+	return repaired, block.Sync()
+}
+
+// repairBlocks rebuilds the damaged storage blocks from their parity and
+// recomputes parity that is damaged itself. A block that can not be repaired
+// is reported to w and the next one is tried. It returns the number of blocks
+// repaired, and an error if some could not be
+func (s *chunkStore) repairBlocks(blockPaths []string, w io.Writer) (repaired int, err error) {
+	if err := s.closeStorageBlocks(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if loadErr := s.loadStorageBlocks(); err == nil {
+			err = loadErr
+		}
+	}()
+
+	for _, blockPath := range blockPaths {
+		if err := s.repairStorageBlock(blockPath); err != nil {
+			fmt.Fprintf(w, "storage block %s can not be repaired: %v\n", blockPath, err)
+			continue
+		}
+		repaired++
+	}
+	if repaired < len(blockPaths) {
+		return repaired, verifyError("%d of %d damaged storage blocks could not be repaired", len(blockPaths)-repaired, len(blockPaths))
+	}
+	return repaired, nil
+}
+
+// repairStorageBlock rebuilds a storage block from its parity and checks it
+func (s *chunkStore) repairStorageBlock(blockPath string) error {
+	parity, err := openParityFile(s.parityPath(blockPath))
+	if err != nil {
+		return err
+	}
+	dataShards, parityShards := int(parity.header.DataShards), int(parity.header.ParityShards)
+	parity.close()
+
+	if _, err := s.repairBlock(blockPath); err != nil {
+		return err
+	}
+	block, err := openStorageBlock(blockPath)
+	if err != nil {
+		return err
+	}
+	defer block.close()
+	badChunks, err := block.verify()
+	if err != nil {
+		return err
+	}
+	if len(badChunks) > 0 {
+		return fmt.Errorf("%d chunks still damaged after repair", len(badChunks))
+	}
+	badStripes, err := s.checkBlockParity(blockPath)
+	if err == nil && len(badStripes) > 0 {
+		err = s.writeBlockParity(block, dataShards, parityShards)
+	}
+	return err
+}
+
+// repairChunks rewrites the damaged loose chunks from the files of the
+// directory that still have them, as recorded by the checkpoints, newest
+// first. Chunks of storage blocks are repaired with their block. It returns
+// the number of chunks rewritten and the hashes of those no file has
+func (s *chunkStore) repairChunks(hashes [][]byte) (int, [][]byte, error) {
+	damaged := make(map[string]bool)
+	for _, hash := range hashes {
+		if _, ok := s.blockIndex[string(hash)]; !ok {
+			damaged[string(hash)] = true
+		}
+	}
+	repaired := 0
+	checkpoints, err := getCheckpointFiles()
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := len(checkpoints) - 1; i >= 0 && len(damaged) > 0; i-- {
+		manifest, err := readManifestFile(checkpoints[i])
+		if err != nil {
+			return repaired, nil, err
+		}
+		root := getCheckpointRoot(manifest)
+		fileList := manifest.ManifestBody.ManifestFileList
+		for j := range fileList {
+			entry := &fileList[j]
+			if entry.FileName == nil || getFileEntryError(entry) != "" || !hasChunkHashes(entry) {
+				continue
+			}
+			relPath := getManifestFileRelPath(root, entry)
+			sizes := getManifestFileChunkSizes(entry)
+			for index, hash := range entry.HashList.ChunksHashes {
+				if !damaged[string(hash)] {
+					continue
+				}
+				// the file changed or is gone, another one may still have it
+				data, err := readCheckpointChunk(nil, relPath, hash, index, sizes[index])
+				if err != nil {
+					continue
+				}
+				if err := s.writeChunk(hash, data); err != nil {
+					return repaired, nil, err
+				}
+				delete(damaged, string(hash))
+				repaired++
+			}
+		}
+	}
+	var missing [][]byte
+	for _, hash := range hashes {
+		if damaged[string(hash)] {
+			missing = append(missing, hash)
+		}
+	}
+	return repaired, missing, nil
+}
+
+// scrub reads every stored chunk and storage block and reports the damage found
+func (s *chunkStore) scrub() (*ScrubReport, error) {
+	var result ScrubReport
+
+	err := s.backend.List(func(hash []byte, size int64) error {
+		if _, err := s.get(hash); err != nil {
+			result.BadChunks = append(result.BadChunks, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	blockPaths, err := s.getBlockPaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, blockPath := range blockPaths {
+		damaged := false
+		block, err := openStorageBlock(blockPath)
+		if err != nil {
+			damaged = true
+		} else {
+			badChunks, err := block.verify()
+			if err != nil || len(badChunks) > 0 {
+				damaged = true
+			}
+			result.BadChunks = append(result.BadChunks, badChunks...)
+			block.close()
+		}
+
+		if _, err := os.Stat(s.parityPath(blockPath)); err != nil {
+			result.UnprotectedBlocks = append(result.UnprotectedBlocks, blockPath)
+		} else {
+			badStripes, err := s.checkBlockParity(blockPath)
+			if err != nil {
+				return nil, err
+			}
+			if len(badStripes) > 0 {
+				damaged = true
+			}
+		}
+		if damaged {
+			result.BadBlocks = append(result.BadBlocks, blockPath)
+		}
+	}
+	return &result, nil
+}
+
+// getBlockPaths returns the block files in the store, including the ones
+// that can not be opened
+func (s *chunkStore) getBlockPaths() ([]string, error) {
+	var result []string
+	files, err := ioutil.ReadDir(s.blocksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".blk") {
+			result = append(result, filepath.Join(s.blocksDir, file.Name()))
+		}
+	}
+	parityFiles, err := ioutil.ReadDir(s.parityDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// blocks that are missing entirely can still be rebuilt from their parity
+	for _, file := range parityFiles {
+		if !strings.HasSuffix(file.Name(), ".par") {
+			continue
+		}
+		blockPath := filepath.Join(s.blocksDir, strings.TrimSuffix(file.Name(), ".par")+".blk")
+		if _, err := os.Stat(blockPath); os.IsNotExist(err) {
+			result = append(result, blockPath)
+		}
+	}
+	return result, nil
+}
+
+// parityStats returns the total size of the storage blocks and of their parity
+func (s *chunkStore) parityStats() (int64, int64, error) {
+	var blocksSize, paritySize int64
+	for _, block := range s.blocks {
+		blocksSize += int64(len(block.data))
+		info, err := os.Stat(s.parityPath(block.path))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		paritySize += info.Size()
+	}
+	return blocksSize, paritySize, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	crtRand "crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParityScrubAndRepair(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "parity")
+	require.NoError(t, err)
+	defer os.RemoveAll(repoDir)
+	require.NoError(t, os.Mkdir(repoDir+"/.cxo", 0700))
+
+	store, err := openChunkStore(repoDir)
+	require.NoError(t, err)
+	defer store.close()
+
+	for i := 0; i < 8; i++ {
+		data := make([]byte, chunkSize)
+		_, err := crtRand.Read(data)
+		require.NoError(t, err)
+		require.NoError(t, store.put(hashChunkData(data), data))
+	}
+	_, err = store.pack(defaultBlockSizeMB << 20)
+	require.NoError(t, err)
+	count, err := store.writeParity(4, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	report, err := store.scrub()
+	require.NoError(t, err)
+	require.Empty(t, report.BadBlocks)
+
+	blockPath := store.blocks[0].path
+	file, err := os.OpenFile(blockPath, os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("bit rot"), 300000)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("more bit rot"), 1500000)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	report, err = store.scrub()
+	require.NoError(t, err)
+	require.Equal(t, []string{blockPath}, report.BadBlocks)
+	require.Len(t, report.BadChunks, 2)
+
+	repaired, err := store.repairBlocks(report.BadBlocks, ioutil.Discard)
+	require.NoError(t, err)
+	require.Equal(t, 1, repaired)
+	report, err = store.scrub()
+	require.NoError(t, err)
+	require.Empty(t, report.BadBlocks)
+	require.Empty(t, report.BadChunks)
+}
+
+func TestRepairBlocksContinuesAfterFailure(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "parity")
+	require.NoError(t, err)
+	defer os.RemoveAll(repoDir)
+	require.NoError(t, os.Mkdir(repoDir+"/.cxo", 0700))
+
+	store, err := openChunkStore(repoDir)
+	require.NoError(t, err)
+	defer store.close()
+
+	for i := 0; i < 8; i++ {
+		data := make([]byte, chunkSize)
+		_, err := crtRand.Read(data)
+		require.NoError(t, err)
+		require.NoError(t, store.put(hashChunkData(data), data))
+	}
+	_, err = store.pack(uint64(4*chunkSize + 4096))
+	require.NoError(t, err)
+	count, err := store.writeParity(4, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// the first block loses its parity, both blocks are damaged
+	var blockPaths []string
+	for _, block := range store.blocks {
+		blockPaths = append(blockPaths, block.path)
+	}
+	require.NoError(t, os.Remove(store.parityPath(blockPaths[0])))
+	for _, blockPath := range blockPaths {
+		file, err := os.OpenFile(blockPath, os.O_WRONLY, 0600)
+		require.NoError(t, err)
+		_, err = file.WriteAt([]byte("bit rot"), 300000)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+	report, err := store.scrub()
+	require.NoError(t, err)
+	require.Len(t, report.BadBlocks, 2)
+
+	var out bytes.Buffer
+	repaired, err := store.repairBlocks(report.BadBlocks, &out)
+	require.Equal(t, exitVerify, getExitCode(err))
+	require.Equal(t, 1, repaired)
+	require.Contains(t, out.String(), blockPaths[0])
+	report, err = store.scrub()
+	require.NoError(t, err)
+	require.Equal(t, []string{blockPaths[0]}, report.BadBlocks)
+}
+
+func TestRepairLooseChunks(t *testing.T) {
+	defer setupTestRepository(t)()
+	store, err := openChunkStore(currentDir)
+	require.NoError(t, err)
+	defer store.close()
+	data := make([]byte, 2*chunkSize)
+	_, err = crtRand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile("a", data, 0600))
+	chunks = store
+	commitTestRepository(t)
+	chunks = nil
+
+	hash := hashChunkData(data[chunkSize:])
+	objectPath := store.backend.(*localChunkStore).chunkPath(hash)
+	require.NoError(t, ioutil.WriteFile(objectPath, []byte("bit rot"), 0600))
+	report, err := store.scrub()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{hash}, report.BadChunks)
+
+	// the chunk is read again from the file
+	repaired, missing, err := store.repairChunks(report.BadChunks)
+	require.NoError(t, err)
+	require.Equal(t, 1, repaired)
+	require.Empty(t, missing)
+	report, err = store.scrub()
+	require.NoError(t, err)
+	require.Empty(t, report.BadChunks)
+
+	// unless the file changed since
+	require.NoError(t, ioutil.WriteFile(objectPath, []byte("bit rot"), 0600))
+	require.NoError(t, ioutil.WriteFile("a", data[:chunkSize], 0600))
+	repaired, missing, err = store.repairChunks([][]byte{hash})
+	require.NoError(t, err)
+	require.Equal(t, 0, repaired)
+	require.Equal(t, [][]byte{hash}, missing)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const progressInterval = time.Second
+
+// progressReporter periodically reports how far a scan of the directory got,
+// on the terminal and/or as JSON lines on stderr
+type progressReporter struct {
+	totalFiles int64
+	totalBytes int64
+	// updated atomically while hashing
+	files int64
+	bytes int64
+
+	startTime time.Time
+	terminal  bool
+	json      bool
+	stopped   chan struct{}
+	finished  chan struct{}
+}
+
+func newProgressReporter(totalFiles int64, totalBytes int64, terminal bool, jsonLines bool) *progressReporter {
+	return &progressReporter{
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		startTime:  time.Now(),
+		terminal:   terminal,
+		json:       jsonLines,
+		stopped:    make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+}
+
+func (p *progressReporter) addFile() {
+	atomic.AddInt64(&p.files, 1)
+}
+
+func (p *progressReporter) addBytes(n int) {
+	atomic.AddInt64(&p.bytes, int64(n))
+}
+
+func (p *progressReporter) start() {
+	go func() {
+		defer close(p.finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report(false)
+			case <-p.stopped:
+				p.report(true)
+				return
+			}
+		}
+	}()
+}
+
+func (p *progressReporter) stop() {
+	close(p.stopped)
+	<-p.finished
+}
+
+func (p *progressReporter) getEvent(done bool) ProgressEvent {
+	result := ProgressEvent{
+		Files:      atomic.LoadInt64(&p.files),
+		TotalFiles: p.totalFiles,
+		Bytes:      atomic.LoadInt64(&p.bytes),
+		TotalBytes: p.totalBytes,
+		Elapsed:    time.Since(p.startTime).Seconds(),
+		Done:       done,
+	}
+	if result.Elapsed > 0 {
+		result.BytesPerSecond = float64(result.Bytes) / result.Elapsed
+	}
+	if result.BytesPerSecond > 0 && result.TotalBytes > result.Bytes {
+		result.ETA = float64(result.TotalBytes-result.Bytes) / result.BytesPerSecond
+	}
+	return result
+}
+
+func (p *progressReporter) report(done bool) {
+	event := p.getEvent(done)
+	if p.json {
+		line, err := json.Marshal(event)
+		if err == nil {
+			fmt.Fprintln(os.Stderr, string(line))
+		}
+	}
+	if p.terminal {
+		percent := 100.0
+		if event.TotalBytes > 0 {
+			percent = float64(event.Bytes) * 100 / float64(event.TotalBytes)
+		}
+		fmt.Fprintf(os.Stderr, "\r%d/%d files  %s/%s (%.1f%%)  %s/s  ETA %s   ",
+			event.Files, event.TotalFiles, formatBytes(event.Bytes), formatBytes(event.TotalBytes), percent,
+			formatBytes(int64(event.BytesPerSecond)), (time.Duration(event.ETA) * time.Second).String())
+		if done {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// countFiles returns the number and total size of the files the scan of the
+// directory will read, ignoring errors the scan itself reports
+func countFiles(ctx context.Context, dir string) (int64, int64, error) {
+	var files, size int64
+	rules, err := loadIgnoreRules(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if info.Name() == ".cxo" || rules.isIgnored(path, true) {
+				return filepath.SkipDir
+			}
+		} else if info.Name() != appName && !rules.isIgnored(path, false) {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// getInterruptContext returns a context that is cancelled on SIGINT or SIGTERM
+func getInterruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			fmt.Fprintln(os.Stderr, "\ninterrupted, finishing the current file")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
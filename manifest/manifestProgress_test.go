@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressAndCancellation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "progress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, chunkSize+10), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("hello"), 0600))
+
+	totalFiles, totalBytes, err := countFiles(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), totalFiles)
+	require.Equal(t, int64(chunkSize+15), totalBytes)
+
+	progress = newProgressReporter(totalFiles, totalBytes, false, false)
+	defer func() { progress = nil }()
+	_, err = processDirAndGenerateMeta(context.Background(), dir)
+	require.NoError(t, err)
+	event := progress.getEvent(true)
+	require.Equal(t, totalFiles, event.Files)
+	require.Equal(t, totalBytes, event.Bytes)
+	require.Equal(t, float64(0), event.ETA)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = processDirAndGenerateMeta(ctx, dir)
+	require.Equal(t, context.Canceled, err)
+}
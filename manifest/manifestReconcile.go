@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ibltVersion = 1
+	// size of the keys of the table, the chunk hashes
+	ibltKeySize = 32
+	// number of cells each key is added to, one in each part of the table
+	ibltHashCount = 3
+	// largest message of the reconcile protocol
+	maxReconcileMessage = 64 << 20
+	// serialized size of a cell of a sketch, its count, key sum and hash
+	// sum, and of the other fields of the sketch
+	ibltCellSize       = 8 + ibltKeySize + 8
+	ibltSketchOverhead = 4 + 8 + 3*4
+	// cells of the first sketch asked for, doubled until the difference
+	// decodes, up to the largest sketch a message holds, about 1.4M cells
+	// for differences of about 900K hashes
+	minIBLTCells = 60
+	maxIBLTCells = (maxReconcileMessage - ibltSketchOverhead) / ibltCellSize / ibltHashCount * ibltHashCount
+)
+
+// iblt is an invertible Bloom lookup table of a set of chunk hashes. The table
+// of a set minus the table of another set, of the same size, holds their
+// difference, which decodes if the table has about 1.5 cells per hash in the
+// difference, whatever the size of the sets
+type iblt struct {
+	counts   []int64
+	keySums  [][ibltKeySize]byte
+	hashSums []uint64
+}
+
+// reconcileStats is what reconciling two sets cost
+type reconcileStats struct {
+	// sketches received and their total number of cells and bytes
+	rounds int
+	cells  int
+	bytes  int
+}
+
+// sketchSource returns the sketch of a set with the number of cells
+type sketchSource func(cells int) (*IBLTSketch, error)
+
+func newIBLT(cells int) *iblt {
+	// the cells are split in one part per hash function
+	cells = (cells + ibltHashCount - 1) / ibltHashCount * ibltHashCount
+	return &iblt{
+		counts:   make([]int64, cells),
+		keySums:  make([][ibltKeySize]byte, cells),
+		hashSums: make([]uint64, cells),
+	}
+}
+
+// newSetIBLT returns the table of a set of chunk hashes
+func newSetIBLT(set [][]byte, cells int) *iblt {
+	result := newIBLT(cells)
+	for _, key := range set {
+		result.add(key, 1)
+	}
+	return result
+}
+
+// mixIBLTHash is the finalizer of splitmix64
+func mixIBLTHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// getIBLTHashes returns the checksum of a key and the cells it is added to
+func (t *iblt) getIBLTHashes(key []byte) (uint64, [ibltHashCount]int) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	part := len(t.counts) / ibltHashCount
+	var cells [ibltHashCount]int
+	for i := range cells {
+		cells[i] = i*part + int(mixIBLTHash(sum+uint64(i+1)*0x9e3779b97f4a7c15)%uint64(part))
+	}
+	return mixIBLTHash(sum), cells
+}
+
+func (t *iblt) add(key []byte, count int64) {
+	checksum, cells := t.getIBLTHashes(key)
+	for _, cell := range cells {
+		t.counts[cell] += count
+		t.hashSums[cell] ^= checksum
+		for i := range key {
+			t.keySums[cell][i] ^= key[i]
+		}
+	}
+}
+
+// subtract removes the keys of the other table, of the same size
+func (t *iblt) subtract(other *iblt) error {
+	if len(other.counts) != len(t.counts) {
+		return fmt.Errorf("tables of %d and %d cells can not be subtracted", len(t.counts), len(other.counts))
+	}
+	for cell := range t.counts {
+		t.counts[cell] -= other.counts[cell]
+		t.hashSums[cell] ^= other.hashSums[cell]
+		for i := range t.keySums[cell] {
+			t.keySums[cell][i] ^= other.keySums[cell][i]
+		}
+	}
+	return nil
+}
+
+// decode lists the keys of the table, those added and those subtracted, and
+// reports whether all of them could be listed. It empties the table
+func (t *iblt) decode() ([][]byte, [][]byte, bool) {
+	var added, subtracted [][]byte
+	for progress := true; progress; {
+		progress = false
+		for cell := range t.counts {
+			count := t.counts[cell]
+			if count != 1 && count != -1 {
+				continue
+			}
+			key := t.keySums[cell]
+			if checksum, _ := t.getIBLTHashes(key[:]); checksum != t.hashSums[cell] {
+				continue
+			}
+			if count == 1 {
+				added = append(added, key[:])
+			} else {
+				subtracted = append(subtracted, key[:])
+			}
+			t.add(key[:], -count)
+			progress = true
+		}
+	}
+	for cell := range t.counts {
+		if t.counts[cell] != 0 || t.hashSums[cell] != 0 || t.keySums[cell] != [ibltKeySize]byte{} {
+			return added, subtracted, false
+		}
+	}
+	SortByteArrays(added)
+	SortByteArrays(subtracted)
+	return added, subtracted, true
+}
+
+func (t *iblt) toSketch(setSize int) *IBLTSketch {
+	result := IBLTSketch{
+		Version:  ibltVersion,
+		SetSize:  uint64(setSize),
+		Counts:   t.counts,
+		KeySums:  make([]byte, 0, len(t.keySums)*ibltKeySize),
+		HashSums: t.hashSums,
+	}
+	for _, keySum := range t.keySums {
+		result.KeySums = append(result.KeySums, keySum[:]...)
+	}
+	return &result
+}
+
+func newIBLTFromSketch(sketch *IBLTSketch) (*iblt, error) {
+	cells := len(sketch.Counts)
+	if sketch.Version != ibltVersion || cells == 0 || cells%ibltHashCount != 0 ||
+		len(sketch.HashSums) != cells || len(sketch.KeySums) != cells*ibltKeySize {
+		return nil, errors.New("invalid sketch")
+	}
+	result := iblt{counts: sketch.Counts, hashSums: sketch.HashSums, keySums: make([][ibltKeySize]byte, cells)}
+	for cell := range result.keySums {
+		copy(result.keySums[cell][:], sketch.KeySums[cell*ibltKeySize:])
+	}
+	return &result, nil
+}
+
+// getDistinctHashes returns the distinct hashes of a sorted hash set
+func getDistinctHashes(set [][]byte) ([][]byte, error) {
+	var result [][]byte
+	for i, hash := range set {
+		if len(hash) != ibltKeySize {
+			return nil, fmt.Errorf("hash of %d bytes in the hash set, %d expected", len(hash), ibltKeySize)
+		}
+		if i == 0 || !bytes.Equal(hash, set[i-1]) {
+			result = append(result, hash)
+		}
+	}
+	return result, nil
+}
+
+// reconcileHashSets returns the hashes only the local set has and those only
+// the remote one has. It asks the remote side for sketches of its set, twice
+// as large each time, until the difference decodes, so what is exchanged is
+// proportional to the size of the difference
+func reconcileHashSets(local [][]byte, remote sketchSource) ([][]byte, [][]byte, reconcileStats, error) {
+	var stats reconcileStats
+	cells := minIBLTCells
+	for {
+		sketch, err := remote(cells)
+		if err != nil {
+			return nil, nil, stats, err
+		}
+		table, err := newIBLTFromSketch(sketch)
+		if err != nil {
+			return nil, nil, stats, err
+		}
+		stats.rounds++
+		stats.cells += len(sketch.Counts)
+		stats.bytes += len(encoder.Serialize(*sketch))
+
+		localTable := newSetIBLT(local, cells)
+		if err := localTable.subtract(table); err != nil {
+			return nil, nil, stats, err
+		}
+		onlyLocal, onlyRemote, ok := localTable.decode()
+		if ok {
+			return onlyLocal, onlyRemote, stats, nil
+		}
+		// the difference is at least the difference of the sizes
+		next := 2 * cells
+		if sizeDifference := 2 * (len(local) - int(sketch.SetSize)); sizeDifference > next {
+			next = sizeDifference
+		} else if -sizeDifference > next {
+			next = -sizeDifference
+		}
+		if cells >= maxIBLTCells {
+			return nil, nil, stats, fmt.Errorf("the hash sets differ by too much to be reconciled with %d cells", cells)
+		}
+		if next > maxIBLTCells {
+			next = maxIBLTCells
+		}
+		cells = next
+	}
+}
+
+// getLocalSketchSource returns the sketches of a set held in memory
+func getLocalSketchSource(set [][]byte) sketchSource {
+	return func(cells int) (*IBLTSketch, error) {
+		return newSetIBLT(set, cells).toSketch(len(set)), nil
+	}
+}
+
+func writeReconcileMessage(w io.Writer, message interface{}) error {
+	data := encoder.Serialize(message)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readReconcileMessage(r io.Reader, message interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint32(length[:])
+	if size > maxReconcileMessage {
+		return fmt.Errorf("reconcile message of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return encoder.DeserializeRawExact(data, message)
+}
+
+// getStreamSketchSource returns the sketches sent by serveReconcile on the
+// other end of a stream
+func getStreamSketchSource(r io.Reader, w io.Writer) sketchSource {
+	return func(cells int) (*IBLTSketch, error) {
+		if err := writeReconcileMessage(w, IBLTRequest{Version: ibltVersion, Cells: uint32(cells)}); err != nil {
+			return nil, err
+		}
+		var sketch IBLTSketch
+		if err := readReconcileMessage(r, &sketch); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, errors.New("the other side closed the stream")
+			}
+			return nil, err
+		}
+		return &sketch, nil
+	}
+}
+
+// serveReconcile answers the requests for sketches of the set read from the
+// stream until it ends
+func serveReconcile(set [][]byte, r io.Reader, w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	for {
+		var request IBLTRequest
+		if err := readReconcileMessage(r, &request); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if request.Version != ibltVersion || request.Cells == 0 || request.Cells > maxIBLTCells {
+			return fmt.Errorf("invalid sketch request of %d cells", request.Cells)
+		}
+		if err := writeReconcileMessage(buffered, *newSetIBLT(set, int(request.Cells)).toSketch(len(set))); err != nil {
+			return err
+		}
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// getHashSetFile returns the name of a .temp file, or of the temp file of a
+// checkpoint of the repository
+func getHashSetFile(name string) (string, error) {
+	if strings.HasSuffix(name, ".temp") {
+		return name, nil
+	}
+	checkpoint, err := getCheckpointFile(name)
+	if err != nil {
+		return "", err
+	}
+	return currentDir + manifestTempFolder + strings.TrimSuffix(filepath.Base(checkpoint), ".cxo") + ".temp", nil
+}
+
+// readHashSet returns the distinct chunk hashes of a .temp file, or of the
+// temp file of a checkpoint of the repository
+func readHashSet(name string) ([][]byte, error) {
+	path, err := getHashSetFile(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var temp ManifestTemp
+	if err := encoder.DeserializeRawExact(data, &temp); err != nil {
+		return nil, fmt.Errorf("%s is not a temp file: %w", path, err)
+	}
+	return getDistinctHashes(temp.HashSet.HashSet)
+}
+
+func printReconcileResult(w io.Writer, onlyLocal, onlyRemote [][]byte, stats reconcileStats, localName, remoteName string) {
+	for _, hash := range onlyLocal {
+		fmt.Fprintf(w, "< %x\n", hash)
+	}
+	for _, hash := range onlyRemote {
+		fmt.Fprintf(w, "> %x\n", hash)
+	}
+	fmt.Fprintf(w, "%d chunk hashes only in %s, %d only in %s\n", len(onlyLocal), localName, len(onlyRemote), remoteName)
+	fmt.Fprintf(os.Stderr, "sketches: %d rounds, %d cells, %s exchanged\n", stats.rounds, stats.cells, formatBytes(int64(stats.bytes)))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"github.com/stretchr/testify/require"
+)
+
+func randomHashes(t *testing.T, count int) [][]byte {
+	var result [][]byte
+	for i := 0; i < count; i++ {
+		hash := make([]byte, ibltKeySize)
+		_, err := rand.Read(hash)
+		require.NoError(t, err)
+		result = append(result, hash)
+	}
+	SortByteArrays(result)
+	return result
+}
+
+func TestReconcileHashSets(t *testing.T) {
+	common := randomHashes(t, 20000)
+	onlyA := randomHashes(t, 30)
+	onlyB := randomHashes(t, 200)
+	a := append(append([][]byte{}, common...), onlyA...)
+	b := append(append([][]byte{}, common...), onlyB...)
+	SortByteArrays(a)
+	SortByteArrays(b)
+
+	gotA, gotB, stats, err := reconcileHashSets(a, getLocalSketchSource(b))
+	require.NoError(t, err)
+	require.Equal(t, onlyA, gotA)
+	require.Equal(t, onlyB, gotB)
+	// what is exchanged depends on the difference, not on the sets
+	require.True(t, stats.cells < 40*(len(onlyA)+len(onlyB)), "%d cells", stats.cells)
+
+	gotA, gotB, stats, err = reconcileHashSets(a, getLocalSketchSource(a))
+	require.NoError(t, err)
+	require.Empty(t, gotA)
+	require.Empty(t, gotB)
+	require.Equal(t, 1, stats.rounds)
+
+	// over a stream
+	requests, requestWriter := io.Pipe()
+	sketches, sketchWriter := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- serveReconcile(b, requests, sketchWriter)
+		sketchWriter.Close()
+	}()
+	gotA, gotB, _, err = reconcileHashSets(a, getStreamSketchSource(sketches, requestWriter))
+	require.NoError(t, err)
+	require.Equal(t, onlyA, gotA)
+	require.Equal(t, onlyB, gotB)
+	requestWriter.Close()
+	require.NoError(t, <-served)
+}
+
+func TestLargestSketchFitsMessage(t *testing.T) {
+	sketch := newSetIBLT(randomHashes(t, 10), 3*100).toSketch(10)
+	require.Len(t, encoder.Serialize(*sketch), ibltSketchOverhead+3*100*ibltCellSize)
+	require.Equal(t, 0, maxIBLTCells%ibltHashCount)
+	require.True(t, ibltSketchOverhead+maxIBLTCells*ibltCellSize <= maxReconcileMessage)
+	require.True(t, ibltSketchOverhead+(maxIBLTCells+ibltHashCount)*ibltCellSize > maxReconcileMessage)
+}
+
+func TestGetDistinctHashes(t *testing.T) {
+	hashes := randomHashes(t, 3)
+	distinct, err := getDistinctHashes([][]byte{hashes[0], hashes[0], hashes[1], hashes[2], hashes[2]})
+	require.NoError(t, err)
+	require.Equal(t, hashes, distinct)
+	_, err = getDistinctHashes([][]byte{{1, 2}})
+	require.Error(t, err)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	// the smallest part of a multipart upload but the last one
+	minS3PartSize     = 5 << 20
+	defaultS3Retries  = 4
+	defaultRetryDelay = 200 * time.Millisecond
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// s3Options are the settings of an s3://bucket/prefix chunk store URL, from
+// its query and the environment: endpoint (AWS_ENDPOINT_URL, the AWS
+// endpoint of the region by default), region (AWS_REGION), part-size, the
+// size of the chunk objects above which they are sent in parts, and retries,
+// the number of times a failed request is retried. The credentials are those
+// of AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, without
+// which requests are not signed
+type s3Options struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	partSize     int64
+	retries      int
+}
+
+// s3ChunkStore keeps the chunk objects in a bucket of an S3-compatible object
+// store, as prefix/<first byte of the hash>/<hash> with path-style requests
+type s3ChunkStore struct {
+	options    s3Options
+	client     *http.Client
+	retryDelay time.Duration
+	// the time requests are signed at, time.Now but in tests
+	now func() time.Time
+}
+
+// s3Error is the error document of a failed request
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func getS3Options(storeURL *url.URL) (*s3Options, error) {
+	query := storeURL.Query()
+	options := &s3Options{
+		bucket:       storeURL.Host,
+		prefix:       strings.Trim(storeURL.Path, "/"),
+		region:       query.Get("region"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		partSize:     minS3PartSize,
+		retries:      defaultS3Retries,
+	}
+	if options.bucket == "" {
+		return nil, usageError("the chunk store URL %q has no bucket, use s3://bucket/prefix", storeURL)
+	}
+	if options.prefix != "" {
+		options.prefix += "/"
+	}
+	if options.region == "" {
+		options.region = os.Getenv("AWS_REGION")
+	}
+	if options.region == "" {
+		options.region = defaultS3Region
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + options.region + ".amazonaws.com"
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, usageError("invalid S3 endpoint %q, use http://host:port or https://host", endpoint)
+	}
+	options.endpoint = parsed
+	if partSize := query.Get("part-size"); partSize != "" {
+		if options.partSize, err = parseSize(partSize); err != nil || options.partSize < 1 {
+			return nil, usageError("invalid part-size %q", partSize)
+		}
+		if options.partSize < minS3PartSize {
+			return nil, usageError("part-size %q is below the S3 minimum of 5M", partSize)
+		}
+	}
+	if retries := query.Get("retries"); retries != "" {
+		if options.retries, err = strconv.Atoi(retries); err != nil || options.retries < 0 {
+			return nil, usageError("invalid retries %q", retries)
+		}
+	}
+	return options, nil
+}
+
+func newS3ChunkStore(storeURL *url.URL) (*s3ChunkStore, error) {
+	options, err := getS3Options(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	return &s3ChunkStore{
+		options:    *options,
+		client:     &http.Client{Timeout: 5 * time.Minute},
+		retryDelay: defaultRetryDelay,
+		now:        time.Now,
+	}, nil
+}
+
+func (s *s3ChunkStore) objectKey(hash []byte) string {
+	name := hex.EncodeToString(hash)
+	return s.options.prefix + name[:2] + "/" + name
+}
+
+// request sends a request for the object, or for the bucket if the key is
+// empty, retrying it after network errors, throttling and server errors
+func (s *s3ChunkStore) request(method string, key string, query url.Values, body []byte) (*http.Response, []byte, error) {
+	target := *s.options.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + s.options.bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+	// the path sent is the one signed
+	target.RawPath = escapeS3Path(target.Path)
+	target.RawQuery = encodeS3Query(query)
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.ContentLength = int64(len(body))
+		s.sign(req, body)
+		resp, err := s.client.Do(req)
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return resp, data, nil
+			}
+			if err == nil {
+				err = getS3Error(method, key, resp, data)
+			}
+		}
+		if attempt >= s.options.retries {
+			return nil, nil, fmt.Errorf("%w, after %d attempts", err, attempt+1)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// getS3Error returns the error of a failed request, with the code and
+// message of its error document
+func getS3Error(method string, key string, resp *http.Response, data []byte) error {
+	var document s3Error
+	if xml.Unmarshal(data, &document) == nil && document.Code != "" {
+		return fmt.Errorf("S3 %s %s: %s: %s %s", method, key, resp.Status, document.Code, document.Message)
+	}
+	return fmt.Errorf("S3 %s %s: %s", method, key, resp.Status)
+}
+
+func (s *s3ChunkStore) Has(hash []byte) (bool, error) {
+	key := s.objectKey(hash)
+	resp, data, err := s.request(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, getS3Error(http.MethodHead, key, resp, data)
+}
+
+func (s *s3ChunkStore) Get(hash []byte) ([]byte, error) {
+	key := s.objectKey(hash)
+	resp, data, err := s.request(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return data, nil
+	case http.StatusNotFound:
+		return nil, &os.PathError{Op: "get", Path: "s3://" + s.options.bucket + "/" + key, Err: os.ErrNotExist}
+	}
+	return nil, getS3Error(http.MethodGet, key, resp, data)
+}
+
+// Put uploads the object in one request, or in parts if it is larger than
+// the part size
+func (s *s3ChunkStore) Put(hash []byte, object []byte) error {
+	key := s.objectKey(hash)
+	if int64(len(object)) > s.options.partSize {
+		return s.putMultipart(key, object)
+	}
+	resp, data, err := s.request(http.MethodPut, key, nil, object)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return getS3Error(http.MethodPut, key, resp, data)
+	}
+	return nil
+}
+
+// putMultipart uploads the object in parts, aborting the upload if a part
+// fails so that the store does not keep them
+func (s *s3ChunkStore) putMultipart(key string, object []byte) error {
+	resp, data, err := s.request(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var upload s3InitiateMultipartUploadResult
+	if resp.StatusCode != http.StatusOK {
+		return getS3Error(http.MethodPost, key, resp, data)
+	}
+	if err := xml.Unmarshal(data, &upload); err != nil || upload.UploadId == "" {
+		return fmt.Errorf("S3 POST %s: no upload id in the response", key)
+	}
+
+	err = s.uploadParts(key, upload.UploadId, object)
+	if err != nil {
+		s.request(http.MethodDelete, key, url.Values{"uploadId": {upload.UploadId}}, nil)
+	}
+	return err
+}
+
+func (s *s3ChunkStore) uploadParts(key string, uploadID string, object []byte) error {
+	var complete s3CompleteMultipartUpload
+	for offset := int64(0); offset < int64(len(object)); offset += s.options.partSize {
+		end := offset + s.options.partSize
+		if end > int64(len(object)) {
+			end = int64(len(object))
+		}
+		partNumber := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		resp, data, err := s.request(http.MethodPut, key, query, object[offset:end])
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return getS3Error(http.MethodPut, key, resp, data)
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{partNumber, resp.Header.Get("ETag")})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, data, err := s.request(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	// the completion can fail after the status is sent, with an error
+	// document in the body of a 200 response
+	var document s3Error
+	if resp.StatusCode != http.StatusOK || (xml.Unmarshal(data, &document) == nil && document.Code != "") {
+		return getS3Error(http.MethodPost, key, resp, data)
+	}
+	return nil
+}
+
+func (s *s3ChunkStore) Delete(hash []byte) error {
+	key := s.objectKey(hash)
+	resp, data, err := s.request(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return getS3Error(http.MethodDelete, key, resp, data)
+}
+
+func (s *s3ChunkStore) List(fn func(hash []byte, size int64) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.options.prefix}}
+	for {
+		resp, data, err := s.request(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return getS3Error(http.MethodGet, s.options.bucket, resp, data)
+		}
+		var result s3ListBucketResult
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return fmt.Errorf("S3 list of %s: %w", s.options.bucket, err)
+		}
+		for _, object := range result.Contents {
+			name := object.Key[strings.LastIndexByte(object.Key, '/')+1:]
+			hash, err := hex.DecodeString(name)
+			if err != nil || object.Key != s.objectKey(hash) {
+				continue
+			}
+			if err := fn(hash, object.Size); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// sign adds the AWS signature version 4 of the request, signing its host,
+// its other headers and the hash of its body
+func (s *s3ChunkStore) sign(req *http.Request, body []byte) {
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.options.accessKey == "" {
+		return
+	}
+	now := s.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	if s.options.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.options.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	date := now.Format("20060102")
+	scope := date + "/" + s.options.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.options.secretKey)
+	for _, part := range []string{date, s.options.region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.options.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapeS3 escapes everything but the unreserved characters, as the
+// signature requires
+func escapeS3(value string, keepSlash bool) string {
+	var result strings.Builder
+	for _, c := range []byte(value) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			result.WriteByte(c)
+		} else {
+			fmt.Fprintf(&result, "%%%02X", c)
+		}
+	}
+	return result.String()
+}
+
+func escapeS3Path(path string) string {
+	return escapeS3(path, true)
+}
+
+// encodeS3Query encodes the query sorted by name, with the escaping of the
+// signature so that the query sent is the one signed
+func encodeS3Query(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, escapeS3(name, false)+"="+escapeS3(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
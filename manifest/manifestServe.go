@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"golang.org/x/net/webdav"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultServeAddress = "127.0.0.1:8080"
+
+// servedRepository is the checkpoints served by 'manifest serve', as a read
+// only file system with a directory for each checkpoint
+type servedRepository struct {
+	mu          sync.Mutex
+	checkpoints map[string]*servedCheckpoint
+	// the chunk store is read by one request at a time
+	storeMu sync.Mutex
+	store   *chunkStore
+}
+
+type servedCheckpoint struct {
+	name     string
+	manifest *ManifestOuputBody
+	tree     *checkpointTree
+}
+
+// servedFileInfo is a file or directory of a checkpoint, or the directory of
+// a checkpoint at the top
+type servedFileInfo struct {
+	name    string
+	size    int64
+	isDir   bool
+	modTime time.Time
+	etag    string
+}
+
+// servedFile reads a file of a checkpoint from the chunk store, or from the
+// file in the current directory while it is unchanged
+type servedFile struct {
+	repo     *servedRepository
+	info     *servedFileInfo
+	relPath  string
+	entry    *ManifestFile
+	children []os.FileInfo
+	offset   int64
+	// the last chunk read, as files are read in order
+	chunkIndex int
+	chunk      []byte
+}
+
+func newServedRepository(store *chunkStore) *servedRepository {
+	return &servedRepository{checkpoints: make(map[string]*servedCheckpoint), store: store}
+}
+
+func (fi *servedFileInfo) Name() string       { return fi.name }
+func (fi *servedFileInfo) Size() int64        { return fi.size }
+func (fi *servedFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *servedFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *servedFileInfo) Sys() interface{}   { return nil }
+
+func (fi *servedFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// ETag is the hash of the content of the file, or the hash of the directory
+func (fi *servedFileInfo) ETag(ctx context.Context) (string, error) {
+	return fi.etag, nil
+}
+
+// ContentType is guessed from the extension, so listing a directory over
+// WebDAV does not read its files
+func (fi *servedFileInfo) ContentType(ctx context.Context) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(fi.name)); contentType != "" {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// getCheckpoint returns the checkpoint of the name, read once
+func (r *servedRepository) getCheckpoint(name string) (*servedCheckpoint, error) {
+	fileName := currentDir + manifestCXOFolder + name + ".cxo"
+	if name == "" || strings.ContainsAny(name, "/\\") || name[0] == '.' {
+		return nil, os.ErrNotExist
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, os.ErrNotExist
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if checkpoint := r.checkpoints[name]; checkpoint != nil {
+		return checkpoint, nil
+	}
+	manifest, err := readManifestFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &servedCheckpoint{name: name, manifest: manifest, tree: getCheckpointTree(manifest)}
+	r.checkpoints[name] = checkpoint
+	return checkpoint, nil
+}
+
+// getCheckpointNames returns the names of the checkpoints, oldest first
+func getCheckpointNames() ([]string, error) {
+	checkpoints, err := getCheckpointFiles()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, checkpoint := range checkpoints {
+		result = append(result, strings.TrimSuffix(filepath.Base(checkpoint), ".cxo"))
+	}
+	return result, nil
+}
+
+// getEntryETag returns the ETag of an entry: the sha256 of the content of a
+// file, or the hash of a directory
+func (c *servedCheckpoint) getEntryETag(relPath string) string {
+	entry := c.tree.entries[relPath]
+	if entry.FileName == nil {
+		return `"` + hex.EncodeToString(c.tree.hashes[relPath]) + `"`
+	}
+	if sum, err := getFileSha256(entry); err == nil {
+		return `"` + hex.EncodeToString(sum) + `"`
+	}
+	return `"` + base64.RawURLEncoding.EncodeToString(entry.HashList.FileHash.Hash) + `"`
+}
+
+// isServedEntry reports whether an entry is served, errored entries have no
+// content
+func isServedEntry(entry *ManifestFile) bool {
+	return entry != nil && getFileEntryError(entry) == ""
+}
+
+func (c *servedCheckpoint) getFileInfo(relPath string) *servedFileInfo {
+	entry := c.tree.entries[relPath]
+	name := path.Base(filepath.ToSlash(relPath))
+	if relPath == "." {
+		name = c.name
+	}
+	return &servedFileInfo{
+		name:    name,
+		size:    entry.Size,
+		isDir:   entry.FileName == nil,
+		modTime: time.Unix(int64(c.manifest.ManifestHeader.CreatedAt), 0),
+		etag:    c.getEntryETag(relPath),
+	}
+}
+
+// getServedRootInfo returns the top directory, whose ETag changes with the
+// list of the checkpoints
+func getServedRootInfo(names []string) *servedFileInfo {
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return &servedFileInfo{name: "/", isDir: true, modTime: time.Now(), etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+}
+
+// resolve returns the checkpoint and the path in it of a name of the file
+// system, or no checkpoint for the top directory
+func (r *servedRepository) resolve(name string) (*servedCheckpoint, string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil, "", nil
+	}
+	parts := strings.SplitN(name, "/", 2)
+	checkpoint, err := r.getCheckpoint(parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	relPath := "."
+	if len(parts) == 2 {
+		relPath = filepath.FromSlash(parts[1])
+	}
+	if !isServedEntry(checkpoint.tree.entries[relPath]) {
+		return nil, "", os.ErrNotExist
+	}
+	return checkpoint, relPath, nil
+}
+
+func (r *servedRepository) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (r *servedRepository) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (r *servedRepository) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (r *servedRepository) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	checkpoint, relPath, err := r.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint == nil {
+		names, err := getCheckpointNames()
+		if err != nil {
+			return nil, err
+		}
+		return getServedRootInfo(names), nil
+	}
+	return checkpoint.getFileInfo(relPath), nil
+}
+
+func (r *servedRepository) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	checkpoint, relPath, err := r.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint == nil {
+		names, err := getCheckpointNames()
+		if err != nil {
+			return nil, err
+		}
+		result := &servedFile{repo: r, info: getServedRootInfo(names)}
+		for _, name := range names {
+			if checkpoint, err := r.getCheckpoint(name); err == nil {
+				result.children = append(result.children, checkpoint.getFileInfo("."))
+			}
+		}
+		return result, nil
+	}
+	result := &servedFile{repo: r, info: checkpoint.getFileInfo(relPath), relPath: relPath, chunkIndex: -1}
+	if result.info.isDir {
+		for _, child := range checkpoint.tree.children[relPath] {
+			childPath := filepath.Join(relPath, child)
+			if isServedEntry(checkpoint.tree.entries[childPath]) {
+				result.children = append(result.children, checkpoint.getFileInfo(childPath))
+			}
+		}
+	} else {
+		result.entry = checkpoint.tree.entries[relPath]
+	}
+	return result, nil
+}
+
+func (f *servedFile) Close() error {
+	return nil
+}
+
+func (f *servedFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *servedFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *servedFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.isDir {
+		return nil, os.ErrInvalid
+	}
+	if count <= 0 {
+		result := f.children
+		f.children = nil
+		return result, nil
+	}
+	if len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.children) {
+		count = len(f.children)
+	}
+	result := f.children[:count]
+	f.children = f.children[count:]
+	return result, nil
+}
+
+func (f *servedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// readChunk returns the data of a chunk of the file, zeros for chunks in the
+// holes of sparse files
+func (f *servedFile) readChunk(index int) ([]byte, error) {
+	if index == f.chunkIndex {
+		return f.chunk, nil
+	}
+	if !hasChunkHashes(f.entry) {
+		return nil, fmt.Errorf("%s has no chunk hashes in the checkpoint", f.relPath)
+	}
+	size := getManifestFileChunkSizes(f.entry)[index]
+	offset := int64(index) * int64(chunkSize)
+	holes, err := getFileEntryHoles(f.entry)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if isInHole(holes, offset, offset+int64(size)) {
+		data = make([]byte, size)
+	} else {
+		f.repo.storeMu.Lock()
+		data, err = readCheckpointChunk(f.repo.store, f.relPath, f.entry.HashList.ChunksHashes[index], index, size)
+		f.repo.storeMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	f.chunkIndex, f.chunk = index, data
+	return data, nil
+}
+
+func (f *servedFile) Read(p []byte) (int, error) {
+	if f.info.isDir {
+		return 0, os.ErrInvalid
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	index := int(f.offset / int64(chunkSize))
+	data, err := f.readChunk(index)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data[f.offset-int64(index)*int64(chunkSize):])
+	f.offset += int64(n)
+	return n, nil
+}
+
+var servedDirectoryTemplate = template.Must(template.New("directory").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<table>
+<tr><th align="left">name</th><th align="right">size</th><th align="left">sha256</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Link}}">{{.Name}}</a></td><td align="right" title="{{.Size}} bytes">{{.FormattedSize}}</td><td><code>{{.Hash}}</code></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type servedDirectoryEntry struct {
+	Name, Link, FormattedSize, Hash string
+	Size                            int64
+}
+
+// serveBrowse serves the directories of the checkpoints as HTML listings
+// and their files with Range requests and ETags
+func (r *servedRepository) serveBrowse(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/files")
+	file, err := r.OpenFile(req.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	defer file.Close()
+	info := file.(*servedFile).info
+	w.Header().Set("ETag", info.etag)
+	if !info.isDir {
+		contentType, _ := info.ContentType(req.Context())
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, req, info.name, info.modTime, file)
+		return
+	}
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		http.Redirect(w, req, req.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	children, err := file.Readdir(0)
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	var entries []servedDirectoryEntry
+	for _, child := range children {
+		childInfo := child.(*servedFileInfo)
+		entry := servedDirectoryEntry{
+			Name:          childInfo.name,
+			Link:          "./" + (&url.URL{Path: childInfo.name}).EscapedPath(),
+			Size:          childInfo.size,
+			FormattedSize: formatBytes(childInfo.size),
+			Hash:          strings.Trim(childInfo.etag, `"`),
+		}
+		if childInfo.isDir {
+			entry.Name += "/"
+			entry.Link += "/"
+		}
+		entries = append(entries, entry)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	servedDirectoryTemplate.Execute(w, struct {
+		Path    string
+		Entries []servedDirectoryEntry
+	}{path.Clean("/" + name), entries})
+}
+
+// getCheckpointSummary returns what the JSON endpoints report of a checkpoint
+func (c *servedCheckpoint) getCheckpointSummary() CheckpointSummary {
+	header := &c.manifest.ManifestHeader
+	result := CheckpointSummary{
+		Name:       c.name,
+		SequenceId: header.SequenceId,
+		CreatedAt:  time.Unix(int64(header.CreatedAt), 0).UTC().Format(time.RFC3339),
+		Creator:    header.Creator,
+		Size:       header.BodyDataFileSize,
+		ChunkSize:  header.ChunkSize,
+		Hash:       hex.EncodeToString(c.tree.hashes["."]),
+		Tags:       make(map[string]string),
+	}
+	for kv := range header.MetaDataTags.KVRange() {
+		result.Tags[string(kv.Key)] = string(kv.Value)
+	}
+	for _, entry := range c.tree.entries {
+		if entry.FileName == nil {
+			result.Directories++
+		} else {
+			result.Files++
+		}
+	}
+	return result
+}
+
+// getCheckpointDetails adds the totals of the meta file of the checkpoint
+func (c *servedCheckpoint) getCheckpointDetails() (*CheckpointDetails, error) {
+	result := CheckpointDetails{CheckpointSummary: c.getCheckpointSummary()}
+	data, err := ioutil.ReadFile(currentDir + manifestMetaFolder + c.name + ".meta")
+	if err != nil {
+		return nil, err
+	}
+	var meta ManifestMeta
+	if err := encoder.DeserializeRawExact(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to deserialize the meta file of %s: %w", c.name, err)
+	}
+	result.UniqueId = meta.ManifestHeaderMeta.UniqueId
+	result.ChunkCount = meta.ChunkHashSetListMeta.HashCountTotal
+	for _, size := range meta.ChunkHashSetListMeta.ChunkSetDataSizeList {
+		result.ChunkDataSize += size
+	}
+	return &result, nil
+}
+
+// serveAPI serves the metadata of the checkpoints as JSON: the list of the
+// checkpoints, the details of one, or its whole document as written by
+// 'manifest export -json'
+func (r *servedRepository) serveAPI(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/checkpoints"), "/"), "/")
+	if parts[0] == "" {
+		names, err := getCheckpointNames()
+		if err != nil {
+			writeServeError(w, err)
+			return
+		}
+		result := []CheckpointSummary{}
+		for _, name := range names {
+			checkpoint, err := r.getCheckpoint(name)
+			if err != nil {
+				writeServeError(w, err)
+				return
+			}
+			result = append(result, checkpoint.getCheckpointSummary())
+		}
+		writeServeJSON(w, result)
+		return
+	}
+	checkpoint, err := r.getCheckpoint(parts[0])
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		details, err := checkpoint.getCheckpointDetails()
+		if err != nil {
+			writeServeError(w, err)
+			return
+		}
+		writeServeJSON(w, details)
+	case len(parts) == 2 && parts[1] == "document":
+		w.Header().Set("Content-Type", "application/json")
+		if err := exportCheckpointJSON(currentDir+manifestCXOFolder+checkpoint.name+".cxo", w); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", req.URL.Path, err)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func writeServeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func writeServeError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "the checkpoints are read only", http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// newServeHandler returns the handler of 'manifest serve': HTML listings and
+// downloads under /files/, WebDAV under /dav/ and JSON under /api/checkpoints
+func newServeHandler(repo *servedRepository) http.Handler {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: repo,
+		LockSystem: webdav.NewMemLS(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dav/", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			dav.ServeHTTP(w, req)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS, PROPFIND")
+			http.Error(w, "the checkpoints are read only", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/files/", repo.serveBrowse)
+	mux.HandleFunc("/api/checkpoints", repo.serveAPI)
+	mux.HandleFunc("/api/checkpoints/", repo.serveAPI)
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		http.Redirect(w, req, "/files/", http.StatusFound)
+	})
+	return mux
+}
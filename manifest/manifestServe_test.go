@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getServeTestResponse(t *testing.T, request *http.Request) (*http.Response, []byte) {
+	response, err := http.DefaultTransport.RoundTrip(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response, body
+}
+
+func TestServeCheckpoints(t *testing.T) {
+	defer setupTestRepository(t)()
+	store, err := openChunkStore(currentDir)
+	require.NoError(t, err)
+	defer store.close()
+	chunks = store
+	defer func() { chunks = nil }()
+
+	a := make([]byte, 2*chunkSize+1000)
+	_, err = rand.Read(a)
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir("sub dir", 0700))
+	require.NoError(t, ioutil.WriteFile("a.txt", a, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub dir", "b"), []byte("b"), 0600))
+	name := strings.TrimSuffix(filepath.Base(commitTestRepository(t)), ".cxo")
+	// the old version is read from the chunk store
+	require.NoError(t, ioutil.WriteFile("a.txt", []byte("changed"), 0600))
+
+	server := httptest.NewServer(newServeHandler(newServedRepository(store)))
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/files/"+name+"/a.txt", nil)
+	require.NoError(t, err)
+	response, body := getServeTestResponse(t, request)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.True(t, bytes.Equal(a, body))
+	sum := sha256.Sum256(a)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	require.Equal(t, etag, response.Header.Get("ETag"))
+	require.Equal(t, "text/plain; charset=utf-8", response.Header.Get("Content-Type"))
+
+	request.Header.Set("Range", "bytes=262140-262150")
+	response, body = getServeTestResponse(t, request)
+	require.Equal(t, http.StatusPartialContent, response.StatusCode)
+	require.Equal(t, a[262140:262151], body)
+
+	request.Header.Del("Range")
+	request.Header.Set("If-None-Match", etag)
+	response, _ = getServeTestResponse(t, request)
+	require.Equal(t, http.StatusNotModified, response.StatusCode)
+
+	request, err = http.NewRequest(http.MethodGet, server.URL+"/files/"+name+"/", nil)
+	require.NoError(t, err)
+	response, body = getServeTestResponse(t, request)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Contains(t, string(body), `<a href="./sub%20dir/">sub dir/</a>`)
+	require.Contains(t, string(body), hex.EncodeToString(sum[:]))
+
+	request, err = http.NewRequest("PROPFIND", server.URL+"/dav/"+name+"/sub%20dir/", nil)
+	require.NoError(t, err)
+	request.Header.Set("Depth", "1")
+	response, body = getServeTestResponse(t, request)
+	require.Equal(t, 207, response.StatusCode)
+	require.Contains(t, string(body), "/dav/"+name+"/sub%20dir/b")
+
+	request, err = http.NewRequest(http.MethodPut, server.URL+"/dav/"+name+"/c", strings.NewReader("c"))
+	require.NoError(t, err)
+	response, _ = getServeTestResponse(t, request)
+	require.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+
+	request, err = http.NewRequest(http.MethodGet, server.URL+"/api/checkpoints", nil)
+	require.NoError(t, err)
+	response, body = getServeTestResponse(t, request)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var summaries []CheckpointSummary
+	require.NoError(t, json.Unmarshal(body, &summaries))
+	require.Len(t, summaries, 1)
+	require.Equal(t, name, summaries[0].Name)
+	require.Equal(t, 2, summaries[0].Files)
+	require.Equal(t, uint64(len(a)+1), summaries[0].Size)
+
+	request, err = http.NewRequest(http.MethodGet, server.URL+"/api/checkpoints/"+name, nil)
+	require.NoError(t, err)
+	response, body = getServeTestResponse(t, request)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var details CheckpointDetails
+	require.NoError(t, json.Unmarshal(body, &details))
+	require.Equal(t, int64(4), details.ChunkCount)
+	require.Equal(t, "true", details.Tags["config.store-chunks"])
+
+	request, err = http.NewRequest(http.MethodGet, server.URL+"/files/"+name+"/missing", nil)
+	require.NoError(t, err)
+	response, _ = getServeTestResponse(t, request)
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+	request, err = http.NewRequest(http.MethodGet, server.URL+"/files/../"+name+"/a.txt", nil)
+	require.NoError(t, err)
+	response, _ = getServeTestResponse(t, request)
+	require.NotEqual(t, http.StatusInternalServerError, response.StatusCode)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// whence of lseek(2) for the next data and the next hole, which the
+	// syscall package does not define
+	seekData = 3
+	seekHole = 4
+)
+
+// getFileHoles returns the holes of a sparse file, found with SEEK_DATA and
+// SEEK_HOLE. File systems without them report no holes
+func getFileHoles(file *os.File, size int64) ([]FileExtent, error) {
+	var result []FileExtent
+	offset := int64(0)
+	for offset < size {
+		data, err := file.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// no data after the offset
+			data = size
+		} else if errors.Is(err, syscall.EINVAL) && offset == 0 {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if data > size {
+			data = size
+		}
+		if data > offset {
+			result = append(result, FileExtent{offset, data - offset})
+		}
+		if data >= size {
+			break
+		}
+		if offset, err = file.Seek(data, seekHole); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// isInHole reports whether the bytes from offset to end are all in one of
+// the holes
+func isInHole(holes []FileExtent, offset int64, end int64) bool {
+	for _, hole := range holes {
+		if hole.Offset <= offset && end <= hole.Offset+hole.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// formatFileHoles returns the holes of a file as recorded in its MetaString,
+// "offset+length" extents without data
+func formatFileHoles(holes []FileExtent) string {
+	var extents []string
+	for _, hole := range holes {
+		extents = append(extents, strconv.FormatInt(hole.Offset, 10)+"+"+strconv.FormatInt(hole.Length, 10))
+	}
+	return strings.Join(extents, ",")
+}
+
+// getFileEntryHoles returns the holes recorded for an entry
+func getFileEntryHoles(file *ManifestFile) ([]FileExtent, error) {
+	value := getFileEntryMeta(file, "holes")
+	if value == "" {
+		return nil, nil
+	}
+	var result []FileExtent
+	for _, extent := range strings.Split(value, ",") {
+		parts := strings.SplitN(extent, "+", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid hole %q", extent)
+		}
+		offset, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hole %q", extent)
+		}
+		length, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hole %q", extent)
+		}
+		result = append(result, FileExtent{offset, length})
+	}
+	return result, nil
+}
+
+// sparseWriter writes data to a file without writing the holes, which stay
+// holes of the file once close truncates it to its size
+type sparseWriter struct {
+	file   *os.File
+	holes  []FileExtent
+	offset int64
+}
+
+func (w *sparseWriter) Write(data []byte) (int, error) {
+	start, end := w.offset, w.offset+int64(len(data))
+	position := start
+	for _, hole := range w.holes {
+		holeStart, holeEnd := hole.Offset, hole.Offset+hole.Length
+		if holeStart < position {
+			holeStart = position
+		}
+		if holeEnd > end {
+			holeEnd = end
+		}
+		if holeStart >= holeEnd {
+			continue
+		}
+		if holeStart > position {
+			if _, err := w.file.WriteAt(data[position-start:holeStart-start], position); err != nil {
+				return 0, err
+			}
+		}
+		position = holeEnd
+	}
+	if position < end {
+		if _, err := w.file.WriteAt(data[position-start:], position); err != nil {
+			return 0, err
+		}
+	}
+	w.offset = end
+	return len(data), nil
+}
+
+func (w *sparseWriter) close() error {
+	return w.file.Truncate(w.offset)
+}
+
+// readFileAt reads the chunk at the offset with pread, or from the mapping of
+// the file if it is mapped
+func readFileAt(file *os.File, mapped []byte, data []byte, offset int64) error {
+	if mapped != nil {
+		copy(data, mapped[offset:])
+		return nil
+	}
+	if _, err := file.ReadAt(data, offset); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%s changed while it was read", file.Name())
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSparseFile writes a file of ten chunks with data in the fifth one and
+// returns its content, or skips the test if the file system has no holes
+func writeSparseFile(t *testing.T, name string) []byte {
+	data := make([]byte, 10*chunkSize)
+	_, err := rand.Read(data[4*chunkSize : 5*chunkSize])
+	require.NoError(t, err)
+	file, err := os.Create(name)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.WriteAt(data[4*chunkSize:5*chunkSize], int64(4*chunkSize))
+	require.NoError(t, err)
+	require.NoError(t, file.Truncate(int64(len(data))))
+	holes, err := getFileHoles(file, int64(len(data)))
+	require.NoError(t, err)
+	if len(holes) == 0 {
+		t.Skip("the file system does not report holes")
+	}
+	return data
+}
+
+func TestSparseFiles(t *testing.T) {
+	defer setupTestRepository(t)()
+	data := writeSparseFile(t, "disk.img")
+
+	for _, threshold := range []int64{0, 1} {
+		mmapThreshold = threshold
+		fileHash, fileChunks, holes, err := getFileChunks("disk.img")
+		mmapThreshold = 0
+		require.NoError(t, err)
+		sum := sha256.Sum256(data)
+		require.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), string(fileHash.Hash))
+		require.Len(t, fileChunks, 10)
+		for i, chunk := range fileChunks {
+			require.Equal(t, hashChunkData(data[i*chunkSize:(i+1)*chunkSize]), chunk.Hash)
+		}
+		require.Equal(t, []FileExtent{{0, int64(4 * chunkSize)}, {int64(5 * chunkSize), int64(5 * chunkSize)}}, holes)
+	}
+
+	checkpoint := commitTestRepository(t)
+	manifest, err := readManifestFile(checkpoint)
+	require.NoError(t, err)
+	for i := range manifest.ManifestBody.ManifestFileList {
+		entry := &manifest.ManifestBody.ManifestFileList[i]
+		if string(entry.FileName) == "disk.img" {
+			holes, err := getFileEntryHoles(entry)
+			require.NoError(t, err)
+			require.Len(t, holes, 2)
+		}
+	}
+
+	// restoring the file recreates the holes
+	versions, err := getFileHistory("disk.img")
+	require.NoError(t, err)
+	version, err := getHistoryVersion(versions, checkpoint)
+	require.NoError(t, err)
+	require.NoError(t, restoreHistoryVersion(nil, version, "restored.img"))
+	restored, err := ioutil.ReadFile("restored.img")
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, restored))
+	file, err := os.Open("restored.img")
+	require.NoError(t, err)
+	defer file.Close()
+	holes, err := getFileHoles(file, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, []FileExtent{{0, int64(4 * chunkSize)}, {int64(5 * chunkSize), int64(5 * chunkSize)}}, holes)
+}
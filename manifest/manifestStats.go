@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	statsFormatText = "text"
+	statsFormatJSON = "json"
+	statsFormatHTML = "html"
+)
+
+// upper bounds of the buckets of the size histogram, past the empty files;
+// the last bucket has the larger files
+var statsSizeBounds = []int64{4 << 10, 64 << 10, 1 << 20, 16 << 20, 256 << 20, 1 << 30, 16 << 30}
+
+// upper bounds in days of the buckets of the ages of the files, with their
+// labels; the last bucket has the older files. The age is from the mtime the
+// checkpoint recorded to its creation date, or from the status change time
+// (ctime) of the file in checkpoints that did not record the mtime
+var statsAgeBounds = []int{7, 30, 91, 365, 3 * 365}
+var statsAgeLabels = []string{"< 1 week", "< 1 month", "< 3 months", "< 1 year", "< 3 years", ">= 3 years"}
+
+type statsOptions struct {
+	// number of extensions and directories reported
+	top int
+	// number of the last pairs of checkpoints the churn is reported for
+	churn int
+}
+
+// statsDedup adds up the chunks of files to compare them with the distinct
+// chunks
+type statsDedup struct {
+	seen   map[string]bool
+	result DedupStats
+}
+
+// getCheckpointStats returns the size histogram, extensions, largest
+// directories, ages and chunk dedup of the files of the checkpoint, with the
+// churn between the checkpoints up to it and the dedup of all of them
+func getCheckpointStats(checkpoint string, options statsOptions) (*CheckpointStats, error) {
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(checkpoint), ".cxo")
+	tree := getCheckpointTree(manifest)
+	stats := &CheckpointStats{
+		Checkpoint: (&servedCheckpoint{name: name, manifest: manifest, tree: tree}).getCheckpointSummary(),
+	}
+
+	stats.SizeHistogram = append(stats.SizeHistogram, StatsBucket{Label: "empty"})
+	for _, bound := range statsSizeBounds {
+		stats.SizeHistogram = append(stats.SizeHistogram, StatsBucket{Label: "< " + formatBytes(bound)})
+	}
+	stats.SizeHistogram = append(stats.SizeHistogram, StatsBucket{Label: ">= " + formatBytes(statsSizeBounds[len(statsSizeBounds)-1])})
+	for _, label := range statsAgeLabels {
+		stats.Ages = append(stats.Ages, StatsBucket{Label: label})
+	}
+	stats.Ages = append(stats.Ages, StatsBucket{Label: "unknown"})
+
+	created := time.Unix(int64(manifest.ManifestHeader.CreatedAt), 0)
+	extensions := make(map[string]*ExtensionStats)
+	directories := make(map[string]*DirectoryStats)
+	dedup := newStatsDedup()
+	root := getCheckpointRoot(manifest)
+	items := manifest.FileList.FileItemList
+	// the file items are those of the files that are not errored, in order
+	item := 0
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		relPath := getManifestFileRelPath(root, entry)
+		if entry.FileName == nil {
+			if relPath != "." {
+				if directories[relPath] == nil {
+					directories[relPath] = &DirectoryStats{Path: filepath.ToSlash(relPath)}
+				}
+				directories[relPath].Bytes = entry.Size
+			}
+			continue
+		}
+		if getFileEntryError(entry) != "" {
+			stats.ErroredFiles++
+			continue
+		}
+		modified, known := getFileEntryModified(entry)
+		if item < len(items) && !known {
+			modified, known = parseStatsDate(items[item].Header.CreationDate)
+		}
+		item++
+
+		size := entry.Size
+		if isFileSizeKnown(entry) {
+			stats.SizeHistogram[getStatsSizeBucket(size)].add(size)
+		} else {
+			stats.UnknownSizeFiles++
+			size = 0
+		}
+		stats.Ages[getStatsAgeBucket(created, modified, known)].add(size)
+
+		extension := getStatsExtension(relPath)
+		if extensions[extension] == nil {
+			extensions[extension] = &ExtensionStats{Extension: extension}
+		}
+		extensions[extension].Files++
+		extensions[extension].Bytes += size
+
+		for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+			if directories[dir] == nil {
+				directories[dir] = &DirectoryStats{Path: filepath.ToSlash(dir)}
+			}
+			directories[dir].Files++
+		}
+		if hasChunkHashes(entry) {
+			dedup.add(entry)
+		}
+	}
+	stats.Dedup = dedup.getStats()
+
+	stats.ExtensionCount = len(extensions)
+	for _, extension := range extensions {
+		stats.Extensions = append(stats.Extensions, *extension)
+	}
+	sort.Slice(stats.Extensions, func(i, j int) bool {
+		a, b := &stats.Extensions[i], &stats.Extensions[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Files != b.Files {
+			return a.Files > b.Files
+		}
+		return a.Extension < b.Extension
+	})
+	if len(stats.Extensions) > options.top {
+		stats.Extensions = stats.Extensions[:options.top]
+	}
+	for _, dir := range directories {
+		stats.LargestDirectories = append(stats.LargestDirectories, *dir)
+	}
+	sort.Slice(stats.LargestDirectories, func(i, j int) bool {
+		a, b := &stats.LargestDirectories[i], &stats.LargestDirectories[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Path < b.Path
+	})
+	if len(stats.LargestDirectories) > options.top {
+		stats.LargestDirectories = stats.LargestDirectories[:options.top]
+	}
+
+	if err := stats.addRepositoryStats(checkpoint, options.churn); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// addRepositoryStats adds the churn between the consecutive checkpoints up to
+// the checkpoint, and the dedup of the chunks of all the checkpoints
+func (stats *CheckpointStats) addRepositoryStats(checkpoint string, churn int) error {
+	checkpoints, err := getCheckpointFiles()
+	if err != nil {
+		return err
+	}
+	last := -1
+	for i, name := range checkpoints {
+		if filepath.Base(name) == filepath.Base(checkpoint) {
+			last = i
+		}
+	}
+	dedup := newStatsDedup()
+	var previous *checkpointTree
+	for i, name := range checkpoints {
+		manifest, err := readManifestFile(name)
+		if err != nil {
+			return err
+		}
+		tree := getCheckpointTree(manifest)
+		for _, entry := range tree.entries {
+			if entry.FileName != nil && getFileEntryError(entry) == "" && hasChunkHashes(entry) {
+				dedup.add(entry)
+			}
+		}
+		if previous != nil && i <= last && i > last-churn {
+			result := getCheckpointChurn(previous, tree)
+			result.From = strings.TrimSuffix(filepath.Base(checkpoints[i-1]), ".cxo")
+			result.To = strings.TrimSuffix(filepath.Base(name), ".cxo")
+			stats.Churn = append(stats.Churn, result)
+		}
+		previous = tree
+	}
+	stats.RepositoryDedup = dedup.getStats()
+	return nil
+}
+
+// getCheckpointChurn returns the files added, removed and modified from
+// checkpoint a to checkpoint b, and the bytes of the added and removed
+// contents
+func getCheckpointChurn(a *checkpointTree, b *checkpointTree) CheckpointChurn {
+	var result CheckpointChurn
+	for relPath, entryA := range a.entries {
+		if entryA.FileName == nil {
+			continue
+		}
+		entryB := b.entries[relPath]
+		switch {
+		case entryB == nil || entryB.FileName == nil:
+			result.Removed++
+			result.BytesRemoved += entryA.Size
+		case string(entryA.HashList.FileHash.Hash) != string(entryB.HashList.FileHash.Hash):
+			result.Modified++
+			result.BytesRemoved += entryA.Size
+			result.BytesAdded += entryB.Size
+		}
+	}
+	for relPath, entryB := range b.entries {
+		if entryB.FileName == nil {
+			continue
+		}
+		if entryA := a.entries[relPath]; entryA == nil || entryA.FileName == nil {
+			result.Added++
+			result.BytesAdded += entryB.Size
+		}
+	}
+	return result
+}
+
+func (b *StatsBucket) add(size int64) {
+	b.Files++
+	b.Bytes += size
+}
+
+// getStatsSizeBucket returns the index in the size histogram of a file size
+func getStatsSizeBucket(size int64) int {
+	if size == 0 {
+		return 0
+	}
+	for i, bound := range statsSizeBounds {
+		if size < bound {
+			return i + 1
+		}
+	}
+	return len(statsSizeBounds) + 1
+}
+
+// parseStatsDate parses the creation date of a file item, its ctime
+func parseStatsDate(creationDate string) (time.Time, bool) {
+	date, err := time.ParseInLocation("2006-01-02", creationDate, time.Local)
+	return date, err == nil
+}
+
+// getStatsAgeBucket returns the index in the ages of a file modified on the
+// date, the last one for an unknown date
+func getStatsAgeBucket(created time.Time, modified time.Time, known bool) int {
+	if !known {
+		return len(statsAgeLabels)
+	}
+	days := int(created.Sub(modified).Hours() / 24)
+	for i, bound := range statsAgeBounds {
+		if days < bound {
+			return i
+		}
+	}
+	return len(statsAgeBounds)
+}
+
+// getStatsExtension returns the lower case extension of a file, empty for
+// the files without one and the dot files like .bashrc
+func getStatsExtension(relPath string) string {
+	base := filepath.Base(relPath)
+	extension := filepath.Ext(base)
+	if extension == base {
+		return ""
+	}
+	return strings.ToLower(extension)
+}
+
+func newStatsDedup() *statsDedup {
+	return &statsDedup{seen: make(map[string]bool)}
+}
+
+func (d *statsDedup) add(entry *ManifestFile) {
+	for i, size := range getManifestFileChunkSizes(entry) {
+		hash := string(entry.HashList.ChunksHashes[i])
+		d.result.Chunks++
+		d.result.LogicalBytes += int64(size)
+		if !d.seen[hash] {
+			d.seen[hash] = true
+			d.result.UniqueChunks++
+			d.result.UniqueBytes += int64(size)
+		}
+	}
+}
+
+func (d *statsDedup) getStats() DedupStats {
+	result := d.result
+	if result.UniqueBytes > 0 {
+		result.Ratio = float64(result.LogicalBytes) / float64(result.UniqueBytes)
+	}
+	return result
+}
+
+// printCheckpointStats writes the stats of the checkpoint as text, JSON or a
+// self-contained HTML page
+func printCheckpointStats(w io.Writer, checkpoint string, format string, options statsOptions) error {
+	switch format {
+	case statsFormatText, statsFormatJSON, statsFormatHTML:
+	default:
+		return usageError("unknown stats format %q, use text, json or html", format)
+	}
+	stats, err := getCheckpointStats(checkpoint, options)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case statsFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	case statsFormatHTML:
+		return statsTemplate.Execute(w, stats)
+	}
+	return writeStatsText(w, stats)
+}
+
+func writeStatsText(w io.Writer, stats *CheckpointStats) error {
+	summary := &stats.Checkpoint
+	fmt.Fprintf(w, "checkpoint %s  sequence %d  created %s  files %d  directories %d  size %s\n",
+		summary.Name, summary.SequenceId, summary.CreatedAt, summary.Files, summary.Directories,
+		formatBytes(int64(summary.Size)))
+	if stats.ErroredFiles > 0 || stats.UnknownSizeFiles > 0 {
+		fmt.Fprintf(w, "errored files %d  files of unknown size %d\n", stats.ErroredFiles, stats.UnknownSizeFiles)
+	}
+	writeStatsBuckets(w, "file sizes", stats.SizeHistogram)
+	writeStatsBuckets(w, "file ages", stats.Ages)
+
+	fmt.Fprintf(w, "\nextensions (%d)\n", stats.ExtensionCount)
+	for _, extension := range stats.Extensions {
+		name := extension.Extension
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(w, "  %-16s %8d files  %10s\n", name, extension.Files, formatBytes(extension.Bytes))
+	}
+	fmt.Fprintf(w, "\nlargest directories\n")
+	for _, dir := range stats.LargestDirectories {
+		fmt.Fprintf(w, "  %10s  %8d files  %s\n", formatBytes(dir.Bytes), dir.Files, dir.Path)
+	}
+
+	if len(stats.Churn) > 0 {
+		fmt.Fprintf(w, "\nchurn\n")
+		for _, churn := range stats.Churn {
+			fmt.Fprintf(w, "  %s -> %s  %d added  %d removed  %d modified  +%s  -%s\n",
+				churn.From, churn.To, churn.Added, churn.Removed, churn.Modified,
+				formatBytes(churn.BytesAdded), formatBytes(churn.BytesRemoved))
+		}
+	}
+	fmt.Fprintf(w, "\nchunk dedup\n")
+	writeStatsDedup(w, "checkpoint", &stats.Dedup)
+	writeStatsDedup(w, "all checkpoints", &stats.RepositoryDedup)
+	return nil
+}
+
+func writeStatsBuckets(w io.Writer, title string, buckets []StatsBucket) {
+	fmt.Fprintf(w, "\n%s\n", title)
+	for _, bucket := range buckets {
+		fmt.Fprintf(w, "  %-12s %8d files  %10s\n", bucket.Label, bucket.Files, formatBytes(bucket.Bytes))
+	}
+}
+
+func writeStatsDedup(w io.Writer, title string, dedup *DedupStats) {
+	fmt.Fprintf(w, "  %-16s %d chunks  %s  unique %d chunks  %s  ratio %.2f\n", title,
+		dedup.Chunks, formatBytes(dedup.LogicalBytes), dedup.UniqueChunks, formatBytes(dedup.UniqueBytes), dedup.Ratio)
+}
+
+// getStatsPercent returns the share of the value in the total, for the
+// widths of the bars of the HTML page
+func getStatsPercent(value int64, total uint64) string {
+	if total == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%.1f", float64(value)*100/float64(total))
+}
+
+var statsTemplate = template.Must(template.New("stats").Funcs(template.FuncMap{
+	"bytes":   formatBytes,
+	"size":    func(size uint64) string { return formatBytes(int64(size)) },
+	"percent": getStatsPercent,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>checkpoint {{.Checkpoint.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 2px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+td.bars { width: 300px; text-align: left; }
+div.bar { background: #4a7bd0; height: 12px; min-width: 1px; }
+</style>
+</head>
+<body>
+{{$total := .Checkpoint.Size}}
+<h1>checkpoint {{.Checkpoint.Name}}</h1>
+<p>sequence {{.Checkpoint.SequenceId}}, created {{.Checkpoint.CreatedAt}}: {{.Checkpoint.Files}} files in {{.Checkpoint.Directories}} directories, {{size .Checkpoint.Size}}{{if .ErroredFiles}}, {{.ErroredFiles}} errored files{{end}}{{if .UnknownSizeFiles}}, {{.UnknownSizeFiles}} files of unknown size{{end}}</p>
+<h2>file sizes</h2>
+<table>
+<tr><th>size</th><th>files</th><th>bytes</th><th></th></tr>
+{{range .SizeHistogram}}<tr><td>{{.Label}}</td><td>{{.Files}}</td><td>{{bytes .Bytes}}</td><td class="bars"><div class="bar" style="width: {{percent .Bytes $total}}%"></div></td></tr>
+{{end}}</table>
+<h2>file ages</h2>
+<table>
+<tr><th>age</th><th>files</th><th>bytes</th><th></th></tr>
+{{range .Ages}}<tr><td>{{.Label}}</td><td>{{.Files}}</td><td>{{bytes .Bytes}}</td><td class="bars"><div class="bar" style="width: {{percent .Bytes $total}}%"></div></td></tr>
+{{end}}</table>
+<h2>extensions ({{.ExtensionCount}})</h2>
+<table>
+<tr><th>extension</th><th>files</th><th>bytes</th><th></th></tr>
+{{range .Extensions}}<tr><td>{{if .Extension}}{{.Extension}}{{else}}(none){{end}}</td><td>{{.Files}}</td><td>{{bytes .Bytes}}</td><td class="bars"><div class="bar" style="width: {{percent .Bytes $total}}%"></div></td></tr>
+{{end}}</table>
+<h2>largest directories</h2>
+<table>
+<tr><th>directory</th><th>files</th><th>bytes</th><th></th></tr>
+{{range .LargestDirectories}}<tr><td>{{.Path}}</td><td>{{.Files}}</td><td>{{bytes .Bytes}}</td><td class="bars"><div class="bar" style="width: {{percent .Bytes $total}}%"></div></td></tr>
+{{end}}</table>
+{{if .Churn}}<h2>churn</h2>
+<table>
+<tr><th>checkpoints</th><th>added</th><th>removed</th><th>modified</th><th>bytes added</th><th>bytes removed</th></tr>
+{{range .Churn}}<tr><td>{{.From}} &rarr; {{.To}}</td><td>{{.Added}}</td><td>{{.Removed}}</td><td>{{.Modified}}</td><td>{{bytes .BytesAdded}}</td><td>{{bytes .BytesRemoved}}</td></tr>
+{{end}}</table>
+{{end}}<h2>chunk dedup</h2>
+<table>
+<tr><th></th><th>chunks</th><th>bytes</th><th>unique chunks</th><th>unique bytes</th><th>ratio</th></tr>
+{{with .Dedup}}<tr><td>checkpoint</td><td>{{.Chunks}}</td><td>{{bytes .LogicalBytes}}</td><td>{{.UniqueChunks}}</td><td>{{bytes .UniqueBytes}}</td><td>{{printf "%.2f" .Ratio}}</td></tr>
+{{end}}{{with .RepositoryDedup}}<tr><td>all checkpoints</td><td>{{.Chunks}}</td><td>{{bytes .LogicalBytes}}</td><td>{{.UniqueChunks}}</td><td>{{bytes .UniqueBytes}}</td><td>{{printf "%.2f" .Ratio}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointStats(t *testing.T) {
+	defer setupTestRepository(t)()
+	data := make([]byte, 2*chunkSize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join("photos", "2020"), 0700))
+	require.NoError(t, os.Mkdir("docs", 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("photos", "2020", "a.JPG"), data, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("photos", "b.jpg"), data, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("docs", "c.txt"), []byte("c"), 0600))
+	require.NoError(t, ioutil.WriteFile(".profile", nil, 0600))
+	first := commitTestRepository(t)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join("docs", "c.txt"), []byte("cc"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("docs", "d.txt"), []byte("d"), 0600))
+	require.NoError(t, os.Remove(".profile"))
+	second := commitTestRepository(t)
+
+	stats, err := getCheckpointStats(second, statsOptions{top: 2, churn: 10})
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.Checkpoint.Files)
+	require.Equal(t, StatsBucket{Label: "< 4.0 KiB", Files: 2, Bytes: 3}, stats.SizeHistogram[1])
+	require.Equal(t, 0, stats.SizeHistogram[0].Files)
+	require.Equal(t, 4, stats.Ages[0].Files)
+
+	require.Equal(t, 2, stats.ExtensionCount)
+	require.Equal(t, []ExtensionStats{{".jpg", 2, int64(4 * chunkSize)}, {".txt", 2, 3}}, stats.Extensions)
+	require.Equal(t, []DirectoryStats{{"photos", 2, int64(4 * chunkSize)}, {"photos/2020", 1, int64(2 * chunkSize)}}, stats.LargestDirectories)
+
+	require.Equal(t, []CheckpointChurn{{
+		From: filepath.Base(first[:len(first)-4]), To: filepath.Base(second[:len(second)-4]),
+		Added: 1, Removed: 1, Modified: 1, BytesAdded: 3, BytesRemoved: 1,
+	}}, stats.Churn)
+
+	// a.JPG and b.jpg have the same chunks
+	require.Equal(t, DedupStats{Chunks: 6, UniqueChunks: 4, LogicalBytes: int64(4*chunkSize) + 3, UniqueBytes: int64(2*chunkSize) + 3, Ratio: stats.Dedup.Ratio}, stats.Dedup)
+	require.InDelta(t, float64(4*chunkSize+3)/float64(2*chunkSize+3), stats.Dedup.Ratio, 0.0001)
+	require.Equal(t, 11, stats.RepositoryDedup.Chunks)
+	require.Equal(t, 5, stats.RepositoryDedup.UniqueChunks)
+
+	var text, jsonOutput, html bytes.Buffer
+	require.NoError(t, printCheckpointStats(&text, second, statsFormatText, statsOptions{top: 10, churn: 10}))
+	require.Contains(t, text.String(), "photos/2020\n")
+	require.Contains(t, text.String(), "1 added  1 removed  1 modified")
+	require.NoError(t, printCheckpointStats(&jsonOutput, second, statsFormatJSON, statsOptions{top: 10, churn: 10}))
+	var decoded CheckpointStats
+	require.NoError(t, json.Unmarshal(jsonOutput.Bytes(), &decoded))
+	require.Equal(t, 4, decoded.Checkpoint.Files)
+	require.NoError(t, printCheckpointStats(&html, second, statsFormatHTML, statsOptions{top: 10, churn: 10}))
+	require.Contains(t, html.String(), "<td>photos/2020</td>")
+	require.NotContains(t, html.String(), "http")
+
+	err = printCheckpointStats(&text, second, "csv", statsOptions{})
+	require.Equal(t, exitUsage, getExitCode(err))
+
+	// the churn stops at the checkpoint
+	stats, err = getCheckpointStats(first, statsOptions{top: 10, churn: 10})
+	require.NoError(t, err)
+	require.Empty(t, stats.Churn)
+	require.Equal(t, 1, stats.SizeHistogram[0].Files)
+
+}
+
+func TestStatsAgesFromModified(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, ioutil.WriteFile("old", []byte("old"), 0600))
+	require.NoError(t, ioutil.WriteFile("new", []byte("new"), 0600))
+	twoYearsAgo := time.Now().AddDate(-2, 0, 0)
+	require.NoError(t, os.Chtimes("old", twoYearsAgo, twoYearsAgo))
+	checkpoint := commitTestRepository(t)
+
+	// the ctime of old is today, its recorded mtime two years ago
+	stats, err := getCheckpointStats(checkpoint, statsOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Ages[0].Files)
+	require.Equal(t, 1, stats.Ages[4].Files)
+
+	// checkpoints without the mtimes fall back to the ctimes
+	manifest, err := readManifestFile(checkpoint)
+	require.NoError(t, err)
+	for i := range manifest.ManifestBody.ManifestFileList {
+		manifest.ManifestBody.ManifestFileList[i].MetaString = []byte{}
+	}
+	baseName, err := writeCheckpoint(manifest)
+	require.NoError(t, err)
+	stats, err = getCheckpointStats(currentDir+manifestCXOFolder+baseName+".cxo", statsOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Ages[0].Files)
+}
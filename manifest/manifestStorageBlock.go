@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	storageBlockMagic   = "CXOBLOCK"
+	storageBlockVersion = 1
+	// magic followed by the uint64 length of the serialized header
+	storageBlockPrefixSize = 16
+	defaultBlockSizeMB     = 1024
+)
+
+// storageBlock is an immutable, memory-mapped block file holding many chunk
+// objects. The index of the chunks it holds is stored at the start of the file.
+type storageBlock struct {
+	path   string
+	header StorageBlockHeader
+	// offset of the data section in the file
+	dataStart uint64
+	data      []byte
+}
+
+type blockLocation struct {
+	block *storageBlock
+	entry StorageBlockIndexEntry
+}
+
+// blockEntrySource is a chunk object to be written into a new block
+type blockEntrySource struct {
+	hash   []byte
+	length uint64
+	read   func() ([]byte, error)
+}
+
+func openStorageBlock(path string) (*storageBlock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < storageBlockPrefixSize {
+		return nil, fmt.Errorf("storage block %s: file too short", path)
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &storageBlock{path: path, data: data}
+	if err := block.parseHeader(); err != nil {
+		block.close()
+		return nil, fmt.Errorf("storage block %s: %w", path, err)
+	}
+	return block, nil
+}
+
+func (b *storageBlock) parseHeader() error {
+	if string(b.data[:len(storageBlockMagic)]) != storageBlockMagic {
+		return fmt.Errorf("bad magic")
+	}
+	headerLength := binary.LittleEndian.Uint64(b.data[len(storageBlockMagic):storageBlockPrefixSize])
+	b.dataStart = storageBlockPrefixSize + headerLength
+	if b.dataStart > uint64(len(b.data)) {
+		return fmt.Errorf("header exceeds file size")
+	}
+	if err := encoder.DeserializeRawExact(b.data[storageBlockPrefixSize:b.dataStart], &b.header); err != nil {
+		return err
+	}
+	for _, entry := range b.header.Index {
+		if b.dataStart+entry.Offset+entry.Length > uint64(len(b.data)) {
+			return fmt.Errorf("chunk %x exceeds file size", entry.Hash)
+		}
+	}
+	return nil
+}
+
+func (b *storageBlock) close() error {
+	if b.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(b.data)
+	b.data = nil
+	return err
+}
+
+// objectBytes returns the serialized chunk object, backed by the mapped file
+func (b *storageBlock) objectBytes(entry StorageBlockIndexEntry) []byte {
+	start := b.dataStart + entry.Offset
+	return b.data[start : start+entry.Length]
+}
+
+// verify checks the merkle root against the index and every chunk against
+// its hash, returning the hashes of the chunks that fail
+func (b *storageBlock) verify() ([][]byte, error) {
+	var result [][]byte
+	var hashes [][]byte
+	for _, entry := range b.header.Index {
+		hashes = append(hashes, entry.Hash)
+	}
+	if !bytes.Equal(getMerkleRoot(hashes), b.header.MerkleRoot) {
+		return nil, fmt.Errorf("storage block %s: merkle root mismatch", b.path)
+	}
+
+	for _, entry := range b.header.Index {
+		if _, err := decodeChunkObject(entry.Hash, b.objectBytes(entry)); err != nil {
+			result = append(result, entry.Hash)
+		}
+	}
+	return result, nil
+}
+
+// getMerkleRoot computes the merkle root of the hashes, pairing the last
+// hash of an odd level with itself
+func getMerkleRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		return sha256.New().Sum(nil)
+	}
+	level := hashes
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			h := sha256.New()
+			h.Write(level[i])
+			h.Write(right)
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// writeStorageBlock writes the chunk objects into a new block file in dir,
+// named by the merkle root of its chunk hashes
+func writeStorageBlock(dir string, sources []blockEntrySource) (string, error) {
+	var header StorageBlockHeader
+	var hashes [][]byte
+	var offset uint64
+
+	for _, source := range sources {
+		header.Index = append(header.Index, StorageBlockIndexEntry{
+			Hash:   source.hash,
+			Offset: offset,
+			Length: source.length,
+		})
+		hashes = append(hashes, source.hash)
+		offset += source.length
+	}
+	header.Version = storageBlockVersion
+	header.MerkleRoot = getMerkleRoot(hashes)
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, hex.EncodeToString(header.MerkleRoot)+".blk")
+	tempFile, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	serializedHeader := encoder.Serialize(header)
+	prefix := make([]byte, storageBlockPrefixSize)
+	copy(prefix, storageBlockMagic)
+	binary.LittleEndian.PutUint64(prefix[len(storageBlockMagic):], uint64(len(serializedHeader)))
+	if _, err := tempFile.Write(append(prefix, serializedHeader...)); err != nil {
+		return "", err
+	}
+
+	for _, source := range sources {
+		object, err := source.read()
+		if err != nil {
+			return "", err
+		}
+		if uint64(len(object)) != source.length {
+			return "", fmt.Errorf("chunk %x: size changed while packing", source.hash)
+		}
+		if _, err := tempFile.Write(object); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tempFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tempFile.Name(), path)
+}
+
+// loadStorageBlocks maps all the block files of the store and indexes their chunks
+func (s *chunkStore) loadStorageBlocks() error {
+	s.blockIndex = make(map[string]blockLocation)
+	files, err := ioutil.ReadDir(s.blocksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".blk") {
+			continue
+		}
+		block, err := openStorageBlock(filepath.Join(s.blocksDir, file.Name()))
+		if err != nil {
+			// damaged blocks are left to scrub and repair
+			s.unreadableBlocks = append(s.unreadableBlocks, filepath.Join(s.blocksDir, file.Name()))
+			continue
+		}
+		s.blocks = append(s.blocks, block)
+		for _, entry := range block.header.Index {
+			s.blockIndex[string(entry.Hash)] = blockLocation{block, entry}
+		}
+	}
+	return nil
+}
+
+func (s *chunkStore) closeStorageBlocks() error {
+	var result error
+	for _, block := range s.blocks {
+		if err := block.close(); err != nil {
+			result = err
+		}
+	}
+	s.blocks = nil
+	s.unreadableBlocks = nil
+	s.blockIndex = make(map[string]blockLocation)
+	return result
+}
+
+// pack moves all loose chunk objects into storage blocks of at most blockSize
+// bytes, returning the number of blocks written
+func (s *chunkStore) pack(blockSize uint64) (int, error) {
+	var sources []blockEntrySource
+	var looseHashes [][]byte
+
+	err := s.backend.List(func(hash []byte, size int64) error {
+		looseHashes = append(looseHashes, hash)
+		if _, ok := s.blockIndex[string(hash)]; ok {
+			return nil
+		}
+		sources = append(sources, blockEntrySource{
+			hash:   hash,
+			length: uint64(size),
+			read: func() ([]byte, error) {
+				return s.backend.Get(hash)
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	paths, err := s.writeStorageBlocks(sources, blockSize)
+	if err != nil {
+		return len(paths), err
+	}
+	for _, hash := range looseHashes {
+		if err := s.backend.Delete(hash); err != nil {
+			return len(paths), err
+		}
+	}
+	return len(paths), s.reloadStorageBlocks()
+}
+
+// repack rewrites the storage blocks holding chunks no checkpoint references,
+// dropping those chunks. It returns the number and size of dropped chunks.
+func (s *chunkStore) repack(referenced map[string]bool, blockSize uint64) (int64, int64, error) {
+	var sources []blockEntrySource
+	var oldBlocks []string
+	var droppedCount, droppedSize int64
+
+	for _, block := range s.blocks {
+		var kept []blockEntrySource
+		for _, entry := range block.header.Index {
+			if !referenced[string(entry.Hash)] {
+				droppedCount++
+				droppedSize += int64(entry.Length)
+				continue
+			}
+			b, e := block, entry
+			kept = append(kept, blockEntrySource{
+				hash:   e.Hash,
+				length: e.Length,
+				read: func() ([]byte, error) {
+					return b.objectBytes(e), nil
+				},
+			})
+		}
+		if len(kept) < len(block.header.Index) {
+			sources = append(sources, kept...)
+			oldBlocks = append(oldBlocks, block.path)
+		}
+	}
+	if len(oldBlocks) == 0 {
+		return 0, 0, nil
+	}
+
+	paths, err := s.writeStorageBlocks(sources, blockSize)
+	if err != nil {
+		return droppedCount, droppedSize, err
+	}
+	newBlocks := make(map[string]bool)
+	for _, path := range paths {
+		newBlocks[path] = true
+	}
+
+	if err := s.closeStorageBlocks(); err != nil {
+		return droppedCount, droppedSize, err
+	}
+	for _, path := range oldBlocks {
+		if newBlocks[path] {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return droppedCount, droppedSize, err
+		}
+		if err := os.Remove(s.parityPath(path)); err != nil && !os.IsNotExist(err) {
+			return droppedCount, droppedSize, err
+		}
+	}
+	return droppedCount, droppedSize, s.loadStorageBlocks()
+}
+
+func (s *chunkStore) writeStorageBlocks(sources []blockEntrySource, blockSize uint64) ([]string, error) {
+	var result []string
+	for len(sources) > 0 {
+		n := blockSourceCount(sources, blockSize)
+		path, err := writeStorageBlock(s.blocksDir, sources[:n])
+		if err != nil {
+			return result, err
+		}
+		result = append(result, path)
+		sources = sources[n:]
+	}
+	return result, nil
+}
+
+func (s *chunkStore) reloadStorageBlocks() error {
+	if err := s.closeStorageBlocks(); err != nil {
+		return err
+	}
+	return s.loadStorageBlocks()
+}
+
+// blockSourceCount returns how many of the sources fit into one block,
+// always at least one
+func blockSourceCount(sources []blockEntrySource, blockSize uint64) int {
+	var size uint64
+	for i, source := range sources {
+		size += source.length
+		if size > blockSize && i > 0 {
+			return i
+		}
+	}
+	return len(sources)
+}
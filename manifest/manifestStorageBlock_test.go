@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageBlockPackAndRepack(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "storageblock")
+	require.NoError(t, err)
+	defer os.RemoveAll(repoDir)
+	require.NoError(t, os.Mkdir(repoDir+"/.cxo", 0700))
+
+	store, err := openChunkStore(repoDir)
+	require.NoError(t, err)
+	defer store.close()
+
+	var hashes [][]byte
+	for i := 0; i < 5; i++ {
+		data := bytes.Repeat([]byte{byte(i + 1)}, 1000*(i+1))
+		hash := hashChunkData(data)
+		require.NoError(t, store.put(hash, data))
+		hashes = append(hashes, hash)
+	}
+
+	count, err := store.pack(8000)
+	require.NoError(t, err)
+	require.True(t, count > 1)
+	require.Len(t, store.blocks, count)
+
+	for i, hash := range hashes {
+		requireChunkStored(t, store, hash, true)
+		data, err := store.get(hash)
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte{byte(i + 1)}, 1000*(i+1)), data)
+	}
+	for _, block := range store.blocks {
+		bad, err := block.verify()
+		require.NoError(t, err)
+		require.Empty(t, bad)
+	}
+
+	referenced := map[string]bool{string(hashes[0]): true, string(hashes[4]): true}
+	dropped, _, err := store.repack(referenced, 8000)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), dropped)
+
+	requireChunkStored(t, store, hashes[0], true)
+	requireChunkStored(t, store, hashes[4], true)
+	requireChunkStored(t, store, hashes[2], false)
+	data, err := store.get(hashes[4])
+	require.NoError(t, err)
+	require.Len(t, data, 5000)
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a, b, c := hashChunkData([]byte("a")), hashChunkData([]byte("b")), hashChunkData([]byte("c"))
+	require.Equal(t, a, getMerkleRoot([][]byte{a}))
+	require.NotEqual(t, getMerkleRoot([][]byte{a, b}), getMerkleRoot([][]byte{b, a}))
+	require.Equal(t, getMerkleRoot([][]byte{getMerkleRoot([][]byte{a, b}), getMerkleRoot([][]byte{c, c})}),
+		getMerkleRoot([][]byte{a, b, c}))
+}
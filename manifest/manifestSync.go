@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// syncOptions change what sync does to the destination
+type syncOptions struct {
+	// remove the files and directories the checkpoint does not have, and
+	// move the files renamed since instead of copying them
+	delete bool
+	// print what would be done without changing the destination
+	dryRun bool
+}
+
+// syncStats is what a sync did
+type syncStats struct {
+	unchanged, created, updated, renamed, deleted, skipped int
+	// chunks read from the source, and those found in the destination
+	copiedChunks, reusedChunks int
+	copiedBytes, reusedBytes   int64
+}
+
+// syncDestFile is a file found in the destination before the sync
+type syncDestFile struct {
+	relPath string
+	size    int64
+	hash    []byte
+	chunks  []ChunkHash
+	// moved to another path by the sync
+	renamed bool
+}
+
+// syncChunkLocation is where a chunk is in the destination
+type syncChunkLocation struct {
+	relPath string
+	offset  int64
+}
+
+// syncer copies the files of a checkpoint to a destination directory
+type syncer struct {
+	store   *chunkStore
+	dest    string
+	options syncOptions
+	w       io.Writer
+	stats   syncStats
+	files   map[string]*syncDestFile
+	chunks  map[string]syncChunkLocation
+}
+
+// scanSyncDestination hashes the files of the destination and records where
+// each of their chunks is
+func (s *syncer) scanSyncDestination() error {
+	s.files = make(map[string]*syncDestFile)
+	s.chunks = make(map[string]syncChunkLocation)
+	if !isFolderExist(s.dest) {
+		return nil
+	}
+	return filepath.Walk(s.dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".cxo" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), tempFilePrefix) {
+			return nil
+		}
+		relPath, err := filepath.Rel(s.dest, path)
+		if err != nil {
+			return err
+		}
+		fileHash, chunks, _, err := getFileChunks(path)
+		if err != nil {
+			return err
+		}
+		s.files[relPath] = &syncDestFile{relPath: relPath, size: info.Size(), hash: fileHash.Hash, chunks: chunks}
+		for index, chunk := range chunks {
+			if _, ok := s.chunks[string(chunk.Hash)]; !ok {
+				s.chunks[string(chunk.Hash)] = syncChunkLocation{relPath, int64(index) * int64(chunkSize)}
+			}
+		}
+		return nil
+	})
+}
+
+// readSyncChunk returns the data of a chunk from the destination if a file
+// there has it, or else from the source. Chunks of the destination are
+// checked, as the files they were found in may have been rewritten since
+func (s *syncer) readSyncChunk(relPath string, hash []byte, index int, size int) ([]byte, error) {
+	if location, ok := s.chunks[string(hash)]; ok {
+		data := make([]byte, size)
+		file, err := os.Open(filepath.Join(s.dest, location.relPath))
+		if err == nil {
+			_, err = file.ReadAt(data, location.offset)
+			file.Close()
+		}
+		if err == nil && bytes.Equal(hashChunkData(data), hash) {
+			s.stats.reusedChunks++
+			s.stats.reusedBytes += int64(size)
+			return data, nil
+		}
+		delete(s.chunks, string(hash))
+	}
+	data, err := readCheckpointChunk(s.store, relPath, hash, index, size)
+	if err != nil {
+		return nil, err
+	}
+	s.stats.copiedChunks++
+	s.stats.copiedBytes += int64(size)
+	return data, nil
+}
+
+// countSyncChunk counts a chunk of a dry run where readSyncChunk would
+// read it
+func (s *syncer) countSyncChunk(hash []byte, size int) {
+	if _, ok := s.chunks[string(hash)]; ok {
+		s.stats.reusedChunks++
+		s.stats.reusedBytes += int64(size)
+	} else {
+		s.stats.copiedChunks++
+		s.stats.copiedBytes += int64(size)
+	}
+}
+
+// findRenamed returns a file of the destination the checkpoint does not
+// have with the content of the entry, to be moved instead of copied
+func (s *syncer) findRenamed(entry *ManifestFile, sourcePaths map[string]bool) *syncDestFile {
+	var candidates []*syncDestFile
+	for relPath, file := range s.files {
+		if !sourcePaths[relPath] && !file.renamed && file.size == entry.Size && bytes.Equal(file.hash, entry.HashList.FileHash.Hash) {
+			candidates = append(candidates, file)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].relPath < candidates[j].relPath
+	})
+	return candidates[0]
+}
+
+// syncFile makes the file of the destination the same as the entry: moved
+// from a renamed file, rewritten where its chunks differ, or written whole
+func (s *syncer) syncFile(relPath string, entry *ManifestFile, sourcePaths map[string]bool) error {
+	existing := s.files[relPath]
+	if existing != nil && existing.size == entry.Size && bytes.Equal(existing.hash, entry.HashList.FileHash.Hash) {
+		s.stats.unchanged++
+		return nil
+	}
+	target := filepath.Join(s.dest, relPath)
+	if s.options.delete {
+		if renamed := s.findRenamed(entry, sourcePaths); renamed != nil {
+			fmt.Fprintf(s.w, "rename %s -> %s\n", renamed.relPath, relPath)
+			s.stats.renamed++
+			renamed.renamed = true
+			if s.options.dryRun {
+				return nil
+			}
+			for _, chunk := range renamed.chunks {
+				if location := s.chunks[string(chunk.Hash)]; location.relPath == renamed.relPath {
+					s.chunks[string(chunk.Hash)] = syncChunkLocation{relPath, location.offset}
+				}
+			}
+			return os.Rename(filepath.Join(s.dest, renamed.relPath), target)
+		}
+	}
+
+	sizes := getManifestFileChunkSizes(entry)
+	holes, err := getFileEntryHoles(entry)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		fmt.Fprintf(s.w, "create %s\n", relPath)
+		s.stats.created++
+	} else {
+		changed := 0
+		for index, hash := range entry.HashList.ChunksHashes {
+			if index >= len(existing.chunks) || !bytes.Equal(existing.chunks[index].Hash, hash) {
+				changed++
+			}
+		}
+		fmt.Fprintf(s.w, "update %s (%d of %d chunks)\n", relPath, changed, len(sizes))
+		s.stats.updated++
+	}
+	if s.options.dryRun {
+		for index, hash := range entry.HashList.ChunksHashes {
+			offset := int64(index) * int64(chunkSize)
+			unchanged := existing != nil && index < len(existing.chunks) && bytes.Equal(existing.chunks[index].Hash, hash)
+			if !unchanged && !isInHole(holes, offset, offset+int64(sizes[index])) {
+				s.countSyncChunk(hash, sizes[index])
+			}
+		}
+		return nil
+	}
+	if existing == nil {
+		return s.createFile(relPath, target, entry, sizes, holes)
+	}
+	return s.updateFile(relPath, target, entry, existing, sizes, holes)
+}
+
+// removeTypeConflicts removes the files of the destination where the
+// checkpoint has a directory, and the directories where it has a file, which
+// the sync could not replace otherwise. Without -delete nothing is removed
+// and the first conflict is returned as an error
+func (s *syncer) removeTypeConflicts(dirs []string, files []string) error {
+	conflicts := make(map[string]string)
+	for _, dir := range dirs {
+		if info, err := os.Stat(filepath.Join(s.dest, dir)); err == nil && !info.IsDir() {
+			conflicts[dir] = "a file where the checkpoint has a directory"
+		}
+	}
+	for _, file := range files {
+		if info, err := os.Lstat(filepath.Join(s.dest, file)); err == nil && info.IsDir() {
+			conflicts[file] = "a directory where the checkpoint has a file"
+		}
+	}
+	var paths []string
+	for relPath := range conflicts {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+	if len(paths) > 0 && !s.options.delete {
+		return usageError("the destination has %s at %s, sync with -delete to replace it", conflicts[paths[0]], paths[0])
+	}
+	for _, relPath := range paths {
+		fmt.Fprintf(s.w, "delete %s\n", relPath)
+		prefix := relPath + string(filepath.Separator)
+		for path := range s.files {
+			if path == relPath || strings.HasPrefix(path, prefix) {
+				delete(s.files, path)
+				s.stats.deleted++
+			}
+		}
+		for hash, location := range s.chunks {
+			if location.relPath == relPath || strings.HasPrefix(location.relPath, prefix) {
+				delete(s.chunks, hash)
+			}
+		}
+		if !s.options.dryRun {
+			if err := os.RemoveAll(filepath.Join(s.dest, relPath)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getSyncChunk returns the data of a chunk of the entry, zeros for chunks in
+// the holes of sparse files
+func (s *syncer) getSyncChunk(relPath string, entry *ManifestFile, index int, size int, holes []FileExtent) ([]byte, error) {
+	offset := int64(index) * int64(chunkSize)
+	if isInHole(holes, offset, offset+int64(size)) {
+		return make([]byte, size), nil
+	}
+	return s.readSyncChunk(relPath, entry.HashList.ChunksHashes[index], index, size)
+}
+
+// createFile writes a new file through a temporary file, leaving the holes
+// of sparse files as holes. It gets the permissions of the umask, as files
+// created by cp do
+func (s *syncer) createFile(relPath string, target string, entry *ManifestFile, sizes []int, holes []FileExtent) error {
+	tempFile, err := createTempFile(filepath.Dir(target), 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	writer := &sparseWriter{file: tempFile, holes: holes}
+	for index, size := range sizes {
+		data, err := s.getSyncChunk(relPath, entry, index, size, holes)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := writer.close(); err != nil {
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), target)
+}
+
+// updateFile rewrites the chunks of an existing file that differ from those
+// of the entry, in place, and truncates it to its size
+func (s *syncer) updateFile(relPath string, target string, entry *ManifestFile, existing *syncDestFile, sizes []int, holes []FileExtent) error {
+	file, err := os.OpenFile(target, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for index, hash := range entry.HashList.ChunksHashes {
+		if index < len(existing.chunks) && bytes.Equal(existing.chunks[index].Hash, hash) {
+			continue
+		}
+		data, err := s.getSyncChunk(relPath, entry, index, sizes[index], holes)
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(data, int64(index)*int64(chunkSize)); err != nil {
+			return err
+		}
+	}
+	if err := file.Truncate(entry.Size); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// syncCheckpoint makes the destination directory hold the files of the
+// checkpoint. Chunks are copied from the chunk store or the files of the
+// current directory only if no file of the destination has them, changed
+// files are rewritten where their chunks differ, and the files written are
+// checked against the checkpoint at the end
+func syncCheckpoint(checkpoint string, dest string, options syncOptions, w io.Writer) (syncStats, error) {
+	s := syncer{options: options, w: w}
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return s.stats, err
+	}
+	s.dest = dest
+	if dest == currentDir || strings.HasPrefix(dest, currentDir+string(filepath.Separator)) {
+		return s.stats, usageError("the destination %s is in the directory of the checkpoint", dest)
+	}
+	if strings.HasPrefix(currentDir+string(filepath.Separator), dest+string(filepath.Separator)) {
+		return s.stats, usageError("the directory of the checkpoint is in the destination %s", dest)
+	}
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return s.stats, err
+	}
+	if isFolderExist(currentDir + manifestChunksFolder) {
+		if s.store, err = openChunkStore(currentDir); err != nil {
+			return s.stats, err
+		}
+		defer s.store.close()
+	}
+	if err := s.scanSyncDestination(); err != nil {
+		return s.stats, err
+	}
+
+	root := getCheckpointRoot(manifest)
+	sourcePaths := make(map[string]bool)
+	var dirs, files []string
+	entries := make(map[string]*ManifestFile)
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		relPath := getManifestFileRelPath(root, entry)
+		sourcePaths[relPath] = true
+		entries[relPath] = entry
+		if entry.FileName == nil {
+			dirs = append(dirs, relPath)
+		} else {
+			files = append(files, relPath)
+		}
+	}
+	sort.Strings(dirs)
+	sort.Strings(files)
+
+	if err := s.removeTypeConflicts(dirs, files); err != nil {
+		return s.stats, err
+	}
+	if !options.dryRun {
+		for _, dir := range dirs {
+			if err := os.MkdirAll(filepath.Join(dest, dir), os.ModePerm); err != nil {
+				return s.stats, err
+			}
+		}
+	}
+	var written []string
+	for _, relPath := range files {
+		entry := entries[relPath]
+		if fileError := getFileEntryError(entry); fileError != "" {
+			fmt.Fprintf(w, "skip %s: it could not be read at the checkpoint: %s\n", relPath, fileError)
+			s.stats.skipped++
+			continue
+		}
+		if !hasChunkHashes(entry) {
+			fmt.Fprintf(w, "skip %s: the checkpoint has no chunk hashes for it\n", relPath)
+			s.stats.skipped++
+			continue
+		}
+		unchanged := s.stats.unchanged
+		if err := s.syncFile(relPath, entry, sourcePaths); err != nil {
+			return s.stats, fmt.Errorf("%s: %w", relPath, err)
+		}
+		if s.stats.unchanged == unchanged {
+			written = append(written, relPath)
+		}
+	}
+
+	if options.delete {
+		var extra []string
+		for relPath, file := range s.files {
+			if !sourcePaths[relPath] && !file.renamed {
+				extra = append(extra, relPath)
+			}
+		}
+		sort.Strings(extra)
+		for _, relPath := range extra {
+			fmt.Fprintf(w, "delete %s\n", relPath)
+			s.stats.deleted++
+			if !options.dryRun {
+				if err := os.Remove(filepath.Join(dest, relPath)); err != nil {
+					return s.stats, err
+				}
+			}
+		}
+		if !options.dryRun {
+			if err := removeExtraDirectories(dest, sourcePaths); err != nil {
+				return s.stats, err
+			}
+		}
+	}
+	if options.dryRun {
+		return s.stats, nil
+	}
+
+	failed := 0
+	for _, relPath := range written {
+		fileHash, err := hashFileAndEncoding(filepath.Join(dest, relPath))
+		if err != nil {
+			return s.stats, err
+		}
+		if fileHash != string(entries[relPath].HashList.FileHash.Hash) {
+			fmt.Fprintf(w, "content differs %s\n", relPath)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return s.stats, verifyError("%d files of the destination do not match the checkpoint after the sync", failed)
+	}
+	if s.stats.skipped > 0 {
+		return s.stats, partialError("%d files could not be synced", s.stats.skipped)
+	}
+	return s.stats, nil
+}
+
+// removeExtraDirectories removes the directories of the destination the
+// checkpoint does not have, deepest first
+func removeExtraDirectories(dest string, sourcePaths map[string]bool) error {
+	var extra []string
+	err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".cxo" {
+			return filepath.SkipDir
+		}
+		relPath, err := filepath.Rel(dest, path)
+		if err != nil {
+			return err
+		}
+		if !sourcePaths[relPath] {
+			extra = append(extra, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(extra) - 1; i >= 0; i-- {
+		if err := os.Remove(extra[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printSyncStats(w io.Writer, stats syncStats) {
+	fmt.Fprintf(w, "%d unchanged, %d created, %d updated, %d renamed, %d deleted, %d skipped\n",
+		stats.unchanged, stats.created, stats.updated, stats.renamed, stats.deleted, stats.skipped)
+	fmt.Fprintf(w, "%d chunks (%s) copied from the source, %d chunks (%s) reused from the destination\n",
+		stats.copiedChunks, formatBytes(stats.copiedBytes), stats.reusedChunks, formatBytes(stats.reusedBytes))
+}
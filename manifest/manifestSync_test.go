@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireSameFiles(t *testing.T, source string, dest string) {
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		require.NoError(t, err)
+		if info.IsDir() && info.Name() == ".cxo" {
+			return filepath.SkipDir
+		}
+		relPath, err := filepath.Rel(source, path)
+		require.NoError(t, err)
+		destInfo, err := os.Stat(filepath.Join(dest, relPath))
+		require.NoError(t, err)
+		require.Equal(t, info.IsDir(), destInfo.IsDir(), relPath)
+		if !info.IsDir() {
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			destData, err := ioutil.ReadFile(filepath.Join(dest, relPath))
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(data, destData), relPath)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestSyncCheckpoint(t *testing.T) {
+	defer setupTestRepository(t)()
+	dest, err := ioutil.TempDir("", "sync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	a := make([]byte, 3*chunkSize+100)
+	_, err = rand.Read(a)
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir("sub", 0700))
+	require.NoError(t, ioutil.WriteFile("a", a, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "b"), []byte("b"), 0600))
+	require.NoError(t, ioutil.WriteFile("c", bytes.Repeat([]byte("c"), 1000), 0600))
+	checkpoint := commitTestRepository(t)
+
+	var out bytes.Buffer
+	defer syscall.Umask(syscall.Umask(022))
+	stats, err := syncCheckpoint(checkpoint, dest, syncOptions{}, &out)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.created)
+	require.Equal(t, 6, stats.copiedChunks)
+	requireSameFiles(t, ".", dest)
+	// the new files get the permissions of the umask, not those of a
+	// temporary file
+	info, err := os.Stat(filepath.Join(dest, "a"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// a chunk of a changes, c is renamed to d, and e has the content of sub/b
+	a[chunkSize+5]++
+	require.NoError(t, ioutil.WriteFile("a", a, 0600))
+	require.NoError(t, os.Rename("c", "d"))
+	require.NoError(t, ioutil.WriteFile("e", []byte("b"), 0600))
+	checkpoint = commitTestRepository(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(dest, "extra", "dir"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "extra", "dir", "junk"), []byte("junk"), 0600))
+
+	out.Reset()
+	stats, err = syncCheckpoint(checkpoint, dest, syncOptions{delete: true, dryRun: true}, &out)
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "update a (1 of 4 chunks)\nrename c -> d\ncreate e\n")
+	require.Equal(t, 1, stats.copiedChunks)
+	require.Equal(t, 1, stats.reusedChunks)
+	require.FileExists(t, filepath.Join(dest, "c"))
+
+	out.Reset()
+	stats, err = syncCheckpoint(checkpoint, dest, syncOptions{delete: true}, &out)
+	require.NoError(t, err)
+	require.Equal(t, syncStats{unchanged: 1, created: 1, updated: 1, renamed: 1, deleted: 1,
+		copiedChunks: 1, reusedChunks: 1, copiedBytes: int64(chunkSize), reusedBytes: 1}, stats)
+	require.Contains(t, out.String(), "delete extra/dir/junk\n")
+	require.NotContains(t, out.String(), "delete c")
+	require.NoDirExists(t, filepath.Join(dest, "extra"))
+	requireSameFiles(t, ".", dest)
+	requireSameFiles(t, dest, ".")
+
+	stats, err = syncCheckpoint(checkpoint, dest, syncOptions{delete: true}, &out)
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.unchanged)
+	require.Equal(t, 0, stats.copiedChunks)
+
+	_, err = syncCheckpoint(checkpoint, filepath.Join(currentDir, "sub"), syncOptions{}, &out)
+	require.Equal(t, exitUsage, getExitCode(err))
+	// a sync into the repository itself or one of its parents would delete it
+	_, err = syncCheckpoint(checkpoint, currentDir, syncOptions{delete: true}, &out)
+	require.Equal(t, exitUsage, getExitCode(err))
+	_, err = syncCheckpoint(checkpoint, filepath.Dir(currentDir), syncOptions{delete: true}, &out)
+	require.Equal(t, exitUsage, getExitCode(err))
+	require.FileExists(t, "d")
+}
+
+func TestSyncTypeChanges(t *testing.T) {
+	defer setupTestRepository(t)()
+	dest, err := ioutil.TempDir("", "sync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	require.NoError(t, os.Mkdir("sub", 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "a"), []byte("a"), 0600))
+	require.NoError(t, ioutil.WriteFile("b", []byte("b"), 0600))
+	checkpoint := commitTestRepository(t)
+
+	// the destination has a file at sub and a directory at b
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "sub"), []byte("sub"), 0600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dest, "b", "dir"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "b", "dir", "junk"), []byte("junk"), 0600))
+
+	var out bytes.Buffer
+	_, err = syncCheckpoint(checkpoint, dest, syncOptions{}, &out)
+	require.Equal(t, exitUsage, getExitCode(err))
+	require.Contains(t, err.Error(), "a directory where the checkpoint has a file at b")
+	require.FileExists(t, filepath.Join(dest, "b", "dir", "junk"))
+
+	stats, err := syncCheckpoint(checkpoint, dest, syncOptions{delete: true}, &out)
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.deleted)
+	require.Equal(t, 2, stats.created)
+	require.Contains(t, out.String(), "delete b\ndelete sub\n")
+	requireSameFiles(t, ".", dest)
+	requireSameFiles(t, dest, ".")
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	torrentFormatV1     = "v1"
+	torrentFormatV2     = "v2"
+	torrentFormatHybrid = "hybrid"
+	// size of the blocks hashed into the merkle trees of v2 torrents
+	torrentBlockSize = 16384
+)
+
+// torrentFile is a file of a torrent, in the order of the torrent
+type torrentFile struct {
+	path   []string
+	length int64
+	// v2 pieces root, nil for empty files and v1 torrents
+	piecesRoot []byte
+	// padding file of BEP 47
+	pad bool
+	// entry of the file in the exported checkpoint
+	entry *ManifestFile
+}
+
+// getTorrentMerkleRoot returns the root of the merkle tree over the hashes,
+// padded with padHash to width, a power of two
+func getTorrentMerkleRoot(hashes [][]byte, width int, padHash []byte) []byte {
+	layer := make([][]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = padHash
+	}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			sum := sha256.Sum256(append(append([]byte{}, layer[2*i]...), layer[2*i+1]...))
+			next[i] = sum[:]
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// getZeroSubtreeRoot returns the root of a merkle tree of the given height
+// whose leaves are all zero hashes, which pads the layers of v2 trees
+func getZeroSubtreeRoot(height int) []byte {
+	result := make([]byte, sha256.Size)
+	for i := 0; i < height; i++ {
+		sum := sha256.Sum256(append(append([]byte{}, result...), result...))
+		result = sum[:]
+	}
+	return result
+}
+
+func nextPowerOfTwo(n int) int {
+	result := 1
+	for result < n {
+		result <<= 1
+	}
+	return result
+}
+
+// v1PieceHasher computes the pieces of a v1 torrent from its data
+type v1PieceHasher struct {
+	pieceLength int
+	buffer      []byte
+	pieces      []byte
+}
+
+func newV1PieceHasher(pieceLength int) *v1PieceHasher {
+	return &v1PieceHasher{pieceLength: pieceLength, buffer: make([]byte, 0, pieceLength)}
+}
+
+func (h *v1PieceHasher) write(data []byte) {
+	for len(data) > 0 {
+		n := h.pieceLength - len(h.buffer)
+		if n > len(data) {
+			n = len(data)
+		}
+		h.buffer = append(h.buffer, data[:n]...)
+		data = data[n:]
+		if len(h.buffer) == h.pieceLength {
+			h.addPiece()
+		}
+	}
+}
+
+func (h *v1PieceHasher) addPiece() {
+	sum := sha1.Sum(h.buffer)
+	h.pieces = append(h.pieces, sum[:]...)
+	h.buffer = h.buffer[:0]
+}
+
+func (h *v1PieceHasher) finish() []byte {
+	if len(h.buffer) > 0 {
+		h.addPiece()
+	}
+	return h.pieces
+}
+
+// v2FileHasher computes the merkle tree of a file of a v2 torrent from its data
+type v2FileHasher struct {
+	pieceLeaves int
+	block       []byte
+	// leaf hashes of the current piece
+	leaves [][]byte
+	pieces [][]byte
+}
+
+func newV2FileHasher(pieceLength int) *v2FileHasher {
+	return &v2FileHasher{
+		pieceLeaves: pieceLength / torrentBlockSize,
+		block:       make([]byte, 0, torrentBlockSize),
+	}
+}
+
+func (h *v2FileHasher) write(data []byte) {
+	for len(data) > 0 {
+		n := torrentBlockSize - len(h.block)
+		if n > len(data) {
+			n = len(data)
+		}
+		h.block = append(h.block, data[:n]...)
+		data = data[n:]
+		if len(h.block) == torrentBlockSize {
+			h.addLeaf()
+		}
+	}
+}
+
+func (h *v2FileHasher) addLeaf() {
+	sum := sha256.Sum256(h.block)
+	h.leaves = append(h.leaves, sum[:])
+	h.block = h.block[:0]
+	if len(h.leaves) == h.pieceLeaves {
+		h.pieces = append(h.pieces, getTorrentMerkleRoot(h.leaves, h.pieceLeaves, make([]byte, sha256.Size)))
+		h.leaves = nil
+	}
+}
+
+// finish returns the pieces root of the file and its piece layer, which is
+// nil for files of at most one piece, and a nil root for empty files
+func (h *v2FileHasher) finish() ([]byte, []byte) {
+	if len(h.block) > 0 {
+		h.addLeaf()
+	}
+	if len(h.pieces) == 0 {
+		if len(h.leaves) == 0 {
+			return nil, nil
+		}
+		// the tree of a file shorter than a piece is only padded to a power of two
+		return getTorrentMerkleRoot(h.leaves, nextPowerOfTwo(len(h.leaves)), make([]byte, sha256.Size)), nil
+	}
+	if len(h.leaves) > 0 {
+		h.pieces = append(h.pieces, getTorrentMerkleRoot(h.leaves, h.pieceLeaves, make([]byte, sha256.Size)))
+	}
+	return getV2PiecesRoot(h.pieces, h.pieceLeaves)
+}
+
+// getV2PiecesRoot returns the pieces root of a file from its piece layer, and
+// the piece layer if the file has more than one piece
+func getV2PiecesRoot(pieces [][]byte, pieceLeaves int) ([]byte, []byte) {
+	if len(pieces) == 1 {
+		return pieces[0], nil
+	}
+	padHash := getZeroSubtreeRoot(bits.TrailingZeros(uint(pieceLeaves)))
+	return getTorrentMerkleRoot(pieces, nextPowerOfTwo(len(pieces)), padHash), bytes.Join(pieces, nil)
+}
+
+// getTorrentChunkHashes computes the torrent hashes of a chunk
+func getTorrentChunkHashes(hash []byte, data []byte) *TorrentChunkHashes {
+	padded := data
+	if len(data) < chunkSize {
+		padded = make([]byte, chunkSize)
+		copy(padded, data)
+	}
+	v1Piece := sha1.Sum(padded)
+	result := TorrentChunkHashes{Hash: hash, Size: uint64(len(data)), V1Piece: v1Piece[:]}
+
+	var leaves [][]byte
+	for offset := 0; offset < len(data); offset += torrentBlockSize {
+		end := offset + torrentBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha256.Sum256(data[offset:end])
+		leaves = append(leaves, sum[:])
+	}
+	pieceLeaves := chunkSize / torrentBlockSize
+	result.V2Piece = getTorrentMerkleRoot(leaves, pieceLeaves, make([]byte, sha256.Size))
+	if len(data) < chunkSize {
+		v1LastPiece := sha1.Sum(data)
+		result.V1LastPiece = v1LastPiece[:]
+		result.V2FileRoot = getTorrentMerkleRoot(leaves, nextPowerOfTwo(len(leaves)), make([]byte, sha256.Size))
+	}
+	return &result
+}
+
+// torrentHashCache keeps the torrent hashes of chunks in .cxo/torrent-hashes,
+// so that torrents whose piece length is the chunk size can be exported
+// without reading the data again. Chunks are identified by their hash and
+// size, as chunks that only differ in trailing zeros have the same hash
+type torrentHashCache struct {
+	chunks  map[string]*TorrentChunkHashes
+	changed bool
+}
+
+func loadTorrentHashCache() (*torrentHashCache, error) {
+	result := torrentHashCache{chunks: make(map[string]*TorrentChunkHashes)}
+	data, err := ioutil.ReadFile(currentDir + manifestTorrentHashFile)
+	if os.IsNotExist(err) {
+		return &result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cache TorrentHashCache
+	if err := encoder.DeserializeRawExact(data, &cache); err != nil {
+		return nil, fmt.Errorf("failed to deserialize %s: %w", manifestTorrentHashFile, err)
+	}
+	for i := range cache.Chunks {
+		chunk := &cache.Chunks[i]
+		result.chunks[getTorrentHashKey(chunk.Hash, int(chunk.Size))] = chunk
+	}
+	return &result, nil
+}
+
+func getTorrentHashKey(hash []byte, size int) string {
+	return string(hash) + ":" + strconv.Itoa(size)
+}
+
+func (c *torrentHashCache) get(hash []byte, size int) *TorrentChunkHashes {
+	return c.chunks[getTorrentHashKey(hash, size)]
+}
+
+func (c *torrentHashCache) add(hash []byte, data []byte) *TorrentChunkHashes {
+	key := getTorrentHashKey(hash, len(data))
+	if result, ok := c.chunks[key]; ok {
+		return result
+	}
+	result := getTorrentChunkHashes(hash, data)
+	c.chunks[key] = result
+	c.changed = true
+	return result
+}
+
+func (c *torrentHashCache) save() error {
+	if !c.changed {
+		return nil
+	}
+	keys := make([]string, 0, len(c.chunks))
+	for key := range c.chunks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var cache TorrentHashCache
+	for _, key := range keys {
+		cache.Chunks = append(cache.Chunks, *c.chunks[key])
+	}
+	if err := writeFileAtomic(currentDir+manifestTorrentHashFile, encoder.Serialize(cache)); err != nil {
+		return err
+	}
+	c.changed = false
+	return nil
+}
+
+// getCheckpointTorrentFiles returns the files of the checkpoint in the order
+// of a torrent, sorted by their path, leaving out errored entries
+func getCheckpointTorrentFiles(manifest *ManifestOuputBody) []torrentFile {
+	root := getCheckpointRoot(manifest)
+	var result []torrentFile
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		if entry.FileName == nil {
+			continue
+		}
+		relPath := getManifestFileRelPath(root, entry)
+		if fileError := getFileEntryError(entry); fileError != "" {
+			fmt.Fprintf(os.Stderr, "leaving out %s: %s\n", relPath, fileError)
+			continue
+		}
+		if !hasChunkHashes(entry) {
+			fmt.Fprintf(os.Stderr, "leaving out %s: the checkpoint has no chunk hashes for it\n", relPath)
+			continue
+		}
+		result = append(result, torrentFile{
+			path:   strings.Split(filepath.ToSlash(relPath), "/"),
+			length: entry.Size,
+			entry:  entry,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return lessPathComponents(result[i].path, result[j].path)
+	})
+	return result
+}
+
+// exportTorrent writes a .torrent of the files of the checkpoint. The chunk
+// hashes of a checkpoint can not be used as torrent hashes: chunks are hashed
+// with sha256 as a whole, v1 pieces with sha1 and v2 pieces as merkle trees
+// of 16 KiB blocks. So the data of the files is read from the chunk store if
+// it has the chunks, or else from the files if they did not change since the
+// checkpoint. With a piece length of the chunk size, v2 and hybrid torrents
+// align pieces with chunks, and the hashes of the chunks in the torrent hash
+// cache are used instead of reading their data
+func exportTorrent(checkpoint string, outPath string, format string, pieceLength int, announce string) error {
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return err
+	}
+	var store *chunkStore
+	if isFolderExist(currentDir + manifestChunksFolder) {
+		store, err = openChunkStore(currentDir)
+		if err != nil {
+			return err
+		}
+		defer store.close()
+	}
+	var cache *torrentHashCache
+	if pieceLength == chunkSize && format != torrentFormatV1 {
+		cache, err = loadTorrentHashCache()
+		if err != nil {
+			return err
+		}
+	}
+
+	files := getCheckpointTorrentFiles(manifest)
+	info := TorrentInfo{
+		Name:        filepath.Base(getCheckpointRoot(manifest)),
+		PieceLength: int64(pieceLength),
+	}
+	pieceLayers := make(map[string][]byte)
+	if format != torrentFormatV1 {
+		info.MetaVersion = 2
+		info.FileTree = make(map[string]interface{})
+	}
+	v1Hasher := newV1PieceHasher(pieceLength)
+	read := 0
+
+	for i := range files {
+		file := &files[i]
+		isLast := i == len(files)-1
+		relPath := strings.Join(file.path, "/")
+		sizes := getManifestFileChunkSizes(file.entry)
+		v2Hasher := newV2FileHasher(pieceLength)
+		var v2Pieces [][]byte
+
+		for index, hash := range file.entry.HashList.ChunksHashes {
+			var chunkHashes *TorrentChunkHashes
+			if cache != nil {
+				chunkHashes = cache.get(hash, sizes[index])
+			}
+			if chunkHashes == nil {
+				data, err := readCheckpointChunk(store, relPath, hash, index, sizes[index])
+				if err != nil {
+					return err
+				}
+				read += len(data)
+				if cache != nil {
+					chunkHashes = cache.add(hash, data)
+				} else {
+					if format != torrentFormatV2 {
+						v1Hasher.write(data)
+					}
+					if format != torrentFormatV1 {
+						v2Hasher.write(data)
+					}
+					continue
+				}
+			}
+
+			// pieces are aligned with chunks
+			if format == torrentFormatHybrid {
+				if isLast && index == len(sizes)-1 && chunkHashes.V1LastPiece != nil {
+					v1Hasher.pieces = append(v1Hasher.pieces, chunkHashes.V1LastPiece...)
+				} else {
+					v1Hasher.pieces = append(v1Hasher.pieces, chunkHashes.V1Piece...)
+				}
+			}
+			v2Pieces = append(v2Pieces, chunkHashes.V2Piece)
+		}
+
+		if format != torrentFormatV2 {
+			info.Files = append(info.Files, TorrentFileEntry{Length: file.length, Path: file.path})
+			padLength := (int64(pieceLength) - file.length%int64(pieceLength)) % int64(pieceLength)
+			if format == torrentFormatHybrid && !isLast && padLength > 0 {
+				padPath := []string{".pad", strconv.FormatInt(padLength, 10)}
+				info.Files = append(info.Files, TorrentFileEntry{Attr: "p", Length: padLength, Path: padPath})
+				if cache == nil {
+					v1Hasher.write(make([]byte, padLength))
+				}
+			}
+		}
+		if format != torrentFormatV1 {
+			var layer []byte
+			if cache == nil {
+				file.piecesRoot, layer = v2Hasher.finish()
+			} else if len(v2Pieces) == 1 && file.length < int64(pieceLength) {
+				file.piecesRoot = cache.get(file.entry.HashList.ChunksHashes[0], sizes[0]).V2FileRoot
+			} else if len(v2Pieces) > 0 {
+				file.piecesRoot, layer = getV2PiecesRoot(v2Pieces, pieceLength/torrentBlockSize)
+			}
+			addTorrentFileTreeEntry(info.FileTree, file.path, file.length, file.piecesRoot)
+			if layer != nil {
+				pieceLayers[string(file.piecesRoot)] = layer
+			}
+		}
+	}
+	if format != torrentFormatV2 {
+		info.Pieces = v1Hasher.finish()
+	}
+
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		return err
+	}
+	metaInfo := TorrentMetaInfo{
+		Announce:     announce,
+		CreatedBy:    appName + " " + versionNo,
+		CreationDate: int64(manifest.ManifestHeader.CreatedAt),
+		Info:         infoBytes,
+	}
+	if len(pieceLayers) > 0 {
+		metaInfo.PieceLayers = pieceLayers
+	}
+	torrentBytes, err := bencode.Marshal(metaInfo)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(outPath, torrentBytes, 0644); err != nil {
+		return err
+	}
+	if cache != nil {
+		if err := cache.save(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("wrote %s: %d files, read %d bytes\n", outPath, len(files), read)
+	if format != torrentFormatV2 {
+		fmt.Printf("v1 info hash %x\n", sha1.Sum(infoBytes))
+	}
+	if format != torrentFormatV1 {
+		fmt.Printf("v2 info hash %x\n", sha256.Sum256(infoBytes))
+	}
+	return nil
+}
+
+// addTorrentFileTreeEntry adds a file to the file tree of a v2 torrent, in
+// which every directory is a dictionary and every file a dictionary with an
+// empty key
+func addTorrentFileTreeEntry(tree map[string]interface{}, path []string, length int64, piecesRoot []byte) {
+	for _, name := range path[:len(path)-1] {
+		subtree, ok := tree[name].(map[string]interface{})
+		if !ok {
+			subtree = make(map[string]interface{})
+			tree[name] = subtree
+		}
+		tree = subtree
+	}
+	entry := map[string]interface{}{"length": length}
+	if piecesRoot != nil {
+		entry["pieces root"] = piecesRoot
+	}
+	tree[path[len(path)-1]] = map[string]interface{}{"": entry}
+}
+
+// loadTorrentFiles reads the files of a .torrent, from the file tree of v2
+// and hybrid torrents, or else from the file list of v1 torrents, which
+// includes the padding files
+func loadTorrentFiles(torrentPath string) (*TorrentInfo, []torrentFile, error) {
+	metaInfo, err := metainfo.LoadFromFile(torrentPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var info TorrentInfo
+	if err := bencode.Unmarshal(metaInfo.InfoBytes, &info); err != nil {
+		return nil, nil, err
+	}
+	if info.PieceLength <= 0 {
+		return nil, nil, fmt.Errorf("invalid piece length %d in %s", info.PieceLength, torrentPath)
+	}
+
+	var result []torrentFile
+	switch {
+	case info.MetaVersion == 2:
+		if info.PieceLength < torrentBlockSize || bits.OnesCount64(uint64(info.PieceLength)) != 1 {
+			return nil, nil, fmt.Errorf("invalid piece length %d of a v2 torrent in %s", info.PieceLength, torrentPath)
+		}
+		err = walkTorrentFileTree(info.FileTree, nil, func(file torrentFile) {
+			result = append(result, file)
+		})
+	case len(info.Files) > 0:
+		for _, entry := range info.Files {
+			result = append(result, torrentFile{path: entry.Path, length: entry.Length, pad: strings.Contains(entry.Attr, "p")})
+		}
+	default:
+		result = append(result, torrentFile{path: []string{info.Name}, length: info.Length})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range result {
+		for _, name := range file.path {
+			if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+				return nil, nil, fmt.Errorf("invalid path %q in %s", strings.Join(file.path, "/"), torrentPath)
+			}
+		}
+	}
+	return &info, result, nil
+}
+
+func walkTorrentFileTree(tree map[string]interface{}, prefix []string, fn func(torrentFile)) error {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid file tree entry %q", name)
+		}
+		path := append(append([]string{}, prefix...), name)
+		entry, isFile := node[""].(map[string]interface{})
+		if !isFile {
+			if err := walkTorrentFileTree(node, path, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		length, ok := entry["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("invalid length of %q", strings.Join(path, "/"))
+		}
+		file := torrentFile{path: path, length: length}
+		if root, ok := entry["pieces root"].(string); ok {
+			file.piecesRoot = []byte(root)
+		}
+		fn(file)
+	}
+	return nil
+}
+
+// getTorrentManifestBody returns a manifest body of the files of a torrent,
+// placed in the current directory. Torrents have no sha256 of whole files,
+// so the entries only have a path and size
+func getTorrentManifestBody(files []torrentFile) *ManifestDirectoryBody {
+	var result ManifestDirectoryBody
+	for _, file := range files {
+		if file.pad {
+			continue
+		}
+		paths, fileName := filepath.Split(currentDir + "/" + strings.Join(file.path, "/"))
+		result.ManifestFileList = append(result.ManifestFileList, ManifestFile{
+			Path:       []byte(paths),
+			FileName:   []byte(fileName),
+			Size:       file.length,
+			HashList:   FileHashList{},
+			MetaString: []byte{},
+		})
+	}
+	return &result
+}
+
+// compareTorrent compares the files of a .torrent with the files in the
+// current directory, checking their content against the pieces root of v2
+// torrents or the pieces of v1 torrents, and prints the differences
+func compareTorrent(torrentPath string) error {
+	info, files, err := loadTorrentFiles(torrentPath)
+	if err != nil {
+		return err
+	}
+	body := getTorrentManifestBody(files)
+	pieceLength := int(info.PieceLength)
+
+	differ := make(map[string]bool)
+	expected := make(map[string]bool)
+	for _, entry := range body.ManifestFileList {
+		relPath := getManifestFileRelPath(currentDir, &entry)
+		expected[relPath] = true
+		fileInfo, err := os.Stat(filepath.Join(currentDir, relPath))
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("missing %s\n", relPath)
+			differ[relPath] = true
+		case err != nil:
+			return err
+		case fileInfo.Size() != entry.Size:
+			fmt.Printf("size differs %s: %d bytes, %d in the torrent\n", relPath, fileInfo.Size(), entry.Size)
+			differ[relPath] = true
+		}
+	}
+
+	if info.MetaVersion == 2 {
+		for _, file := range files {
+			relPath := filepath.Join(file.path...)
+			if differ[relPath] || file.length == 0 {
+				continue
+			}
+			v2Hasher := newV2FileHasher(pieceLength)
+			if err := readLocalFile(relPath, file.length, v2Hasher.write); err != nil {
+				return err
+			}
+			if root, _ := v2Hasher.finish(); !bytes.Equal(root, file.piecesRoot) {
+				fmt.Printf("content differs %s\n", relPath)
+				differ[relPath] = true
+			}
+		}
+	} else {
+		// pieces span files, the files that share a bad piece are reported
+		v1Hasher := newV1PieceHasher(pieceLength)
+		offsets := make([]int64, len(files))
+		var offset int64
+		for i, file := range files {
+			offsets[i] = offset
+			offset += file.length
+			relPath := filepath.Join(file.path...)
+			if file.pad || differ[relPath] {
+				v1Hasher.write(make([]byte, file.length))
+				continue
+			}
+			if err := readLocalFile(relPath, file.length, v1Hasher.write); err != nil {
+				return err
+			}
+		}
+		pieces := v1Hasher.finish()
+		for piece := 0; piece*sha1.Size < len(pieces) && piece*sha1.Size < len(info.Pieces); piece++ {
+			start := piece * sha1.Size
+			if bytes.Equal(pieces[start:start+sha1.Size], info.Pieces[start:start+sha1.Size]) {
+				continue
+			}
+			pieceStart, pieceEnd := int64(piece)*info.PieceLength, int64(piece+1)*info.PieceLength
+			for i, file := range files {
+				relPath := filepath.Join(file.path...)
+				if file.pad || differ[relPath] || offsets[i] >= pieceEnd || offsets[i]+file.length <= pieceStart {
+					continue
+				}
+				fmt.Printf("content differs %s\n", relPath)
+				differ[relPath] = true
+			}
+		}
+	}
+
+	rules, err := loadIgnoreRules(".")
+	if err != nil {
+		return err
+	}
+	extra := 0
+	err = filepath.Walk(".", func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isRepositoryPath(path) || rules.isIgnored(path, fileInfo.IsDir()) {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fileInfo.IsDir() && fileInfo.Name() != appName && !expected[filepath.Clean(path)] {
+			fmt.Printf("not in torrent %s\n", filepath.Clean(path))
+			extra++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d of %d files of %s match\n", len(body.ManifestFileList)-len(differ), len(body.ManifestFileList), info.Name)
+	if len(differ) > 0 || extra > 0 {
+		return verifyError("%d files differ from the torrent, %d are not in it", len(differ), extra)
+	}
+	return nil
+}
+
+// readLocalFile passes the data of a file of the current directory to fn,
+// reading length bytes
+func readLocalFile(relPath string, length int64, fn func([]byte)) error {
+	file, err := os.Open(filepath.Join(currentDir, relPath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buffer := make([]byte, chunkSize)
+	reader := io.LimitReader(file, length)
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			fn(buffer[:n])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTorrentChunkHashes(t *testing.T) {
+	for _, size := range []int{1, torrentBlockSize, 20480, chunkSize - 1, chunkSize} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		chunkHashes := getTorrentChunkHashes(hashChunkData(data), data)
+
+		// a file of only this chunk
+		v2Hasher := newV2FileHasher(chunkSize)
+		v2Hasher.write(data)
+		root, layer := v2Hasher.finish()
+		require.Nil(t, layer)
+		if size < chunkSize {
+			require.Equal(t, root, chunkHashes.V2FileRoot)
+			require.Equal(t, sha1Sum(data), chunkHashes.V1LastPiece)
+		} else {
+			require.Equal(t, root, chunkHashes.V2Piece)
+			require.Nil(t, chunkHashes.V1LastPiece)
+		}
+		v1Hasher := newV1PieceHasher(chunkSize)
+		v1Hasher.write(data)
+		v1Hasher.write(make([]byte, chunkSize-size))
+		require.Equal(t, v1Hasher.finish(), chunkHashes.V1Piece)
+
+		// the last chunk of a longer file
+		v2Hasher = newV2FileHasher(chunkSize)
+		v2Hasher.write(make([]byte, chunkSize))
+		v2Hasher.write(data)
+		_, layer = v2Hasher.finish()
+		require.Equal(t, chunkHashes.V2Piece, layer[32:])
+	}
+
+	// a single block is its own root
+	data := []byte("block")
+	v2Hasher := newV2FileHasher(chunkSize)
+	v2Hasher.write(data)
+	root, _ := v2Hasher.finish()
+	require.Equal(t, sha256Sum(data), root)
+}
+
+func TestExportAndCompareTorrent(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.MkdirAll("sub/deep", 0700))
+	for name, size := range map[string]int{"empty": 0, "a": 1000, "sub/b": chunkSize, "sub/deep/c": 3*chunkSize + 5} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(name, data, 0600))
+	}
+	checkpoint := commitTestRepository(t)
+	outDir, err := ioutil.TempDir("", "torrent")
+	require.NoError(t, err)
+	defer os.RemoveAll(outDir)
+
+	// the pieces roots of v2 files do not depend on the piece length
+	var roots [][][]byte
+	for _, pieceLength := range []int{chunkSize, 4 * torrentBlockSize} {
+		torrentPath := filepath.Join(outDir, "hybrid.torrent")
+		require.NoError(t, exportTorrent(checkpoint, torrentPath, torrentFormatHybrid, pieceLength, ""))
+		info, files, err := loadTorrentFiles(torrentPath)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), info.MetaVersion)
+		require.Len(t, files, 4)
+		require.Equal(t, []string{"a"}, files[0].path)
+		require.Equal(t, []string{"sub", "deep", "c"}, files[3].path)
+		require.Nil(t, files[1].piecesRoot)
+		var fileRoots [][]byte
+		for _, file := range files {
+			fileRoots = append(fileRoots, file.piecesRoot)
+		}
+		roots = append(roots, fileRoots)
+		require.NoError(t, compareTorrent(torrentPath))
+	}
+	require.Equal(t, roots[0], roots[1])
+	_, err = os.Stat(currentDir + manifestTorrentHashFile)
+	require.NoError(t, err)
+
+	v1Path := filepath.Join(outDir, "v1.torrent")
+	require.NoError(t, exportTorrent(checkpoint, v1Path, torrentFormatV1, 100000, ""))
+	require.NoError(t, compareTorrent(v1Path))
+	body := getTorrentManifestBody(mustLoadTorrentFiles(t, v1Path))
+	require.Len(t, body.ManifestFileList, 4)
+
+	file, err := os.OpenFile("sub/deep/c", os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("changed"), int64(chunkSize))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, exitVerify, getExitCode(compareTorrent(v1Path)))
+	require.Equal(t, exitVerify, getExitCode(exportTorrent(checkpoint, v1Path, torrentFormatV1, 100000, "")))
+}
+
+func mustLoadTorrentFiles(t *testing.T, torrentPath string) []torrentFile {
+	_, files, err := loadTorrentFiles(torrentPath)
+	require.NoError(t, err)
+	return files
+}
+
+func sha1Sum(data []byte) []byte {
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
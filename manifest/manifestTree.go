@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkpointTree is the entries of a checkpoint by their path relative to the
+// directory, with the hash of every directory
+type checkpointTree struct {
+	entries map[string]*ManifestFile
+	// names of the entries of each directory, sorted
+	children map[string][]string
+	hashes   map[string][]byte
+}
+
+// checkpointDiff is the differences between two checkpoint trees
+type checkpointDiff struct {
+	w                        io.Writer
+	a, b                     *checkpointTree
+	added, removed, modified int
+	// directories not compared because their hashes are the same
+	skipped int
+}
+
+// getTreeEntryHash returns the hash a file contributes to its directory's
+// hash, the raw sha256, or nothing for errored entries
+func getTreeEntryHash(entry *ManifestFile) []byte {
+	if getFileEntryError(entry) != "" {
+		return nil
+	}
+	if sum, err := getFileSha256(entry); err == nil {
+		return sum
+	}
+	return entry.HashList.FileHash.Hash
+}
+
+func getDirectoryDepth(relPath string) int {
+	if relPath == "." {
+		return -1
+	}
+	return strings.Count(relPath, string(filepath.Separator))
+}
+
+// getDirectoryHashes computes the hash of every directory of the entries
+// from the type, name, hash and MetaString of its children, like a git tree,
+// so that directories with the same hash have the same files. The holes of
+// sparse files and the mtimes are left out, see getTreeMetaString
+func getDirectoryHashes(root string, fileList []ManifestFile) map[string][]byte {
+	trees := make(map[string]*DirectoryTree)
+	dirMeta := make(map[string][]byte)
+	var dirs []string
+	addDir := func(relPath string) {
+		for {
+			if trees[relPath] != nil {
+				return
+			}
+			trees[relPath] = &DirectoryTree{}
+			dirs = append(dirs, relPath)
+			if relPath == "." {
+				return
+			}
+			relPath = filepath.Dir(relPath)
+		}
+	}
+	for i := range fileList {
+		entry := &fileList[i]
+		relPath := getManifestFileRelPath(root, entry)
+		if entry.FileName == nil {
+			addDir(relPath)
+			dirMeta[relPath] = getTreeMetaString(entry)
+			continue
+		}
+		addDir(filepath.Dir(relPath))
+		tree := trees[filepath.Dir(relPath)]
+		tree.Entries = append(tree.Entries, DirectoryTreeEntry{
+			Type:       []byte("file"),
+			Name:       entry.FileName,
+			Hash:       getTreeEntryHash(entry),
+			MetaString: getTreeMetaString(entry),
+		})
+	}
+
+	// the subdirectories first
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return getDirectoryDepth(dirs[i]) > getDirectoryDepth(dirs[j])
+	})
+	result := make(map[string][]byte, len(dirs))
+	for _, dir := range dirs {
+		tree := trees[dir]
+		sort.Slice(tree.Entries, func(i, j int) bool {
+			return bytes.Compare(tree.Entries[i].Name, tree.Entries[j].Name) < 0
+		})
+		h := sha256.New()
+		h.Write(encoder.Serialize(*tree))
+		result[dir] = h.Sum(nil)
+		if dir != "." {
+			parent := trees[filepath.Dir(dir)]
+			parent.Entries = append(parent.Entries, DirectoryTreeEntry{
+				Type:       []byte("dir"),
+				Name:       []byte(filepath.Base(dir)),
+				Hash:       result[dir],
+				MetaString: dirMeta[dir],
+			})
+		}
+	}
+	return result
+}
+
+// getTreeMetaString returns the MetaString of an entry without the holes of
+// sparse files and the mtime, which depend on the file system rather than on
+// the content, so that a file that was copied or touched is the same
+func getTreeMetaString(entry *ManifestFile) []byte {
+	var kvList KeysValuesList
+	if len(entry.MetaString) == 0 || encoder.DeserializeRawExact(entry.MetaString, &kvList) != nil {
+		return entry.MetaString
+	}
+	var result KeysValuesList
+	for i, key := range kvList.Keys {
+		if string(key) != "holes" && string(key) != "modified" && i < len(kvList.Values) {
+			result.Add(KeyValueByte{key, kvList.Values[i]})
+		}
+	}
+	if len(result.Keys) == len(kvList.Keys) {
+		return entry.MetaString
+	}
+	if len(result.Keys) == 0 {
+		return []byte{}
+	}
+	return encoder.Serialize(result)
+}
+
+// setDirectoryHashes stores the hash of every directory entry of the body in
+// its FileHash
+func setDirectoryHashes(root string, body *ManifestDirectoryBody) {
+	hashes := getDirectoryHashes(root, body.ManifestFileList)
+	for i := range body.ManifestFileList {
+		entry := &body.ManifestFileList[i]
+		if entry.FileName == nil {
+			hash := hashes[getManifestFileRelPath(root, entry)]
+			entry.HashList.FileHash = HashVariable{[]byte("base64,sha256"), []byte(base64.StdEncoding.EncodeToString(hash))}
+		}
+	}
+}
+
+// getCheckpointTree returns the entries of the checkpoint with the stored
+// hashes of its directories, or computed ones for checkpoints written before
+// directories had hashes
+func getCheckpointTree(manifest *ManifestOuputBody) *checkpointTree {
+	root := getCheckpointRoot(manifest)
+	result := checkpointTree{
+		entries:  make(map[string]*ManifestFile),
+		children: make(map[string][]string),
+		hashes:   make(map[string][]byte),
+	}
+	stored := true
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		relPath := getManifestFileRelPath(root, entry)
+		result.entries[relPath] = entry
+		if relPath != "." {
+			parent := filepath.Dir(relPath)
+			result.children[parent] = append(result.children[parent], filepath.Base(relPath))
+		}
+		if entry.FileName == nil {
+			hash, err := base64.StdEncoding.DecodeString(string(entry.HashList.FileHash.Hash))
+			if err != nil || len(hash) == 0 {
+				stored = false
+			}
+			result.hashes[relPath] = hash
+		}
+	}
+	if !stored {
+		result.hashes = getDirectoryHashes(root, fileList)
+	}
+	for _, names := range result.children {
+		sort.Strings(names)
+	}
+	return &result
+}
+
+// diffCheckpoints prints the files and directories added, removed or modified
+// from checkpoint a to checkpoint b, skipping the directories whose hashes are
+// the same
+func diffCheckpoints(w io.Writer, a string, b string) error {
+	var trees []*checkpointTree
+	for _, checkpoint := range []string{a, b} {
+		manifest, err := readManifestFile(checkpoint)
+		if err != nil {
+			return err
+		}
+		trees = append(trees, getCheckpointTree(manifest))
+	}
+	diff := checkpointDiff{w: w, a: trees[0], b: trees[1]}
+	diff.compareDir(".")
+	fmt.Fprintf(w, "%d added, %d removed, %d modified, %d unchanged directories skipped\n",
+		diff.added, diff.removed, diff.modified, diff.skipped)
+	return nil
+}
+
+func (d *checkpointDiff) compareDir(dir string) {
+	if hashA := d.a.hashes[dir]; hashA != nil && bytes.Equal(hashA, d.b.hashes[dir]) {
+		d.skipped++
+		return
+	}
+	names := append(append([]string{}, d.a.children[dir]...), d.b.children[dir]...)
+	sort.Strings(names)
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		entryA, entryB := d.a.entries[path], d.b.entries[path]
+		isDirA := entryA != nil && entryA.FileName == nil
+		isDirB := entryB != nil && entryB.FileName == nil
+		switch {
+		case isDirA && isDirB:
+			d.compareDir(path)
+		case entryA != nil && entryB != nil && isDirA == isDirB:
+			if !bytes.Equal(getTreeEntryHash(entryA), getTreeEntryHash(entryB)) ||
+				!bytes.Equal(getTreeMetaString(entryA), getTreeMetaString(entryB)) {
+				fmt.Fprintf(d.w, "M %s\n", path)
+				d.modified++
+			}
+		default:
+			if entryA != nil {
+				fmt.Fprintf(d.w, "- %s\n", getDiffName(path, isDirA))
+				d.removed++
+			}
+			if entryB != nil {
+				fmt.Fprintf(d.w, "+ %s\n", getDiffName(path, isDirB))
+				d.added++
+			}
+		}
+	}
+}
+
+func getDiffName(path string, isDir bool) string {
+	if isDir {
+		return path + "/"
+	}
+	return path
+}
+
+// printDirectoryHashes prints the hash of the directory and of every
+// directory below it
+func printDirectoryHashes(w io.Writer, checkpoint string, dir string) error {
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return err
+	}
+	tree := getCheckpointTree(manifest)
+	dir = filepath.Clean(dir)
+	if tree.hashes[dir] == nil {
+		return usageError("%s is not a directory of the checkpoint", dir)
+	}
+	var dirs []string
+	for relPath := range tree.hashes {
+		if dir == "." || relPath == dir || strings.HasPrefix(relPath, dir+string(filepath.Separator)) {
+			dirs = append(dirs, relPath)
+		}
+	}
+	sort.Strings(dirs)
+	for _, relPath := range dirs {
+		fmt.Fprintf(w, "%x  %s\n", tree.hashes[relPath], relPath)
+	}
+	return nil
+}
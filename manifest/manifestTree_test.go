@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryHashes(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.MkdirAll(filepath.Join("same", "deep"), 0700))
+	require.NoError(t, os.MkdirAll("changed", 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("same", "deep", "a"), []byte("a"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("changed", "b"), []byte("b"), 0600))
+	require.NoError(t, ioutil.WriteFile("c", []byte("c"), 0600))
+	first := commitTestRepository(t)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join("changed", "b"), []byte("b2"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("changed", "new"), []byte("new"), 0600))
+	require.NoError(t, os.Remove("c"))
+	second := commitTestRepository(t)
+
+	manifestA, err := readManifestFile(first)
+	require.NoError(t, err)
+	manifestB, err := readManifestFile(second)
+	require.NoError(t, err)
+	treeA, treeB := getCheckpointTree(manifestA), getCheckpointTree(manifestB)
+	require.Len(t, treeA.hashes["."], 32)
+	require.Equal(t, treeA.hashes["same"], treeB.hashes["same"])
+	require.NotEqual(t, treeA.hashes["changed"], treeB.hashes["changed"])
+	require.NotEqual(t, treeA.hashes["."], treeB.hashes["."])
+
+	// the stored hashes are those computed from the entries
+	require.Equal(t, treeA.hashes, getDirectoryHashes(getCheckpointRoot(manifestA), manifestA.ManifestBody.ManifestFileList))
+
+	var output bytes.Buffer
+	require.NoError(t, diffCheckpoints(&output, first, second))
+	require.Equal(t, "- c\nM changed/b\n+ changed/new\n1 added, 1 removed, 1 modified, 1 unchanged directories skipped\n", output.String())
+
+	output.Reset()
+	require.NoError(t, diffCheckpoints(&output, first, first))
+	require.Equal(t, "0 added, 0 removed, 0 modified, 1 unchanged directories skipped\n", output.String())
+}
+
+func TestDirectoryHashesIgnoreHoles(t *testing.T) {
+	defer setupTestRepository(t)()
+	require.NoError(t, os.Mkdir("dir", 0700))
+	data := writeSparseFile(t, filepath.Join("dir", "disk.img"))
+	sparse := commitTestRepository(t)
+	// the same content without holes
+	require.NoError(t, ioutil.WriteFile(filepath.Join("dir", "disk.img"), data, 0600))
+	dense := commitTestRepository(t)
+
+	manifestA, err := readManifestFile(sparse)
+	require.NoError(t, err)
+	manifestB, err := readManifestFile(dense)
+	require.NoError(t, err)
+	require.Equal(t, getCheckpointTree(manifestA).hashes, getCheckpointTree(manifestB).hashes)
+
+	var output bytes.Buffer
+	require.NoError(t, diffCheckpoints(&output, sparse, dense))
+	require.Equal(t, "0 added, 0 removed, 0 modified, 1 unchanged directories skipped\n", output.String())
+}
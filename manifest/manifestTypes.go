@@ -1,5 +1,7 @@
 package main
 
+import "github.com/anacrolix/torrent/bencode"
+
 var (
 	// files and directories info list when parsing the current directory
 	filesList *FilesInfoList
@@ -7,16 +9,50 @@ var (
 	currentDir   string
 	manifestMeta ManifestMeta
 	manifestTemp ManifestTemp
+	// chunk store the commit writes chunk data to, nil if chunks are not stored
+	chunks *chunkStore
+	// keep files that can not be read as errored entries instead of failing
+	continueOnError bool
+	// progress of the scan, nil if progress is not reported
+	progress *progressReporter
+	// data of the files read by earlier scans of watch mode, nil otherwise
+	fileCache *fileDataCache
+	// cache the commit adds the torrent hashes of the chunks it reads to, nil
+	// if they are not computed
+	torrentHashes *torrentHashCache
+	// size of file chunks, padding 0x0000, set from the repository
+	// configuration
+	chunkSize = defaultChunkSize
+	// files of at least this size are mapped to be read, 0 to read all files
+	// with pread, set from the repository configuration
+	mmapThreshold int64
 )
 
 const (
-	// size of file chunks, padding 0x0000
-	chunkSize          = 262144
+	defaultChunkSize   = 262144
 	versionNo          = "1.0.0"
 	appName            = "manifest"
 	manifestCXOFolder  = "/.cxo/checkpoints/"
 	manifestTempFolder = "/.cxo/temp/"
 	manifestMetaFolder = "/.cxo/meta/"
+	// chunk objects are stored in subfolders named by the first hash byte
+	manifestChunksFolder = "/.cxo/chunks/"
+	manifestBlocksFolder = "/.cxo/blocks/"
+	manifestParityFolder = "/.cxo/parity/"
+	// compression codec of repositories created before .cxo/config
+	manifestCodecFile  = "/.cxo/compression"
+	manifestConfigFile = "/.cxo/config"
+	manifestLockFile   = "/.cxo/lock"
+	// patterns of the files and directories left out of checkpoints
+	manifestIgnoreFile = "/.cxoignore"
+	// torrent hashes of chunks, see TorrentChunkHashes
+	manifestTorrentHashFile = "/.cxo/torrent-hashes"
+	// index of the files of all checkpoints for 'manifest find', see FindIndex
+	manifestFindIndexFile = "/.cxo/find-index"
+	// when the chunks were last verified, see VerifyState
+	manifestVerifyStateFile = "/.cxo/verify-state"
+	// prefix of the temporary files written before being renamed into place
+	tempFilePrefix = ".tmp-"
 )
 
 type ManifestOuputBody struct {
@@ -77,6 +113,10 @@ type FilesInfoList struct {
 	filesMetaList         ManifestDirectMetaList
 	filesChunksList       [][]ChunkHash
 	filesCreationDateList []string
+	// error reading each file, empty for files read successfully
+	filesErrorList []string
+	// errors of the paths skipped with continueOnError
+	skippedList []string
 }
 
 type KeyValueByte struct {
@@ -100,6 +140,14 @@ type FileMeta struct {
 	CreateAt       uint64 `json:"creation time"`
 	LastModified   uint64 `json:"last modified time"`
 	UnixPermission string `json:"permission"`
+	// holes of a sparse file, recorded in the MetaString of its entry
+	Holes []FileExtent `json:"holes,omitempty"`
+}
+
+// FileExtent is a range of bytes of a file
+type FileExtent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
 }
 
 type ManifestDirectMetaList []FileMeta
@@ -109,6 +157,7 @@ type FileData struct {
 	FileSize     int       `json:"size"`
 	FileHash     []byte    `json:"hash"`
 	FileMetaData *FileMeta `json:"meta,omitempty"`
+	FileError    string    `json:"error,omitempty"`
 }
 
 type FileDataList []FileData
@@ -205,6 +254,292 @@ type ManifestTemp struct {
 	HashSet HashSet
 }
 
+// ChunkObject is the on-disk form of a stored chunk. The codec is recorded
+// per object so a repository may hold chunks written with different codecs.
+type ChunkObject struct {
+	Codec []byte
+	// uncompressed size of the chunk data, without padding
+	Size uint64
+	Data []byte
+}
+
+type ChunkStoreStats struct {
+	Count        int64
+	LogicalSize  int64
+	PhysicalSize int64
+}
+
+type StorageBlockHeader struct {
+	Version uint32
+	// merkle root of the chunk hashes in index order
+	MerkleRoot []byte
+	Index      []StorageBlockIndexEntry
+}
+
+type StorageBlockIndexEntry struct {
+	Hash []byte
+	// offset of the chunk object from the start of the data section
+	Offset uint64
+	Length uint64
+}
+
+type ParityFileHeader struct {
+	Version uint32
+	// size of the storage block the parity protects
+	BlockSize    uint64
+	DataShards   uint32
+	ParityShards uint32
+	ShardSize    uint64
+	StripeCount  uint64
+	// size of a serialized ParityStripe
+	StripeLength uint64
+}
+
+type ParityStripe struct {
+	// hashes of the data shards followed by the hashes of the parity shards
+	ShardHashes [][]byte
+	Parity      [][]byte
+}
+
+// ScrubReport lists the damage found in the chunk store
+type ScrubReport struct {
+	// chunks whose data does not match their hash
+	BadChunks [][]byte
+	// storage blocks that have damaged stripes or can not be read
+	BadBlocks []string
+	// storage blocks without parity
+	UnprotectedBlocks []string
+}
+
+// ProgressEvent is a progress report of a scan, printed as a JSON line
+type ProgressEvent struct {
+	Files          int64   `json:"files"`
+	TotalFiles     int64   `json:"total_files"`
+	Bytes          int64   `json:"bytes"`
+	TotalBytes     int64   `json:"total_bytes"`
+	Elapsed        float64 `json:"elapsed_seconds"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETA            float64 `json:"eta_seconds"`
+	Done           bool    `json:"done"`
+}
+
+// TorrentMetaInfo is a .torrent file, with the piece layers of BEP 52
+type TorrentMetaInfo struct {
+	Announce     string            `bencode:"announce,omitempty"`
+	CreatedBy    string            `bencode:"created by,omitempty"`
+	CreationDate int64             `bencode:"creation date,omitempty"`
+	Info         bencode.Bytes     `bencode:"info"`
+	PieceLayers  map[string][]byte `bencode:"piece layers,omitempty"`
+}
+
+// TorrentInfo is the info dictionary of a torrent: Files and Pieces for v1,
+// FileTree and MetaVersion 2 for v2, all of them for hybrid torrents
+type TorrentInfo struct {
+	Files       []TorrentFileEntry     `bencode:"files,omitempty"`
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
+	Length      int64                  `bencode:"length,omitempty"`
+	MetaVersion int64                  `bencode:"meta version,omitempty"`
+	Name        string                 `bencode:"name"`
+	PieceLength int64                  `bencode:"piece length"`
+	Pieces      []byte                 `bencode:"pieces,omitempty"`
+}
+
+type TorrentFileEntry struct {
+	// "p" for the padding files of BEP 47
+	Attr   string   `bencode:"attr,omitempty"`
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// TorrentChunkHashes are the hashes of a chunk as a piece of a torrent whose
+// piece length is the chunk size, and whose files start at piece boundaries
+type TorrentChunkHashes struct {
+	Hash []byte
+	Size uint64
+	// sha1 of the chunk padded with zeros to the piece length
+	V1Piece []byte
+	// sha1 of the chunk, for the last piece of a torrent, if it is short
+	V1LastPiece []byte
+	// merkle root of the chunk's 16 KiB blocks, padded to the piece length
+	V2Piece []byte
+	// pieces root of a file of only this chunk, if it is short
+	V2FileRoot []byte
+}
+
+type TorrentHashCache struct {
+	Chunks []TorrentChunkHashes
+}
+
+// ExportRecord is an entry of a checkpoint exported as a JSON line. Paths
+// that are not valid UTF-8 are given in PathBase64 instead of Path
+type ExportRecord struct {
+	Path       string `json:"path,omitempty"`
+	PathBase64 string `json:"path_base64,omitempty"`
+	Type       string `json:"type"`
+	Size       *int64 `json:"size,omitempty"`
+	Sha256     string `json:"sha256,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// FindIndex lists every version of a file found in the checkpoints once,
+// with the checkpoints it is in, and the chunk hashes of every content
+type FindIndex struct {
+	Version     uint32
+	Checkpoints []FindIndexCheckpoint
+	Files       []FindIndexFile
+	Contents    []FindIndexContent
+}
+
+type FindIndexCheckpoint struct {
+	// base name of the checkpoint file
+	Name      string
+	CreatedAt uint64
+}
+
+type FindIndexFile struct {
+	// path relative to the directory of the repository
+	Path string
+	// -1 if unknown
+	Size int64
+	// FileHash of the checkpoint entry
+	Hash []byte
+	// change date of the file, "2006-01-02"
+	Date string
+	// indexes of the checkpoints in FindIndex.Checkpoints
+	Checkpoints []uint32
+}
+
+type FindIndexContent struct {
+	// FileHash of the checkpoint entries
+	Hash        []byte
+	ChunkHashes [][]byte
+}
+
+// VerifyState is when the chunks of the files were last verified, for
+// 'manifest verify -since' and the coverage of verify
+type VerifyState struct {
+	Version uint64
+	Files   []VerifyStateFile
+}
+
+type VerifyStateFile struct {
+	Path string
+	// FileHash of the file, the times are dropped when the file changes
+	Hash []byte
+	// unix time each chunk was last verified, 0 if never, a single time for
+	// files without chunk hashes
+	VerifiedAt []uint64
+}
+
+// IBLTSketch is an invertible Bloom lookup table of a set of chunk hashes,
+// sent by 'manifest reconcile-serve', see manifestReconcile.go
+type IBLTSketch struct {
+	Version uint32
+	// number of hashes in the set
+	SetSize uint64
+	Counts  []int64
+	// the xor of the hashes added to each cell, one after the other
+	KeySums  []byte
+	HashSums []uint64
+}
+
+// IBLTRequest asks for the sketch of a set with a number of cells
+type IBLTRequest struct {
+	Version uint32
+	Cells   uint32
+}
+
+// HashSetFilter is a Bloom or cuckoo filter of chunk hashes, written by
+// 'manifest hashset export', see manifestFilter.go
+type HashSetFilter struct {
+	Version uint32
+	// bloom or cuckoo
+	Type string
+	// number of hashes added
+	Count uint64
+	// bits and hash functions of a Bloom filter
+	Bits      uint64
+	HashCount uint32
+	// buckets, fingerprints per bucket and bytes per fingerprint of a cuckoo
+	// filter
+	Buckets         uint64
+	BucketSize      uint32
+	FingerprintSize uint32
+	Data            []byte
+}
+
+// DirectoryTree is what the hash of a directory entry is computed from, the
+// children of the directory sorted by name
+type DirectoryTree struct {
+	Entries []DirectoryTreeEntry
+}
+
+type DirectoryTreeEntry struct {
+	// "file" or "dir"
+	Type []byte
+	Name []byte
+	// sha256 of a file, or the hash of a directory
+	Hash       []byte
+	MetaString []byte
+}
+
+// CheckpointSummary is a checkpoint in the JSON of 'manifest serve'
+type CheckpointSummary struct {
+	Name        string `json:"name"`
+	SequenceId  uint64 `json:"sequence"`
+	CreatedAt   string `json:"created_at"`
+	Creator     string `json:"creator"`
+	Files       int    `json:"files"`
+	Directories int    `json:"directories"`
+	Size        uint64 `json:"size"`
+	ChunkSize   int64  `json:"chunk_size"`
+	// hash of the top directory, in hex
+	Hash string            `json:"hash"`
+	Tags map[string]string `json:"tags"`
+}
+
+// CheckpointDetails is a checkpoint with the totals of its meta file
+type CheckpointDetails struct {
+	CheckpointSummary
+	UniqueId      string `json:"unique_id"`
+	ChunkCount    int64  `json:"chunk_count"`
+	ChunkDataSize int64  `json:"chunk_data_size"`
+}
+
+// CheckpointDocument is a checkpoint with its meta and temp files, written
+// as canonical JSON by 'manifest export -json', see manifestJSON.go
+type CheckpointDocument struct {
+	Format     string
+	Version    uint64
+	Checkpoint ManifestOuputBody
+	Meta       ManifestMeta
+	Temp       ManifestTemp
+}
+
+// RepositoryConfig is the settings of a repository, kept in .cxo/config as
+// "key = value" lines, see manifestConfig.go
+type RepositoryConfig struct {
+	Version       int
+	ChunkSize     int
+	HashAlgorithm string
+	// patterns left out of checkpoints in addition to those of .cxoignore
+	Ignore []string
+	// creator of the checkpoints, the name of the user if empty
+	Creator string
+	// key the checkpoints are to be signed with, recorded for the tools that
+	// sign them
+	SigningKey  string
+	Compression string
+	// store the chunk data on every commit, as with commit -store-chunks
+	StoreChunks bool
+	// files of at least this size are mapped to be read, 0 to read all files
+	// with pread
+	MmapThreshold int64
+	// URL of the backend of the loose chunks, the .cxo/chunks folder if
+	// empty, see manifestChunkBackend.go
+	ChunkStore string
+}
+
 type HashSet struct {
 	Id      []byte
 	HashSet [][]byte
@@ -263,3 +598,63 @@ func (s DirectoryMetaList) Swap(i, j int) {
 func (s DirectoryMetaList) Less(i, j int) bool {
 	return s[i].DirectoryName < s[j].DirectoryName
 }
+
+// CheckpointStats is the report of 'manifest stats' on a checkpoint
+type CheckpointStats struct {
+	Checkpoint       CheckpointSummary `json:"checkpoint"`
+	ErroredFiles     int               `json:"errored_files"`
+	UnknownSizeFiles int               `json:"unknown_size_files"`
+	SizeHistogram    []StatsBucket     `json:"size_histogram"`
+	// age of the files at the time of the checkpoint, from the creation
+	// dates it records
+	Ages               []StatsBucket     `json:"ages"`
+	ExtensionCount     int               `json:"extension_count"`
+	Extensions         []ExtensionStats  `json:"extensions"`
+	LargestDirectories []DirectoryStats  `json:"largest_directories"`
+	Churn              []CheckpointChurn `json:"churn"`
+	Dedup              DedupStats        `json:"dedup"`
+	RepositoryDedup    DedupStats        `json:"repository_dedup"`
+}
+
+// StatsBucket is a range of file sizes or ages
+type StatsBucket struct {
+	Label string `json:"label"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ExtensionStats is the files of an extension, empty for the files without one
+type ExtensionStats struct {
+	Extension string `json:"extension"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// DirectoryStats is a directory with the size and the number of the files
+// below it
+type DirectoryStats struct {
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// CheckpointChurn is what changed from a checkpoint to the next one
+type CheckpointChurn struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Added        int    `json:"added"`
+	Removed      int    `json:"removed"`
+	Modified     int    `json:"modified"`
+	BytesAdded   int64  `json:"bytes_added"`
+	BytesRemoved int64  `json:"bytes_removed"`
+}
+
+// DedupStats is the size of the chunks of files against the size of the
+// distinct chunks
+type DedupStats struct {
+	Chunks       int     `json:"chunks"`
+	UniqueChunks int     `json:"unique_chunks"`
+	LogicalBytes int64   `json:"logical_bytes"`
+	UniqueBytes  int64   `json:"unique_bytes"`
+	Ratio        float64 `json:"ratio"`
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -20,49 +24,93 @@ func getCurrentDir() string {
 	return dir
 }
 
-func getFileMeta(filename string) FileMeta {
+func getFileMeta(filename string) (FileMeta, error) {
 
 	var result FileMeta
 
-	fileInfo, _ := os.Stat(filename)
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return result, err
+	}
 	fStat := fileInfo.Sys().(*syscall.Stat_t)
 	result.LastModified = uint64(fileInfo.ModTime().Unix())
 	result.UnixPermission = fileInfo.Mode().String()
 	sec, _ := fStat.Ctim.Unix()
 	result.CreateAt = uint64(sec)
 
-	return result
+	return result, nil
 }
 
-func createFolderAndFile(baseFolder string, subFolder string, fileExt string) (*os.File, error) {
-	err := os.MkdirAll(baseFolder, os.ModePerm)
+// writeFileAtomic writes the file through a temporary file in the same
+// folder, so the file is either complete or missing after a crash
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	err := os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	FileName := currentDir + subFolder + strconv.FormatInt(time.Now().Unix(), 10) + fileExt
-
-	File, err := os.OpenFile(FileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	tempFile, err := ioutil.TempFile(dir, tempFilePrefix)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
 
-	return File, nil
+	if _, err = tempFile.Write(data); err != nil {
+		return err
+	}
+	if err = tempFile.Sync(); err != nil {
+		return err
+	}
+	if err = tempFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tempFile.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// createTempFile creates a temporary file in the folder like ioutil.TempFile,
+// with the permissions masked by the umask instead of 0600, for files that
+// are renamed in place of those of the user
+func createTempFile(dir string, perm os.FileMode) (*os.File, error) {
+	suffix := make([]byte, 8)
+	for i := 0; i < 100; i++ {
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, tempFilePrefix+hex.EncodeToString(suffix))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+	return nil, fmt.Errorf("could not create a temporary file in %s", dir)
 }
 
-func getDirectorySize(directory string) (int, error) {
-	totalSize := 0
-	err := filepath.Walk(directory,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				totalSize = +int(info.Size())
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
 
-			}
-			return nil
-		})
-	return totalSize, err
+// getCheckpointBaseName returns a name for a new checkpoint that no existing
+// checkpoint uses: the unix time in seconds, with a counter appended when
+// several checkpoints are created within the same second
+func getCheckpointBaseName() string {
+	baseName := strconv.FormatInt(time.Now().Unix(), 10)
+	result := baseName
+	for i := 1; ; i++ {
+		if _, err := os.Stat(currentDir + manifestCXOFolder + result + ".cxo"); os.IsNotExist(err) {
+			return result
+		}
+		result = baseName + "_" + strconv.Itoa(i)
+	}
 }
 
 func createFolder(folderName string) error {
@@ -72,28 +120,24 @@ func createFolder(folderName string) error {
 	}
 	err = os.Mkdir(folderName, 0777)
 	if err != nil {
-		log.Fatal(err)
-	}
-	err = os.Chmod(folderName, 0777)
-	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	return err
+	return os.Chmod(folderName, 0777)
 }
 
-func hashFileAndEncoding(filePath string) string {
+func hashFileAndEncoding(filePath string) (string, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer f.Close()
 
 	h := sha256.New()
 	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
 }
 
 func isFolderExist(path string) bool {
@@ -120,3 +164,286 @@ func timespecToDate(ts syscall.Timespec) string {
 	res := time.Unix(int64(ts.Sec), int64(ts.Nsec)).Format("2006-01-02")
 	return res
 }
+
+// getCheckpointFiles returns the full names of all the .cxo checkpoint files,
+// oldest first
+func getCheckpointFiles() ([]string, error) {
+	return getRepositoryCheckpointFiles(currentDir)
+}
+
+// getRepositoryCheckpointFiles returns the full names of the checkpoint files
+// of the repository in the directory, oldest first
+func getRepositoryCheckpointFiles(dir string) ([]string, error) {
+	var result []string
+	cxoFolderName := dir + manifestCXOFolder
+	files, err := ioutil.ReadDir(cxoFolderName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".cxo") {
+			result = append(result, cxoFolderName+file.Name())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return checkpointNameLess(strings.TrimSuffix(filepath.Base(result[i]), ".cxo"), strings.TrimSuffix(filepath.Base(result[j]), ".cxo"))
+	})
+	return result, nil
+}
+
+// checkpointNameLess orders checkpoint names by their time and then by the
+// counter getCheckpointBaseName appends, so that _10 comes after _2. Names
+// it did not make come after, by name
+func checkpointNameLess(a, b string) bool {
+	timeA, counterA, okA := parseCheckpointName(a)
+	timeB, counterB, okB := parseCheckpointName(b)
+	switch {
+	case okA && okB && timeA != timeB:
+		return timeA < timeB
+	case okA && okB:
+		return counterA < counterB
+	case okA != okB:
+		return okA
+	}
+	return a < b
+}
+
+// parseCheckpointName returns the unix time and the counter of a checkpoint
+// name made by getCheckpointBaseName
+func parseCheckpointName(name string) (int64, int, bool) {
+	counter := 0
+	if index := strings.Index(name, "_"); index >= 0 {
+		var err error
+		if counter, err = strconv.Atoi(name[index+1:]); err != nil {
+			return 0, 0, false
+		}
+		name = name[:index]
+	}
+	seconds, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return seconds, counter, true
+}
+
+func readManifestFile(filename string) (*ManifestOuputBody, error) {
+	var manifestOuputBody ManifestOuputBody
+	fileBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	_, err = encoder.DeserializeRaw(fileBytes, &manifestOuputBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize manifest file %s: %w", filename, err)
+	}
+	return &manifestOuputBody, nil
+}
+
+// getErrorMetaString returns the MetaString of an errored entry, a
+// serialized key-value list with the "error" key
+func getErrorMetaString(message string) []byte {
+	var kvList KeysValuesList
+	kvList.Add(KeyValueByte{[]byte("error"), []byte(message)})
+	return encoder.Serialize(kvList)
+}
+
+// getFileMetaString returns the MetaString of a file entry, a serialized
+// key-value list with the "modified" key, the mtime of the file in Unix
+// seconds, and the "holes" key of a sparse file
+func getFileMetaString(meta FileMeta) []byte {
+	var kvList KeysValuesList
+	if meta.LastModified != 0 {
+		kvList.Add(KeyValueByte{[]byte("modified"), []byte(strconv.FormatUint(meta.LastModified, 10))})
+	}
+	if len(meta.Holes) > 0 {
+		kvList.Add(KeyValueByte{[]byte("holes"), []byte(formatFileHoles(meta.Holes))})
+	}
+	if len(kvList.Keys) == 0 {
+		return []byte{}
+	}
+	return encoder.Serialize(kvList)
+}
+
+// getFileEntryModified returns the mtime recorded for an entry, and false
+// when the checkpoint did not record it
+func getFileEntryModified(file *ManifestFile) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(getFileEntryMeta(file, "modified"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// getFileEntryError returns the error recorded for an errored entry, or an
+// empty string
+func getFileEntryError(file *ManifestFile) string {
+	return getFileEntryMeta(file, "error")
+}
+
+// getFileEntryMeta returns the value of a key of the MetaString of an entry,
+// or an empty string
+func getFileEntryMeta(file *ManifestFile, key string) string {
+	var kvList KeysValuesList
+	if len(file.MetaString) == 0 {
+		return ""
+	}
+	if err := encoder.DeserializeRawExact(file.MetaString, &kvList); err != nil {
+		return ""
+	}
+	for i, k := range kvList.Keys {
+		if string(k) == key && i < len(kvList.Values) {
+			return string(kvList.Values[i])
+		}
+	}
+	return ""
+}
+
+// isFileSizeKnown reports whether the size of an entry is known, which it is
+// not for entries imported from checksum lists without sizes
+func isFileSizeKnown(file *ManifestFile) bool {
+	return getFileEntryMeta(file, "size") != "unknown"
+}
+
+// hasChunkHashes reports whether the chunk hashes of an entry are known, which
+// they are not for entries imported from checksum lists
+func hasChunkHashes(file *ManifestFile) bool {
+	return isFileSizeKnown(file) && (file.Size == 0 || len(file.HashList.ChunksHashes) > 0)
+}
+
+// getCheckpointFile returns the full name of the checkpoint given by its name
+// as printed by 'manifest list', with or without the .cxo extension, or by
+// its path; "latest" selects the newest checkpoint
+func getCheckpointFile(name string) (string, error) {
+	if name == "latest" {
+		checkpoints, err := getCheckpointFiles()
+		if err != nil {
+			return "", err
+		}
+		if len(checkpoints) == 0 {
+			return "", usageError("there are no checkpoints, use 'manifest commit' first")
+		}
+		return checkpoints[len(checkpoints)-1], nil
+	}
+	if !strings.HasSuffix(name, ".cxo") {
+		name += ".cxo"
+	}
+	candidates := []string{name, currentDir + manifestCXOFolder + filepath.Base(name)}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", usageError("checkpoint %s not found, see 'manifest list'", strings.TrimSuffix(filepath.Base(name), ".cxo"))
+}
+
+// getCheckpointRoot returns the directory the checkpoint was committed in, as
+// recorded in its entry for the top directory
+func getCheckpointRoot(manifest *ManifestOuputBody) string {
+	for _, file := range manifest.ManifestBody.ManifestFileList {
+		if file.FileName == nil && strings.HasSuffix(string(file.Path), "/.") {
+			return strings.TrimSuffix(string(file.Path), "/.")
+		}
+	}
+	return currentDir
+}
+
+// getManifestFileRelPath returns the path of a checkpoint entry relative to
+// the directory the checkpoint was committed in
+func getManifestFileRelPath(root string, file *ManifestFile) string {
+	fullName := string(file.Path) + string(file.FileName)
+	if file.FileName == nil {
+		fullName = strings.TrimSuffix(fullName, "/")
+	}
+	relPath := strings.TrimPrefix(fullName, root+"/")
+	return filepath.Clean(relPath)
+}
+
+// getManifestFileChunkSizes returns the size of each chunk of a checkpoint
+// entry, which are all full except the last one
+func getManifestFileChunkSizes(file *ManifestFile) []int {
+	return getChunkSizes(file, chunkSize)
+}
+
+// getChunkSizes returns the size of each chunk of an entry of a checkpoint
+// with chunks of the size, for the checkpoints of other repositories
+func getChunkSizes(file *ManifestFile, size int) []int {
+	count := len(file.HashList.ChunksHashes)
+	result := make([]int, count)
+	for i := range result {
+		result[i] = size
+	}
+	if count > 0 {
+		result[count-1] = int(file.Size - int64(count-1)*int64(size))
+	}
+	return result
+}
+
+// getCheckpointChunkSize returns the chunk size of a checkpoint, that of the
+// repository for checkpoints whose header has none
+func getCheckpointChunkSize(manifest *ManifestOuputBody) int {
+	if manifest.ManifestHeader.ChunkSize <= 0 {
+		return chunkSize
+	}
+	return int(manifest.ManifestHeader.ChunkSize)
+}
+
+// checkCheckpointChunkSize returns an error if the checkpoint has chunk hashes
+// of another chunk size than the repository. The commands reading the
+// chunks of the checkpoints of the repository use its chunk size
+func checkCheckpointChunkSize(manifest *ManifestOuputBody, name string) error {
+	size := getCheckpointChunkSize(manifest)
+	if size == chunkSize {
+		return nil
+	}
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		if len(fileList[i].HashList.ChunksHashes) > 0 {
+			return usageError("%s has chunks of %d bytes, those of the repository are %d bytes", name, size, chunkSize)
+		}
+	}
+	return nil
+}
+
+// readCheckpointChunk returns the data of a chunk of a checkpoint entry from
+// the chunk store if it has it, or else from the file in the current
+// directory, failing if the file changed since the checkpoint
+func readCheckpointChunk(store *chunkStore, relPath string, hash []byte, index int, size int) ([]byte, error) {
+	found := false
+	if store != nil {
+		var err error
+		if found, err = store.has(hash); err != nil {
+			return nil, err
+		}
+	}
+	if found {
+		data, err := store.get(hash)
+		if err != nil {
+			return nil, err
+		}
+		// chunks that only differ in trailing zeros are stored once
+		if len(data) >= size {
+			return data[:size], nil
+		}
+		return append(data, make([]byte, size-len(data))...), nil
+	}
+
+	file, err := os.Open(filepath.Join(currentDir, relPath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, int64(index)*int64(chunkSize)); err != nil {
+		if err == io.EOF {
+			return nil, verifyError("%s changed since the checkpoint", relPath)
+		}
+		return nil, err
+	}
+	if !bytes.Equal(hashChunkData(data), hash) {
+		return nil, verifyError("%s changed since the checkpoint", relPath)
+	}
+	return data, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	verifyStateVersion = 1
+	// days the coverage of verify is reported for when -since is not given
+	defaultVerifyWindow = 30
+	secondsPerDay       = 24 * 60 * 60
+)
+
+// verifyOptions select the data verify hashes, the zero value hashes every
+// file of the checkpoint
+type verifyOptions struct {
+	// fraction of the bytes of the checkpoint to hash, in chunks picked at
+	// random weighted by their size, 0 to hash whole files
+	sample float64
+	// the same seed picks the same chunks
+	seed int64
+	// only hash the chunks not verified for this many days, 0 for all
+	sinceDays int
+}
+
+// verifyFile is a file of the checkpoint with the times its chunks were
+// last verified
+type verifyFile struct {
+	entry   *ManifestFile
+	relPath string
+	size    int64
+	state   *VerifyStateFile
+	// size of each chunk, or the size of the file without chunk hashes
+	sizes []int64
+}
+
+// verifyUnit is a chunk of a file picked for a sample
+type verifyUnit struct {
+	file  *verifyFile
+	index int
+	key   float64
+}
+
+func loadVerifyState() (map[string]*VerifyStateFile, error) {
+	result := make(map[string]*VerifyStateFile)
+	data, err := ioutil.ReadFile(currentDir + manifestVerifyStateFile)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state VerifyState
+	if err := encoder.DeserializeRawExact(data, &state); err != nil || state.Version != verifyStateVersion {
+		fmt.Fprintf(os.Stderr, "ignoring %s, which can not be read\n", manifestVerifyStateFile)
+		return result, nil
+	}
+	for i := range state.Files {
+		file := &state.Files[i]
+		result[getVerifyStateKey(file.Path, file.Hash)] = file
+	}
+	return result, nil
+}
+
+func getVerifyStateKey(relPath string, hash []byte) string {
+	return relPath + "\x00" + string(hash)
+}
+
+// saveVerifyState writes the times of the files of the checkpoint, those of
+// other files are dropped. A verify that ran at the same time may have
+// verified other chunks, the latest time of each chunk is kept
+func saveVerifyState(files []*verifyFile) error {
+	return withRepositoryLock(func() error {
+		saved, err := loadVerifyState()
+		if err != nil {
+			return err
+		}
+		state := VerifyState{Version: verifyStateVersion}
+		for _, file := range files {
+			if other := saved[getVerifyStateKey(file.state.Path, file.state.Hash)]; other != nil && len(other.VerifiedAt) == len(file.state.VerifiedAt) {
+				for i, verifiedAt := range other.VerifiedAt {
+					if verifiedAt > file.state.VerifiedAt[i] {
+						file.state.VerifiedAt[i] = verifiedAt
+					}
+				}
+			}
+			state.Files = append(state.Files, *file.state)
+		}
+		return writeFileAtomic(currentDir+manifestVerifyStateFile, encoder.Serialize(state))
+	})
+}
+
+// getVerifyKey returns the key of a chunk in a sample: the chunks with the
+// smallest keys are picked, which samples chunks weighted by their size. The
+// key only depends on the seed, the file and the chunk, so the same seed picks
+// the same chunks
+func getVerifyKey(seed int64, relPath string, index int, size int64) float64 {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, seed)
+	h.Write([]byte(relPath))
+	binary.Write(h, binary.LittleEndian, int64(index))
+	// uniform in (0, 1]
+	u := float64(binary.LittleEndian.Uint64(h.Sum(nil))>>11+1) / (1 << 53)
+	if size < 1 {
+		size = 1
+	}
+	return -math.Log(u) / float64(size)
+}
+
+// verifyCheckpoint compares the files of the checkpoint with the files in the
+// current directory by size and sha256, and prints the ones that are missing
+// or differ. Files added since the checkpoint are not reported. The times
+// chunks were verified are kept in .cxo/verify-state, for the options and the
+// coverage printed at the end
+func verifyCheckpoint(checkpoint string, options verifyOptions) error {
+	manifest, err := readManifestFile(checkpoint)
+	if err != nil {
+		return err
+	}
+	state, err := loadVerifyState()
+	if err != nil {
+		return err
+	}
+	now := uint64(time.Now().Unix())
+	var cutoff uint64
+	if options.sinceDays > 0 {
+		cutoff = now - uint64(options.sinceDays)*secondsPerDay
+	}
+
+	root := getCheckpointRoot(manifest)
+	var files []*verifyFile
+	// the files that are present with their size
+	var present []*verifyFile
+	failed, recent := 0, 0
+	fileList := manifest.ManifestBody.ManifestFileList
+	for i := range fileList {
+		entry := &fileList[i]
+		if entry.FileName == nil || getFileEntryError(entry) != "" {
+			continue
+		}
+		file := &verifyFile{entry: entry, relPath: getManifestFileRelPath(root, entry), size: entry.Size}
+		if hasChunkHashes(entry) {
+			for _, size := range getManifestFileChunkSizes(entry) {
+				file.sizes = append(file.sizes, int64(size))
+			}
+		}
+		file.state = state[getVerifyStateKey(file.relPath, entry.HashList.FileHash.Hash)]
+		files = append(files, file)
+
+		info, err := os.Stat(filepath.Join(currentDir, file.relPath))
+		if os.IsNotExist(err) {
+			fmt.Printf("missing %s\n", file.relPath)
+			failed++
+		} else if err != nil {
+			return err
+		} else if isFileSizeKnown(entry) && info.Size() != entry.Size {
+			fmt.Printf("size differs %s: %d bytes, %d in the checkpoint\n", file.relPath, info.Size(), entry.Size)
+			failed++
+		} else {
+			file.size = info.Size()
+			present = append(present, file)
+		}
+		if file.sizes == nil {
+			file.sizes = []int64{file.size}
+		}
+		if file.state == nil || len(file.state.VerifiedAt) != len(file.sizes) {
+			file.state = &VerifyStateFile{
+				Path:       file.relPath,
+				Hash:       entry.HashList.FileHash.Hash,
+				VerifiedAt: make([]uint64, len(file.sizes)),
+			}
+		}
+	}
+
+	if options.sample > 0 {
+		var total int64
+		var units []verifyUnit
+		for _, file := range files {
+			total += file.size
+		}
+		for _, file := range present {
+			for index, size := range file.sizes {
+				if file.state.VerifiedAt[index] < cutoff || cutoff == 0 {
+					units = append(units, verifyUnit{file, index, getVerifyKey(options.seed, file.relPath, index, size)})
+				}
+			}
+		}
+		sort.Slice(units, func(i, j int) bool {
+			return units[i].key < units[j].key
+		})
+		budget := int64(math.Ceil(options.sample * float64(total)))
+		var picked int64
+		for i, unit := range units {
+			if picked >= budget {
+				units = units[:i]
+				break
+			}
+			picked += unit.file.sizes[unit.index]
+		}
+		// read the files in order
+		sort.Slice(units, func(i, j int) bool {
+			if units[i].file.relPath != units[j].file.relPath {
+				return units[i].file.relPath < units[j].file.relPath
+			}
+			return units[i].index < units[j].index
+		})
+		verified, chunkFailed := 0, 0
+		for _, unit := range units {
+			ok, err := verifyChunk(unit.file, unit.index)
+			if err != nil {
+				return err
+			}
+			if ok {
+				unit.file.state.VerifiedAt[unit.index] = now
+				verified++
+			} else {
+				fmt.Printf("content differs %s (chunk %d)\n", unit.file.relPath, unit.index)
+				chunkFailed++
+			}
+		}
+		failed += chunkFailed
+		fmt.Printf("%d of %d sampled chunks verified, %s of %s\n", verified, len(units), formatBytes(picked), formatBytes(total))
+	} else {
+		checked := failed
+		for _, file := range present {
+			stale := cutoff == 0
+			for _, verifiedAt := range file.state.VerifiedAt {
+				stale = stale || verifiedAt < cutoff
+			}
+			if !stale {
+				recent++
+				continue
+			}
+			checked++
+			fileHash, err := hashFileAndEncoding(filepath.Join(currentDir, file.relPath))
+			if err != nil {
+				return err
+			}
+			if fileHash != string(file.entry.HashList.FileHash.Hash) {
+				fmt.Printf("content differs %s\n", file.relPath)
+				failed++
+				continue
+			}
+			for i := range file.state.VerifiedAt {
+				file.state.VerifiedAt[i] = now
+			}
+		}
+		fmt.Printf("%d of %d files verified\n", checked-failed, checked)
+		if recent > 0 {
+			fmt.Printf("%d files skipped, verified in the last %d days\n", recent, options.sinceDays)
+		}
+	}
+
+	if err := saveVerifyState(files); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: the verification times were not recorded: %v\n", err)
+	}
+	window := options.sinceDays
+	if window <= 0 {
+		window = defaultVerifyWindow
+	}
+	printVerifyCoverage(os.Stdout, files, now, window)
+	if failed > 0 {
+		return verifyError("%d files or chunks do not match the checkpoint", failed)
+	}
+	return nil
+}
+
+// verifyChunk hashes a chunk of the file, or the whole file if it has no
+// chunk hashes
+func verifyChunk(file *verifyFile, index int) (bool, error) {
+	if !hasChunkHashes(file.entry) {
+		fileHash, err := hashFileAndEncoding(filepath.Join(currentDir, file.relPath))
+		if err != nil {
+			return false, err
+		}
+		return fileHash == string(file.entry.HashList.FileHash.Hash), nil
+	}
+	_, err := readCheckpointChunk(nil, file.relPath, file.entry.HashList.ChunksHashes[index], index, int(file.sizes[index]))
+	var manifestErr *manifestError
+	if errors.As(err, &manifestErr) && manifestErr.code == exitVerify {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// printVerifyCoverage prints the share of the bytes of the files verified in
+// the last days, and of those never verified
+func printVerifyCoverage(w io.Writer, files []*verifyFile, now uint64, days int) {
+	cutoff := now - uint64(days)*secondsPerDay
+	var total, covered, never int64
+	var oldest uint64
+	for _, file := range files {
+		for i, size := range file.sizes {
+			verifiedAt := file.state.VerifiedAt[i]
+			total += size
+			switch {
+			case verifiedAt == 0:
+				never += size
+			case verifiedAt >= cutoff:
+				covered += size
+			}
+			if verifiedAt != 0 && (oldest == 0 || verifiedAt < oldest) {
+				oldest = verifiedAt
+			}
+		}
+	}
+	fmt.Fprintf(w, "coverage: %s of %s (%s) verified in the last %d days, %s (%s) never verified",
+		formatBytes(covered), formatBytes(total), formatPercent(covered, total), days, formatBytes(never), formatPercent(never, total))
+	if oldest != 0 {
+		fmt.Fprintf(w, ", oldest verification %s", time.Unix(int64(oldest), 0).Format("2006-01-02"))
+	}
+	fmt.Fprintln(w)
+}
+
+func formatPercent(part int64, total int64) string {
+	if total == 0 {
+		return "100%"
+	}
+	return strconv.FormatFloat(100*float64(part)/float64(total), 'f', 1, 64) + "%"
+}
+
+// parseSample parses the share of a sample, as a percentage like 1% or 0.5
+func parseSample(value string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil || !(percent > 0 && percent <= 100) {
+		return 0, usageError("invalid sample %q, give a percentage like 1%% or 0.5", value)
+	}
+	return percent / 100, nil
+}
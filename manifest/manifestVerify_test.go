@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// getVerifiedChunks returns which chunks of the file verify recorded
+func getVerifiedChunks(t *testing.T, relPath string) []bool {
+	state, err := loadVerifyState()
+	require.NoError(t, err)
+	for _, file := range state {
+		if file.Path == relPath {
+			var result []bool
+			for _, verifiedAt := range file.VerifiedAt {
+				result = append(result, verifiedAt != 0)
+			}
+			return result
+		}
+	}
+	return nil
+}
+
+func TestVerifySample(t *testing.T) {
+	defer setupTestRepository(t)()
+	data := make([]byte, 8*chunkSize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile("a", data, 0600))
+	require.NoError(t, ioutil.WriteFile("b", []byte("b"), 0600))
+	checkpoint := commitTestRepository(t)
+
+	require.NoError(t, verifyCheckpoint(checkpoint, verifyOptions{}))
+	require.Equal(t, []bool{true, true, true, true, true, true, true, true}, getVerifiedChunks(t, "a"))
+
+	// the same seed picks the same chunks
+	sample := verifyOptions{sample: 0.25, seed: 7}
+	require.NoError(t, os.Remove(currentDir+manifestVerifyStateFile))
+	require.NoError(t, verifyCheckpoint(checkpoint, sample))
+	picked := getVerifiedChunks(t, "a")
+	count := 0
+	for _, verified := range picked {
+		if verified {
+			count++
+		}
+	}
+	require.True(t, count >= 2 && count <= 3, "%d chunks picked", count)
+	require.NoError(t, os.Remove(currentDir+manifestVerifyStateFile))
+	require.NoError(t, verifyCheckpoint(checkpoint, sample))
+	require.Equal(t, picked, getVerifiedChunks(t, "a"))
+
+	// with -since, samples rotate through the chunks not verified yet
+	sample.sinceDays = 1
+	for i := 0; i < 4; i++ {
+		require.NoError(t, verifyCheckpoint(checkpoint, sample))
+	}
+	require.Equal(t, []bool{true, true, true, true, true, true, true, true}, getVerifiedChunks(t, "a"))
+	require.Equal(t, []bool{true}, getVerifiedChunks(t, "b"))
+
+	file, err := os.OpenFile("a", os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("changed"), int64(5*chunkSize))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	// every chunk was verified in the last day
+	require.NoError(t, verifyCheckpoint(checkpoint, sample))
+	err = verifyCheckpoint(checkpoint, verifyOptions{sample: 1})
+	require.Error(t, err)
+	require.Equal(t, exitVerify, getExitCode(err))
+}
+
+func TestParseSample(t *testing.T) {
+	sample, err := parseSample("1%")
+	require.NoError(t, err)
+	require.Equal(t, 0.01, sample)
+	sample, err = parseSample("50")
+	require.NoError(t, err)
+	require.Equal(t, 0.5, sample)
+	for _, value := range []string{"0", "101%", "-1", "x"} {
+		_, err = parseSample(value)
+		require.Error(t, err, value)
+	}
+}
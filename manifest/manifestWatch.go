@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultQuietPeriod  = 5 * time.Second
+	defaultPollInterval = time.Minute
+)
+
+// fileDataCache keeps the data read from the files of the tree between the
+// scans of watch mode, so that a scan only reads the files that changed
+type fileDataCache struct {
+	entries map[string]*cachedFileData
+	// files the watcher reported as changed, read again even if their size
+	// and times are the same
+	dirty map[string]bool
+	// number of files read since the cache was last pruned
+	read int
+}
+
+type cachedFileData struct {
+	size    int64
+	modTime time.Time
+	ctime   syscall.Timespec
+	hash    HashVariable
+	chunks  []ChunkHash
+	meta    FileMeta
+}
+
+func newFileDataCache() *fileDataCache {
+	return &fileDataCache{
+		entries: make(map[string]*cachedFileData),
+		dirty:   make(map[string]bool),
+	}
+}
+
+func (c *fileDataCache) markDirty(path string) {
+	c.dirty[filepath.Clean(path)] = true
+}
+
+func (c *fileDataCache) get(path string, info os.FileInfo) (HashVariable, []ChunkHash, FileMeta, error) {
+	path = filepath.Clean(path)
+	ctime := info.Sys().(*syscall.Stat_t).Ctim
+	entry, ok := c.entries[path]
+	if ok && !c.dirty[path] && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) && entry.ctime == ctime {
+		return entry.hash, entry.chunks, entry.meta, nil
+	}
+
+	delete(c.dirty, path)
+	c.read++
+	fileHash, fileChunks, fileMeta, err := readFileData(path)
+	if err != nil {
+		delete(c.entries, path)
+		return fileHash, fileChunks, fileMeta, err
+	}
+	c.entries[path] = &cachedFileData{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		ctime:   ctime,
+		hash:    fileHash,
+		chunks:  fileChunks,
+		meta:    fileMeta,
+	}
+	return fileHash, fileChunks, fileMeta, nil
+}
+
+// prune drops the files that are not in the scanned list any more
+func (c *fileDataCache) prune(fList *FilesInfoList) {
+	present := make(map[string]bool, len(fList.fileNames))
+	for _, name := range fList.fileNames {
+		present[filepath.Clean(name)] = true
+	}
+	for path := range c.entries {
+		if !present[path] {
+			delete(c.entries, path)
+		}
+	}
+	c.dirty = make(map[string]bool)
+	c.read = 0
+}
+
+// watchDirectory writes a checkpoint of the current directory whenever its
+// files change, after no change was seen for quietPeriod or, while changes
+// keep coming, every interval if it is not 0. If the directory can not be
+// watched because the inotify limits are reached, it is scanned every
+// pollInterval instead. It returns when ctx is cancelled
+func watchDirectory(ctx context.Context, storeChunks bool, quietPeriod, interval, pollInterval time.Duration) error {
+	fileCache = newFileDataCache()
+	defer func() { fileCache = nil }()
+
+	rules, err := loadIgnoreRules(".")
+	if err != nil {
+		return err
+	}
+	log.Printf("reading the files of %s", currentDir)
+	if err := commitChanges(ctx, storeChunks); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = addWatches(watcher, ".", rules)
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		if !isWatchLimitError(err) {
+			return err
+		}
+		log.Printf("inotify limit reached watching the directory: %v", err)
+		return pollDirectory(ctx, storeChunks, pollInterval)
+	}
+	defer watcher.Close()
+	log.Printf("watching %s for changes with inotify", currentDir)
+
+	quietTimer := time.NewTimer(quietPeriod)
+	quietTimer.Stop()
+	resetQuietTimer := func() {
+		if !quietTimer.Stop() {
+			select {
+			case <-quietTimer.C:
+			default:
+			}
+		}
+		quietTimer.Reset(quietPeriod)
+	}
+	var scheduled <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		scheduled = ticker.C
+	}
+	pending := false
+	commit := func() {
+		if err := commitChanges(ctx, storeChunks); err != nil {
+			if ctx.Err() == nil {
+				// retried once the directory is quiet again
+				log.Printf("checkpoint failed: %v", err)
+				resetQuietTimer()
+			}
+			return
+		}
+		pending = false
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			path := filepath.Clean(event.Name)
+			if isRepositoryPath(path) {
+				continue
+			}
+			if path == filepath.Clean("."+manifestIgnoreFile) {
+				if rules, err = loadIgnoreRules("."); err != nil {
+					return err
+				}
+			}
+			info, statErr := os.Lstat(path)
+			isDir := statErr == nil && info.IsDir()
+			if rules.isIgnored(path, isDir) {
+				continue
+			}
+			if isDir && event.Op&fsnotify.Create != 0 {
+				if err := addWatches(watcher, path, rules); err != nil {
+					if !isWatchLimitError(err) {
+						return err
+					}
+					log.Printf("inotify limit reached watching %s: %v", path, err)
+					watcher.Close()
+					return pollDirectory(ctx, storeChunks, pollInterval)
+				}
+			}
+			fileCache.markDirty(path)
+			pending = true
+			resetQuietTimer()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if err != fsnotify.ErrEventOverflow {
+				return err
+			}
+			// the next scan compares the size and times of every file
+			log.Printf("inotify dropped events, rescanning the directory")
+			pending = true
+			resetQuietTimer()
+		case <-quietTimer.C:
+			if pending {
+				commit()
+			}
+		case <-scheduled:
+			if pending {
+				commit()
+			}
+		}
+	}
+}
+
+// pollDirectory scans the current directory every interval and writes a
+// checkpoint if its files changed
+func pollDirectory(ctx context.Context, storeChunks bool, interval time.Duration) error {
+	log.Printf("falling back to scanning %s every %s", currentDir, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := commitChanges(ctx, storeChunks); err != nil && ctx.Err() == nil {
+				log.Printf("checkpoint failed: %v", err)
+			}
+		}
+	}
+}
+
+// addWatches watches the directory and the directories below it
+func addWatches(watcher *fsnotify.Watcher, root string, rules *ignoreRules) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable directories are reported by the scan
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if isRepositoryPath(path) || rules.isIgnored(path, true) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// isWatchLimitError reports whether the error is caused by the limits on the
+// number of inotify instances or watches
+func isWatchLimitError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+func isRepositoryPath(path string) bool {
+	path = filepath.Clean(path)
+	return path == ".cxo" || strings.HasPrefix(path, ".cxo"+string(filepath.Separator))
+}
+
+// commitChanges scans the current directory, reading only the files that
+// changed since the last scan, and writes a checkpoint unless the files are
+// the same as in the newest checkpoint
+func commitChanges(ctx context.Context, storeChunks bool) error {
+	return withRepositoryLock(func() error {
+		if storeChunks {
+			store, err := openChunkStore(currentDir)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				store.close()
+				chunks = nil
+			}()
+			chunks = store
+		}
+
+		fList, err := processDirAndGenerateMeta(ctx, ".")
+		if err != nil {
+			return err
+		}
+		read := fileCache.read
+		fileCache.prune(fList)
+		filesList = fList
+		for _, fileError := range append(fList.filesErrorList, fList.skippedList...) {
+			if fileError != "" {
+				log.Print(fileError)
+			}
+		}
+
+		body, err := getManifestOutputBody(fList)
+		if err != nil {
+			return err
+		}
+		unchanged, err := isNewestCheckpoint(body)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			return nil
+		}
+		baseName, err := writeCheckpoint(body)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote checkpoint %s, read %d of %d files", baseName, read, len(fList.fileNames))
+		return nil
+	})
+}
+
+// isNewestCheckpoint reports whether the newest checkpoint has the same files
+// as the body, by the hash of its root directory, which the sizes and other
+// fields of the directory entries do not change
+func isNewestCheckpoint(body *ManifestOuputBody) (bool, error) {
+	checkpoints, err := getCheckpointFiles()
+	if err != nil || len(checkpoints) == 0 {
+		return false, err
+	}
+	newest, err := readManifestFile(checkpoints[len(checkpoints)-1])
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(getCheckpointTree(newest).hashes["."], getCheckpointTree(body).hashes["."]), nil
+}
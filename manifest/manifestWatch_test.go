@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDataCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pathA := filepath.Join(dir, "a")
+	pathB := filepath.Join(dir, "b")
+	require.NoError(t, ioutil.WriteFile(pathA, []byte("first"), 0600))
+	require.NoError(t, ioutil.WriteFile(pathB, []byte("second"), 0600))
+
+	fileCache = newFileDataCache()
+	defer func() { fileCache = nil }()
+	fList, err := processDirAndGenerateMeta(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, fileCache.read)
+	fileCache.prune(fList)
+
+	// unchanged files are not read again
+	_, err = processDirAndGenerateMeta(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, 0, fileCache.read)
+
+	// a changed file and a file the watcher reported are
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, ioutil.WriteFile(pathA, []byte("changed"), 0600))
+	require.NoError(t, os.Chtimes(pathA, later, later))
+	fileCache.markDirty(pathB)
+	fList, err = processDirAndGenerateMeta(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, fileCache.read)
+	fresh, _, _, err := readFileData(pathA)
+	require.NoError(t, err)
+	require.Equal(t, fresh, fList.filesHashlist[0])
+
+	require.NoError(t, os.Remove(pathB))
+	fList, err = processDirAndGenerateMeta(context.Background(), dir)
+	require.NoError(t, err)
+	fileCache.prune(fList)
+	require.Len(t, fileCache.entries, 1)
+
+	require.True(t, isRepositoryPath(".cxo/checkpoints"))
+	require.False(t, isRepositoryPath(".cxoignore"))
+}
+
+func TestCommitChangesSkipsUnchanged(t *testing.T) {
+	defer setupTestRepository(t)()
+	fileCache = newFileDataCache()
+	defer func() { fileCache = nil }()
+	require.NoError(t, os.Mkdir("sub", 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "a"), []byte("a"), 0600))
+
+	require.NoError(t, commitChanges(context.Background(), false))
+	require.NoError(t, commitChanges(context.Background(), false))
+	checkpoints, err := getCheckpointFiles()
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 1)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "a"), []byte("changed"), 0600))
+	fileCache.markDirty(filepath.Join("sub", "a"))
+	require.NoError(t, commitChanges(context.Background(), false))
+	checkpoints, err = getCheckpointFiles()
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 2)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	crtRand "crypto/rand"
 	"fmt"
 	"io"
@@ -37,6 +38,36 @@ func setupTestCase(t *testing.T) func(t *testing.T) {
 	}
 }
 
+// setupTestRepository creates an initialized repository in a temporary
+// directory and changes to it, returning the function that changes back
+func setupTestRepository(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "repository")
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, ".cxo"), 0700))
+	savedWd, err := os.Getwd()
+	require.NoError(t, err)
+	savedDir := currentDir
+	require.NoError(t, os.Chdir(dir))
+	currentDir = getCurrentDir()
+	return func() {
+		os.Chdir(savedWd)
+		currentDir = savedDir
+		os.RemoveAll(dir)
+	}
+}
+
+// commitTestRepository writes a checkpoint of the current directory and
+// returns its file name
+func commitTestRepository(t *testing.T) string {
+	fList, err := processDirAndGenerateMeta(context.Background(), ".")
+	require.NoError(t, err)
+	body, err := getManifestOutputBody(fList)
+	require.NoError(t, err)
+	baseName, err := writeCheckpoint(body)
+	require.NoError(t, err)
+	return currentDir + manifestCXOFolder + baseName + ".cxo"
+}
+
 func TestManifestWithGeneratedData(t *testing.T) {
 	var funcs []func() error
 	funcs = append(funcs, generateTestData1)
@@ -62,7 +93,8 @@ func TestManifestWithGeneratedData(t *testing.T) {
 			changeDir("./testdata")
 			defer changeDir("..")
 
-			fList := processDirAndGenerateMeta(".")
+			fList, err := processDirAndGenerateMeta(context.Background(), ".")
+			require.NoError(t, err)
 			execManifestCmd()
 
 			manifestFileDirList := getTestDataManifest()
@@ -353,3 +385,23 @@ func testManifestOutput(t *testing.T, manifestFileDirList *[]ManifestFile, fList
 	require.Equal(t, dirNamesTest, outPutDirNames, "The two directory name list should have the same content.")
 	require.Equal(t, testFileHashList, outPutFileHashList, "The two hash list should have the same content.")
 }
+
+func TestDirectorySizes(t *testing.T) {
+	defer setupTestRepository(t)()
+	ignore := "*.log\n"
+	require.NoError(t, os.Mkdir("sub", 0700))
+	require.NoError(t, ioutil.WriteFile("a", make([]byte, 10), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "b"), make([]byte, 20), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join("sub", "c.log"), make([]byte, 1000), 0600))
+	require.NoError(t, ioutil.WriteFile(currentDir+manifestIgnoreFile, []byte(ignore), 0600))
+
+	// the sizes leave out the ignored files and the .cxo folder, which grows
+	// with every checkpoint
+	for i := 0; i < 2; i++ {
+		manifest, err := readManifestFile(commitTestRepository(t))
+		require.NoError(t, err)
+		entries := getCheckpointTree(manifest).entries
+		require.Equal(t, int64(10+20+len(ignore)), entries["."].Size)
+		require.Equal(t, int64(20), entries["sub"].Size)
+	}
+}